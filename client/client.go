@@ -0,0 +1,478 @@
+// Package client publishes and receives messages through the publisher and
+// subscriber services, and makes requests to other clients over their topics
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Headers of a request, the inbox its replies go to and the ID they carry back
+const (
+	ReplyToHeader     = "reply-to"
+	CorrelationHeader = "correlation-id"
+)
+
+// PartitionKeyHeader is the header that keeps the messages with the same value
+// in order, they're delivered one after another by the same subscriber
+const PartitionKeyHeader = "partition-key"
+
+// Prefix of the topics of the inboxes the subscriber gives to its connections
+const inboxPrefix = "_inbox."
+
+// Time the subscriber has to answer with the inbox of a new client
+const inboxTimeout = 10 * time.Second
+
+// receiptHeader asks the publisher to answer whether a message was queued, the
+// answer carries the header value
+const receiptHeader = "receipt"
+
+// ErrClosed is returned by the publishes and requests that were waiting when the
+// client was closed or lost its connection to one of the services
+var ErrClosed = errors.New("client closed")
+
+// ErrPublisherLost is returned by the confirmed publishes and the requests that
+// were waiting when the connection to the publisher was lost, and by the ones
+// made after. Messages keep being received from the subscriber
+var ErrPublisherLost = errors.New("connection to the publisher lost")
+
+// ErrReceiptHeader is returned when publishing a message with a receipt header,
+// which the client uses to confirm publishes
+var ErrReceiptHeader = errors.New("the receipt header is used by the client")
+
+// PublishError is returned when the publisher refuses a message, with the reason
+// it gave
+type PublishError struct {
+	Topic  string
+	Reason string
+}
+
+// Error returns the topic and the reason of the publisher
+func (e *PublishError) Error() string {
+	return "publisher refused the message to " + e.Topic + ": " + e.Reason
+}
+
+// ErrNoReplyTo is returned when replying to a message that isn't a request
+var ErrNoReplyTo = errors.New("the message has no reply-to header")
+
+// Message is a message as the services send and receive it. Text payloads go
+// in Content and binary ones in Data
+type Message struct {
+	ID      string `json:",omitempty"`
+	Topic   string
+	Content string
+	Data    []byte            `json:",omitempty"`
+	Headers map[string]string `json:",omitempty"`
+}
+
+// Payload returns Data for binary messages and Content for the rest
+func (m Message) Payload() []byte {
+	if len(m.Data) > 0 {
+		return m.Data
+	}
+
+	return []byte(m.Content)
+}
+
+// Config holds the credentials used with the services, and the TLS settings
+// that verify them
+type Config struct {
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+}
+
+// Client holds a /publish and a /subscribe websocket. Messages of the topics it
+// subscribes to are sent to Messages, and replies to its requests to whoever
+// made them
+type Client struct {
+	pub      *websocket.Conn
+	sub      *websocket.Conn
+	inbox    string
+	prefix   string
+	lastID   uint64
+	waiting  map[string]chan Message
+	receipts map[string]chan error
+	messages chan Message
+	closed   chan struct{}
+	pubMux   sync.Mutex
+	subMux   sync.Mutex
+	mux      sync.Mutex
+	once     sync.Once
+}
+
+// Dial connects to the publisher and the subscriber and opens the inbox the
+// replies to the requests of the client are sent to
+func Dial(publisherAddr string, subscriberAddr string, config Config) (*Client, error) {
+	pub, err := dial(publisherAddr, "/publish", config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := dial(subscriberAddr, "/subscribe", config)
+
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+
+	inbox, err := openInbox(sub)
+
+	if err != nil {
+		pub.Close()
+		sub.Close()
+		return nil, err
+	}
+
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+
+	c := &Client{
+		pub:      pub,
+		sub:      sub,
+		inbox:    inbox,
+		prefix:   hex.EncodeToString(prefix) + "-",
+		waiting:  make(map[string]chan Message),
+		receipts: make(map[string]chan error),
+		messages: make(chan Message),
+		closed:   make(chan struct{}),
+	}
+
+	go c.readPublisher()
+	go c.readSubscriber()
+
+	return c, nil
+}
+
+func dial(addr string, path string, config Config) (*websocket.Conn, error) {
+	serviceURL := url.URL{Scheme: "wss", Host: addr, Path: path}
+	header := http.Header{}
+
+	if config.Username != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password)))
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = config.TLSConfig
+	conn, _, err := dialer.Dial(serviceURL.String(), header)
+
+	return conn, err
+}
+
+// openInbox asks the subscriber for the inbox of the connection, which is
+// answered with a message without ID on the inbox and "inbox" as its content
+func openInbox(sub *websocket.Conn) (string, error) {
+	err := sub.WriteJSON(Message{Content: "inbox"})
+
+	if err != nil {
+		return "", err
+	}
+
+	sub.SetReadDeadline(time.Now().Add(inboxTimeout))
+	defer sub.SetReadDeadline(time.Time{})
+
+	for {
+		var m Message
+		err = sub.ReadJSON(&m)
+
+		if err != nil {
+			return "", err
+		}
+
+		if m.ID == "" && m.Content == "inbox" && strings.HasPrefix(m.Topic, inboxPrefix) {
+			return m.Topic, nil
+		}
+	}
+}
+
+// Inbox returns the topic the replies to the requests of the client go to
+func (c *Client) Inbox() string {
+	return c.inbox
+}
+
+// Messages returns where the messages of the subscribed topics are sent. It
+// must be read while there are subscriptions, or the replies wait behind them
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Subscribe adds a topic or pattern to the subscriptions of the client
+func (c *Client) Subscribe(topic string) error {
+	return c.writeSubscriber(Message{Topic: topic, Content: "sub"})
+}
+
+// Unsubscribe removes a topic or pattern from the subscriptions of the client
+func (c *Client) Unsubscribe(topic string) error {
+	return c.writeSubscriber(Message{Topic: topic, Content: "unsub"})
+}
+
+// JoinGroup subscribes the client to a topic or pattern as a member of a group,
+// which shares the messages with the other members: each one goes to only one
+// of them
+func (c *Client) JoinGroup(topic string, group string) error {
+	return c.writeSubscriber(groupRequest{Topic: topic, Content: "sub", Group: group})
+}
+
+// LeaveGroup removes the client from a group
+func (c *Client) LeaveGroup(topic string, group string) error {
+	return c.writeSubscriber(groupRequest{Topic: topic, Content: "unsub", Group: group})
+}
+
+// groupRequest is a sub or unsub request with the group to join or leave
+type groupRequest struct {
+	Topic   string
+	Content string
+	Group   string
+}
+
+func (c *Client) writeSubscriber(m interface{}) error {
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+
+	return c.sub.WriteJSON(m)
+}
+
+// Publish sends a message to a topic without waiting for the publisher to queue
+// it. Payloads that aren't UTF-8 text are sent as Data
+func (c *Client) Publish(topic string, payload []byte, headers map[string]string) error {
+	if _, ok := headers[receiptHeader]; ok {
+		return ErrReceiptHeader
+	}
+
+	return c.writePublisher(newMessage(topic, payload, headers))
+}
+
+// PublishConfirmed sends a message to a topic and waits for the publisher to
+// queue it, until the context is done. A refused message returns a
+// *PublishError
+func (c *Client) PublishConfirmed(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	if _, ok := headers[receiptHeader]; ok {
+		return ErrReceiptHeader
+	}
+
+	c.mux.Lock()
+
+	if c.receipts == nil {
+		c.mux.Unlock()
+		return ErrPublisherLost
+	}
+
+	receipt := c.nextID()
+	answer := make(chan error, 1)
+	c.receipts[receipt] = answer
+	c.mux.Unlock()
+
+	defer func() {
+		c.mux.Lock()
+		delete(c.receipts, receipt)
+		c.mux.Unlock()
+	}()
+
+	m := newMessage(topic, payload, headers)
+	m.Headers[receiptHeader] = receipt
+	err := c.writePublisher(m)
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-answer:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newMessage copies the headers, so the receipt can be added to them
+func newMessage(topic string, payload []byte, headers map[string]string) Message {
+	m := Message{Topic: topic, Content: string(payload), Headers: make(map[string]string)}
+
+	for name, value := range headers {
+		m.Headers[name] = value
+	}
+
+	if !utf8.Valid(payload) {
+		m.Content, m.Data = "", payload
+	}
+
+	return m
+}
+
+func (c *Client) writePublisher(m Message) error {
+	c.pubMux.Lock()
+	defer c.pubMux.Unlock()
+
+	return c.pub.WriteJSON(m)
+}
+
+// nextID returns a new ID for a request or a receipt, c.mux must be held
+func (c *Client) nextID() string {
+	c.lastID++
+
+	return c.prefix + strconv.FormatUint(c.lastID, 10)
+}
+
+// Request publishes a payload to a topic and waits for the publisher to queue it
+// and for the first reply, until the context is done. Later replies to the same
+// request are dropped
+func (c *Client) Request(ctx context.Context, topic string, payload []byte) (Message, error) {
+	c.mux.Lock()
+	id := c.nextID()
+	reply := make(chan Message, 1)
+	c.waiting[id] = reply
+	c.mux.Unlock()
+
+	defer func() {
+		c.mux.Lock()
+		delete(c.waiting, id)
+		c.mux.Unlock()
+	}()
+
+	err := c.PublishConfirmed(ctx, topic, payload, map[string]string{ReplyToHeader: c.inbox, CorrelationHeader: id})
+
+	if err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-c.closed:
+		return Message{}, ErrClosed
+	}
+}
+
+// Reply publishes a payload to the inbox of a request, with its correlation ID
+func (c *Client) Reply(request Message, payload []byte) error {
+	replyTo := request.Headers[ReplyToHeader]
+
+	if replyTo == "" {
+		return ErrNoReplyTo
+	}
+
+	return c.Publish(replyTo, payload, map[string]string{CorrelationHeader: request.Headers[CorrelationHeader]})
+}
+
+// Close closes both websockets, the publishes and requests still waiting get
+// ErrClosed
+func (c *Client) Close() error {
+	c.stop()
+	c.pub.Close()
+
+	return c.sub.Close()
+}
+
+func (c *Client) stop() {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+}
+
+// readPublisher hands the answers of the publisher to the messages waiting for
+// them, the client can't publish once the connection is lost
+func (c *Client) readPublisher() {
+	defer c.failReceipts()
+
+	for {
+		var reply struct {
+			Receipt string `json:"receipt"`
+			Error   string `json:"error"`
+			Topic   string `json:"topic"`
+		}
+
+		_, frame, err := c.pub.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		if json.Unmarshal(frame, &reply) != nil || reply.Receipt == "" {
+			continue
+		}
+
+		if reply.Error != "" {
+			err = &PublishError{Topic: reply.Topic, Reason: reply.Error}
+		}
+
+		c.mux.Lock()
+		answer, ok := c.receipts[reply.Receipt]
+		delete(c.receipts, reply.Receipt)
+		c.mux.Unlock()
+
+		if ok {
+			answer <- err
+		}
+	}
+}
+
+// failReceipts releases the confirmed publishes still waiting once the
+// connection to the publisher is lost, the subscriber is left as it is
+func (c *Client) failReceipts() {
+	err := ErrPublisherLost
+
+	select {
+	case <-c.closed:
+		err = ErrClosed
+	default:
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, answer := range c.receipts {
+		answer <- err
+	}
+
+	c.receipts = nil
+}
+
+// readSubscriber hands the replies that arrive on the inbox to the request they
+// answer, and the rest of the messages to Messages
+func (c *Client) readSubscriber() {
+	defer c.stop()
+
+	for {
+		var m Message
+		err := c.sub.ReadJSON(&m)
+
+		if err != nil {
+			return
+		}
+
+		if m.Topic != c.inbox {
+			select {
+			case c.messages <- m:
+			case <-c.closed:
+				return
+			}
+
+			continue
+		}
+
+		c.mux.Lock()
+		reply, ok := c.waiting[m.Headers[CorrelationHeader]]
+		delete(c.waiting, m.Headers[CorrelationHeader])
+		c.mux.Unlock()
+
+		if ok {
+			reply <- m
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServices plays the publisher and the subscriber: requests to "echo" are
+// answered on the inbox, "silent" ones never are, messages to "refused" are
+// refused, the ones to "hang-up" close the publisher websocket, and the rest are
+// delivered to the subscriber websocket as they are
+type fakeServices struct {
+	sub    *websocket.Conn
+	ready  chan bool
+	mux    sync.Mutex
+	server *httptest.Server
+}
+
+func (f *fakeServices) deliver(m Message) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.sub.WriteJSON(m)
+}
+
+func (f *fakeServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+
+	if !ok || username != "hello" || password != "test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	if r.URL.Path == "/subscribe" {
+		var m Message
+		err = conn.ReadJSON(&m)
+
+		if err != nil || m.Content != "inbox" {
+			return
+		}
+
+		f.sub = conn
+		f.deliver(Message{Topic: "_inbox.test", Content: "inbox"})
+		f.ready <- true
+
+		// Requests to join a group are answered with a message to the group
+		for {
+			var request groupRequest
+			err = conn.ReadJSON(&request)
+
+			if err != nil {
+				return
+			}
+
+			if request.Group != "" {
+				f.deliver(Message{ID: "g-1", Topic: request.Topic, Content: request.Content + " " + request.Group})
+			}
+		}
+	}
+
+	<-f.ready
+
+	for {
+		var m Message
+		err = conn.ReadJSON(&m)
+
+		if err != nil {
+			return
+		}
+
+		receipt := m.Headers[receiptHeader]
+		delete(m.Headers, receiptHeader)
+
+		if m.Topic == "hang-up" {
+			return
+		}
+
+		if m.Topic == "refused" {
+			conn.WriteJSON(map[string]string{"error": "not allowed", "topic": m.Topic, "receipt": receipt})
+			continue
+		}
+
+		conn.WriteJSON(map[string]string{"receipt": receipt, "id": "p-1"})
+
+		switch m.Topic {
+		case "echo":
+			// Replies to other requests and repeats are ignored
+			f.deliver(Message{ID: "r-0", Topic: m.Headers[ReplyToHeader], Content: "other", Headers: map[string]string{CorrelationHeader: "other"}})
+			f.deliver(Message{ID: "r-1", Topic: m.Headers[ReplyToHeader], Content: "re: " + m.Content, Headers: map[string]string{CorrelationHeader: m.Headers[CorrelationHeader]}})
+			f.deliver(Message{ID: "r-2", Topic: m.Headers[ReplyToHeader], Content: "late", Headers: map[string]string{CorrelationHeader: m.Headers[CorrelationHeader]}})
+		case "silent":
+		default:
+			f.deliver(m)
+		}
+	}
+}
+
+func dialFake(t *testing.T) (*Client, *fakeServices) {
+	fake := &fakeServices{ready: make(chan bool, 1)}
+	fake.server = httptest.NewTLSServer(fake)
+	addr := strings.TrimPrefix(fake.server.URL, "https://")
+	tlsConfig := fake.server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	c, err := Dial(addr, addr, Config{Username: "hello", Password: "test", TLSConfig: tlsConfig})
+
+	if err != nil {
+		fake.server.Close()
+		t.Fatal("[tests] Error dialing the services", err)
+	}
+
+	return c, fake
+}
+
+func TestRequest(t *testing.T) {
+	c, fake := dialFake(t)
+	defer fake.server.Close()
+	defer c.Close()
+
+	if c.Inbox() != "_inbox.test" {
+		t.Fatal("[tests] Wrong inbox", c.Inbox())
+	}
+
+	for _, content := range []string{"first", "second"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := c.Request(ctx, "echo", []byte(content))
+		cancel()
+
+		if err != nil || string(reply.Payload()) != "re: "+content || reply.ID != "r-1" {
+			t.Fatal("[tests] Wrong reply to a request", reply, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err := c.Request(ctx, "silent", []byte("anyone?"))
+	cancel()
+
+	if err != context.DeadlineExceeded {
+		t.Fatal("[tests] Request without replies didn't time out", err)
+	}
+
+	// Messages the publisher refuses fail with its reason when they're confirmed
+	if err = c.Publish("refused", []byte("hello"), nil); err != nil {
+		t.Fatal("[tests] Publish waited for the publisher", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	err = c.PublishConfirmed(ctx, "refused", []byte("hello"), nil)
+	cancel()
+
+	if e, ok := err.(*PublishError); !ok || e.Topic != "refused" || e.Reason != "not allowed" {
+		t.Fatal("[tests] Refused message didn't fail", err)
+	}
+
+	if c.Publish("news", []byte("hello"), map[string]string{receiptHeader: "mine"}) != ErrReceiptHeader {
+		t.Fatal("[tests] Receipt header of the caller was overwritten")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	_, err = c.Request(ctx, "refused", []byte("hello"))
+	cancel()
+
+	if _, ok := err.(*PublishError); !ok {
+		t.Fatal("[tests] Refused request waited for a reply", err)
+	}
+
+	c.mux.Lock()
+	waiting := len(c.waiting) + len(c.receipts)
+	c.mux.Unlock()
+
+	if waiting != 0 {
+		t.Fatal("[tests] Finished requests are still waiting", waiting)
+	}
+
+	// Messages that aren't replies go to Messages
+	err = c.Publish("news", []byte{0, 0xff}, map[string]string{ReplyToHeader: c.Inbox(), CorrelationHeader: "c-1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var request Message
+
+	select {
+	case request = <-c.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Message wasn't received")
+	}
+
+	if request.Topic != "news" || string(request.Payload()) != "\x00\xff" || request.Content != "" || request.Headers[CorrelationHeader] != "c-1" {
+		t.Fatal("[tests] Binary message wasn't received as Data", request)
+	}
+
+	c.JoinGroup("jobs", "workers")
+
+	select {
+	case m := <-c.Messages():
+		if m.Topic != "jobs" || m.Content != "sub workers" {
+			t.Fatal("[tests] Wrong request to join a group", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Request to join a group wasn't sent")
+	}
+
+	if c.Reply(Message{Topic: "news"}, []byte("nobody asked")) != ErrNoReplyTo {
+		t.Fatal("[tests] Replied to a message that isn't a request")
+	}
+
+	// Requests waiting when the client is closed are told so
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := c.Request(context.Background(), "silent", []byte("bye"))
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err = <-result:
+		if err != ErrClosed {
+			t.Fatal("[tests] Waiting request didn't fail when closing", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Waiting request wasn't released when closing")
+	}
+}
+
+func TestPublisherLost(t *testing.T) {
+	c, fake := dialFake(t)
+	defer fake.server.Close()
+	defer c.Close()
+
+	// The publishes waiting for their receipt fail, and so do the next ones
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.PublishConfirmed(ctx, "hang-up", []byte("bye"), nil); err != ErrPublisherLost {
+		t.Fatal("[tests] Waiting publish didn't fail when the publisher was lost", err)
+	}
+
+	if err := c.PublishConfirmed(ctx, "news", []byte("hello"), nil); err != ErrPublisherLost {
+		t.Fatal("[tests] Publish didn't fail without the publisher", err)
+	}
+
+	// Messages are still received from the subscriber
+	c.JoinGroup("jobs", "workers")
+
+	select {
+	case m := <-c.Messages():
+		if m.Topic != "jobs" {
+			t.Fatal("[tests] Wrong message after losing the publisher", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Subscriber stopped with the publisher")
+	}
+}
+
+func TestDialFail(t *testing.T) {
+	fake := &fakeServices{ready: make(chan bool, 1)}
+	fake.server = httptest.NewTLSServer(fake)
+	defer fake.server.Close()
+	addr := strings.TrimPrefix(fake.server.URL, "https://")
+	tlsConfig := fake.server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	_, err := Dial(addr, addr, Config{Username: "hello", Password: "wrong", TLSConfig: tlsConfig})
+
+	if err == nil {
+		t.Fatal("[tests] Dialed with wrong credentials")
+	}
+
+	_, err = Dial(addr, addr, Config{Username: "hello", Password: "test"})
+
+	if err == nil {
+		t.Fatal("[tests] Dialed without verifying the certificate of the services")
+	}
+}
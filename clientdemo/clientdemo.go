@@ -3,9 +3,13 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,32 +21,74 @@ type message struct {
 	Content string
 }
 
+var (
+	publisherAddr  = flag.String("publisher", "localhost:8081", "address of the publisher service")
+	subscriberAddr = flag.String("subscriber", "localhost:8082", "address of the subscriber service")
+	username       = flag.String("username", "hello", "username used with the services")
+	password       = flag.String("password", "test", "password used with the services")
+	certDir        = flag.String("cert-dir", os.Getenv("WS_CERT_DIR"), "directory with ca.crt and the optional client.crt")
+)
+
 func main() {
-	pubConn, err := dialToService("localhost:8081", "/publish", "hello", "test")
+	flag.Parse()
+
+	pubConn, err := dialToService(*publisherAddr, "/publish", *username, *password)
 
 	if err != nil {
 		fmt.Printf("[clientdemo] Error dialing pub server\n%s", err)
 		os.Exit(1)
 	}
 
-	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test")
+	subConn, err := dialToService(*subscriberAddr, "/subscribe", *username, *password)
 
 	if err != nil {
 		fmt.Printf("[clientdemo] Error dialing sub server\n%s", err)
 		os.Exit(1)
 	}
 
+	// Nothing is received from the publisher, but reading answers its pings
+	go readMessages(pubConn)
 	go readMessages(subConn)
 
 	writeMessages(pubConn, subConn)
 }
 
+// clientTLSConfig verifies the services against the ca.crt found on certDir and
+// presents client.crt if there's one
+func clientTLSConfig(certDir string) (*tls.Config, error) {
+	config := &tls.Config{}
+	pem, err := ioutil.ReadFile(certDir + "ca.crt")
+
+	if err == nil {
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates found in " + certDir + "ca.crt")
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certDir+"client.crt", certDir+"client.key")
+
+	if err == nil {
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 func dialToService(addr string, path string, username string, password string) (*websocket.Conn, error) {
 	serviceURL := url.URL{Scheme: "wss", Host: addr, Path: path}
 	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	tlsConfig, err := clientTLSConfig(*certDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
 
-	serviceConn, _, err := websocket.DefaultDialer.Dial(serviceURL.String(), authHeader)
+	serviceConn, _, err := dialer.Dial(serviceURL.String(), authHeader)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,373 @@
+// Package admin serves the admin API of the services on its own listener, and
+// keeps track of the websockets it lists and manages. It also has the JSON
+// replies the HTTP endpoints of the services share
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWeakPassword is returned when the admin API is given no password, or the
+// one of the demo credentials
+var ErrWeakPassword = errors.New("the admin password can't be empty or test")
+
+// CheckPassword refuses the passwords the admin API can't be served with
+func CheckPassword(password string) error {
+	if password == "" || password == "test" {
+		return ErrWeakPassword
+	}
+
+	return nil
+}
+
+// ReplyJSON writes body as the JSON answer of a request
+func ReplyJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// ReplyError answers a request with an error message
+func ReplyError(w http.ResponseWriter, status int, text string) {
+	ReplyJSON(w, status, map[string]string{"error": text})
+}
+
+// Conn describes an open websocket, as listed by the admin API
+type Conn struct {
+	ID       string          `json:"id"`
+	Endpoint string          `json:"endpoint"`
+	Remote   string          `json:"remote"`
+	Identity string          `json:"identity"`
+	Since    time.Time       `json:"since"`
+	WS       *websocket.Conn `json:"-"`
+
+	draining chan struct{}
+	drained  bool
+}
+
+// NewConn describes a websocket accepted on the endpoint
+func NewConn(id string, endpoint string, r *http.Request, identity string, ws *websocket.Conn) *Conn {
+	return &Conn{ID: id, Endpoint: endpoint, Remote: r.RemoteAddr, Identity: identity, Since: time.Now(), WS: ws, draining: make(chan struct{})}
+}
+
+// Draining is closed once the websocket is drained and mustn't be sent more
+func (c *Conn) Draining() <-chan struct{} {
+	return c.draining
+}
+
+// CloseConn sends a close frame, and closes the connection without waiting for
+// the answer when forced
+func CloseConn(ws *websocket.Conn, code int, text string, force bool, timeout time.Duration) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(timeout))
+
+	if force {
+		ws.Close()
+	}
+}
+
+// ConnSet keeps track of the open websockets so they can be listed and closed
+type ConnSet struct {
+	conns map[*websocket.Conn]*Conn
+	logs  logging.Logger
+	mux   sync.Mutex
+}
+
+// NewConnSet returns an empty set, failures to close its websockets are logged
+func NewConnSet(logs logging.Logger) *ConnSet {
+	return &ConnSet{conns: make(map[*websocket.Conn]*Conn), logs: logs}
+}
+
+// Add puts a websocket in the set
+func (s *ConnSet) Add(c *Conn) {
+	s.mux.Lock()
+	s.conns[c.WS] = c
+	s.mux.Unlock()
+}
+
+// Remove takes a websocket out of the set
+func (s *ConnSet) Remove(ws *websocket.Conn) {
+	s.mux.Lock()
+	delete(s.conns, ws)
+	s.mux.Unlock()
+}
+
+// Count returns how many websockets are open
+func (s *ConnSet) Count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.conns)
+}
+
+// List returns a copy of the description of every connection, oldest first
+func (s *ConnSet) List() []Conn {
+	s.mux.Lock()
+	conns := make([]Conn, 0, len(s.conns))
+
+	for _, c := range s.conns {
+		conns = append(conns, *c)
+	}
+
+	s.mux.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+
+	return conns
+}
+
+// SetIdentity changes the identity of a websocket, for the clients that
+// authenticate once they're connected
+func (s *ConnSet) SetIdentity(c *Conn, identity string) {
+	s.mux.Lock()
+	c.Identity = identity
+	s.mux.Unlock()
+}
+
+// StartDraining closes the Draining channel of a websocket, it can be called
+// more than once
+func (s *ConnSet) StartDraining(ws *websocket.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if c, ok := s.conns[ws]; ok && !c.drained {
+		c.drained = true
+		close(c.draining)
+	}
+}
+
+// CloseAll sends a close frame to every connection, the reading side of each one
+// is expected to notice it and release the connection
+func (s *ConnSet) CloseAll(code int, text string, deadline time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for ws := range s.conns {
+		err := ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+
+		if err != nil {
+			s.logs.Warn("Error sending close frame", "remote", ws.RemoteAddr(), "error", err)
+		}
+	}
+}
+
+// PauseGate stops a loop from taking more work while it's paused. The channel
+// returned by State is closed whenever it's paused or resumed
+type PauseGate struct {
+	paused  bool
+	changed chan struct{}
+	mux     sync.Mutex
+}
+
+// NewPauseGate returns a gate that isn't paused
+func NewPauseGate() *PauseGate {
+	return &PauseGate{changed: make(chan struct{})}
+}
+
+// State tells whether the gate is paused, and returns the channel closed on the
+// next change
+func (g *PauseGate) State() (bool, <-chan struct{}) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return g.paused, g.changed
+}
+
+// Set pauses or resumes the gate
+func (g *PauseGate) Set(paused bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.paused == paused {
+		return
+	}
+
+	g.paused = paused
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// Server is the admin API of a service. Sets are the connections it lists and
+// manages, and Drain stops sending messages to one of them and closes it
+type Server struct {
+	Username     string
+	Password     string
+	Sets         []*ConnSet
+	Drain        func(c Conn)
+	WriteTimeout time.Duration
+	Logs         logging.Logger
+	AuthFailures *metrics.CounterVec
+}
+
+// Handler only lets through requests with the admin credentials and one of the
+// given methods. Requests that change something are logged
+func (s *Server) Handler(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+
+		// Both are compared in constant time, so they can't be guessed by timing
+		// the answers
+		valid := subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) & subtle.ConstantTimeCompare([]byte(password), []byte(s.Password))
+
+		if !ok || valid != 1 {
+			s.Logs.Warn("Error validating admin credentials", "remote", r.RemoteAddr, "identity", username)
+			s.AuthFailures.Inc("admin")
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			ReplyError(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+
+		allowed := false
+
+		for _, method := range methods {
+			allowed = allowed || r.Method == method
+		}
+
+		if !allowed {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			ReplyError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if r.Method != "GET" {
+			s.Logs.Info("Admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "identity", username)
+		}
+
+		handler(w, r)
+	}
+}
+
+// ListConnections answers GET /connections with every connection of the sets
+func (s *Server) ListConnections(w http.ResponseWriter, r *http.Request) {
+	ReplyJSON(w, http.StatusOK, s.Connections())
+}
+
+// Connections returns every connection of the sets, oldest first in each set
+func (s *Server) Connections() []Conn {
+	conns := []Conn{}
+
+	for _, set := range s.Sets {
+		conns = append(conns, set.List()...)
+	}
+
+	return conns
+}
+
+// ManageConnection kicks a connection on DELETE /connections/{id} and drains it
+// on POST /connections/{id}/drain
+func (s *Server) ManageConnection(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+	kick := len(parts) == 1 && r.Method == "DELETE"
+	drain := len(parts) == 2 && parts[1] == "drain" && r.Method == "POST"
+
+	if !kick && !drain {
+		ReplyError(w, http.StatusNotFound, "use DELETE /connections/{id} or POST /connections/{id}/drain")
+		return
+	}
+
+	for _, c := range s.Connections() {
+		if c.ID != parts[0] {
+			continue
+		}
+
+		if kick {
+			CloseConn(c.WS, websocket.ClosePolicyViolation, "kicked by admin", true, s.WriteTimeout)
+		} else {
+			s.Drain(c)
+		}
+
+		ReplyJSON(w, http.StatusOK, c)
+		return
+	}
+
+	ReplyError(w, http.StatusNotFound, "no connection "+parts[0])
+}
+
+// LogLevel answers GET /log/level with the lowest level logged, and changes it
+// on PUT
+func LogLevel(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+
+	if r.Method == "PUT" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+
+		if err != nil {
+			ReplyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		level, err := logging.ParseLevel(body.Level)
+
+		if err != nil {
+			ReplyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		logging.SetLevel(level)
+	}
+
+	body.Level = logging.LevelName()
+	ReplyJSON(w, http.StatusOK, body)
+}
+
+// Serve answers the routes of mux on addr, with the server certificate of
+// certDir, until stopping is closed. The requests still running then are given
+// until the deadline, which is set before stopping is closed. It refuses to
+// start with a password CheckPassword doesn't accept
+func (s *Server) Serve(addr string, certDir string, mux *http.ServeMux, ready chan<- bool, stopping <-chan struct{}, deadline *time.Time) error {
+	err := CheckPassword(s.Password)
+
+	if err != nil {
+		return err
+	}
+
+	certs := certstore.New(certDir, certstore.ServerCertFile, certstore.ServerKeyFile, true, s.Logs)
+	err = certs.Load()
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", addr, certs.ServerConfig(tls.NoClientCert))
+
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	if ready != nil {
+		ready <- true
+	}
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-stopping
+		ctx, cancel := context.WithDeadline(context.Background(), *deadline)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	s.Logs.Info("Admin API running", "addr", addr)
+	err = server.Serve(listener)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
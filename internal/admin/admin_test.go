@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	server := &Server{Username: "admin", Password: "secret", Logs: logging.New("admin"), AuthFailures: metrics.NewCounterVec("test_auth_failures_total", "Failures", "endpoint")}
+	handler := server.Handler(func(w http.ResponseWriter, r *http.Request) {
+		ReplyJSON(w, http.StatusOK, "done")
+	}, "GET", "PUT")
+
+	for _, c := range []struct {
+		method   string
+		username string
+		password string
+		status   int
+	}{
+		{"GET", "admin", "secret", http.StatusOK},
+		{"PUT", "admin", "secret", http.StatusOK},
+		{"GET", "admin", "wrong", http.StatusUnauthorized},
+		{"GET", "", "", http.StatusUnauthorized},
+		{"DELETE", "admin", "secret", http.StatusMethodNotAllowed},
+	} {
+		r := httptest.NewRequest(c.method, "/", nil)
+
+		if c.username != "" {
+			r.SetBasicAuth(c.username, c.password)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != c.status {
+			t.Fatal("[tests] Admin request wasn't answered as expected", c, w.Code, w.Body)
+		}
+	}
+
+	if server.AuthFailures.Snapshot()["admin"] != 2 {
+		t.Fatal("[tests] Rejected credentials weren't counted", server.AuthFailures.Snapshot())
+	}
+}
+
+func TestWeakPassword(t *testing.T) {
+	for _, password := range []string{"", "test"} {
+		server := &Server{Username: "admin", Password: password, Logs: logging.New("admin")}
+		err := server.Serve("localhost:0", t.Name(), http.NewServeMux(), nil, nil, nil)
+
+		if err != ErrWeakPassword {
+			t.Fatal("[tests] Admin API started with a weak password", password, err)
+		}
+	}
+}
+
+func TestConnSet(t *testing.T) {
+	set := NewConnSet(logging.New("admin"))
+	first := &Conn{ID: "first", Since: time.Now(), WS: &websocket.Conn{}, draining: make(chan struct{})}
+	second := &Conn{ID: "second", Since: first.Since.Add(time.Second), WS: &websocket.Conn{}, draining: make(chan struct{})}
+	set.Add(second)
+	set.Add(first)
+
+	if conns := set.List(); set.Count() != 2 || conns[0].ID != "first" || conns[1].ID != "second" {
+		t.Fatal("[tests] Connections aren't listed oldest first", conns)
+	}
+
+	var drained []string
+	server := &Server{Sets: []*ConnSet{set}, Drain: func(c Conn) {
+		drained = append(drained, c.ID)
+		set.StartDraining(c.WS)
+		set.StartDraining(c.WS)
+	}}
+
+	w := httptest.NewRecorder()
+	server.ManageConnection(w, httptest.NewRequest("POST", "/connections/second/drain", nil))
+
+	select {
+	case <-second.Draining():
+	default:
+		t.Fatal("[tests] Connection wasn't drained")
+	}
+
+	if w.Code != http.StatusOK || len(drained) != 1 || drained[0] != "second" {
+		t.Fatal("[tests] Drain wasn't answered", w.Code, drained)
+	}
+
+	w = httptest.NewRecorder()
+	server.ManageConnection(w, httptest.NewRequest("POST", "/connections/third/drain", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatal("[tests] Unknown connection was found", w.Code)
+	}
+
+	set.Remove(second.WS)
+
+	if set.Count() != 1 {
+		t.Fatal("[tests] Connection wasn't removed")
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	gate := NewPauseGate()
+	paused, changed := gate.State()
+	gate.Set(false)
+
+	select {
+	case <-changed:
+		t.Fatal("[tests] Gate changed without being paused")
+	default:
+	}
+
+	gate.Set(true)
+
+	if <-changed; paused {
+		t.Fatal("[tests] New gate was paused")
+	}
+
+	if paused, _ := gate.State(); !paused {
+		t.Fatal("[tests] Gate wasn't paused")
+	}
+}
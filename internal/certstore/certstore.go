@@ -0,0 +1,198 @@
+// Package certstore loads the certificates of the services from a directory and
+// reloads them when they change, so they can be rotated without restarting
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/Javivi/ws-go/internal/logging"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files looked up inside the certificate directory, the client ones are
+// presented when dialing other services
+const (
+	ServerCertFile = "server.crt"
+	ServerKeyFile  = "server.key"
+	ClientCertFile = "client.crt"
+	ClientKeyFile  = "client.key"
+	CACertFile     = "ca.crt"
+)
+
+// How often the certificate files are checked for changes
+const certCheckInterval = time.Second
+
+// Store keeps a key pair and a CA pool loaded from a directory and reloads
+// them when the files change, so certificates can be rotated without restarting
+type Store struct {
+	dir             string
+	certFile        string
+	keyFile         string
+	keyPairRequired bool
+	log             logging.Logger
+
+	mux       sync.Mutex
+	cert      *tls.Certificate
+	caPool    *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// New returns a store for the given files of the directory, the key pair can be
+// optional. Nothing is read until it's loaded
+func New(dir string, certFile string, keyFile string, keyPairRequired bool, log logging.Logger) *Store {
+	return &Store{dir: dir, certFile: certFile, keyFile: keyFile, keyPairRequired: keyPairRequired, log: log}
+}
+
+// Load reads the key pair and the CA from disk, a missing optional file is not an error
+func (s *Store) Load() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.loadLocked()
+}
+
+func (s *Store) loadLocked() error {
+	modTimes := s.currentModTimes()
+
+	var cert *tls.Certificate
+
+	if !modTimes[s.certFile].IsZero() || s.keyPairRequired {
+		keyPair, err := tls.LoadX509KeyPair(s.dir+s.certFile, s.dir+s.keyFile)
+
+		if err != nil {
+			return err
+		}
+
+		cert = &keyPair
+	}
+
+	var caPool *x509.CertPool
+
+	if !modTimes[CACertFile].IsZero() {
+		pem, err := ioutil.ReadFile(s.dir + CACertFile)
+
+		if err != nil {
+			return err
+		}
+
+		caPool = x509.NewCertPool()
+
+		if !caPool.AppendCertsFromPEM(pem) {
+			return errors.New("no valid certificates found in " + s.dir + CACertFile)
+		}
+	}
+
+	s.cert = cert
+	s.caPool = caPool
+	s.modTimes = modTimes
+	s.lastCheck = time.Now()
+
+	return nil
+}
+
+func (s *Store) currentModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+
+	for _, name := range []string{s.certFile, s.keyFile, CACertFile} {
+		info, err := os.Stat(s.dir + name)
+
+		if err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+
+	return modTimes
+}
+
+// Current returns the loaded certificates, reloading them first if any of the
+// files changed since the last check. A failed reload keeps the previous ones
+func (s *Store) Current() (*tls.Certificate, *x509.CertPool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if time.Since(s.lastCheck) < certCheckInterval {
+		return s.cert, s.caPool
+	}
+
+	s.lastCheck = time.Now()
+	modTimes := s.currentModTimes()
+	changed := s.modTimes == nil || len(modTimes) != len(s.modTimes)
+
+	for name, modTime := range modTimes {
+		if !modTime.Equal(s.modTimes[name]) {
+			changed = true
+		}
+	}
+
+	if changed {
+		err := s.loadLocked()
+
+		if err != nil {
+			s.log.Error("Error reloading certificates, keeping the previous ones", "dir", s.dir, "error", err)
+		} else {
+			s.log.Info("Loaded certificates", "dir", s.dir)
+		}
+	}
+
+	return s.cert, s.caPool
+}
+
+// ServerConfig returns a TLS config that always serves the latest certificates
+func (s *Store) ServerConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, caPool := s.Current()
+
+			if cert == nil {
+				return nil, errors.New("no server certificate loaded")
+			}
+
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    caPool,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS config that verifies the server against the CA and
+// presents the client certificate if there's one
+func (s *Store) ClientConfig() *tls.Config {
+	cert, caPool := s.Current()
+	config := &tls.Config{RootCAs: caPool}
+
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	return config
+}
+
+// ParseClientAuth maps the none/request/require modes to their TLS equivalent
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, errors.New("invalid client auth mode " + mode)
+}
+
+// Identity returns the common name of the verified client certificate
+func Identity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
@@ -0,0 +1,175 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Javivi/ws-go/internal/logging"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a self-signed certificate with the given common name
+func writeTestKeyPair(dir string, commonName string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(dir+ServerCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dir+ServerKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	err = writeTestKeyPair(dir, "first")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := New(dir, ServerCertFile, ServerKeyFile, true, logging.New("test"))
+	err = certs.Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeTestKeyPair(dir, "second")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the change is noticed even on filesystems with coarse timestamps
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(dir+ServerCertFile, future, future)
+	certs.lastCheck = time.Time{}
+
+	cert, _ := certs.Current()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.Subject.CommonName != "second" {
+		t.Fatal("[tests] Certificate wasn't reloaded")
+	}
+
+	os.Remove(dir + ServerKeyFile)
+	certs.lastCheck = time.Time{}
+
+	cert, _ = certs.Current()
+
+	if cert == nil {
+		t.Fatal("[tests] A failed reload discarded the previous certificate")
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	// Without files there's nothing to present and the system roots are used
+	certs := New(dir, ClientCertFile, ClientKeyFile, false, logging.New("test"))
+	err = certs.Load()
+
+	if err != nil {
+		t.Fatal("[tests] The client certificate isn't optional", err)
+	}
+
+	if config := certs.ClientConfig(); len(config.Certificates) != 0 || config.RootCAs != nil {
+		t.Fatal("[tests] Client config has certificates that weren't loaded")
+	}
+
+	err = writeTestKeyPair(dir, "client")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test key pair is written with the server names
+	certs = New(dir, ServerCertFile, ServerKeyFile, false, logging.New("test"))
+	err = certs.Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config := certs.ClientConfig(); len(config.Certificates) != 1 {
+		t.Fatal("[tests] Client certificate isn't presented")
+	}
+
+	if New(dir+"missing/", ServerCertFile, ServerKeyFile, true, logging.New("test")).Load() == nil {
+		t.Fatal("[tests] A required key pair was missing and nothing failed")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	modes := map[string]tls.ClientAuthType{"": tls.NoClientCert, "none": tls.NoClientCert, "request": tls.VerifyClientCertIfGiven, "require": tls.RequireAndVerifyClientCert}
+
+	for mode, expected := range modes {
+		if clientAuth, err := ParseClientAuth(mode); err != nil || clientAuth != expected {
+			t.Fatal("[tests] Wrong client auth for", mode, clientAuth, err)
+		}
+	}
+
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Fatal("[tests] Accepted an invalid client auth mode")
+	}
+
+	if _, ok := Identity(nil); ok {
+		t.Fatal("[tests] Got an identity without a connection")
+	}
+
+	if _, ok := Identity(&tls.ConnectionState{}); ok {
+		t.Fatal("[tests] Got an identity without a verified certificate")
+	}
+}
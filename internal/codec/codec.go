@@ -0,0 +1,587 @@
+// Package codec encodes the message envelopes of the websockets with the
+// subprotocols clients can ask for
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Envelope is a message as clients send and receive it. Text payloads go in
+// Content and binary ones in Data, which JSON carries in base64
+type Envelope struct {
+	ID          string `json:",omitempty"`
+	Topic       string
+	Content     string
+	Data        []byte            `json:",omitempty"`
+	Headers     map[string]string `json:",omitempty"`
+	Traceparent string            `json:",omitempty"`
+}
+
+// Payload returns Data for binary messages and Content for the rest
+func (m Envelope) Payload() []byte {
+	if len(m.Data) > 0 {
+		return m.Data
+	}
+
+	return []byte(m.Content)
+}
+
+// Codec encodes the messages of a websocket, picked with its subprotocol.
+// Websockets without one carry the JSON text of the messages as it is
+type Codec interface {
+	FrameType() int
+	Encode(m Envelope) []byte
+	Decode(data []byte) (Envelope, error)
+}
+
+// Names are the subprotocols of the codecs, in order of preference
+var Names = []string{"json", "msgpack", "cbor", "protobuf"}
+
+var codecs = map[string]Codec{
+	"json":     jsonCodec{},
+	"msgpack":  mapCodec{head: msgpackHead, header: msgpackHeader},
+	"cbor":     mapCodec{head: cborHead, header: cborHeader},
+	"protobuf": protobufCodec{},
+}
+
+// For returns the codec of a subprotocol, or nil if it has none
+func For(subprotocol string) Codec {
+	return codecs[subprotocol]
+}
+
+// ErrEnvelope is returned for messages that a codec can't decode
+var ErrEnvelope = errors.New("invalid message envelope")
+
+type jsonCodec struct{}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(m Envelope) []byte {
+	data, _ := json.Marshal(m)
+
+	return data
+}
+
+func (jsonCodec) Decode(data []byte) (Envelope, error) {
+	var m Envelope
+	err := json.Unmarshal(data, &m)
+
+	return m, err
+}
+
+// Kinds of the values of MessagePack and CBOR, only the ones of an envelope
+// are told apart
+const (
+	valueOther = iota
+	valueNil
+	valueMap
+	valueArray
+	valueString
+	valueBinary
+)
+
+// Nesting allowed in the values that are skipped
+const maxValueDepth = 32
+
+// mapCodec encodes envelopes as a map with the names of the JSON fields, in
+// MessagePack or CBOR. Both only differ in how the header of each value is
+// written. Names are matched without case when decoding, and unknown ones are
+// skipped
+type mapCodec struct {
+	head   func(out []byte, kind int, n int) []byte
+	header func(r *valueReader) (int, int)
+}
+
+func (c mapCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (c mapCodec) Encode(m Envelope) []byte {
+	var fields []byte
+	count := 0
+
+	for _, field := range [][2]string{{"ID", m.ID}, {"Topic", m.Topic}, {"Content", m.Content}, {"Traceparent", m.Traceparent}} {
+		if field[1] != "" || field[0] == "Topic" {
+			fields = c.appendString(c.appendString(fields, field[0]), field[1])
+			count++
+		}
+	}
+
+	if len(m.Data) > 0 {
+		fields = append(c.head(c.appendString(fields, "Data"), valueBinary, len(m.Data)), m.Data...)
+		count++
+	}
+
+	if len(m.Headers) > 0 {
+		fields = c.head(c.appendString(fields, "Headers"), valueMap, len(m.Headers))
+		count++
+
+		for _, name := range sortedKeys(m.Headers) {
+			fields = c.appendString(c.appendString(fields, name), m.Headers[name])
+		}
+	}
+
+	return append(c.head(nil, valueMap, count), fields...)
+}
+
+func (c mapCodec) appendString(out []byte, s string) []byte {
+	return append(c.head(out, valueString, len(s)), s...)
+}
+
+func (c mapCodec) Decode(data []byte) (Envelope, error) {
+	var m Envelope
+	r := &valueReader{data: data, header: c.header}
+	kind, n := r.header(r)
+
+	if kind != valueMap {
+		return m, ErrEnvelope
+	}
+
+	for i := 0; i < n && r.err == nil; i++ {
+		switch strings.ToLower(r.string()) {
+		case "id":
+			m.ID = r.string()
+		case "topic":
+			m.Topic = r.string()
+		case "content":
+			m.Content = r.string()
+		case "data":
+			m.Data = r.binary()
+		case "headers":
+			m.Headers = r.stringMap()
+		case "traceparent":
+			m.Traceparent = r.string()
+		default:
+			r.skip(0)
+		}
+	}
+
+	if r.err == nil && len(r.data) > 0 {
+		r.err = ErrEnvelope
+	}
+
+	return m, r.err
+}
+
+// valueReader reads MessagePack or CBOR values, the first error is kept and
+// every read after it returns nothing
+type valueReader struct {
+	data   []byte
+	err    error
+	header func(r *valueReader) (int, int)
+}
+
+func (r *valueReader) take(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.data)) {
+		r.err = ErrEnvelope
+		return nil
+	}
+
+	taken := r.data[:n]
+	r.data = r.data[n:]
+
+	return taken
+}
+
+// uint reads a big endian unsigned integer of 1, 2, 4 or 8 bytes
+func (r *valueReader) uint(size int) uint64 {
+	b := r.take(uint64(size))
+
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// length checks that a length read from a header can be right, every element
+// takes at least a byte
+func (r *valueReader) length(n uint64) int {
+	if n > uint64(len(r.data)) {
+		r.err = ErrEnvelope
+		return 0
+	}
+
+	return int(n)
+}
+
+// string reads a UTF-8 string, a nil value is an empty one
+func (r *valueReader) string() string {
+	kind, n := r.header(r)
+
+	if kind == valueNil {
+		return ""
+	}
+
+	s := r.take(uint64(n))
+
+	if kind != valueString || !utf8.Valid(s) {
+		r.err = ErrEnvelope
+	}
+
+	return string(s)
+}
+
+// binary reads a binary value, strings are taken too
+func (r *valueReader) binary() []byte {
+	kind, n := r.header(r)
+
+	if kind == valueNil {
+		return nil
+	}
+
+	if kind != valueBinary && kind != valueString {
+		r.err = ErrEnvelope
+	}
+
+	return r.take(uint64(n))
+}
+
+func (r *valueReader) stringMap() map[string]string {
+	kind, n := r.header(r)
+
+	if kind == valueNil {
+		return nil
+	}
+
+	if kind != valueMap {
+		r.err = ErrEnvelope
+		return nil
+	}
+
+	values := make(map[string]string, n)
+
+	for i := 0; i < n && r.err == nil; i++ {
+		name := r.string()
+		values[name] = r.string()
+	}
+
+	return values
+}
+
+// skip reads a value that isn't part of the envelope
+func (r *valueReader) skip(depth int) {
+	if depth > maxValueDepth {
+		r.err = ErrEnvelope
+		return
+	}
+
+	kind, n := r.header(r)
+
+	switch kind {
+	case valueString, valueBinary:
+		r.take(uint64(n))
+	case valueMap:
+		n *= 2
+		fallthrough
+	case valueArray:
+		for i := 0; i < n && r.err == nil; i++ {
+			r.skip(depth + 1)
+		}
+	}
+}
+
+// msgpackHeader reads the type of a MessagePack value, and its length for the
+// ones that have one. Other values are skipped
+func msgpackHeader(r *valueReader) (int, int) {
+	b := r.uint(1)
+
+	switch {
+	case r.err != nil:
+		return valueOther, 0
+	case b <= 0x7f || b >= 0xe0:
+		return valueOther, 0
+	case b <= 0x8f:
+		return valueMap, r.length(2*(b&0x0f)) / 2
+	case b <= 0x9f:
+		return valueArray, r.length(b & 0x0f)
+	case b <= 0xbf:
+		return valueString, r.length(b & 0x1f)
+	}
+
+	switch b {
+	case 0xc0:
+		return valueNil, 0
+	case 0xc4, 0xc5, 0xc6:
+		return valueBinary, r.length(r.uint(1 << (b - 0xc4)))
+	case 0xc7, 0xc8, 0xc9:
+		r.take(r.uint(1<<(b-0xc7)) + 1)
+	case 0xca, 0xcb:
+		r.take(4 << (b - 0xca))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		r.take(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		r.take(1 << (b - 0xd0))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		r.take(1<<(b-0xd4) + 1)
+	case 0xd9, 0xda, 0xdb:
+		return valueString, r.length(r.uint(1 << (b - 0xd9)))
+	case 0xdc, 0xdd:
+		return valueArray, r.length(r.uint(2 << (b - 0xdc)))
+	case 0xde, 0xdf:
+		return valueMap, r.length(2*r.uint(2<<(b-0xde))) / 2
+	case 0xc1:
+		r.err = ErrEnvelope
+	}
+
+	return valueOther, 0
+}
+
+func msgpackHead(out []byte, kind int, n int) []byte {
+	switch {
+	case kind == valueMap && n < 16:
+		return append(out, 0x80|byte(n))
+	case kind == valueMap && n < 1<<16:
+		return append(out, 0xde, byte(n>>8), byte(n))
+	case kind == valueMap:
+		return append(out, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	case kind == valueString && n < 32:
+		return append(out, 0xa0|byte(n))
+	case kind == valueString && n < 1<<8:
+		return append(out, 0xd9, byte(n))
+	case kind == valueString && n < 1<<16:
+		return append(out, 0xda, byte(n>>8), byte(n))
+	case kind == valueString:
+		return append(out, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	case n < 1<<8:
+		return append(out, 0xc4, byte(n))
+	case n < 1<<16:
+		return append(out, 0xc5, byte(n>>8), byte(n))
+	}
+
+	return append(out, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// cborHeader reads the type of a CBOR value, and its length for the ones that
+// have one. Tags are skipped, and indefinite lengths aren't supported
+func cborHeader(r *valueReader) (int, int) {
+	for r.err == nil {
+		b := r.uint(1)
+		major, info := b>>5, b&0x1f
+		arg := info
+
+		if info >= 24 && info <= 27 {
+			arg = r.uint(1 << (info - 24))
+		} else if info > 27 {
+			r.err = ErrEnvelope
+		}
+
+		switch {
+		case r.err != nil:
+		case major == 2:
+			return valueBinary, r.length(arg)
+		case major == 3:
+			return valueString, r.length(arg)
+		case major == 4:
+			return valueArray, r.length(arg)
+		case major == 5:
+			return valueMap, r.length(2*arg) / 2
+		case major == 6:
+			continue
+		case major == 7 && (info == 22 || info == 23):
+			return valueNil, 0
+		}
+
+		return valueOther, 0
+	}
+
+	return valueOther, 0
+}
+
+func cborHead(out []byte, kind int, n int) []byte {
+	major := [...]byte{valueBinary: 2 << 5, valueString: 3 << 5, valueMap: 5 << 5}[kind]
+
+	switch {
+	case n < 24:
+		return append(out, major|byte(n))
+	case n < 1<<8:
+		return append(out, major|24, byte(n))
+	case n < 1<<16:
+		return append(out, major|25, byte(n>>8), byte(n))
+	}
+
+	return append(out, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// protobufCodec encodes envelopes as this Protobuf message:
+//
+//	message Envelope {
+//	  string id = 1;
+//	  string topic = 2;
+//	  string content = 3;
+//	  bytes data = 4;
+//	  map<string, string> headers = 5;
+//	  string traceparent = 6;
+//	}
+type protobufCodec struct{}
+
+func (protobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func appendUvarint(out []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+
+	return append(out, buf[:n]...)
+}
+
+// appendProtobufField writes a length delimited field, empty ones are left out
+func appendProtobufField(out []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return out
+	}
+
+	out = appendUvarint(out, uint64(field<<3|2))
+	out = appendUvarint(out, uint64(len(value)))
+
+	return append(out, value...)
+}
+
+func (protobufCodec) Encode(m Envelope) []byte {
+	var out []byte
+	out = appendProtobufField(out, 1, []byte(m.ID))
+	out = appendProtobufField(out, 2, []byte(m.Topic))
+	out = appendProtobufField(out, 3, []byte(m.Content))
+	out = appendProtobufField(out, 4, m.Data)
+
+	for _, name := range sortedKeys(m.Headers) {
+		entry := appendProtobufField(nil, 1, []byte(name))
+		entry = appendProtobufField(entry, 2, []byte(m.Headers[name]))
+		out = appendProtobufField(out, 5, entry)
+	}
+
+	return appendProtobufField(out, 6, []byte(m.Traceparent))
+}
+
+// readProtobuf calls field with the length delimited fields of a message, and
+// skips every other one
+func readProtobuf(data []byte, field func(number uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return ErrEnvelope
+		}
+
+		data = data[n:]
+		var size uint64
+
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+
+			if n <= 0 {
+				return ErrEnvelope
+			}
+		case 1:
+			n = 8
+		case 2:
+			size, n = binary.Uvarint(data)
+
+			if n <= 0 || size > uint64(len(data)-n) {
+				return ErrEnvelope
+			}
+		case 5:
+			n = 4
+		default:
+			return ErrEnvelope
+		}
+
+		if n > len(data) {
+			return ErrEnvelope
+		}
+
+		if key&7 == 2 {
+			err := field(key>>3, data[n:n+int(size)])
+
+			if err != nil {
+				return err
+			}
+		}
+
+		data = data[n+int(size):]
+	}
+
+	return nil
+}
+
+func (protobufCodec) Decode(data []byte) (Envelope, error) {
+	var m Envelope
+
+	err := readProtobuf(data, func(number uint64, value []byte) error {
+		if number != 4 && number != 5 && !utf8.Valid(value) {
+			return ErrEnvelope
+		}
+
+		switch number {
+		case 1:
+			m.ID = string(value)
+		case 2:
+			m.Topic = string(value)
+		case 3:
+			m.Content = string(value)
+		case 4:
+			m.Data = value
+		case 5:
+			var name, header string
+
+			err := readProtobuf(value, func(number uint64, value []byte) error {
+				if !utf8.Valid(value) {
+					return ErrEnvelope
+				}
+
+				if number == 1 {
+					name = string(value)
+				} else if number == 2 {
+					header = string(value)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if m.Headers == nil {
+				m.Headers = make(map[string]string)
+			}
+
+			m.Headers[name] = header
+		case 6:
+			m.Traceparent = string(value)
+		}
+
+		return nil
+	})
+
+	return m, err
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
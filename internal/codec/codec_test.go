@@ -0,0 +1,47 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	full := Envelope{ID: "c-1", Topic: "binary", Content: "text", Data: []byte{0, 0xff, 'x'}, Headers: map[string]string{"a": "1", "b": ""}, Traceparent: "00-x"}
+	vectors := map[string][]byte{
+		"msgpack":  append([]byte{0x81, 0xa5}, "Topic\xa1a"...),
+		"cbor":     append([]byte{0xa1, 0x65}, "Topic\x61a"...),
+		"protobuf": []byte("\x12\x01a"),
+	}
+
+	for name, c := range codecs {
+		decoded, err := c.Decode(c.Encode(full))
+
+		if err != nil || !reflect.DeepEqual(decoded, full) {
+			t.Fatal("[tests] "+name+" doesn't decode what it encodes", decoded, err)
+		}
+
+		if vector, ok := vectors[name]; ok && !bytes.Equal(c.Encode(Envelope{Topic: "a"}), vector) {
+			t.Fatal("[tests] "+name+" encoding doesn't match the format", c.Encode(Envelope{Topic: "a"}))
+		}
+
+		data := c.Encode(full)
+
+		if _, err := c.Decode(data[:len(data)-1]); err == nil {
+			t.Fatal("[tests] " + name + " decoded a truncated message")
+		}
+	}
+
+	// Keys without case, unknown values skipped and strings as Data
+	m, err := For("msgpack").Decode([]byte("\x83\xa5topic\xa1t\xa5extra\x92\x01\x81\xa1x\xc0\xa4data\xc4\x01\x00"))
+
+	if err != nil || m.Topic != "t" || !bytes.Equal(m.Data, []byte{0}) {
+		t.Fatal("[tests] MessagePack envelope wasn't decoded", m, err)
+	}
+
+	m, err = For("cbor").Decode([]byte("\xa2\x65topic\x61t\xc0\x64data\x41\x00"))
+
+	if err != nil || m.Topic != "t" || !bytes.Equal(m.Data, []byte{0}) {
+		t.Fatal("[tests] CBOR envelope wasn't decoded", m, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Package compression negotiates permessage-deflate on the websockets of the
+// services and measures what it saves
+package compression
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Config is the permessage-deflate setting of a kind of websocket, messages
+// smaller than the min size are sent uncompressed
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	Level   int  `yaml:"level"`
+	MinSize int  `yaml:"min_size"`
+}
+
+// Validate checks the level and the min size
+func (c Config) Validate() error {
+	if c.Level < 1 || c.Level > 9 {
+		return errors.New("compression level must be between 1 and 9")
+	}
+
+	if c.MinSize < 0 {
+		return errors.New("compression min size can't be negative")
+	}
+
+	return nil
+}
+
+// The services set these to count the sizes as metrics. CountBytes gets the
+// size of the messages written (stage "message") and the bytes written for them
+// ("wire"), CountMessage whether each message was compressed
+var (
+	CountBytes   = func(size int, endpoint string, stage string) {}
+	CountMessage = func(endpoint string, compressed bool) {}
+)
+
+// MeteredConn is the connection under a websocket. Once compression has been
+// negotiated it counts the bytes written, to be compared with the size of the
+// messages
+type MeteredConn struct {
+	net.Conn
+	endpoint   string
+	minSize    int
+	compressed bool
+}
+
+// Write counts the bytes written for the compressed messages
+func (c *MeteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+
+	if c.compressed {
+		CountBytes(n, c.endpoint, "wire")
+	}
+
+	return n, err
+}
+
+// meteredHijacker hands a MeteredConn to the websocket upgrader
+type meteredHijacker struct {
+	http.ResponseWriter
+	conn *MeteredConn
+}
+
+func (h *meteredHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := h.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.conn = &MeteredConn{Conn: conn}
+
+	return h.conn, rw, nil
+}
+
+// Upgrade accepts a websocket, compressed with the given settings when the
+// upgrader has compression enabled and the client asks for it
+func Upgrade(u *websocket.Upgrader, w http.ResponseWriter, r *http.Request, endpoint string, settings Config) (*websocket.Conn, error) {
+	hijacker := &meteredHijacker{ResponseWriter: w}
+	conn, err := u.Upgrade(hijacker, r, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.EnableCompression && Offered(r.Header) {
+		Start(conn, hijacker.conn, endpoint, settings)
+	}
+
+	return conn, nil
+}
+
+// Offered tells whether the handshake headers of a websocket ask for, or accept,
+// permessage-deflate
+func Offered(header http.Header) bool {
+	for _, extensions := range header["Sec-Websocket-Extensions"] {
+		if strings.Contains(extensions, "permessage-deflate") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Start sets the level of a websocket once compression has been negotiated, and
+// starts metering the connection under it
+func Start(conn *websocket.Conn, metered *MeteredConn, endpoint string, settings Config) {
+	conn.SetCompressionLevel(settings.Level)
+	metered.endpoint = endpoint
+	metered.minSize = settings.MinSize
+	metered.compressed = true
+}
+
+// MeterWrite has to be called before writing a message, it decides by its size
+// whether it's compressed and counts it
+func MeterWrite(conn *websocket.Conn, size int) {
+	metered, ok := conn.UnderlyingConn().(*MeteredConn)
+
+	if !ok || !metered.compressed {
+		return
+	}
+
+	compress := size >= metered.minSize
+	conn.EnableWriteCompression(compress)
+	CountBytes(size, metered.endpoint, "message")
+	CountMessage(metered.endpoint, compress)
+}
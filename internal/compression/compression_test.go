@@ -0,0 +1,92 @@
+package compression
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{{Level: 0}, {Level: 10}, {Level: 5, MinSize: -1}} {
+		if c.Validate() == nil {
+			t.Fatal("[tests] Accepted invalid settings", c)
+		}
+	}
+
+	if err := (Config{Level: 1}).Validate(); err != nil {
+		t.Fatal("[tests] Rejected valid settings", err)
+	}
+
+	if !Offered(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits"}}) || Offered(http.Header{}) {
+		t.Fatal("[tests] Wrong permessage-deflate offer")
+	}
+}
+
+func TestMeterWrite(t *testing.T) {
+	var mux sync.Mutex
+	counted := make(map[string]int)
+	CountBytes = func(size int, endpoint string, stage string) {
+		mux.Lock()
+		counted[endpoint+" "+stage] += size
+		mux.Unlock()
+	}
+	CountMessage = func(endpoint string, compressed bool) {
+		mux.Lock()
+
+		if compressed {
+			counted[endpoint+" compressed"]++
+		} else {
+			counted[endpoint+" uncompressed"]++
+		}
+
+		mux.Unlock()
+	}
+
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(&upgrader, w, r, "/test", Config{Enabled: true, Level: 9, MinSize: 64})
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for _, msg := range []string{strings.Repeat("compressible ", 100), "small"} {
+			MeterWrite(conn, len(msg))
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		_, _, err = conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	if counted["/test compressed"] != 1 || counted["/test uncompressed"] != 1 || counted["/test message"] != 1305 {
+		t.Fatal("[tests] Wrong messages counted", counted)
+	}
+
+	if counted["/test wire"] == 0 || counted["/test wire"] >= counted["/test message"] {
+		t.Fatal("[tests] The messages weren't compressed", counted)
+	}
+}
@@ -0,0 +1,92 @@
+// Package health answers the liveness and readiness probes of the services
+// with the result of their checks
+package health
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"net/http"
+	"time"
+)
+
+// Check is one of the conditions reported by /healthz and /readyz
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the body of the answers, with the result of every check
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Handler answers 200 when every check passes and 503 otherwise, with a JSON
+// body that lists the result of each one
+func Handler(checks func() []Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := Report{Status: "ok", Checks: checks()}
+
+		for _, c := range report.Checks {
+			if !c.OK {
+				report.Status = "fail"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Certificate fails when there's no server certificate or it isn't valid now
+func Certificate(certs *certstore.Store) Check {
+	cert, _ := certs.Current()
+
+	if cert == nil || len(cert.Certificate) == 0 {
+		return Check{Name: "certificate", Detail: "no certificate loaded"}
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		return Check{Name: "certificate", Detail: err.Error()}
+	}
+
+	now := time.Now()
+
+	if now.Before(leaf.NotBefore) {
+		return Check{Name: "certificate", Detail: "not valid until " + leaf.NotBefore.Format(time.RFC3339)}
+	}
+
+	if now.After(leaf.NotAfter) {
+		return Check{Name: "certificate", Detail: "expired on " + leaf.NotAfter.Format(time.RFC3339)}
+	}
+
+	return Check{Name: "certificate", OK: true, Detail: "expires on " + leaf.NotAfter.Format(time.RFC3339)}
+}
+
+// Shutdown fails once stopping is closed
+func Shutdown(stopping <-chan struct{}) Check {
+	select {
+	case <-stopping:
+		return Check{Name: "shutdown", Detail: "shutting down"}
+	default:
+		return Check{Name: "shutdown", OK: true}
+	}
+}
+
+// Queue fails when the fraction of the queue in use reaches maxUsage
+func Queue(name string, length int, capacity int, maxUsage float64) Check {
+	usage := float64(length) / float64(capacity)
+	detail := fmt.Sprintf("%d of %d messages", length, capacity)
+
+	return Check{Name: name, OK: usage < maxUsage, Detail: detail}
+}
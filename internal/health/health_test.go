@@ -0,0 +1,48 @@
+package health
+
+import (
+	"encoding/json"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	stopping := make(chan struct{})
+	checks := []Check{{Name: "good", OK: true}, Shutdown(stopping), Queue("queue", 8, 10, 0.9)}
+
+	recorder := httptest.NewRecorder()
+	Handler(func() []Check { return checks })(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatal("[tests] Passing checks weren't ok", recorder.Code, recorder.Body)
+	}
+
+	close(stopping)
+	checks = append(checks, Shutdown(stopping), Queue("full", 9, 10, 0.9))
+	checks = append(checks, Certificate(certstore.New(t.Name(), certstore.ServerCertFile, certstore.ServerKeyFile, true, logging.New("health"))))
+
+	recorder = httptest.NewRecorder()
+	Handler(func() []Check { return checks })(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report Report
+	err := json.NewDecoder(recorder.Body).Decode(&report)
+
+	if err != nil || recorder.Code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Fatal("[tests] Failed checks weren't reported", recorder.Code, report, err)
+	}
+
+	failed := map[string]string{}
+
+	for _, c := range report.Checks {
+		if !c.OK {
+			failed[c.Name] = c.Detail
+		}
+	}
+
+	if len(failed) != 3 || failed["shutdown"] != "shutting down" || failed["full"] != "9 of 10 messages" || failed["certificate"] != "no certificate loaded" {
+		t.Fatal("[tests] Checks don't have the expected results", report.Checks)
+	}
+}
@@ -0,0 +1,140 @@
+// Package keepalive pings the websockets of the services, to notice the peers
+// that are gone, and closes the ones left idle
+package keepalive
+
+import (
+	"errors"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/gorilla/websocket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config controls how dead and idle websockets are detected
+type Config struct {
+	PingInterval time.Duration `yaml:"ping_interval"`
+	PongTimeout  time.Duration `yaml:"pong_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+// Validate checks that the timeouts are positive, the idle one can be 0
+func (c Config) Validate() error {
+	if c.PingInterval <= 0 || c.PongTimeout <= 0 || c.WriteTimeout <= 0 {
+		return errors.New("ping interval, pong timeout and write timeout must be positive")
+	}
+
+	if c.IdleTimeout < 0 {
+		return errors.New("idle timeout can't be negative")
+	}
+
+	return nil
+}
+
+// Conn pings a websocket and closes it when no messages are sent or received
+// for longer than the idle timeout. A peer that stops answering the pings makes
+// the next read fail once the read deadline passes
+type Conn struct {
+	conn     *websocket.Conn
+	settings Config
+	log      logging.Logger
+	lastUse  int64
+	pending  int32
+	done     chan struct{}
+	stopOnce sync.Once
+	writeMux sync.Mutex
+}
+
+// Start must be called before the first read, as it sets the read deadline and
+// the pong handler of the connection
+func Start(conn *websocket.Conn, settings Config, log logging.Logger) *Conn {
+	k := &Conn{conn: conn, settings: settings, log: log, lastUse: time.Now().UnixNano(), done: make(chan struct{})}
+
+	conn.SetReadDeadline(time.Now().Add(settings.PingInterval + settings.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(settings.PingInterval + settings.PongTimeout))
+	})
+
+	go k.run()
+
+	return k
+}
+
+func (k *Conn) run() {
+	ticker := time.NewTicker(k.settings.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&k.lastUse)))
+
+			if k.settings.IdleTimeout > 0 && idle > k.settings.IdleTimeout {
+				k.log.Info("Closing idle connection", "remote", k.conn.RemoteAddr(), "idle", idle)
+				k.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"), time.Now().Add(k.settings.WriteTimeout))
+				k.conn.Close()
+				return
+			}
+
+			err := k.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(k.settings.WriteTimeout))
+
+			if err != nil {
+				k.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Received has to be called for every message read, the peer is alive and the
+// connection in use
+func (k *Conn) Received() {
+	atomic.StoreInt64(&k.lastUse, time.Now().UnixNano())
+	k.conn.SetReadDeadline(time.Now().Add(k.settings.PingInterval + k.settings.PongTimeout))
+}
+
+// Write sends a message giving up after the write timeout. Messages can be
+// written from several goroutines, only one at a time
+func (k *Conn) Write(messageType int, data []byte) error {
+	atomic.AddInt32(&k.pending, 1)
+	defer atomic.AddInt32(&k.pending, -1)
+
+	k.writeMux.Lock()
+	defer k.writeMux.Unlock()
+
+	k.conn.SetWriteDeadline(time.Now().Add(k.settings.WriteTimeout))
+	compression.MeterWrite(k.conn, len(data))
+	err := k.conn.WriteMessage(messageType, data)
+
+	if err == nil {
+		atomic.StoreInt64(&k.lastUse, time.Now().UnixNano())
+	}
+
+	return err
+}
+
+// Pending returns how many messages are being written or waiting for their turn
+func (k *Conn) Pending() int {
+	return int(atomic.LoadInt32(&k.pending))
+}
+
+// RemoteAddr returns the address of the peer
+func (k *Conn) RemoteAddr() string {
+	return k.conn.RemoteAddr().String()
+}
+
+// Done is closed once the pings are stopped
+func (k *Conn) Done() <-chan struct{} {
+	return k.done
+}
+
+// Stop stops the pings, the connection is left open
+func (k *Conn) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.done)
+	})
+}
@@ -0,0 +1,180 @@
+package keepalive
+
+import (
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSettings = Config{
+	PingInterval: 100 * time.Millisecond,
+	PongTimeout:  100 * time.Millisecond,
+	WriteTimeout: time.Second,
+	IdleTimeout:  300 * time.Millisecond,
+}
+
+// startServer accepts websockets kept alive with the given settings, it reads
+// them until they fail and then sends how long they lasted
+func startServer(settings Config) (*httptest.Server, chan time.Duration) {
+	lasted := make(chan time.Duration, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		start := time.Now()
+		alive := Start(conn, settings, logging.New("test"))
+		defer alive.Stop()
+
+		for {
+			_, _, err := conn.ReadMessage()
+
+			if err != nil {
+				lasted <- time.Since(start)
+				return
+			}
+
+			alive.Received()
+		}
+	}))
+
+	return server, lasted
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server, lasted := startServer(testSettings)
+	defer server.Close()
+
+	// Reading answers the pings, so only the idle timeout can close it
+	conn := dial(t, server)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err := conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatal("[tests] Idle connection wasn't closed", err)
+	}
+
+	if d := <-lasted; d < testSettings.IdleTimeout {
+		t.Fatal("[tests] Connection closed before the idle timeout", d)
+	}
+}
+
+func TestInUse(t *testing.T) {
+	server, lasted := startServer(testSettings)
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Messages received more often than the idle timeout keep it open
+	for i := 0; i < 8; i++ {
+		time.Sleep(100 * time.Millisecond)
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	}
+
+	select {
+	case d := <-lasted:
+		t.Fatal("[tests] Connection in use was closed after", d)
+	default:
+	}
+}
+
+func TestPending(t *testing.T) {
+	server, _ := startServer(testSettings)
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	alive := Start(conn, testSettings, logging.New("test"))
+	defer alive.Stop()
+
+	// A write waiting for its turn is pending until it's done
+	alive.writeMux.Lock()
+	written := make(chan error, 1)
+
+	go func() {
+		written <- alive.Write(websocket.TextMessage, []byte("hello"))
+	}()
+
+	for i := 0; i < 100 && alive.Pending() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if alive.Pending() != 1 {
+		t.Fatal("[tests] Waiting write wasn't pending", alive.Pending())
+	}
+
+	alive.writeMux.Unlock()
+
+	if err := <-written; err != nil || alive.Pending() != 0 {
+		t.Fatal("[tests] Finished write is still pending", alive.Pending(), err)
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	settings := testSettings
+	settings.IdleTimeout = 0
+	server, lasted := startServer(settings)
+	defer server.Close()
+
+	// Not reading means the pings are never answered
+	conn := dial(t, server)
+	defer conn.Close()
+
+	select {
+	case d := <-lasted:
+		if d < settings.PingInterval+settings.PongTimeout {
+			t.Fatal("[tests] Connection failed before the pong timeout", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("[tests] Connection that didn't answer the pings wasn't closed")
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	invalid := []Config{
+		{PongTimeout: time.Second, WriteTimeout: time.Second},
+		{PingInterval: time.Second, WriteTimeout: time.Second},
+		{PingInterval: time.Second, PongTimeout: time.Second},
+		{PingInterval: time.Second, PongTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: -time.Second},
+	}
+
+	for _, c := range invalid {
+		if c.Validate() == nil {
+			t.Fatal("[tests] Accepted invalid settings", c)
+		}
+	}
+
+	if err := testSettings.Validate(); err != nil {
+		t.Fatal("[tests] Rejected valid settings", err)
+	}
+}
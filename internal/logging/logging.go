@@ -0,0 +1,337 @@
+// Package logging writes the structured log entries of the services, as logfmt
+// or JSON lines with the secrets and the message payloads left out
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Log levels, entries below the configured one are discarded
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (int32, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return int32(i), nil
+		}
+	}
+
+	return LevelInfo, errors.New("invalid log level " + name)
+}
+
+// SetLevel changes the lowest level written
+func SetLevel(level int32) {
+	atomic.StoreInt32(&output.level, level)
+}
+
+// LevelName returns the name of the lowest level written
+func LevelName() string {
+	return levelNames[atomic.LoadInt32(&output.level)]
+}
+
+// Fields whose values are never written
+var secretFields = map[string]bool{"password": true, "authorization": true, "token": true, "secret": true}
+
+// logOutput is where the entries end up and how they're written. The sink can be
+// any writer, it's only written to by one goroutine at a time
+type logOutput struct {
+	level            int32
+	format           string
+	sink             io.Writer
+	payloads         bool
+	sampleInitial    int
+	sampleThereafter int
+	samples          map[string]*sampleCount
+	mux              sync.Mutex
+}
+
+type sampleCount struct {
+	second int64
+	count  int
+}
+
+var output = &logOutput{level: LevelInfo, format: "logfmt", sink: os.Stdout, samples: make(map[string]*sampleCount)}
+
+// Logger writes entries with a set of fields attached, like the connection or
+// the message they refer to
+type Logger struct {
+	fields  []interface{}
+	sampled bool
+}
+
+// New returns the logger of a service, its entries carry the service name
+func New(service string) Logger {
+	return Logger{fields: []interface{}{"service", service}}
+}
+
+// With returns a logger that adds the given key value pairs to every entry
+func (l Logger) With(keyValues ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+
+	return Logger{fields: fields, sampled: l.sampled}
+}
+
+// Sample returns a logger for high volume paths, that only writes the first
+// entries with the same message each second and one of every few after those
+func (l Logger) Sample() Logger {
+	return Logger{fields: l.fields, sampled: true}
+}
+
+// Enabled tells whether entries of the level are written
+func (l Logger) Enabled(level int32) bool {
+	return level >= atomic.LoadInt32(&output.level)
+}
+
+// Debug writes an entry with the debug level
+func (l Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LevelDebug, msg, keyValues)
+}
+
+// Info writes an entry with the info level
+func (l Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LevelInfo, msg, keyValues)
+}
+
+// Warn writes an entry with the warn level
+func (l Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LevelWarn, msg, keyValues)
+}
+
+// Error writes an entry with the error level
+func (l Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LevelError, msg, keyValues)
+}
+
+func (l Logger) log(level int32, msg string, keyValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	output.mux.Lock()
+	defer output.mux.Unlock()
+
+	if l.sampled && !output.keep(level, msg) {
+		return
+	}
+
+	fields := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", levelNames[level], "msg", msg}, l.fields...)
+	fields = append(fields, keyValues...)
+
+	var entry bytes.Buffer
+
+	if output.format == "json" {
+		writeJSON(&entry, fields, output.payloads)
+	} else {
+		writeLogfmt(&entry, fields, output.payloads)
+	}
+
+	entry.WriteByte('\n')
+	output.sink.Write(entry.Bytes())
+}
+
+// keep decides if a sampled entry is written, must be called with the lock held
+func (o *logOutput) keep(level int32, msg string) bool {
+	if o.sampleInitial <= 0 {
+		return true
+	}
+
+	key := levelNames[level] + msg
+	second := time.Now().Unix()
+	sample, ok := o.samples[key]
+
+	if !ok || sample.second != second {
+		sample = &sampleCount{second: second}
+		o.samples[key] = sample
+	}
+
+	sample.count++
+
+	if sample.count <= o.sampleInitial {
+		return true
+	}
+
+	return o.sampleThereafter > 0 && (sample.count-o.sampleInitial)%o.sampleThereafter == 0
+}
+
+// FieldValue turns a value into something safe to write. Byte slices are
+// message payloads and only their size is written unless payloads are enabled
+func FieldValue(key string, value interface{}, payloads bool) interface{} {
+	if secretFields[key] {
+		return "REDACTED"
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		if payloads {
+			return string(v)
+		}
+
+		return fmt.Sprintf("REDACTED %d bytes", len(v))
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case string, bool, int, int32, int64, uint64, float64:
+		return v
+	}
+
+	return fmt.Sprint(value)
+}
+
+func writeJSON(entry *bytes.Buffer, fields []interface{}, payloads bool) {
+	entry.WriteByte('{')
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+
+		if i > 0 {
+			entry.WriteByte(',')
+		}
+
+		encodedKey, _ := json.Marshal(key)
+		encodedValue, err := json.Marshal(FieldValue(key, fields[i+1], payloads))
+
+		if err != nil {
+			encodedValue, _ = json.Marshal(err.Error())
+		}
+
+		entry.Write(encodedKey)
+		entry.WriteByte(':')
+		entry.Write(encodedValue)
+	}
+
+	entry.WriteByte('}')
+}
+
+func writeLogfmt(entry *bytes.Buffer, fields []interface{}, payloads bool) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := fmt.Sprint(FieldValue(key, fields[i+1], payloads))
+
+		if i > 0 {
+			entry.WriteByte(' ')
+		}
+
+		entry.WriteString(key)
+		entry.WriteByte('=')
+
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+
+		entry.WriteString(value)
+	}
+}
+
+// Connections are numbered to tell apart the entries of each one
+var lastConnID uint64
+
+// Conn returns a logger for the entries about one connection, and the ID given
+// to the connection
+func (l Logger) Conn(remoteAddr string, endpoint string) (Logger, string) {
+	id := "c" + strconv.FormatUint(atomic.AddUint64(&lastConnID, 1), 10)
+
+	return l.With("conn", id, "remote", remoteAddr, "endpoint", endpoint), id
+}
+
+// MessageID returns the ID assigned to a message by the publisher, if it has one
+func MessageID(msg []byte) string {
+	var m struct{ ID string }
+	json.Unmarshal(msg, &m)
+
+	return m.ID
+}
+
+// Settings are the logging options every service has
+type Settings struct {
+	Level            string
+	Format           string
+	Output           string
+	Payloads         bool
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// Configure applies the logging settings, it can be called again at any time
+func Configure(s Settings) error {
+	level, err := ParseLevel(s.Level)
+
+	if err != nil {
+		return err
+	}
+
+	var sink io.Writer
+
+	switch s.Output {
+	case "", "stdout":
+		sink = os.Stdout
+	case "stderr":
+		sink = os.Stderr
+	default:
+		sink, err = os.OpenFile(s.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	output.mux.Lock()
+	defer output.mux.Unlock()
+
+	if file, ok := output.sink.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+		file.Close()
+	}
+
+	atomic.StoreInt32(&output.level, level)
+	output.format = s.Format
+	output.sink = sink
+	output.payloads = s.Payloads
+	output.sampleInitial = s.SampleInitial
+	output.sampleThereafter = s.SampleThereafter
+
+	return nil
+}
+
+// Reload applies the settings returned by load again on SIGHUP, so the level
+// can be changed and the log file reopened without restarting the service
+func (l Logger) Reload(load func() (Settings, error)) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		s, err := load()
+
+		if err == nil {
+			err = Configure(s)
+		}
+
+		if err != nil {
+			l.Error("Error reloading the logging configuration, keeping the previous one", "error", err)
+			continue
+		}
+
+		l.Info("Reloaded the logging configuration", "level", s.Level, "format", s.Format, "output", s.Output)
+	}
+}
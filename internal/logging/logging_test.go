@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogs(t *testing.T) {
+	var entries bytes.Buffer
+	logs := New("msgqueue")
+	err := Configure(Settings{Level: "info", Format: "json", SampleInitial: 2, SampleThereafter: 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output.sink = &entries
+	defer Configure(Settings{Level: "info", Format: "logfmt"})
+
+	log := logs.With("password", "test")
+	log.Debug("Not written")
+	log.Info("Written", "payload", []byte("hello team!"))
+
+	var entry map[string]interface{}
+	err = json.Unmarshal(entries.Bytes(), &entry)
+
+	if err != nil {
+		t.Fatal("[tests] Entry isn't valid JSON", entries.String())
+	}
+
+	if entry["msg"] != "Written" || entry["level"] != "info" || entry["service"] != "msgqueue" {
+		t.Fatal("[tests] Entry is missing fields", entries.String())
+	}
+
+	if entry["password"] != "REDACTED" || entry["payload"] != "REDACTED 11 bytes" {
+		t.Fatal("[tests] Secrets or payloads were written", entries.String())
+	}
+
+	entries.Reset()
+	output.format = "logfmt"
+	output.payloads = true
+	logs.Warn("Written", "payload", []byte("hello team!"), "size", 11)
+
+	if !strings.Contains(entries.String(), ` level=warn msg=Written service=msgqueue payload="hello team!" size=11`) {
+		t.Fatal("[tests] Wrong logfmt entry", entries.String())
+	}
+
+	entries.Reset()
+
+	for i := 0; i < 8; i++ {
+		logs.Sample().Info("Sampled")
+	}
+
+	// The first 2 entries and then one of every 3, or one more if a second went by
+	if lines := strings.Count(entries.String(), "\n"); lines < 4 || lines > 5 {
+		t.Fatal("[tests] Sampling kept", lines, "entries")
+	}
+}
+
+func TestConn(t *testing.T) {
+	var entries bytes.Buffer
+	logs := New("publisher")
+	output.mux.Lock()
+	output.sink = &entries
+	output.mux.Unlock()
+	defer Configure(Settings{Level: "info", Format: "logfmt"})
+
+	first, firstID := logs.Conn("127.0.0.1:1234", "/publish")
+	_, secondID := logs.Conn("127.0.0.1:1234", "/publish")
+
+	if firstID == secondID {
+		t.Fatal("[tests] Two connections got the same ID", firstID)
+	}
+
+	first.Info("Connected")
+
+	if !strings.Contains(entries.String(), " service=publisher conn="+firstID+" remote=127.0.0.1:1234 endpoint=/publish") {
+		t.Fatal("[tests] Connection fields are missing", entries.String())
+	}
+
+	if id := MessageID([]byte(`{"ID":"m-1","Topic":"test"}`)); id != "m-1" {
+		t.Fatal("[tests] Wrong message ID", id)
+	}
+}
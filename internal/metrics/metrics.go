@@ -0,0 +1,210 @@
+// Package metrics keeps the metrics of a service and serves them in the
+// Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is anything that can be written in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+func register(m metric) {
+	registry = append(registry, m)
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelPairs formats the labels of a sample, values are escaped as the format requires
+func labelPairs(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	for i, name := range names {
+		pairs[i] = name + `="` + escaper.Replace(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter with one value for each combination of labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mux    sync.Mutex
+}
+
+// NewCounterVec registers a counter with the given label names
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+
+	// Without labels there's a single value, which can be reported from the start
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+
+	return c
+}
+
+// Inc adds one to the value of the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta to the value of the label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mux.Lock()
+	c.values[strings.Join(labelValues, "\x00")] += delta
+	c.mux.Unlock()
+}
+
+// Snapshot returns the current values keyed by the label values, joined by
+// spaces when there's more than one
+func (c *CounterVec) Snapshot() map[string]float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	values := make(map[string]float64, len(c.values))
+
+	for key, value := range c.values {
+		values[strings.Replace(key, "\x00", " ", -1)] = value
+	}
+
+	return values
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, labelPairs(c.labels, strings.Split(key, "\x00")), c.values[key])
+	}
+}
+
+// GaugeFunc is a gauge whose values are read when the metrics are scraped, keyed
+// by the value of its only label, or by "" when it has none
+type GaugeFunc struct {
+	name   string
+	help   string
+	label  string
+	values func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge that reads its values with the given function
+func NewGaugeFunc(name string, help string, label string, values func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label, values: values}
+	register(g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.values()
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if g.label == "" {
+			fmt.Fprintf(w, "%s %g\n", g.name, values[key])
+			continue
+		}
+
+		fmt.Fprintf(w, "%s%s %g\n", g.name, labelPairs([]string{g.label}, []string{key}), values[key])
+	}
+}
+
+// Histogram counts observations, in seconds, in cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	mux     sync.Mutex
+}
+
+// LatencyBuckets are the buckets of the write durations
+var LatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// NewHistogram registers a histogram with the given bucket bounds
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+
+	return h
+}
+
+// Observe counts a duration in its buckets
+func (h *Histogram) Observe(d time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	seconds := d.Seconds()
+
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += seconds
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count)
+}
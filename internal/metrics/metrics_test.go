@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	plain := NewCounterVec("test_plain_total", "Counter without labels")
+	labelled := NewCounterVec("test_labelled_total", "Counter with labels", "endpoint", "reason")
+	NewGaugeFunc("test_depth", "Gauge with a label", "queue", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": 1}
+	})
+	latency := NewHistogram("test_duration_seconds", "Histogram", []float64{0.1, 1})
+
+	labelled.Inc("/x", `say "hi"`)
+	labelled.Add(2, "/x", `say "hi"`)
+	latency.Observe(50 * time.Millisecond)
+	latency.Observe(500 * time.Millisecond)
+
+	if labelled.Snapshot()[`/x say "hi"`] != 3 {
+		t.Fatal("[tests] Counter snapshot doesn't have the labelled value", labelled.Snapshot())
+	}
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# HELP test_plain_total Counter without labels\n# TYPE test_plain_total counter\ntest_plain_total 0\n",
+		`test_labelled_total{endpoint="/x",reason="say \"hi\""} 3` + "\n",
+		"# TYPE test_depth gauge\ntest_depth{queue=\"a\"} 1\ntest_depth{queue=\"b\"} 2\n",
+		"test_duration_seconds_bucket{le=\"0.1\"} 1\ntest_duration_seconds_bucket{le=\"1\"} 2\ntest_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"test_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatal("[tests] Metrics don't have "+line, body)
+		}
+	}
+
+	if plain.Snapshot()[""] != 0 || w.Header().Get("Content-Type") != "text/plain; version=0.0.4" {
+		t.Fatal("[tests] Metrics weren't served in the text format", w.Header())
+	}
+}
@@ -0,0 +1,122 @@
+// Package settings loads the configuration of the services. The values are
+// taken, in order of precedence, from the command line flags, the environment,
+// a YAML file and the defaults
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Option is a setting that can be overridden from the environment and the
+// command line. Value points to a string, int, float64, bool or duration
+type Option struct {
+	Flag  string
+	Env   string
+	Usage string
+	Value interface{}
+}
+
+// Load reads the file given with -config or WS_CONFIG into c, which holds the
+// defaults, and then applies the environment and the flags of the options,
+// which point into c. It also reports whether -print-config was requested
+func Load(args []string, c interface{}, options []Option) (bool, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("WS_CONFIG"), "path to a YAML configuration file")
+	printConfig := flags.Bool("print-config", false, "print the configuration and exit")
+	flagValues := make(map[string]*string)
+
+	for _, opt := range options {
+		flagValues[opt.Flag] = flags.String(opt.Flag, "", opt.Usage+" (env "+opt.Env+")")
+	}
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return false, err
+	}
+
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+
+		if err != nil {
+			return false, err
+		}
+
+		err = yaml.UnmarshalStrict(data, c)
+
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", *configFile, err)
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := os.LookupEnv(opt.Env); ok {
+			err = set(opt, value)
+
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := flagValues[f.Name]; ok && err == nil {
+			err = set(byFlag(options, f.Name), *value)
+		}
+	})
+
+	return *printConfig, err
+}
+
+func byFlag(options []Option, name string) Option {
+	for _, opt := range options {
+		if opt.Flag == name {
+			return opt
+		}
+	}
+
+	return Option{}
+}
+
+func set(opt Option, value string) error {
+	var err error
+
+	switch v := opt.Value.(type) {
+	case *string:
+		*v = value
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *float64:
+		*v, err = strconv.ParseFloat(value, 64)
+	case *bool:
+		*v, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*v, err = time.ParseDuration(value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", value, opt.Flag, err)
+	}
+
+	return nil
+}
+
+// Print writes the configuration to the standard output as YAML, the secrets
+// have to be redacted by the caller
+func Print(c interface{}) error {
+	out, err := yaml.Marshal(c)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+
+	return err
+}
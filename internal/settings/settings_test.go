@@ -0,0 +1,81 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name    string        `yaml:"name"`
+	Size    int           `yaml:"size"`
+	Ratio   float64       `yaml:"ratio"`
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *testConfig) options() []Option {
+	return []Option{
+		{Flag: "name", Env: "WS_TEST_NAME", Usage: "name", Value: &c.Name},
+		{Flag: "size", Env: "WS_TEST_SIZE", Usage: "size", Value: &c.Size},
+		{Flag: "ratio", Env: "WS_TEST_RATIO", Usage: "ratio", Value: &c.Ratio},
+		{Flag: "enabled", Env: "WS_TEST_ENABLED", Usage: "enabled", Value: &c.Enabled},
+		{Flag: "timeout", Env: "WS_TEST_TIMEOUT", Usage: "timeout", Value: &c.Timeout},
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "settings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	file.WriteString("name: file\nsize: 2\nratio: 0.5\n")
+	file.Close()
+
+	os.Setenv("WS_TEST_SIZE", "3")
+	os.Setenv("WS_TEST_ENABLED", "true")
+	defer os.Unsetenv("WS_TEST_SIZE")
+	defer os.Unsetenv("WS_TEST_ENABLED")
+
+	// The flags win over the environment, which wins over the file and the defaults
+	c := testConfig{Name: "default", Timeout: time.Second}
+	printOnly, err := Load([]string{"-config", file.Name(), "-size", "4", "-timeout", "2s", "-print-config"}, &c, c.options())
+
+	if err != nil || !printOnly {
+		t.Fatal("[tests] Configuration wasn't loaded", err)
+	}
+
+	if c != (testConfig{Name: "file", Size: 4, Ratio: 0.5, Enabled: true, Timeout: 2 * time.Second}) {
+		t.Fatal("[tests] Configuration doesn't follow the order of precedence", c)
+	}
+
+	c = testConfig{}
+
+	if _, err := Load([]string{"-size", "many"}, &c, c.options()); err == nil {
+		t.Fatal("[tests] Invalid flag value was accepted")
+	}
+
+	os.Setenv("WS_TEST_ENABLED", "maybe")
+
+	if _, err := Load(nil, &c, c.options()); err == nil {
+		t.Fatal("[tests] Invalid environment value was accepted")
+	}
+
+	os.Unsetenv("WS_TEST_ENABLED")
+	file, err = os.Create(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteString("unknown: 1\n")
+	file.Close()
+
+	if _, err := Load([]string{"-config", file.Name()}, &c, c.options()); err == nil {
+		t.Fatal("[tests] Unknown setting in the file was accepted")
+	}
+}
@@ -0,0 +1,131 @@
+// Package shutdown stops the services on SIGINT and SIGTERM, and keeps the
+// messages they couldn't deliver in a spool file until they start again
+package shutdown
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/logging"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit statuses of the services
+const (
+	ExitOK           = 0
+	ExitError        = 1
+	ExitConfig       = 2
+	ExitMessagesLost = 3
+)
+
+// HandleSignals waits for SIGINT or SIGTERM, then sets the deadline of the
+// shutdown and closes stopping
+func HandleSignals(stopping chan struct{}, deadline *time.Time, timeout time.Duration, logs logging.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	logs.Info("Shutting down", "signal", sig)
+
+	*deadline = time.Now().Add(timeout)
+	close(stopping)
+}
+
+// TakeAll empties a queue and returns what it held
+func TakeAll(queue chan []byte) [][]byte {
+	var taken [][]byte
+
+	for {
+		select {
+		case msg := <-queue:
+			taken = append(taken, msg)
+		default:
+			return taken
+		}
+	}
+}
+
+// Spool appends messages to a file, one JSON encoded message per line, and
+// returns how many were written. Without a file they're lost
+func Spool(path string, pending [][]byte) (int, error) {
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	if path == "" {
+		return 0, fmt.Errorf("%d messages lost, there's no spool file configured", len(pending))
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(file)
+
+	for i, msg := range pending {
+		err = encoder.Encode(msg)
+
+		if err != nil {
+			file.Close()
+			return i, err
+		}
+	}
+
+	return len(pending), file.Close()
+}
+
+// Restore queues again the messages spooled on a previous shutdown and removes
+// the file, queue returns where each one goes
+func Restore(path string, queue func(msg []byte) chan []byte) (int, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var restored [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	for scanner.Scan() {
+		var msg []byte
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+
+		restored = append(restored, msg)
+	}
+
+	file.Close()
+
+	if scanner.Err() != nil {
+		return 0, scanner.Err()
+	}
+
+	err = os.Remove(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// There may be more messages than room on the queue, so they're pushed as it empties
+	go func() {
+		for _, msg := range restored {
+			queue(msg) <- msg
+		}
+	}()
+
+	return len(restored), nil
+}
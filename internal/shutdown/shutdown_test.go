@@ -0,0 +1,53 @@
+package shutdown
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	queue := make(chan []byte, 2)
+	queue <- []byte("first\nline")
+	queue <- []byte("second")
+
+	_, err = Spool("", TakeAll(queue))
+
+	if err == nil {
+		t.Fatal("[tests] Messages were dropped without an error")
+	}
+
+	queue <- []byte("first\nline")
+	queue <- []byte("second")
+
+	spooled, err := Spool(dir+"/spool", TakeAll(queue))
+
+	if err != nil || spooled != 2 {
+		t.Fatal("[tests] Messages weren't spooled", err)
+	}
+
+	restored, err := Restore(dir+"/spool", func(msg []byte) chan []byte { return queue })
+
+	if err != nil || restored != 2 {
+		t.Fatal("[tests] Messages weren't restored", err)
+	}
+
+	if !bytes.Equal(<-queue, []byte("first\nline")) || !bytes.Equal(<-queue, []byte("second")) {
+		t.Fatal("[tests] Restored messages don't match")
+	}
+
+	_, err = os.Stat(dir + "/spool")
+
+	if !os.IsNotExist(err) {
+		t.Fatal("[tests] Spool file wasn't removed after restoring it")
+	}
+}
@@ -0,0 +1,463 @@
+// Package tracing records the spans of the messages going through the services
+// and exports them as OTLP JSON, continuing the traces they carry
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/logging"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	traceBatchSize    = 100
+	traceBatchDelay   = time.Second
+	traceFlushTimeout = 5 * time.Second
+)
+
+// Span kinds as numbered by OTLP
+const (
+	Server   = 2
+	Producer = 4
+	Consumer = 5
+)
+
+// SpanContext identifies a span, it travels between the services in the
+// Traceparent field of the messages, formatted as a W3C traceparent
+type SpanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// ParseTraceParent reads a traceparent, it fails on unknown formats and invalid IDs
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(value, "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	// Only version 00 is known, later ones may add fields at the end
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	_, err := hex.Decode(sc.traceID[:], []byte(parts[1]))
+
+	if err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+
+	_, err = hex.Decode(sc.spanID[:], []byte(parts[2]))
+
+	if err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+
+	if err != nil {
+		return sc, false
+	}
+
+	sc.sampled = flags&1 == 1
+
+	return sc, true
+}
+
+// TraceParent formats the context as a traceparent
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+
+	if sc.sampled {
+		flags = "01"
+	}
+
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// Span is one step of a message through a service. Every method accepts a nil
+// span, which is what Start returns when tracing is disabled
+type Span struct {
+	context    SpanContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes []interface{}
+	err        string
+}
+
+// Start starts a span, continuing the trace of the parent when there is one
+func Start(name string, kind int, parent SpanContext, hasParent bool) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now()}
+
+	if hasParent {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = tracer.sample(s.context.traceID)
+	}
+
+	rand.Read(s.context.spanID[:])
+
+	return s
+}
+
+// StartMessage starts a span that continues the trace carried by a message,
+// or a new trace if it doesn't carry one
+func StartMessage(name string, kind int, msg []byte) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	var m struct{ Traceparent string }
+	json.Unmarshal(msg, &m)
+	parent, ok := ParseTraceParent(m.Traceparent)
+
+	return Start(name, kind, parent, ok)
+}
+
+// Child starts a span with this one as its parent
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return Start(name, kind, s.context, true)
+}
+
+// Set adds attributes to the span, as key value pairs
+func (s *Span) Set(keyValues ...interface{}) {
+	if s != nil {
+		s.attributes = append(s.attributes, keyValues...)
+	}
+}
+
+// Fail marks the span as failed with the error
+func (s *Span) Fail(err error) {
+	if s != nil {
+		s.err = err.Error()
+	}
+}
+
+// Finish ends the span and queues it to be exported if it's sampled
+func (s *Span) Finish() {
+	if s == nil || !s.context.sampled {
+		return
+	}
+
+	s.end = time.Now()
+	tracer.record(s)
+}
+
+// Context returns the context that identifies the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.context
+}
+
+// WithTrace sets the Traceparent field of a JSON object message to the given
+// span, so the next service continues the trace from it
+func WithTrace(msg []byte, s *Span) []byte {
+	if s == nil {
+		return msg
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(msg, &fields)
+
+	if err != nil || fields == nil {
+		return msg
+	}
+
+	fields["Traceparent"], _ = json.Marshal(s.context.TraceParent())
+	traced, err := json.Marshal(fields)
+
+	if err != nil {
+		return msg
+	}
+
+	return traced
+}
+
+// spanExporter sends the finished spans somewhere, it's only called from the
+// goroutine of the tracer
+type spanExporter interface {
+	export(spans []*Span) error
+}
+
+// writerExporter writes every span as a line of OTLP JSON, the format read by
+// the file receiver of the OpenTelemetry collector
+type writerExporter struct {
+	service string
+	w       io.Writer
+}
+
+func (e *writerExporter) export(spans []*Span) error {
+	for _, s := range spans {
+		line, err := json.Marshal(otlpRequest(e.service, []*Span{s}))
+
+		if err != nil {
+			return err
+		}
+
+		_, err = e.w.Write(append(line, '\n'))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// otlpExporter posts the spans to an OTLP/HTTP endpoint using the JSON encoding
+type otlpExporter struct {
+	service  string
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(e.service, spans))
+
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return errors.New("collector answered " + response.Status)
+	}
+
+	return nil
+}
+
+func otlpRequest(service string, spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+
+	for i, s := range spans {
+		encoded[i] = map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.traceID[:]),
+			"spanId":            hex.EncodeToString(s.context.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+
+		if s.parentID != [8]byte{} {
+			encoded[i]["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+
+		if s.err != "" {
+			encoded[i]["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]interface{}{"service.name", service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/Javivi/ws-go"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(keyValues []interface{}) []interface{} {
+	attributes := make([]interface{}, 0, len(keyValues)/2)
+
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		var value map[string]interface{}
+
+		switch v := keyValues[i+1].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(logging.FieldValue("", v, true))}
+		}
+
+		attributes = append(attributes, map[string]interface{}{"key": keyValues[i], "value": value})
+	}
+
+	return attributes
+}
+
+// tracerState batches the finished spans and hands them to the exporter
+type tracerState struct {
+	exporter spanExporter
+	log      logging.Logger
+	ratio    float64
+	spans    chan *Span
+	flushes  chan chan struct{}
+}
+
+// The tracer is nil while tracing is disabled
+var tracer *tracerState
+
+// sample decides if a new trace is recorded, from its ID so the decision is
+// random but doesn't need more random numbers
+func (t *tracerState) sample(traceID [16]byte) bool {
+	var n uint64
+
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+
+	return float64(n>>11)/float64(1<<53) < t.ratio
+}
+
+func (t *tracerState) record(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		t.log.Sample().Warn("Dropping span, the export queue is full", "span", s.name)
+	}
+}
+
+func (t *tracerState) run() {
+	ticker := time.NewTicker(traceBatchDelay)
+	defer ticker.Stop()
+
+	var batch []*Span
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := t.exporter.export(batch)
+
+		if err != nil {
+			t.log.Warn("Error exporting spans", "count", len(batch), "error", err)
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flushes:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+
+			export()
+			close(done)
+		}
+	}
+}
+
+// Flush exports the spans waiting to be sent, used before exiting
+func Flush() {
+	if tracer == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	timeout := time.After(traceFlushTimeout)
+
+	select {
+	case tracer.flushes <- done:
+	case <-timeout:
+		return
+	}
+
+	select {
+	case <-done:
+	case <-timeout:
+		tracer.log.Warn("Timed out exporting the last spans")
+	}
+}
+
+// Settings are the tracing options every service has, the spans are exported
+// as coming from the given service
+type Settings struct {
+	Service     string
+	Exporter    string
+	File        string
+	Endpoint    string
+	SampleRatio float64
+}
+
+// Configure starts the tracer with the configured exporter, it must be called
+// before any message is handled
+func Configure(s Settings, log logging.Logger) error {
+	var exporter spanExporter
+
+	switch s.Exporter {
+	case "", "none":
+		tracer = nil
+		return nil
+	case "stdout":
+		exporter = &writerExporter{service: s.Service, w: os.Stdout}
+	case "file":
+		file, err := os.OpenFile(s.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		exporter = &writerExporter{service: s.Service, w: file}
+	case "otlp":
+		exporter = &otlpExporter{service: s.Service, endpoint: s.Endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return errors.New("invalid trace exporter " + s.Exporter)
+	}
+
+	tracer = &tracerState{
+		exporter: exporter,
+		log:      log,
+		ratio:    s.SampleRatio,
+		spans:    make(chan *Span, 10*traceBatchSize),
+		flushes:  make(chan chan struct{}),
+	}
+
+	go tracer.run()
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/Javivi/ws-go/internal/logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceParent(t *testing.T) {
+	_, ok := ParseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+
+	if ok {
+		t.Fatal("[tests] Accepted a traceparent with an invalid trace ID")
+	}
+
+	parent, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	if !ok || !parent.sampled || parent.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatal("[tests] Valid traceparent wasn't parsed")
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	requests := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer collector.Close()
+
+	err := Configure(Settings{Service: "publisher", Exporter: "otlp", Endpoint: collector.URL + "/v1/traces", SampleRatio: 1}, logging.New("publisher"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer Configure(Settings{}, logging.New("publisher"))
+
+	span := StartMessage("publish receive", Server, []byte(`{"Topic":"test","Content":"message"}`))
+	span.Child("child", Producer).Finish()
+	span.Finish()
+	Flush()
+
+	select {
+	case body := <-requests:
+		if bytes.Count(body, []byte(`"traceId":"`+hex.EncodeToString(span.context.traceID[:])+`"`)) != 2 || !bytes.Contains(body, []byte(`"stringValue":"publisher"`)) {
+			t.Fatal("[tests] Collector didn't receive both spans of the trace", string(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("[tests] Nothing was exported to the collector")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+)
+
+type connInfo = admin.Conn
+
+// Stops the consumers from popping messages while it's paused
+var popping = admin.NewPauseGate()
+
+func adminConnSets() []*admin.ConnSet {
+	return []*admin.ConnSet{publishers, consumers}
+}
+
+// drainConn stops sending messages to a consumer and then closes it, other
+// connections are asked to close straight away
+func drainConn(info connInfo) {
+	if info.Endpoint == "/popmsg" {
+		consumers.StartDraining(info.WS)
+		return
+	}
+
+	admin.CloseConn(info.WS, websocket.CloseGoingAway, "drained by admin", false, cfg.KeepAlive.WriteTimeout)
+}
+
+type queueStats struct {
+	Depth    int  `json:"depth"`
+	Capacity int  `json:"capacity"`
+	Paused   bool `json:"paused"`
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	paused, _ := popping.State()
+
+	admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{
+		"queue":       queueStats{Depth: len(messageQueue), Capacity: cap(messageQueue), Paused: paused},
+		"partitions":  partitions.stats(),
+		"instances":   interests.stats(),
+		"connections": map[string]int{"/pushmsg": publishers.Count(), "/popmsg": consumers.Count()},
+		"enqueued":    enqueued.Snapshot()[""],
+		"dequeued":    dequeued.Snapshot()[""],
+		"dropped":     dropped.Snapshot(),
+	})
+}
+
+// purgeQueue drops every message waiting on the queue, the partitions and the
+// instances
+func purgeQueue(w http.ResponseWriter, r *http.Request) {
+	purged := len(partitions.takeAll())
+
+	for _, queue := range append([]chan []byte{messageQueue}, interests.queues()...) {
+		purged += len(shutdown.TakeAll(queue))
+	}
+
+	dropped.Add(float64(purged), "purged")
+	admin.ReplyJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func pauseQueue(w http.ResponseWriter, r *http.Request) {
+	popping.Set(strings.HasSuffix(r.URL.Path, "/pause"))
+	showStats(w, r)
+}
+
+// adminServer is the admin API with the credentials and connections of the
+// service
+func adminServer() *admin.Server {
+	return &admin.Server{
+		Username:     cfg.Admin.Username,
+		Password:     cfg.Admin.Password,
+		Sets:         adminConnSets(),
+		Drain:        drainConn,
+		WriteTimeout: cfg.KeepAlive.WriteTimeout,
+		Logs:         logs,
+		AuthFailures: authFailures,
+	}
+}
+
+// initAdmin serves the admin API on its own listener, with the same server
+// certificate as the websockets
+func initAdmin(addr string, certDir string, adminReady chan<- bool) error {
+	server := adminServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", server.Handler(server.ListConnections, "GET"))
+	mux.HandleFunc("/connections/", server.Handler(server.ManageConnection, "DELETE", "POST"))
+	mux.HandleFunc("/log/level", server.Handler(admin.LogLevel, "GET", "PUT"))
+	mux.HandleFunc("/stats", server.Handler(showStats, "GET"))
+	mux.HandleFunc("/queue/purge", server.Handler(purgeQueue, "POST"))
+	mux.HandleFunc("/queue/pause", server.Handler(pauseQueue, "POST"))
+	mux.HandleFunc("/queue/resume", server.Handler(pauseQueue, "POST"))
+
+	return server.Serve(addr, certDir, mux, adminReady, stopping, &stopDeadline)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Websocket subprotocol of /pushmsg connections that send batches, as binary
+// frames. Text frames are still single messages
+const batchProtocol = "ws-go.batch"
+
+// Bytes before each message of a batch with its length
+const batchLengthSize = 4
+
+var errBatchMalformed = errors.New("malformed batch")
+
+// Held while the messages of a push are put in the queue, so the ones of a
+// batch aren't mixed with the ones of other publishers
+var enqueueMux sync.Mutex
+
+// decodeBatch splits a batch in its messages, each one after its length as a
+// big endian uint32. A batch that doesn't end with a whole message is an error
+func decodeBatch(frame []byte) ([][]byte, error) {
+	var batch [][]byte
+
+	for len(frame) > 0 {
+		if len(frame) < batchLengthSize {
+			return nil, errBatchMalformed
+		}
+
+		length := binary.BigEndian.Uint32(frame)
+		frame = frame[batchLengthSize:]
+
+		if uint64(length) > uint64(len(frame)) {
+			return nil, errBatchMalformed
+		}
+
+		batch = append(batch, frame[:length])
+		frame = frame[length:]
+	}
+
+	if len(batch) == 0 {
+		return nil, errBatchMalformed
+	}
+
+	return batch, nil
+}
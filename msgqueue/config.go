@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/settings"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// config holds every setting of the service. The values are taken, in order of
+// precedence, from the command line flags, the environment, the configuration
+// file and the defaults
+type config struct {
+	Listen          string `yaml:"listen"`
+	CertDir         string `yaml:"cert_dir"`
+	ClientAuth      string `yaml:"client_auth"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	ReadBufferSize  int    `yaml:"read_buffer_size"`
+	WriteBufferSize int    `yaml:"write_buffer_size"`
+	QueueSize       int    `yaml:"queue_size"`
+	Partitions      int    `yaml:"partitions"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	ReadyQueueUsage float64       `yaml:"ready_queue_usage"`
+	SpoolFile       string        `yaml:"spool_file"`
+
+	TransactionTimeout time.Duration `yaml:"transaction_timeout"`
+	TransactionSize    int           `yaml:"transaction_size"`
+	InstanceTimeout    time.Duration `yaml:"instance_timeout"`
+	InstanceFullWait   time.Duration `yaml:"instance_full_wait"`
+
+	LogLevel            string `yaml:"log_level"`
+	LogFormat           string `yaml:"log_format"`
+	LogOutput           string `yaml:"log_output"`
+	LogPayloads         bool   `yaml:"log_payloads"`
+	LogSampleInitial    int    `yaml:"log_sample_initial"`
+	LogSampleThereafter int    `yaml:"log_sample_thereafter"`
+
+	TraceExporter    string  `yaml:"trace_exporter"`
+	TraceFile        string  `yaml:"trace_file"`
+	TraceEndpoint    string  `yaml:"trace_endpoint"`
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio"`
+
+	KeepAlive   keepalive.Config   `yaml:"keepalive"`
+	Compression compression.Config `yaml:"compression"`
+	Dedup       dedupConfig        `yaml:"dedup"`
+	Admin       adminConfig        `yaml:"admin"`
+}
+
+// adminConfig is where the admin API listens and the credentials it accepts,
+// which are separate from the ones of the clients
+type adminConfig struct {
+	Listen   string `yaml:"listen"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() config {
+	return config{
+		Listen:              "localhost:8080",
+		ClientAuth:          "none",
+		Username:            "hello",
+		Password:            "test",
+		ReadBufferSize:      1024,
+		WriteBufferSize:     1024,
+		QueueSize:           100,
+		Partitions:          8,
+		ShutdownTimeout:     10 * time.Second,
+		ReadyQueueUsage:     0.9,
+		TransactionTimeout:  30 * time.Second,
+		TransactionSize:     1000,
+		InstanceTimeout:     time.Minute,
+		InstanceFullWait:    time.Second,
+		LogLevel:            "info",
+		LogFormat:           "logfmt",
+		LogOutput:           "stdout",
+		LogSampleInitial:    10,
+		LogSampleThereafter: 100,
+		TraceExporter:       "none",
+		TraceEndpoint:       "http://localhost:4318/v1/traces",
+		TraceSampleRatio:    1,
+		Admin: adminConfig{
+			Username: "admin",
+		},
+		KeepAlive: keepalive.Config{
+			PingInterval: 30 * time.Second,
+			PongTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		Compression: compression.Config{
+			Level:   1,
+			MinSize: 256,
+		},
+		Dedup: dedupConfig{
+			Window:  10 * time.Minute,
+			MaxKeys: 100000,
+		},
+	}
+}
+
+func (c *config) options() []settings.Option {
+	return []settings.Option{
+		{Flag: "listen", Env: "WS_LISTEN", Usage: "address to listen on", Value: &c.Listen},
+		{Flag: "cert-dir", Env: "WS_CERT_DIR", Usage: "directory with the certificates", Value: &c.CertDir},
+		{Flag: "client-auth", Env: "WS_CLIENT_AUTH", Usage: "client certificates: none, request or require", Value: &c.ClientAuth},
+		{Flag: "username", Env: "WS_USERNAME", Usage: "username accepted from clients", Value: &c.Username},
+		{Flag: "password", Env: "WS_PASSWORD", Usage: "password accepted from clients", Value: &c.Password},
+		{Flag: "read-buffer-size", Env: "WS_READ_BUFFER_SIZE", Usage: "websocket read buffer size in bytes", Value: &c.ReadBufferSize},
+		{Flag: "write-buffer-size", Env: "WS_WRITE_BUFFER_SIZE", Usage: "websocket write buffer size in bytes", Value: &c.WriteBufferSize},
+		{Flag: "queue-size", Env: "WS_QUEUE_SIZE", Usage: "number of messages the queue can hold", Value: &c.QueueSize},
+		{Flag: "partitions", Env: "WS_PARTITIONS", Usage: "number of partitions the messages with a partition key are spread over, each holds queue-size messages", Value: &c.Partitions},
+		{Flag: "shutdown-timeout", Env: "WS_SHUTDOWN_TIMEOUT", Usage: "time given to deliver the pending messages on shutdown", Value: &c.ShutdownTimeout},
+		{Flag: "ready-queue-usage", Env: "WS_READY_QUEUE_USAGE", Usage: "fraction of the queue in use at which the service stops being ready", Value: &c.ReadyQueueUsage},
+		{Flag: "spool-file", Env: "WS_SPOOL_FILE", Usage: "file where the undelivered messages are kept between restarts", Value: &c.SpoolFile},
+		{Flag: "transaction-timeout", Env: "WS_TRANSACTION_TIMEOUT", Usage: "time a transaction can stay open before it's aborted", Value: &c.TransactionTimeout},
+		{Flag: "transaction-size", Env: "WS_TRANSACTION_SIZE", Usage: "most messages a transaction can hold, it can't be committed when more are published in it", Value: &c.TransactionSize},
+		{Flag: "instance-timeout", Env: "WS_INSTANCE_TIMEOUT", Usage: "time the messages of a subscriber instance are kept while it's disconnected", Value: &c.InstanceTimeout},
+		{Flag: "instance-full-wait", Env: "WS_INSTANCE_FULL_WAIT", Usage: "time a message waits for room on the queues of the connected subscriber instances before it's dropped for them", Value: &c.InstanceFullWait},
+		{Flag: "log-level", Env: "WS_LOG_LEVEL", Usage: "lowest level logged: debug, info, warn or error", Value: &c.LogLevel},
+		{Flag: "log-format", Env: "WS_LOG_FORMAT", Usage: "log format: json or logfmt", Value: &c.LogFormat},
+		{Flag: "log-output", Env: "WS_LOG_OUTPUT", Usage: "where logs are written: stdout, stderr or a file path", Value: &c.LogOutput},
+		{Flag: "log-payloads", Env: "WS_LOG_PAYLOADS", Usage: "log the content of the messages instead of their size", Value: &c.LogPayloads},
+		{Flag: "log-sample-initial", Env: "WS_LOG_SAMPLE_INITIAL", Usage: "per message entries logged each second before sampling, 0 disables sampling", Value: &c.LogSampleInitial},
+		{Flag: "log-sample-thereafter", Env: "WS_LOG_SAMPLE_THEREAFTER", Usage: "once sampling, log one of every this many entries, 0 drops them all", Value: &c.LogSampleThereafter},
+		{Flag: "trace-exporter", Env: "WS_TRACE_EXPORTER", Usage: "where spans are sent: none, stdout, file or otlp", Value: &c.TraceExporter},
+		{Flag: "trace-file", Env: "WS_TRACE_FILE", Usage: "file the spans are appended to with the file exporter", Value: &c.TraceFile},
+		{Flag: "trace-endpoint", Env: "WS_TRACE_ENDPOINT", Usage: "OTLP/HTTP traces URL of the collector with the otlp exporter", Value: &c.TraceEndpoint},
+		{Flag: "trace-sample-ratio", Env: "WS_TRACE_SAMPLE_RATIO", Usage: "fraction of the new traces that are recorded", Value: &c.TraceSampleRatio},
+		{Flag: "admin-listen", Env: "WS_ADMIN_LISTEN", Usage: "address of the admin API, empty disables it, it needs a password other than test", Value: &c.Admin.Listen},
+		{Flag: "admin-username", Env: "WS_ADMIN_USERNAME", Usage: "username accepted by the admin API", Value: &c.Admin.Username},
+		{Flag: "admin-password", Env: "WS_ADMIN_PASSWORD", Usage: "password accepted by the admin API", Value: &c.Admin.Password},
+		{Flag: "ping-interval", Env: "WS_PING_INTERVAL", Usage: "time between pings to the clients", Value: &c.KeepAlive.PingInterval},
+		{Flag: "pong-timeout", Env: "WS_PONG_TIMEOUT", Usage: "time a client has to answer a ping after the interval", Value: &c.KeepAlive.PongTimeout},
+		{Flag: "write-timeout", Env: "WS_WRITE_TIMEOUT", Usage: "time allowed to write a message to a client", Value: &c.KeepAlive.WriteTimeout},
+		{Flag: "idle-timeout", Env: "WS_IDLE_TIMEOUT", Usage: "close clients without messages for this long, 0 disables it", Value: &c.KeepAlive.IdleTimeout},
+		{Flag: "compression", Env: "WS_COMPRESSION", Usage: "accept permessage-deflate from the clients that ask for it", Value: &c.Compression.Enabled},
+		{Flag: "compression-level", Env: "WS_COMPRESSION_LEVEL", Usage: "deflate level for the clients, from 1 (fastest) to 9 (smallest)", Value: &c.Compression.Level},
+		{Flag: "compression-min-size", Env: "WS_COMPRESSION_MIN_SIZE", Usage: "messages to the clients smaller than this many bytes aren't compressed", Value: &c.Compression.MinSize},
+		{Flag: "dedup-window", Env: "WS_DEDUP_WINDOW", Usage: "time the idempotency keys are remembered, 0 disables deduplication", Value: &c.Dedup.Window},
+		{Flag: "dedup-max-keys", Env: "WS_DEDUP_MAX_KEYS", Usage: "idempotency keys remembered at most, the oldest are forgotten first", Value: &c.Dedup.MaxKeys},
+	}
+}
+
+func (c *config) validate() error {
+	_, _, err := net.SplitHostPort(c.Listen)
+
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %s", c.Listen, err)
+	}
+
+	_, err = certstore.ParseClientAuth(c.ClientAuth)
+
+	if err != nil {
+		return err
+	}
+
+	if c.Username == "" {
+		return errors.New("username can't be empty")
+	}
+
+	if c.Admin.Listen != "" {
+		_, _, err = net.SplitHostPort(c.Admin.Listen)
+
+		if err != nil {
+			return fmt.Errorf("invalid admin listen address %q: %s", c.Admin.Listen, err)
+		}
+
+		if c.Admin.Username == "" {
+			return errors.New("admin username can't be empty")
+		}
+
+		err = admin.CheckPassword(c.Admin.Password)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0 {
+		return errors.New("buffer sizes must be positive")
+	}
+
+	if c.QueueSize <= 0 {
+		return errors.New("queue size must be positive")
+	}
+
+	if c.Partitions <= 0 {
+		return errors.New("partitions must be positive")
+	}
+
+	if c.InstanceTimeout <= 0 || c.InstanceFullWait <= 0 {
+		return errors.New("instance timeout and instance full wait must be positive")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+
+	if c.ReadyQueueUsage <= 0 || c.ReadyQueueUsage > 1 {
+		return errors.New("ready queue usage must be between 0 and 1")
+	}
+
+	_, err = logging.ParseLevel(c.LogLevel)
+
+	if err != nil {
+		return err
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "logfmt" {
+		return fmt.Errorf("invalid log format %q, it must be json or logfmt", c.LogFormat)
+	}
+
+	if c.LogSampleInitial < 0 || c.LogSampleThereafter < 0 {
+		return errors.New("log sampling counts can't be negative")
+	}
+
+	switch c.TraceExporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		if c.TraceFile == "" {
+			return errors.New("the file trace exporter needs a trace file")
+		}
+	default:
+		return fmt.Errorf("invalid trace exporter %q, it must be none, stdout, file or otlp", c.TraceExporter)
+	}
+
+	endpoint, err := url.Parse(c.TraceEndpoint)
+
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid trace endpoint %q, it must be an http or https URL", c.TraceEndpoint)
+	}
+
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return errors.New("trace sample ratio must be between 0 and 1")
+	}
+
+	if c.TransactionTimeout <= 0 {
+		return errors.New("transaction timeout must be positive")
+	}
+
+	if c.TransactionSize <= 0 {
+		return errors.New("transaction size must be positive")
+	}
+
+	err = c.Compression.Validate()
+
+	if err != nil {
+		return err
+	}
+
+	err = c.Dedup.validate()
+
+	if err != nil {
+		return err
+	}
+
+	return c.KeepAlive.Validate()
+}
+
+// loadConfig builds the configuration from the defaults, the file given with
+// -config or WS_CONFIG, the environment and the flags, and validates it. It also
+// reports whether -print-config was requested
+func loadConfig(args []string) (config, bool, error) {
+	c := defaultConfig()
+	printOnly, err := settings.Load(args, &c, c.options())
+
+	if err != nil {
+		return c, false, err
+	}
+
+	if c.CertDir != "" && !strings.HasSuffix(c.CertDir, "/") {
+		c.CertDir += "/"
+	}
+
+	return c, printOnly, c.validate()
+}
+
+// printConfig writes the configuration as YAML with the secrets redacted
+func printConfig(c config) error {
+	if c.Password != "" {
+		c.Password = "REDACTED"
+	}
+
+	if c.Admin.Password != "" {
+		c.Admin.Password = "REDACTED"
+	}
+
+	return settings.Print(c)
+}
+
+// applyConfig makes the configuration the one used by the service
+func applyConfig(c config) {
+	cfg = c
+	upgrader.ReadBufferSize = c.ReadBufferSize
+	upgrader.WriteBufferSize = c.WriteBufferSize
+	upgrader.EnableCompression = c.Compression.Enabled
+	messageQueue = make(chan []byte, c.QueueSize)
+	partitions = newPartitionTable(c.Partitions, c.QueueSize)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Header of a message with the key a producer gives to every attempt to send
+// it, so the retries of a message that was already queued are dropped
+const idempotencyHeader = "idempotency-key"
+
+// Suffix added to the spool file for the file the dedup index is kept in
+const dedupFileSuffix = ".dedup"
+
+// dedupConfig is how long keys are remembered and how many of them at most,
+// the oldest ones are forgotten first when there are too many
+type dedupConfig struct {
+	Window  time.Duration `yaml:"window"`
+	MaxKeys int           `yaml:"max_keys"`
+}
+
+func (d dedupConfig) validate() error {
+	if d.Window < 0 {
+		return errors.New("dedup window can't be negative")
+	}
+
+	if d.MaxKeys < 1 {
+		return errors.New("dedup max keys must be at least 1")
+	}
+
+	return nil
+}
+
+// dedupEntry is a key in the index and the message that was queued with it,
+// it's also the line written to the dedup file
+type dedupEntry struct {
+	Key     string
+	ID      string
+	Expires time.Time
+}
+
+// dedupIndex remembers the keys seen in the window in the order they were
+// added, which is the order they expire in. Once its file is open every key
+// recorded is appended to it, so the index survives a crash of msgqueue, and
+// the file is compacted when as many keys were appended as can be remembered
+type dedupIndex struct {
+	keys     map[string]*dedupEntry
+	order    []*dedupEntry
+	path     string
+	file     *os.File
+	appended int
+	mux      sync.Mutex
+}
+
+var dedup = newDedupIndex()
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{keys: make(map[string]*dedupEntry)}
+}
+
+// expire forgets the keys out of the window, and the oldest ones while there
+// are more than max. The caller holds the lock
+func (d *dedupIndex) expire(now time.Time, max int) {
+	for len(d.order) > 0 && (len(d.order) > max || !now.Before(d.order[0].Expires)) {
+		if d.keys[d.order[0].Key] == d.order[0] {
+			delete(d.keys, d.order[0].Key)
+		}
+
+		d.order[0] = nil
+		d.order = d.order[1:]
+	}
+}
+
+// check looks the key of a message up. It returns the ID of the message first
+// queued with it when it's a repeat, or else records it
+func (d *dedupIndex) check(key string, id string, settings dedupConfig) (string, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	now := time.Now()
+	d.expire(now, settings.MaxKeys)
+
+	if entry, ok := d.keys[key]; ok {
+		return entry.ID, true
+	}
+
+	if settings.Window == 0 {
+		return id, false
+	}
+
+	entry := &dedupEntry{Key: key, ID: id, Expires: now.Add(settings.Window)}
+	d.keys[key] = entry
+	d.order = append(d.order, entry)
+	d.expire(now, settings.MaxKeys)
+
+	if d.file != nil {
+		d.record(entry, settings)
+	}
+
+	return id, false
+}
+
+// record appends a key to the file of the index. A key that can't be written
+// is still remembered until msgqueue stops. The caller holds the lock
+func (d *dedupIndex) record(entry *dedupEntry, settings dedupConfig) {
+	line, _ := json.Marshal(entry)
+	_, err := d.file.Write(append(line, '\n'))
+
+	if err != nil {
+		logs.Error("Error recording idempotency key", "file", d.path, "error", err)
+		return
+	}
+
+	d.appended++
+
+	if d.appended < settings.MaxKeys {
+		return
+	}
+
+	err = d.compact(settings)
+
+	if err != nil {
+		logs.Error("Error compacting the dedup index, keys aren't recorded anymore", "file", d.path, "error", err)
+	}
+}
+
+// open compacts the file of the index and appends the keys recorded from then
+// on to it
+func (d *dedupIndex) open(path string, settings dedupConfig) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.path = path
+
+	return d.compact(settings)
+}
+
+// compact replaces the file of the index with one that only has the keys in the
+// window, and opens it to append to. The caller holds the lock
+func (d *dedupIndex) compact(settings dedupConfig) error {
+	d.close()
+	_, err := d.write(d.path, settings)
+
+	if err != nil {
+		return err
+	}
+
+	d.file, err = os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	d.appended = 0
+
+	return err
+}
+
+// close stops appending to the file of the index. The caller holds the lock
+func (d *dedupIndex) close() {
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+}
+
+func (d *dedupIndex) size() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return len(d.keys)
+}
+
+// save stops appending to the file of the index and writes the keys still in
+// the window to it, on shutdown
+func (d *dedupIndex) save(path string, settings dedupConfig) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.close()
+
+	return d.write(path, settings)
+}
+
+// write puts the keys still in the window in a new file that then replaces the
+// old one, one JSON entry per line. The caller holds the lock
+func (d *dedupIndex) write(path string, settings dedupConfig) (int, error) {
+	d.expire(time.Now(), settings.MaxKeys)
+
+	if len(d.order) == 0 {
+		err := os.Remove(path)
+
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(file)
+
+	for _, entry := range d.order {
+		err = encoder.Encode(entry)
+
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+
+	err = file.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(d.order), os.Rename(path+".tmp", path)
+}
+
+// restore adds the keys of the file that are still in the window, a missing
+// file is an empty index. The last line is skipped when it can't be read, as
+// msgqueue may have stopped while it was being appended
+func (d *dedupIndex) restore(path string, settings dedupConfig) (int, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	now := time.Now()
+	restored := 0
+	scanner := bufio.NewScanner(file)
+
+	var torn error
+
+	for scanner.Scan() {
+		if torn != nil {
+			return restored, torn
+		}
+
+		var entry dedupEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+
+		if err != nil {
+			torn = err
+			continue
+		}
+
+		if !now.Before(entry.Expires) || d.keys[entry.Key] != nil {
+			continue
+		}
+
+		d.keys[entry.Key] = &entry
+		d.order = append(d.order, &entry)
+		restored++
+	}
+
+	d.expire(now, settings.MaxKeys)
+
+	return restored, scanner.Err()
+}
+
+// dedupKey returns the key a message is deduplicated by, the topic and its
+// idempotency key, and its ID. Messages without a key aren't deduplicated
+func dedupKey(msg []byte) (string, string, bool) {
+	if !bytes.Contains(msg, []byte(idempotencyHeader)) {
+		return "", "", false
+	}
+
+	var m struct {
+		ID      string
+		Topic   string
+		Headers map[string]string
+	}
+
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil || m.Headers[idempotencyHeader] == "" {
+		return "", "", false
+	}
+
+	return m.Topic + "\x00" + m.Headers[idempotencyHeader], m.ID, true
+}
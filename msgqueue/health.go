@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/health"
+)
+
+type check = health.Check
+
+func queueCheck(name string, length int, capacity int) check {
+	return health.Queue(name, length, capacity, cfg.ReadyQueueUsage)
+}
+
+// partitionsCheck fails when the fullest partition is, as its publishers are the
+// ones that can't queue more
+func partitionsCheck() check {
+	deepest := 0
+
+	for _, queue := range partitions.queues {
+		if len(queue) > deepest {
+			deepest = len(queue)
+		}
+	}
+
+	return queueCheck("partitions", deepest, cap(partitions.queues[0]))
+}
+
+// livenessChecks only fail when restarting the service is the way to recover
+func livenessChecks() []check {
+	return []check{{Name: "server", OK: true}}
+}
+
+// readinessChecks fail while the service can't take more work
+func readinessChecks(certs *certstore.Store) []check {
+	return []check{
+		health.Shutdown(stopping),
+		health.Certificate(certs),
+		queueCheck("queue", len(messageQueue), cap(messageQueue)),
+		partitionsCheck(),
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query parameter of /popmsg with the name of the subscriber instance, which
+// gets a queue of its own with the messages it's interested in
+const instanceParam = "instance"
+
+// Longest name of an instance
+const maxInstanceName = 128
+
+// Suffix added to the spool file for the file the instances are kept in
+const instancesFileSuffix = ".instances"
+
+// Field added to the copy of a message sent to an instance with groups, with
+// the ones it was picked for. The rest of its groups skip the message
+const groupsField = "Groups"
+
+// interestFrame is what an instance sends on /popmsg with the topics, patterns
+// and MQTT filters its clients subscribed to, and the groups they joined. Each
+// one replaces the previous
+type interestFrame struct {
+	Topics  []string
+	Filters []string
+	Groups  []groupInterest
+}
+
+// groupInterest is a group joined on a topic or pattern. The instances with the
+// same one share its messages, each goes to only one of them
+type groupInterest struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+}
+
+// interestMatch is an instance that gets a message, with the groups it was
+// picked for when it has any on the topic
+type interestMatch struct {
+	inst    *instance
+	groups  []groupInterest
+	grouped bool
+}
+
+// instance is a subscriber instance with the messages queued for it, which are
+// kept while it reconnects, until it's been gone for the instance timeout
+type instance struct {
+	name     string
+	interest interestFrame
+	queue    chan []byte
+	conns    int
+	gone     chan struct{}
+	expiry   *time.Timer
+}
+
+// interestTable holds the instances by name. While there's any, every message
+// goes to the instances interested in its topic instead of the shared queue
+type interestTable struct {
+	instances map[string]*instance
+	turns     map[groupInterest]int
+	mux       sync.Mutex
+}
+
+var interests = newInterestTable()
+
+func newInterestTable() *interestTable {
+	return &interestTable{instances: make(map[string]*instance), turns: make(map[groupInterest]int)}
+}
+
+func validInstance(name string) error {
+	if len(name) > maxInstanceName {
+		return fmt.Errorf("instance names can't be longer than %d characters", maxInstanceName)
+	}
+
+	return nil
+}
+
+// Held while a consumer joins, so instances and consumers without one are
+// never connected at once
+var joining sync.Mutex
+
+// joinConsumer adds a /popmsg consumer to the instances when it names one, or to
+// the consumers sharing the partitions. They can't be mixed, as the messages go
+// either to the instances or to the shared queue and the partitions
+func joinConsumer(name string, info *connInfo, pop popFunc) (*instance, *partitionMember, error) {
+	joining.Lock()
+	defer joining.Unlock()
+
+	if name == "" {
+		if interests.count() > 0 {
+			return nil, nil, errors.New("subscriber instances are connected, consumers must name their instance")
+		}
+
+		return nil, partitions.join(info, pop), nil
+	}
+
+	if partitions.consumers() > 0 {
+		return nil, nil, errors.New("consumers without an instance are connected")
+	}
+
+	first := interests.count() == 0
+	inst := interests.connect(name, cfg.QueueSize)
+
+	// Messages queued before the first instance came are routed to them
+	if first {
+		go rerouteQueued()
+	}
+
+	return inst, nil, nil
+}
+
+// rerouteQueued moves the messages waiting on the shared queue and the
+// partitions to the instances interested in them. It holds enqueueMux, so newer
+// messages can't overtake them
+func rerouteQueued() {
+	enqueueMux.Lock()
+	defer enqueueMux.Unlock()
+
+	reroute := func(queue chan []byte, taken [][]byte) {
+		for _, msg := range taken {
+			if !interests.route(msg) {
+				queue <- msg
+			}
+		}
+	}
+
+	reroute(messageQueue, shutdown.TakeAll(messageQueue))
+
+	for i, queue := range partitions.queues {
+		reroute(queue, partitions.take(i))
+	}
+}
+
+// add returns the instance with a name, creating it if it's new. The caller
+// holds the lock
+func (t *interestTable) add(name string, size int) *instance {
+	inst := t.instances[name]
+
+	if inst == nil {
+		inst = &instance{name: name, queue: make(chan []byte, size), gone: make(chan struct{})}
+		t.instances[name] = inst
+	}
+
+	return inst
+}
+
+// connect counts a connection of an instance, which stops it from expiring
+func (t *interestTable) connect(name string, size int) *instance {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	inst := t.add(name, size)
+	inst.conns++
+
+	if inst.expiry != nil {
+		inst.expiry.Stop()
+		inst.expiry = nil
+	}
+
+	return inst
+}
+
+// disconnect forgets a connection of an instance, when it was the last one the
+// instance and its messages are dropped unless it connects within the timeout
+func (t *interestTable) disconnect(inst *instance, timeout time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	inst.conns--
+
+	if inst.conns == 0 {
+		t.expire(inst, timeout)
+	}
+}
+
+// expire drops an instance that isn't connected after the timeout. The caller
+// holds the lock
+func (t *interestTable) expire(inst *instance, timeout time.Duration) {
+	inst.expiry = time.AfterFunc(timeout, func() {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+
+		if inst.conns > 0 || t.instances[inst.name] != inst {
+			return
+		}
+
+		delete(t.instances, inst.name)
+		t.pruneTurns()
+		close(inst.gone)
+		lost := len(shutdown.TakeAll(inst.queue))
+		dropped.Add(float64(lost), "instance_expired")
+		logs.Warn("Instance expired", "instance", inst.name, "dropped", lost)
+	})
+}
+
+func (t *interestTable) setInterest(inst *instance, frame interestFrame) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	inst.interest = frame
+	t.pruneTurns()
+}
+
+// pruneTurns forgets the turns of the groups no instance has anymore. The caller
+// holds the lock
+func (t *interestTable) pruneTurns() {
+	held := make(map[groupInterest]bool)
+
+	for _, inst := range t.instances {
+		for _, g := range inst.interest.Groups {
+			held[g] = true
+		}
+	}
+
+	for g := range t.turns {
+		if !held[g] {
+			delete(t.turns, g)
+		}
+	}
+}
+
+// count returns how many instances there are, connected or not
+func (t *interestTable) count() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return len(t.instances)
+}
+
+// interested returns the instances interested in a topic, and whether there
+// are instances at all. Each group on the topic is given to one of the
+// instances that have it, taking turns
+func (t *interestTable) interested(topic string) ([]interestMatch, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	holders := make(map[groupInterest][]*instance)
+
+	for _, inst := range t.instances {
+		for _, g := range inst.interest.Groups {
+			if topicMatches(g.Topic, topic) {
+				holders[g] = append(holders[g], inst)
+			}
+		}
+	}
+
+	picked := make(map[*instance][]groupInterest)
+	grouped := make(map[*instance]bool)
+
+	for g, insts := range holders {
+		sort.Slice(insts, func(i, j int) bool { return insts[i].name < insts[j].name })
+		chosen := insts[t.turns[g]%len(insts)]
+		t.turns[g]++
+		picked[chosen] = append(picked[chosen], g)
+
+		for _, inst := range insts {
+			grouped[inst] = true
+		}
+	}
+
+	var matched []interestMatch
+
+	for _, inst := range t.instances {
+		if inst.wants(topic) || len(picked[inst]) > 0 {
+			matched = append(matched, interestMatch{inst: inst, groups: picked[inst], grouped: grouped[inst]})
+		}
+	}
+
+	return matched, len(t.instances) > 0
+}
+
+// topicMatches tells whether a subscription covers a topic, with the same
+// matching as the subscriber
+func topicMatches(subscribed string, topic string) bool {
+	if subscribed == topic {
+		return true
+	}
+
+	matched, _ := path.Match(subscribed, topic)
+
+	return matched && strings.ContainsAny(subscribed, "*?[")
+}
+
+// wants tells whether the topics or filters of an instance cover a topic
+func (inst *instance) wants(topic string) bool {
+	for _, subscribed := range inst.interest.Topics {
+		if topicMatches(subscribed, topic) {
+			return true
+		}
+	}
+
+	for _, filter := range inst.interest.Filters {
+		if matchFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchFilter tells whether a topic matches an MQTT filter, where + is any
+// single level and # any number of levels. Topics starting with $ are only
+// matched by filters that start with the same level
+func matchFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// withGroups returns a copy of a message with the groups an instance was picked
+// for, messages that aren't JSON objects are left as they are
+func withGroups(msg []byte, groups []groupInterest) []byte {
+	var fields map[string]json.RawMessage
+
+	if json.Unmarshal(msg, &fields) != nil || fields == nil {
+		return msg
+	}
+
+	if groups == nil {
+		groups = []groupInterest{}
+	}
+
+	fields[groupsField], _ = json.Marshal(groups)
+	out, err := json.Marshal(fields)
+
+	if err != nil {
+		return msg
+	}
+
+	return out
+}
+
+// route puts a copy of a message in the queue of every instance interested in
+// it, and tells whether there were instances. It waits up to instance_full_wait
+// in all for room on the queues of the connected instances, as the caller holds
+// enqueueMux, and drops the message for the rest when theirs are full
+func (t *interestTable) route(msg []byte) bool {
+	var m struct{ Topic string }
+	json.Unmarshal(msg, &m)
+	matched, clustered := t.interested(m.Topic)
+
+	if !clustered {
+		return false
+	}
+
+	if len(matched) == 0 {
+		dropped.Inc("no_interest")
+	}
+
+	// Shared by the instances, once it's used up the full queues drop at once
+	var wait <-chan time.Time
+	waited := false
+
+	for _, match := range matched {
+		inst, copied := match.inst, msg
+
+		if match.grouped {
+			copied = withGroups(msg, match.groups)
+		}
+
+		select {
+		case inst.queue <- copied:
+			continue
+		default:
+		}
+
+		t.mux.Lock()
+		connected := inst.conns > 0
+		t.mux.Unlock()
+
+		if !connected || waited {
+			dropped.Inc("instance_full")
+			continue
+		}
+
+		if wait == nil {
+			timer := time.NewTimer(cfg.InstanceFullWait)
+			defer timer.Stop()
+			wait = timer.C
+		}
+
+		select {
+		case inst.queue <- copied:
+		case <-inst.gone:
+			dropped.Inc("instance_expired")
+		case <-wait:
+			waited = true
+			logs.Warn("Dropping message for an instance with a full queue", "instance", inst.name, "id", logging.MessageID(msg))
+			dropped.Inc("instance_full")
+		}
+	}
+
+	return true
+}
+
+// queues returns the queues of every instance
+func (t *interestTable) queues() []chan []byte {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var queues []chan []byte
+
+	for _, inst := range t.instances {
+		queues = append(queues, inst.queue)
+	}
+
+	return queues
+}
+
+// depth returns the messages waiting on the queues of every instance
+func (t *interestTable) depth() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	depth := 0
+
+	for _, inst := range t.instances {
+		depth += len(inst.queue)
+	}
+
+	return depth
+}
+
+// instanceStats is an instance as the admin API shows it
+type instanceStats struct {
+	Name        string          `json:"name"`
+	Depth       int             `json:"depth"`
+	Connections int             `json:"connections"`
+	Topics      []string        `json:"topics"`
+	Filters     []string        `json:"filters"`
+	Groups      []groupInterest `json:"groups"`
+}
+
+func (t *interestTable) stats() []instanceStats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	stats := make([]instanceStats, 0, len(t.instances))
+
+	for _, inst := range t.instances {
+		stats = append(stats, instanceStats{
+			Name:        inst.name,
+			Depth:       len(inst.queue),
+			Connections: inst.conns,
+			Topics:      inst.interest.Topics,
+			Filters:     inst.interest.Filters,
+			Groups:      inst.interest.Groups,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// savedInstance is an instance as it's written to the instances file, one per
+// line, with the messages left on its queue
+type savedInstance struct {
+	Instance string
+	Interest interestFrame
+	Messages [][]byte
+}
+
+// save empties the queues of the instances into a file, so they're restored with
+// their interest on the next start, and returns how many messages were written
+func (t *interestTable) save(fileName string) (int, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if len(t.instances) == 0 {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(file)
+	saved := 0
+
+	for _, inst := range t.instances {
+		pending := shutdown.TakeAll(inst.queue)
+		err = encoder.Encode(savedInstance{Instance: inst.name, Interest: inst.interest, Messages: pending})
+
+		if err != nil {
+			file.Close()
+			return saved, err
+		}
+
+		saved += len(pending)
+	}
+
+	return saved, file.Close()
+}
+
+// restore adds the instances saved on a previous shutdown, which expire unless
+// they connect within the timeout, and removes the file
+func (t *interestTable) restore(fileName string, size int, timeout time.Duration) (int, error) {
+	file, err := os.Open(fileName)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var restored []savedInstance
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	for scanner.Scan() {
+		var saved savedInstance
+		err = json.Unmarshal(scanner.Bytes(), &saved)
+
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+
+		restored = append(restored, saved)
+	}
+
+	file.Close()
+
+	if scanner.Err() != nil {
+		return 0, scanner.Err()
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	count := 0
+
+	for _, saved := range restored {
+		inst := t.add(saved.Instance, size)
+		inst.interest = saved.Interest
+		t.expire(inst, timeout)
+
+		// There may be more messages than room on the queue, they're pushed as it empties
+		go func(inst *instance, messages [][]byte) {
+			for _, msg := range messages {
+				select {
+				case inst.queue <- msg:
+				case <-inst.gone:
+					return
+				}
+			}
+		}(inst, saved.Messages)
+
+		count += len(saved.Messages)
+	}
+
+	return count, os.Remove(fileName)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"strconv"
+)
+
+var (
+	enqueued           = metrics.NewCounterVec("msgqueue_messages_enqueued_total", "Messages received on /pushmsg")
+	batches            = metrics.NewCounterVec("msgqueue_batches_received_total", "Batch frames received on /pushmsg")
+	dequeued           = metrics.NewCounterVec("msgqueue_messages_dequeued_total", "Messages delivered on /popmsg")
+	dropped            = metrics.NewCounterVec("msgqueue_messages_dropped_total", "Messages lost by reason", "reason")
+	transactionsEnded  = metrics.NewCounterVec("msgqueue_transactions_total", "Transactions by how they ended: committed, aborted or expired", "result")
+	dedupChecks        = metrics.NewCounterVec("msgqueue_dedup_checks_total", "Messages with an idempotency key by whether they were a repeat (hit) or not (miss)", "result")
+	authFailures       = metrics.NewCounterVec("msgqueue_auth_failures_total", "Rejected credentials by endpoint", "endpoint")
+	compressionBytes   = metrics.NewCounterVec("msgqueue_compression_bytes_total", "Size of the messages written to compressed websockets and bytes written for them, by endpoint", "endpoint", "stage")
+	compressedMessages = metrics.NewCounterVec("msgqueue_compression_messages_total", "Messages written to compressed websockets by endpoint and whether they were compressed", "endpoint", "compressed")
+	rebalances         = metrics.NewCounterVec("msgqueue_partition_rebalances_total", "Times the partitions were moved between /popmsg consumers as they joined and left")
+	writeDuration      = metrics.NewHistogram("msgqueue_write_duration_seconds", "Time taken to write a message to a consumer", metrics.LatencyBuckets)
+)
+
+func init() {
+	compression.CountBytes = func(size int, endpoint string, stage string) {
+		compressionBytes.Add(float64(size), endpoint, stage)
+	}
+	compression.CountMessage = func(endpoint string, compressed bool) {
+		compressedMessages.Inc(endpoint, strconv.FormatBool(compressed))
+	}
+	metrics.NewGaugeFunc("msgqueue_queue_depth", "Messages waiting on the queue", "", func() map[string]float64 {
+		return map[string]float64{"": float64(len(messageQueue))}
+	})
+	metrics.NewGaugeFunc("msgqueue_queue_capacity", "Messages the queue can hold", "", func() map[string]float64 {
+		return map[string]float64{"": float64(cap(messageQueue))}
+	})
+	metrics.NewGaugeFunc("msgqueue_partition_depth", "Messages waiting on each partition", "partition", func() map[string]float64 {
+		depths := make(map[string]float64)
+
+		for i, queue := range partitions.queues {
+			depths[strconv.Itoa(i)] = float64(len(queue))
+		}
+
+		return depths
+	})
+	metrics.NewGaugeFunc("msgqueue_instance_depth", "Messages waiting on the queue of each subscriber instance", "instance", func() map[string]float64 {
+		depths := make(map[string]float64)
+
+		for _, inst := range interests.stats() {
+			depths[inst.Name] = float64(inst.Depth)
+		}
+
+		return depths
+	})
+	metrics.NewGaugeFunc("msgqueue_dedup_keys", "Idempotency keys remembered in the dedup window", "", func() map[string]float64 {
+		return map[string]float64{"": float64(dedup.size())}
+	})
+	metrics.NewGaugeFunc("msgqueue_transactions_open", "Transactions begun and not ended yet", "", func() map[string]float64 {
+		return map[string]float64{"": float64(transactions.count())}
+	})
+	metrics.NewGaugeFunc("msgqueue_connections_active", "Open websockets by endpoint", "endpoint", func() map[string]float64 {
+		return map[string]float64{"/pushmsg": float64(publishers.Count()), "/popmsg": float64(consumers.Count())}
+	})
+}
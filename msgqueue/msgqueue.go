@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"fmt"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/Javivi/ws-go/internal/tracing"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"os"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{batchProtocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -19,85 +33,553 @@ var upgrader = websocket.Upgrader{
 var messageQueue = make(chan []byte, 100)
 
 func main() {
-	err := initServer("localhost:8080", os.Getenv("WS_CERT_DIR"), nil)
+	c, printOnly, err := loadConfig(os.Args[1:])
+
+	if err == flag.ErrHelp {
+		return
+	}
 
 	if err != nil {
-		fmt.Printf("[msgqueue] Error initialising server\n%s", err)
-		os.Exit(1)
+		logs.Error("Error loading configuration", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	if printOnly {
+		err = printConfig(c)
+
+		if err != nil {
+			logs.Error("Error printing configuration", "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		return
+	}
+
+	applyConfig(c)
+	err = logging.Configure(c.logSettings())
+
+	if err != nil {
+		logs.Error("Error configuring logs", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	err = tracing.Configure(c.traceSettings(), logs)
+
+	if err != nil {
+		logs.Error("Error configuring tracing", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	go reloadLogs(os.Args[1:])
+
+	if cfg.SpoolFile != "" {
+		restored, err := shutdown.Restore(cfg.SpoolFile, queueOf)
+
+		if err != nil {
+			logs.Error("Error restoring spooled messages", "file", cfg.SpoolFile, "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		if restored > 0 {
+			logs.Info("Restored spooled messages", "file", cfg.SpoolFile, "count", restored)
+		}
+
+		restored, err = interests.restore(cfg.SpoolFile+instancesFileSuffix, cfg.QueueSize, cfg.InstanceTimeout)
+
+		if err != nil {
+			logs.Error("Error restoring the instances", "file", cfg.SpoolFile+instancesFileSuffix, "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		if restored > 0 {
+			logs.Info("Restored messages of instances", "file", cfg.SpoolFile+instancesFileSuffix, "count", restored)
+		}
+
+		restored, err = dedup.restore(cfg.SpoolFile+dedupFileSuffix, cfg.Dedup)
+
+		if err != nil {
+			logs.Error("Error restoring the dedup index", "file", cfg.SpoolFile+dedupFileSuffix, "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		if restored > 0 {
+			logs.Info("Restored idempotency keys", "file", cfg.SpoolFile+dedupFileSuffix, "count", restored)
+		}
+
+		err = dedup.open(cfg.SpoolFile+dedupFileSuffix, cfg.Dedup)
+
+		if err != nil {
+			logs.Error("Error opening the dedup index", "file", cfg.SpoolFile+dedupFileSuffix, "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+	}
+
+	go shutdown.HandleSignals(stopping, &stopDeadline, cfg.ShutdownTimeout, logs)
+
+	if cfg.Admin.Listen != "" {
+		go func() {
+			err := initAdmin(cfg.Admin.Listen, cfg.CertDir, nil)
+
+			if err != nil {
+				logs.Error("Error initialising admin API", "error", err)
+				os.Exit(shutdown.ExitError)
+			}
+		}()
+	}
+
+	err = initServer(cfg.Listen, cfg.CertDir, nil)
+
+	if err != nil {
+		logs.Error("Error initialising server", "error", err)
+		os.Exit(shutdown.ExitError)
+	}
+
+	status := drain()
+	tracing.Flush()
+	os.Exit(status)
+}
+
+// authenticate accepts either a verified client certificate or the basic auth
+// credentials, and returns the identity of the client
+func authenticate(r *http.Request) (string, bool) {
+	if identity, ok := certstore.Identity(r.TLS); ok {
+		return identity, identity == cfg.Username
+	}
+
+	username, password, ok := r.BasicAuth()
+
+	return username, ok && username == cfg.Username && password == cfg.Password
+}
+
+// pushAck is what a publisher is told about what it pushed. For a message with
+// an idempotency key, that it was queued, or that it was a repeat and the one
+// queued had the ID in Original. For the end of a transaction, its status and
+// how many messages were queued
+type pushAck struct {
+	ID          string `json:",omitempty"`
+	Original    string `json:",omitempty"`
+	Duplicate   bool   `json:",omitempty"`
+	Transaction string `json:",omitempty"`
+	Status      string `json:",omitempty"`
+	Count       int    `json:",omitempty"`
+}
+
+// enqueue puts the messages of a push in the queue one after another. The
+// repeats of a message with an idempotency key are dropped, and the messages of
+// a transaction are kept until it's committed. It returns what to tell the
+// publisher about the messages with a key and the transactions ended
+func enqueue(batch [][]byte, log logger) []pushAck {
+	enqueueMux.Lock()
+	defer enqueueMux.Unlock()
+
+	var acks []pushAck
+
+	for _, msg := range batch {
+		frame, transaction := transactionOf(msg)
+
+		switch {
+		case frame.Transaction != "":
+			acks = append(acks, runTransactionFrame(frame, log)...)
+		case transaction != "":
+			open, kept := transactions.add(transaction, msg, cfg.TransactionSize)
+
+			if !open {
+				log.Warn("Dropping message of a transaction that isn't open", "id", logging.MessageID(msg), "transaction", transaction)
+				dropped.Inc("no_transaction")
+			} else if !kept {
+				log.Warn("Dropping message of a full transaction", "id", logging.MessageID(msg), "transaction", transaction, "size", cfg.TransactionSize)
+				dropped.Inc("transaction_full")
+			}
+		default:
+			if ack, ok := queueMessage(msg, log); ok {
+				acks = append(acks, ack)
+			}
+		}
+	}
+
+	return acks
+}
+
+// queueMessage puts a message in the queue unless it's a repeat. Messages with
+// an idempotency key return what to tell the publisher about them
+func queueMessage(msg []byte, log logger) (pushAck, bool) {
+	key, id, keyed := dedupKey(msg)
+	var ack pushAck
+
+	if keyed {
+		original, duplicate := dedup.check(key, id, cfg.Dedup)
+		ack = pushAck{ID: id, Original: original, Duplicate: duplicate}
+
+		if duplicate {
+			dedupChecks.Inc("hit")
+			log.Sample().Debug("Dropping repeated message", "id", id, "original", original)
+			return ack, true
+		}
+
+		dedupChecks.Inc("miss")
+	}
+
+	span := tracing.StartMessage("enqueue", tracing.Consumer, msg)
+	msg = tracing.WithTrace(msg, span)
+	span.Set("messaging.message.id", logging.MessageID(msg), "messaging.message.body.size", len(msg))
+
+	if !interests.route(msg) {
+		queueOf(msg) <- msg
+	}
+
+	enqueued.Inc()
+	span.Finish()
+
+	log.Sample().Debug("Pushing message", "id", logging.MessageID(msg), "size", len(msg), "payload", msg)
+
+	return ack, keyed
+}
+
+// runTransactionFrame begins, commits or aborts a transaction. Committing puts
+// its messages in the queue together, as the caller holds enqueueMux, so no
+// other message is queued between them. Readers don't take enqueueMux, so
+// /popmsg can deliver the first messages of a commit before the last are queued
+func runTransactionFrame(frame transactionFrame, log logger) []pushAck {
+	log = log.With("transaction", frame.Transaction)
+
+	if frame.Action == "begin" {
+		transactions.begin(frame.Transaction, cfg.TransactionTimeout)
+		log.Debug("Transaction begun")
+		return nil
+	}
+
+	if frame.Action != "commit" && frame.Action != "abort" {
+		log.Warn("Ignoring unknown transaction action", "action", frame.Action)
+		return nil
+	}
+
+	t, open := transactions.end(frame.Transaction)
+
+	if !open {
+		log.Warn("Transaction to end isn't open", "action", frame.Action)
+		return []pushAck{{Transaction: frame.Transaction, Status: "unknown"}}
+	}
+
+	if frame.Action == "abort" {
+		transactionsEnded.Inc("aborted")
+		log.Debug("Transaction aborted", "count", len(t.messages))
+		return []pushAck{{Transaction: frame.Transaction, Status: "aborted"}}
+	}
+
+	if t.full {
+		transactionsEnded.Inc("full")
+		log.Warn("Transaction too large to commit was aborted", "count", len(t.messages))
+		return []pushAck{{Transaction: frame.Transaction, Status: "full"}}
+	}
+
+	var acks []pushAck
+	queued := 0
+
+	for _, msg := range t.messages {
+		ack, keyed := queueMessage(msg, log)
+
+		if keyed {
+			acks = append(acks, ack)
+		}
+
+		if !ack.Duplicate {
+			queued++
+		}
 	}
+
+	transactionsEnded.Inc("committed")
+	log.Debug("Transaction committed", "count", queued)
+
+	return append(acks, pushAck{Transaction: frame.Transaction, Status: "committed", Count: queued})
 }
 
 func initServer(addr string, certDir string, serverReady chan<- bool) error {
-	cert, err := tls.LoadX509KeyPair(certDir+"server.crt", certDir+"server.key")
+	clientAuth, err := certstore.ParseClientAuth(cfg.ClientAuth)
 
 	if err != nil {
 		return err
 	}
 
-	http.HandleFunc("/pushmsg", func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
+	certs := certstore.New(certDir, certstore.ServerCertFile, certstore.ServerKeyFile, true, logs)
+	err = certs.Load()
 
-		if !ok || username != "hello" || password != "test" {
-			fmt.Printf("[msgqueue] Error validating credentials [%s:%s]\n", username, password)
+	if err != nil {
+		return err
+	}
+
+	if clientAuth != tls.NoClientCert {
+		_, caPool := certs.Current()
+
+		if caPool == nil {
+			return errors.New("client certificates can't be verified without " + certDir + certstore.CACertFile)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/pushmsg", func(w http.ResponseWriter, r *http.Request) {
+		log, connID := logs.Conn(r.RemoteAddr, "/pushmsg")
+		identity, ok := authenticate(r)
+
+		if !ok {
+			log.Warn("Error validating credentials", "identity", identity)
+			authFailures.Inc("/pushmsg")
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := compression.Upgrade(&upgrader, w, r, "/pushmsg", cfg.Compression)
 
 		if err != nil {
-			fmt.Printf("[msgqueue] Error upgrading connection\n%s", err)
+			log.Warn("Error upgrading connection", "error", err)
 			return
 		}
 
+		log = log.With("identity", identity)
+		log.Info("Connection opened")
+		publishers.Add(admin.NewConn(connID, "/pushmsg", r, identity, conn))
+		alive := keepalive.Start(conn, cfg.KeepAlive, logs)
+
 		go func() {
+			defer publishers.Remove(conn)
+			defer conn.Close()
+			defer alive.Stop()
+
 			for {
-				_, msg, err := conn.ReadMessage()
+				kind, frame, err := conn.ReadMessage()
 
 				if err != nil {
-					fmt.Printf("[msgqueue] Error reading message\n%s", err)
+					log.Info("Connection closed", "reason", err)
 					return
 				}
 
-				messageQueue <- msg
+				alive.Received()
+				batch := [][]byte{frame}
+
+				if kind == websocket.BinaryMessage && conn.Subprotocol() == batchProtocol {
+					batch, err = decodeBatch(frame)
+
+					if err != nil {
+						log.Warn("Dropping batch", "size", len(frame), "error", err)
+						dropped.Inc("invalid_batch")
+						continue
+					}
+
+					batches.Inc()
+				}
+
+				acks := enqueue(batch, log)
 
-				fmt.Printf("[msgqueue] Pushing message: %s\n", msg)
+				if len(acks) == 0 {
+					continue
+				}
+
+				reply, _ := json.Marshal(acks)
+				err = alive.Write(websocket.TextMessage, reply)
+
+				if err != nil {
+					log.Warn("Error acknowledging messages", "count", len(acks), "error", err)
+				}
 			}
 		}()
 	})
 
-	http.HandleFunc("/popmsg", func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
+	mux.HandleFunc("/popmsg", func(w http.ResponseWriter, r *http.Request) {
+		log, connID := logs.Conn(r.RemoteAddr, "/popmsg")
+		identity, ok := authenticate(r)
 
-		if !ok || username != "hello" || password != "test" {
-			fmt.Printf("[msgqueue] Error validating credentials [%s:%s]\n", username, password)
+		if !ok {
+			log.Warn("Error validating credentials", "identity", identity)
+			authFailures.Inc("/popmsg")
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		name := r.URL.Query().Get(instanceParam)
+
+		if err := validInstance(name); err != nil {
+			log.Warn("Refusing instance", "instance", name, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Instances and consumers without one can't be mixed, checked again
+		// once the consumer joins
+		if (name == "" && interests.count() > 0) || (name != "" && partitions.consumers() > 0) {
+			log.Warn("Refusing consumer", "instance", name, "instances", interests.count(), "consumers", partitions.consumers())
+			http.Error(w, "instances and consumers without one can't be connected at once", http.StatusConflict)
+			return
+		}
+
+		conn, err := compression.Upgrade(&upgrader, w, r, "/popmsg", cfg.Compression)
 
 		if err != nil {
-			fmt.Printf("[msgqueue] Error upgrading connection\n%s", err)
+			log.Warn("Error upgrading connection", "error", err)
 			return
 		}
 
+		log = log.With("identity", identity)
+		log.Info("Connection opened")
+		info := admin.NewConn(connID, "/popmsg", r, identity, conn)
+		consumers.Add(info)
+		alive := keepalive.Start(conn, cfg.KeepAlive, logs)
+
+		// send writes a message to the consumer
+		send := func(msg []byte) error {
+			span := tracing.StartMessage("dequeue", tracing.Producer, msg)
+			msg = tracing.WithTrace(msg, span)
+			span.Set("messaging.message.id", logging.MessageID(msg), "messaging.message.body.size", len(msg), "net.peer.name", r.RemoteAddr)
+			log.Sample().Debug("Popping message", "id", logging.MessageID(msg), "size", len(msg), "payload", msg)
+			start := time.Now()
+			err := alive.Write(websocket.TextMessage, msg)
+			writeDuration.Observe(time.Since(start))
+
+			if err != nil {
+				log.Warn("Error sending message", "id", logging.MessageID(msg), "error", err)
+				span.Fail(err)
+				span.Finish()
+				return err
+			}
+
+			dequeued.Inc()
+			span.Finish()
+
+			return nil
+		}
+
+		// The consumer stops taking messages when it's drained or can't be
+		// written, the message that failed is handed back
+		pop := func(queue chan []byte, first []byte, revoked <-chan struct{}) ([]byte, bool) {
+			if first != nil && send(first) != nil {
+				return first, true
+			}
+
+			for {
+				paused, changed := popping.State()
+				from := queue
+
+				if paused {
+					from = nil
+				}
+
+				select {
+				case <-stopPopping:
+					return nil, false
+				case <-revoked:
+					return nil, false
+				case <-info.Draining():
+					return nil, true
+				case <-changed:
+				case msg := <-from:
+					if send(msg) != nil {
+						return msg, true
+					}
+				}
+			}
+		}
+
+		// Subscriber instances only get the messages queued for them, the rest of
+		// the consumers share the partitions and the messages without a key
+		inst, member, err := joinConsumer(name, info, pop)
+
+		if err != nil {
+			log.Warn("Refusing consumer", "instance", name, "error", err)
+			consumers.Remove(conn)
+			alive.Stop()
+			admin.CloseConn(conn, websocket.ClosePolicyViolation, err.Error(), true, cfg.KeepAlive.WriteTimeout)
+			return
+		}
+
+		queue := messageQueue
+
+		if inst != nil {
+			queue = inst.queue
+			log = log.With("instance", name)
+		}
+
+		// Closed when the connection is, so nothing else is popped for it
+		closed := make(chan struct{})
+
+		// Reading is needed to process the control frames, like pongs and the
+		// close handshake, and the interest of instances
 		go func() {
+			defer consumers.Remove(conn)
+			defer conn.Close()
+			defer alive.Stop()
+
+			if inst != nil {
+				defer interests.disconnect(inst, cfg.InstanceTimeout)
+			} else {
+				defer partitions.leave(member)
+			}
+
+			defer close(closed)
+
 			for {
+				kind, frame, err := conn.ReadMessage()
+
+				if err != nil {
+					log.Info("Connection closed", "reason", err)
+					return
+				}
+
+				alive.Received()
+
+				if inst == nil || kind != websocket.TextMessage {
+					continue
+				}
+
+				var interest interestFrame
+				err = json.Unmarshal(frame, &interest)
+
+				if err != nil {
+					log.Warn("Ignoring invalid interest", "size", len(frame), "error", err)
+					continue
+				}
+
+				interests.setInterest(inst, interest)
+				log.Debug("Interest changed", "topics", len(interest.Topics), "filters", len(interest.Filters))
+			}
+		}()
+
+		go func() {
+			unsent, done := pop(queue, nil, closed)
+
+			// Only the partitions keep the order, the shared queue and the ones
+			// of the instances take the message back at the end
+			if unsent != nil {
 				select {
-				case msg := <-messageQueue:
-					fmt.Printf("[msgqueue] Popping message: %s\n", msg)
-					err := conn.WriteMessage(websocket.TextMessage, msg)
+				case queue <- unsent:
+				default:
+					dropped.Inc("write_error")
+				}
+			}
 
-					if err != nil {
-						fmt.Printf("[msgqueue] Error sending message\n%s", err)
-						return
-					}
+			if !done {
+				return
+			}
+
+			partitions.leave(member)
+
+			select {
+			case <-info.Draining():
+				// The partitions are closed after writing what they popped
+				if member != nil {
+					member.running.Wait()
 				}
+
+				log.Info("Connection drained")
+				admin.CloseConn(conn, websocket.CloseGoingAway, "drained by admin", false, cfg.KeepAlive.WriteTimeout)
+			default:
 			}
 		}()
 	})
 
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
-	listener, err := tls.Listen("tcp", addr, config)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/healthz", health.Handler(livenessChecks))
+	mux.HandleFunc("/readyz", health.Handler(func() []check {
+		return readinessChecks(certs)
+	}))
+
+	listener, err := tls.Listen("tcp", addr, certs.ServerConfig(clientAuth))
 
 	if err != nil {
 		return err
@@ -109,8 +591,21 @@ func initServer(addr string, certDir string, serverReady chan<- bool) error {
 		serverReady <- true
 	}
 
-	fmt.Println("[msgqueue] Server running")
-	http.Serve(listener, nil)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-stopping
+		ctx, cancel := context.WithDeadline(context.Background(), stopDeadline)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	logs.Info("Server running", "addr", addr)
+	err = server.Serve(listener)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
 
-	return nil
+	return err
 }
@@ -4,18 +4,37 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/tracing"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 var serverRunning = false
 
+// Password of the admin API in the tests, the one of the demo credentials is
+// refused
+const adminPassword = "admin-tests"
+
 func TestMain(m *testing.M) {
+	// Set before anything reads it, so the instances of the tests expire quickly
+	cfg.InstanceTimeout = 500 * time.Millisecond
+	cfg.InstanceFullWait = 100 * time.Millisecond
+	cfg.Admin.Password = adminPassword
 	ready := make(chan bool)
 
 	go func() {
@@ -154,3 +173,1007 @@ func TestRoundtrip(t *testing.T) {
 		t.Fatal("[tests] messages don't match")
 	}
 }
+
+func TestLoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "msgqueue.yml")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("listen: localhost:9000\nqueue_size: 5\nusername: file\n")
+	file.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("WS_QUEUE_SIZE", "7")
+	defer os.Unsetenv("WS_QUEUE_SIZE")
+
+	c, printOnly, err := loadConfig([]string{"-config", file.Name(), "-listen", "localhost:9001", "-cert-dir", "certs", "--print-config"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !printOnly {
+		t.Fatal("[tests] -print-config wasn't detected")
+	}
+
+	if c.Listen != "localhost:9001" || c.QueueSize != 7 || c.Username != "file" || c.CertDir != "certs/" || c.Password != "test" {
+		t.Fatalf("[tests] Unexpected configuration %+v", c)
+	}
+
+	_, _, err = loadConfig([]string{"-queue-size", "0"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an invalid queue size")
+	}
+
+	_, _, err = loadConfig([]string{"-listen", "nope"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an invalid listen address")
+	}
+
+	_, _, err = loadConfig([]string{"-instance-timeout", "0s"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an instance timeout that isn't positive")
+	}
+
+	_, _, err = loadConfig([]string{"-admin-listen", "localhost:9080", "-admin-password", "test"})
+
+	if err != admin.ErrWeakPassword {
+		t.Fatal("[tests] Accepted the test password for the admin API", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	defaults := cfg.KeepAlive
+	defer func() { cfg.KeepAlive = defaults }()
+
+	cfg.KeepAlive = keepalive.Config{
+		PingInterval: 100 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+		WriteTimeout: time.Second,
+		IdleTimeout:  300 * time.Millisecond,
+	}
+
+	pushURL := url.URL{Scheme: "wss", Host: "localhost:8080", Path: "/pushmsg"}
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	// Reading answers the pings, so only the idle timeout can close it
+	idleConn, _, err := dialer.Dial(pushURL.String(), authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idleConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, _, err = idleConn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatal("[tests] Idle connection wasn't closed", err)
+	}
+
+	// Not reading means the pings are never answered
+	cfg.KeepAlive.IdleTimeout = 0
+	deadConn, _, err := dialer.Dial(pushURL.String(), authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	deadConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, _, err = deadConn.ReadMessage()
+
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatal("[tests] Connection that didn't answer the pings wasn't closed", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		response, err := client.Get("https://localhost:8080" + path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := health.Report{}
+		err = json.NewDecoder(response.Body).Decode(&report)
+		response.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != http.StatusOK || report.Status != "ok" {
+			t.Fatalf("[tests] %s isn't ok: %+v", path, report)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler := health.Handler(func() []check {
+		return []check{{Name: "good", OK: true}, queueCheck("full", 100, 100)}
+	})
+	handler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), `"name":"full","ok":false,"detail":"100 of 100 messages"`) {
+		t.Fatalf("[tests] Failed check wasn't reported: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	c := defaultConfig()
+	c.TraceExporter = "file"
+	c.TraceFile = dir + "/spans.json"
+
+	err = tracing.Configure(c.traceSettings(), logs)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tracing.Configure(defaultConfig().traceSettings(), logs)
+
+	msg := []byte(`{"Topic":"test","Content":"message","Traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+	span := tracing.StartMessage("enqueue", tracing.Consumer, msg)
+	span.Set("messaging.message.body.size", len(msg))
+	traced := tracing.WithTrace(msg, span)
+	span.Finish()
+	tracing.Flush()
+
+	var m struct{ Traceparent string }
+	json.Unmarshal(traced, &m)
+
+	if !strings.HasPrefix(m.Traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(m.Traceparent, "00f067aa0ba902b7") {
+		t.Fatal("[tests] The message doesn't carry the new span", m.Traceparent)
+	}
+
+	spans, err := ioutil.ReadFile(c.TraceFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`, `"parentSpanId":"00f067aa0ba902b7"`, `"name":"enqueue"`, `"stringValue":"msgqueue"`, `"intValue":"` + strconv.Itoa(len(msg)) + `"`} {
+		if !bytes.Contains(spans, []byte(field)) {
+			t.Fatal("[tests] Exported span is missing", field, string(spans))
+		}
+	}
+}
+
+func adminRequest(t *testing.T, method string, path string, body string, password string) (int, []byte) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, err := http.NewRequest(method, "https://localhost:9080"+path, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.SetBasicAuth("admin", password)
+	response, err := client.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+	reply, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, reply
+}
+
+func TestAdmin(t *testing.T) {
+	ready := make(chan bool)
+
+	go func() {
+		err := initAdmin("localhost:9080", os.Getenv("WS_CERT_DIR"), ready)
+
+		if err != nil {
+			fmt.Println(err)
+			close(ready)
+		}
+	}()
+
+	if !<-ready {
+		t.Fatal("[tests] Admin API not running")
+	}
+
+	status, _ := adminRequest(t, "GET", "/stats", "", "hello")
+
+	if status != http.StatusUnauthorized {
+		t.Fatal("[tests] Admin API accepted invalid credentials")
+	}
+
+	status, _ = adminRequest(t, "POST", "/queue/pause", "", adminPassword)
+
+	if status != http.StatusOK {
+		t.Fatal("[tests] Queue wasn't paused")
+	}
+
+	messageQueue <- []byte("purge me")
+	status, reply := adminRequest(t, "POST", "/queue/purge", "", adminPassword)
+
+	if status != http.StatusOK || !bytes.Contains(reply, []byte(`"purged":1`)) {
+		t.Fatal("[tests] Paused queue wasn't purged", string(reply))
+	}
+
+	status, reply = adminRequest(t, "POST", "/queue/resume", "", adminPassword)
+
+	if status != http.StatusOK || !bytes.Contains(reply, []byte(`"depth":0,"capacity":100,"paused":false`)) {
+		t.Fatal("[tests] Queue wasn't resumed", string(reply))
+	}
+
+	popURL := url.URL{Scheme: "wss", Host: "localhost:8080", Path: "/popmsg"}
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	popConn, _, err := websocket.DefaultDialer.Dial(popURL.String(), authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer popConn.Close()
+
+	var conns []connInfo
+	_, reply = adminRequest(t, "GET", "/connections", "", adminPassword)
+	err = json.Unmarshal(reply, &conns)
+
+	if err != nil || len(conns) == 0 || conns[len(conns)-1].Endpoint != "/popmsg" || conns[len(conns)-1].Identity != "hello" {
+		t.Fatal("[tests] New consumer isn't listed", string(reply))
+	}
+
+	status, _ = adminRequest(t, "POST", "/connections/"+conns[len(conns)-1].ID+"/drain", "", adminPassword)
+
+	if status != http.StatusOK {
+		t.Fatal("[tests] Consumer wasn't drained")
+	}
+
+	popConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, _, err = popConn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatal("[tests] Drained consumer didn't receive a going away close frame", err)
+	}
+
+	status, _ = adminRequest(t, "DELETE", "/connections/unknown", "", adminPassword)
+
+	if status != http.StatusNotFound {
+		t.Fatal("[tests] Kicked a connection that doesn't exist")
+	}
+
+	status, _ = adminRequest(t, "PUT", "/log/level", `{"level":"verbose"}`, adminPassword)
+
+	if status != http.StatusBadRequest {
+		t.Fatal("[tests] Accepted an invalid log level")
+	}
+
+	status, reply = adminRequest(t, "PUT", "/log/level", `{"level":"warn"}`, adminPassword)
+	defer logging.SetLevel(logging.LevelInfo)
+
+	if status != http.StatusOK || !logs.Enabled(logging.LevelWarn) || logs.Enabled(logging.LevelInfo) {
+		t.Fatal("[tests] Log level wasn't changed", string(reply))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	popping.Set(true)
+	defer popping.Set(false)
+
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, Subprotocols: []string{batchProtocol}}
+	pushConn, _, err := dialer.Dial("wss://localhost:8080/pushmsg", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pushConn.Close()
+
+	if pushConn.Subprotocol() != batchProtocol {
+		t.Fatal("[tests] Batches weren't negotiated", pushConn.Subprotocol())
+	}
+
+	before := dropped.Snapshot()["invalid_batch"]
+	pushConn.WriteMessage(websocket.BinaryMessage, []byte("\x00\x00\x00\x05first\x00\x00\x00\x10truncated"))
+	pushConn.WriteMessage(websocket.BinaryMessage, []byte("\x00\x00\x00\x05first\x00\x00\x00\x06second"))
+	pushConn.WriteMessage(websocket.TextMessage, []byte("\x00\x00\x00\x05third"))
+
+	for _, expected := range []string{"first", "second", "\x00\x00\x00\x05third"} {
+		select {
+		case msg := <-messageQueue:
+			if string(msg) != expected {
+				t.Fatal("[tests] Batch wasn't unpacked in order", string(msg))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("[tests] Message wasn't enqueued", expected)
+		}
+	}
+
+	if dropped.Snapshot()["invalid_batch"] != before+1 {
+		t.Fatal("[tests] Malformed batch wasn't dropped")
+	}
+
+	if len(messageQueue) != 0 {
+		t.Fatal("[tests] Part of the malformed batch was enqueued")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	popping.Set(true)
+	defer popping.Set(false)
+
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, Subprotocols: []string{batchProtocol}}
+	pushConn, _, err := dialer.Dial("wss://localhost:8080/pushmsg", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pushConn.Close()
+
+	before := dedupChecks.Snapshot()
+	pushConn.WriteMessage(websocket.TextMessage, []byte(`{"ID":"d-1","Topic":"orders","Content":"first","Headers":{"idempotency-key":"k1"}}`))
+	pushConn.WriteMessage(websocket.BinaryMessage, encodeTestBatch(
+		`{"ID":"d-2","Topic":"orders","Content":"retry","Headers":{"idempotency-key":"k1"}}`,
+		`{"ID":"d-3","Topic":"invoices","Content":"same key, other topic","Headers":{"idempotency-key":"k1"}}`,
+		`{"ID":"d-4","Topic":"orders","Content":"no key"}`,
+	))
+
+	var first, second []pushAck
+	pushConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = pushConn.ReadJSON(&first)
+
+	if err != nil || len(first) != 1 || first[0] != (pushAck{ID: "d-1", Original: "d-1"}) {
+		t.Fatal("[tests] First message wasn't acknowledged", first, err)
+	}
+
+	err = pushConn.ReadJSON(&second)
+
+	if err != nil || len(second) != 2 || second[0] != (pushAck{ID: "d-2", Original: "d-1", Duplicate: true}) || second[1].Duplicate {
+		t.Fatal("[tests] Repeat wasn't acknowledged with the original ID", second, err)
+	}
+
+	for _, expected := range []string{"d-1", "d-3", "d-4"} {
+		select {
+		case msg := <-messageQueue:
+			if logging.MessageID(msg) != expected {
+				t.Fatal("[tests] Wrong message enqueued", string(msg))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("[tests] Message wasn't enqueued", expected)
+		}
+	}
+
+	after := dedupChecks.Snapshot()
+
+	if after["hit"]-before["hit"] != 1 || after["miss"]-before["miss"] != 2 {
+		t.Fatal("[tests] Dedup checks weren't counted", after)
+	}
+
+	// Keys are forgotten after the window or when there are too many
+	index := newDedupIndex()
+	settings := dedupConfig{Window: 50 * time.Millisecond, MaxKeys: 2}
+	index.check("a", "1", settings)
+
+	if original, duplicate := index.check("a", "2", settings); !duplicate || original != "1" {
+		t.Fatal("[tests] Repeat within the window wasn't found")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, duplicate := index.check("a", "3", settings); duplicate {
+		t.Fatal("[tests] Key wasn't forgotten after the window")
+	}
+
+	index.check("b", "4", settings)
+	index.check("c", "5", settings)
+
+	if _, duplicate := index.check("a", "6", settings); duplicate || index.size() != 2 {
+		t.Fatal("[tests] Oldest key wasn't forgotten", index.size())
+	}
+
+	// The index is saved with the spool file and read back on the next start
+	file, err := ioutil.TempFile("", "dedup")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+	defer os.Remove(file.Name())
+
+	settings.Window = time.Minute
+	index.check("d", "7", settings)
+	saved, err := index.save(file.Name(), settings)
+
+	if err != nil || saved != 2 {
+		t.Fatal("[tests] Index wasn't saved", saved, err)
+	}
+
+	restored := newDedupIndex()
+	count, err := restored.restore(file.Name(), settings)
+
+	if original, duplicate := restored.check("d", "8", settings); err != nil || count != 2 || !duplicate || original != "7" {
+		t.Fatal("[tests] Index wasn't restored", count, err)
+	}
+	// Keys are appended to the file as they're recorded, so they're restored
+	// after a crash, without the index being saved
+	recording := newDedupIndex()
+	err = recording.open(file.Name(), settings)
+
+	if err != nil {
+		t.Fatal("[tests] Index file wasn't opened", err)
+	}
+
+	recording.check("e", "9", settings)
+	recording.check("f", "10", settings)
+
+	// A line cut short by the crash is skipped
+	torn, err := os.OpenFile(file.Name(), os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torn.WriteString(`{"key":"g","id":`)
+	torn.Close()
+
+	crashed := newDedupIndex()
+	count, err = crashed.restore(file.Name(), settings)
+
+	if original, duplicate := crashed.check("f", "11", settings); err != nil || count != 2 || !duplicate || original != "10" {
+		t.Fatal("[tests] Recorded keys weren't restored", count, err)
+	}
+
+	recording.mux.Lock()
+	recording.close()
+	recording.mux.Unlock()
+}
+
+// encodeTestBatch builds a batch frame with the given messages
+func encodeTestBatch(messages ...string) []byte {
+	var frame []byte
+
+	for _, msg := range messages {
+		length := len(msg)
+		frame = append(frame, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		frame = append(frame, msg...)
+	}
+
+	return frame
+}
+
+func TestTransaction(t *testing.T) {
+	popping.Set(true)
+	defer popping.Set(false)
+
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, Subprotocols: []string{batchProtocol}}
+	pushConn, _, err := dialer.Dial("wss://localhost:8080/pushmsg", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pushConn.Close()
+
+	readAcks := func() []pushAck {
+		var acks []pushAck
+		pushConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := pushConn.ReadJSON(&acks)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return acks
+	}
+
+	pushConn.WriteMessage(websocket.BinaryMessage, encodeTestBatch(
+		`{"Transaction":"tx-1","Action":"begin"}`,
+		`{"ID":"t-1","Topic":"orders","Content":"order created","Headers":{"transaction":"tx-1"}}`,
+		`{"ID":"t-2","Topic":"outside","Content":"not in the transaction"}`,
+		`{"ID":"t-3","Topic":"inventory","Content":"inventory reserved","Headers":{"transaction":"tx-1"}}`,
+	))
+
+	select {
+	case msg := <-messageQueue:
+		if logging.MessageID(msg) != "t-2" {
+			t.Fatal("[tests] Message of an open transaction was enqueued", string(msg))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Message outside the transaction wasn't enqueued")
+	}
+
+	if len(messageQueue) != 0 || transactions.count() != 1 {
+		t.Fatal("[tests] Uncommitted messages are visible", len(messageQueue), transactions.count())
+	}
+
+	pushConn.WriteMessage(websocket.TextMessage, []byte(`{"Transaction":"tx-1","Action":"commit"}`))
+
+	if acks := readAcks(); len(acks) != 1 || acks[0] != (pushAck{Transaction: "tx-1", Status: "committed", Count: 2}) {
+		t.Fatal("[tests] Commit wasn't acknowledged", acks)
+	}
+
+	for _, expected := range []string{"t-1", "t-3"} {
+		if msg := <-messageQueue; logging.MessageID(msg) != expected {
+			t.Fatal("[tests] Committed messages weren't enqueued in order", string(msg))
+		}
+	}
+
+	before := dropped.Snapshot()["no_transaction"]
+	pushConn.WriteMessage(websocket.BinaryMessage, encodeTestBatch(
+		`{"Transaction":"tx-2","Action":"begin"}`,
+		`{"ID":"t-4","Topic":"orders","Content":"aborted","Headers":{"transaction":"tx-2"}}`,
+		`{"Transaction":"tx-2","Action":"abort"}`,
+		`{"ID":"t-5","Topic":"orders","Content":"never begun","Headers":{"transaction":"tx-3"}}`,
+		`{"Transaction":"tx-3","Action":"commit"}`,
+	))
+
+	if acks := readAcks(); len(acks) != 2 || acks[0].Status != "aborted" || acks[1] != (pushAck{Transaction: "tx-3", Status: "unknown"}) {
+		t.Fatal("[tests] Abort and unknown commit weren't acknowledged", acks)
+	}
+
+	if len(messageQueue) != 0 || dropped.Snapshot()["no_transaction"] != before+1 {
+		t.Fatal("[tests] Aborted or unknown transaction messages were enqueued", len(messageQueue))
+	}
+
+	// Transactions holding more than transaction_size messages can't be committed
+	cfg.TransactionSize = 1
+	defer func() { cfg.TransactionSize = defaultConfig().TransactionSize }()
+	before = dropped.Snapshot()["transaction_full"]
+	pushConn.WriteMessage(websocket.BinaryMessage, encodeTestBatch(
+		`{"Transaction":"tx-4","Action":"begin"}`,
+		`{"ID":"t-7","Topic":"orders","Content":"kept","Headers":{"transaction":"tx-4"}}`,
+		`{"ID":"t-8","Topic":"orders","Content":"too many","Headers":{"transaction":"tx-4"}}`,
+		`{"Transaction":"tx-4","Action":"commit"}`,
+	))
+
+	if acks := readAcks(); len(acks) != 1 || acks[0] != (pushAck{Transaction: "tx-4", Status: "full"}) {
+		t.Fatal("[tests] Full transaction was committed", acks)
+	}
+
+	if len(messageQueue) != 0 || dropped.Snapshot()["transaction_full"] != before+1 {
+		t.Fatal("[tests] Messages of a full transaction were enqueued", len(messageQueue))
+	}
+
+	// Abandoned transactions are aborted after the timeout
+	expired := transactionsEnded.Snapshot()["expired"]
+	transactions.begin("tx-abandoned", 20*time.Millisecond)
+	transactions.add("tx-abandoned", []byte(`{"ID":"t-6"}`), cfg.TransactionSize)
+	time.Sleep(100 * time.Millisecond)
+
+	if _, open := transactions.end("tx-abandoned"); open || transactionsEnded.Snapshot()["expired"] != expired+1 {
+		t.Fatal("[tests] Abandoned transaction didn't expire")
+	}
+}
+
+func TestPartitionHandover(t *testing.T) {
+	table := newPartitionTable(1, 10)
+
+	for i := 0; i < 3; i++ {
+		table.queues[0] <- []byte(fmt.Sprintf("k-%d", i))
+	}
+
+	// The first consumer fails writing the first message once the second joins
+	fail := make(chan struct{})
+	failing := func(queue chan []byte, first []byte, revoked <-chan struct{}) ([]byte, bool) {
+		<-fail
+		return <-queue, true
+	}
+
+	got := make(chan string, 10)
+	taking := func(queue chan []byte, first []byte, revoked <-chan struct{}) ([]byte, bool) {
+		if first != nil {
+			got <- string(first)
+		}
+
+		for {
+			select {
+			case msg := <-queue:
+				got <- string(msg)
+			case <-revoked:
+				return nil, false
+			}
+		}
+	}
+
+	table.join(&connInfo{ID: "failing"}, failing)
+	next := table.join(&connInfo{ID: "taking"}, taking)
+	defer table.leave(next)
+	close(fail)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-got:
+			if id != fmt.Sprintf("k-%d", i) {
+				t.Fatal("[tests] Message that failed to be written wasn't handed over first", id, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("[tests] Partition wasn't handed over", table.stats())
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	if _, ok := partitionKey([]byte(`{"ID":"k-0","Topic":"orders","Headers":{"partition-key":""}}`)); ok {
+		t.Fatal("[tests] Empty partition key was accepted")
+	}
+
+	if queueOf([]byte(`{"ID":"k-0","Topic":"orders"}`)) != messageQueue {
+		t.Fatal("[tests] Message without a partition key wasn't put in the shared queue")
+	}
+
+	// Two keys on the partitions of each consumer, which take turns by index
+	var keys []string
+
+	for even, odd, i := 0, 0, 0; even+odd < 4; i++ {
+		key := "order-" + strconv.Itoa(i)
+
+		if partitions.index(key)%2 == 0 && even < 2 {
+			keys, even = append(keys, key), even+1
+		} else if partitions.index(key)%2 == 1 && odd < 2 {
+			keys, odd = append(keys, key), odd+1
+		}
+	}
+
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	pushConn, _, err := dialer.Dial("wss://localhost:8080/pushmsg", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pushConn.Close()
+
+	type popped struct {
+		consumer int
+		id       string
+	}
+
+	received := make(chan popped, 100)
+
+	dialConsumer := func(consumer int) *websocket.Conn {
+		conn, _, err := dialer.Dial("wss://localhost:8080/popmsg", authHeader)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for {
+				_, msg, err := conn.ReadMessage()
+
+				if err != nil {
+					return
+				}
+
+				received <- popped{consumer, logging.MessageID(msg)}
+			}
+		}()
+
+		return conn
+	}
+
+	// waitOwners waits until the partitions are spread among that many consumers
+	waitOwners := func(count int) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			owners := make(map[string]bool)
+
+			for _, p := range partitions.stats() {
+				owners[p.Consumer] = true
+			}
+
+			if len(owners) == count && !owners[""] {
+				return
+			}
+		}
+
+		t.Fatal("[tests] Partitions weren't rebalanced", partitions.stats())
+	}
+
+	// round pushes five messages of each key, interleaved, and checks that each
+	// key is delivered in order by a single consumer
+	round := func(name string) map[int]int {
+		for i := 0; i < 5; i++ {
+			for _, key := range keys {
+				pushConn.WriteMessage(websocket.TextMessage, []byte(`{"ID":"`+name+`-`+key+`-`+strconv.Itoa(i)+`","Topic":"orders","Headers":{"partition-key":"`+key+`"}}`))
+			}
+		}
+
+		next := make(map[string]int)
+		consumerOf := make(map[string]int)
+		perConsumer := make(map[int]int)
+
+		for n := 0; n < 5*len(keys); n++ {
+			var p popped
+
+			select {
+			case p = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("[tests] Keyed message wasn't delivered", name, n)
+			}
+
+			parts := strings.Split(p.id, "-")
+			key := parts[1] + "-" + parts[2]
+
+			if parts[0] != name || parts[3] != strconv.Itoa(next[key]) {
+				t.Fatal("[tests] Messages of a key weren't delivered in order", p.id, next[key])
+			}
+
+			if consumer, ok := consumerOf[key]; ok && consumer != p.consumer {
+				t.Fatal("[tests] Messages of a key were delivered to two consumers", p.id)
+			}
+
+			next[key]++
+			consumerOf[key] = p.consumer
+			perConsumer[p.consumer]++
+		}
+
+		return perConsumer
+	}
+
+	first := dialConsumer(1)
+	defer first.Close()
+	waitOwners(1)
+
+	if perConsumer := round("a"); perConsumer[1] != 20 {
+		t.Fatal("[tests] The only consumer didn't get every partition", perConsumer)
+	}
+
+	moved := rebalances.Snapshot()[""]
+	second := dialConsumer(2)
+	waitOwners(2)
+
+	if perConsumer := round("b"); perConsumer[1] != 10 || perConsumer[2] != 10 {
+		t.Fatal("[tests] Partitions weren't shared between the consumers", perConsumer)
+	}
+
+	second.Close()
+	waitOwners(1)
+
+	if perConsumer := round("c"); perConsumer[1] != 20 {
+		t.Fatal("[tests] Partitions of a consumer that left weren't taken over", perConsumer)
+	}
+
+	if rebalances.Snapshot()[""] != moved+2 {
+		t.Fatal("[tests] Rebalances weren't counted", rebalances.Snapshot())
+	}
+}
+
+func TestInstanceFull(t *testing.T) {
+	table := newInterestTable()
+	slow, fast := table.connect("slow", 1), table.connect("fast", 10)
+	table.setInterest(slow, interestFrame{Topics: []string{"load"}, Groups: []groupInterest{{Topic: "jobs.*", Group: "workers"}}})
+	table.setInterest(fast, interestFrame{Topics: []string{"load"}})
+	before := dropped.Snapshot()["instance_full"]
+	start := time.Now()
+
+	// A connected instance that doesn't read only holds the rest up for a while
+	for i := 0; i < 3; i++ {
+		table.route([]byte(fmt.Sprintf(`{"ID":"f-%d","Topic":"load"}`, i)))
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*cfg.InstanceFullWait {
+		t.Fatal("[tests] Full instance held the messages up for", elapsed)
+	}
+
+	if len(slow.queue) != 1 || len(fast.queue) != 3 || dropped.Snapshot()["instance_full"]-before != 2 {
+		t.Fatal("[tests] Messages for a full instance weren't dropped", table.stats(), dropped.Snapshot())
+	}
+
+	// The turns of a group are forgotten with it
+	table.interested("jobs.build")
+	table.setInterest(slow, interestFrame{Topics: []string{"load"}})
+
+	if len(table.turns) != 0 {
+		t.Fatal("[tests] Turns of a group without instances were kept", table.turns)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	_, _, err := dialer.Dial("wss://localhost:8080/popmsg?instance="+strings.Repeat("i", maxInstanceName+1), authHeader)
+
+	if err == nil {
+		t.Fatal("[tests] Instance with a long name was accepted")
+	}
+
+	pushConn, _, err := dialer.Dial("wss://localhost:8080/pushmsg", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pushConn.Close()
+
+	// Consumers of the earlier tests may still be leaving
+	for start := time.Now(); partitions.consumers() > 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dialInstance := func(name string, interest string) *websocket.Conn {
+		conn, _, err := dialer.Dial("wss://localhost:8080/popmsg?instance="+name, authHeader)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(interest))
+
+		return conn
+	}
+
+	waitFor := func(what string, done func(stats []instanceStats) bool) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if done(interests.stats()) {
+				return
+			}
+		}
+
+		t.Fatal("[tests] Instances didn't change:", what, interests.stats())
+	}
+
+	readIDs := func(conn *websocket.Conn, count int) string {
+		var ids []string
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		for len(ids) < count {
+			_, msg, err := conn.ReadMessage()
+
+			if err != nil {
+				t.Fatal("[tests] Message for an instance wasn't delivered", ids, err)
+			}
+
+			ids = append(ids, logging.MessageID(msg))
+		}
+
+		return strings.Join(ids, ",")
+	}
+
+	push := func(id string, topic string) {
+		pushConn.WriteMessage(websocket.TextMessage, []byte(`{"ID":"`+id+`","Topic":"`+topic+`","Content":"for instances"}`))
+	}
+
+	first := dialInstance("first", `{"Topics":["orders.*"],"Filters":["sensors/+"]}`)
+	defer first.Close()
+	second := dialInstance("second", `{"Topics":["orders.created","news"]}`)
+
+	waitFor("interest of both", func(stats []instanceStats) bool {
+		return len(stats) == 2 && len(stats[0].Topics) == 1 && len(stats[1].Topics) == 2
+	})
+
+	// Consumers without an instance can't share the messages with them
+	_, response, err := dialer.Dial("wss://localhost:8080/popmsg", authHeader)
+
+	if err == nil || response == nil || response.StatusCode != http.StatusConflict {
+		t.Fatal("[tests] Consumer without an instance was accepted along with instances", err)
+	}
+
+	before := dropped.Snapshot()
+	push("n-1", "orders.created")
+	push("n-2", "news")
+	push("n-3", "sensors/kitchen")
+	push("n-4", "nobody.cares")
+
+	if ids := readIDs(first, 2); ids != "n-1,n-3" {
+		t.Fatal("[tests] First instance didn't get its interest", ids)
+	}
+
+	if ids := readIDs(second, 2); ids != "n-1,n-2" {
+		t.Fatal("[tests] Second instance didn't get its interest", ids)
+	}
+
+	// Each message of a group goes to one of the instances that have it
+	first.WriteMessage(websocket.TextMessage, []byte(`{"Topics":["orders.*"],"Filters":["sensors/+"],"Groups":[{"topic":"jobs.*","group":"workers"}]}`))
+	second.WriteMessage(websocket.TextMessage, []byte(`{"Topics":["orders.created","news"],"Groups":[{"topic":"jobs.*","group":"workers"}]}`))
+	waitFor("groups of both", func(stats []instanceStats) bool {
+		return len(stats) == 2 && len(stats[0].Groups) == 1 && len(stats[1].Groups) == 1
+	})
+
+	for i := 0; i < 4; i++ {
+		push(fmt.Sprintf("j-%d", i), "jobs.build")
+	}
+
+	if ids := readIDs(first, 2) + ";" + readIDs(second, 2); ids != "j-0,j-2;j-1,j-3" {
+		t.Fatal("[tests] Instances didn't take turns with the messages of the group", ids)
+	}
+
+	// Messages are kept while an instance reconnects
+	second.Close()
+	waitFor("second disconnected", func(stats []instanceStats) bool {
+		return len(stats) == 2 && stats[1].Connections == 0
+	})
+	push("n-5", "news")
+	waitFor("message kept", func(stats []instanceStats) bool {
+		return stats[1].Depth == 1
+	})
+
+	second = dialInstance("second", `{"Topics":["orders.created","news"]}`)
+
+	if ids := readIDs(second, 1); ids != "n-5" {
+		t.Fatal("[tests] Instance didn't get the messages queued while it reconnected", ids)
+	}
+
+	// And dropped when it doesn't come back in time
+	second.Close()
+	waitFor("second disconnected again", func(stats []instanceStats) bool {
+		return len(stats) == 2 && stats[1].Connections == 0
+	})
+	push("n-6", "news")
+	waitFor("second expired", func(stats []instanceStats) bool {
+		return len(stats) == 1 && stats[0].Name == "first"
+	})
+
+	after := dropped.Snapshot()
+
+	if after["no_interest"] != before["no_interest"]+1 || after["instance_expired"] != before["instance_expired"]+1 {
+		t.Fatal("[tests] Messages without interest or of expired instances weren't counted", after)
+	}
+
+	first.Close()
+	waitFor("every instance expired", func(stats []instanceStats) bool {
+		return len(stats) == 0
+	})
+
+	// Instances are saved with their interest and messages on shutdown
+	file, err := ioutil.TempFile("", "instances")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+	defer os.Remove(file.Name())
+
+	table := newInterestTable()
+	table.setInterest(table.connect("saved", 10), interestFrame{Topics: []string{"orders.*"}})
+	table.route([]byte(`{"ID":"n-7","Topic":"orders.paid"}`))
+	saved, err := table.save(file.Name())
+
+	if err != nil || saved != 1 {
+		t.Fatal("[tests] Instances weren't saved", saved, err)
+	}
+
+	restored := newInterestTable()
+	count, err := restored.restore(file.Name(), 10, time.Minute)
+
+	if err != nil || count != 1 {
+		t.Fatal("[tests] Instances weren't restored", count, err)
+	}
+
+	matched, _ := restored.interested("orders.shipped")
+
+	if len(matched) != 1 || matched[0].inst.name != "saved" || logging.MessageID(<-matched[0].inst.queue) != "n-7" {
+		t.Fatal("[tests] Restored instance lost its interest or messages", restored.stats())
+	}
+}
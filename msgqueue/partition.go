@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"hash/fnv"
+	"sync"
+)
+
+// Header of a message with the key that picks its partition. The messages with
+// the same key are delivered in the order they were queued
+const partitionHeader = "partition-key"
+
+// popFunc sends a consumer first, unless it's nil, and then the messages of a
+// queue until revoked is closed or the service stops. It returns the message it
+// couldn't write, if any, and whether it stopped because the consumer doesn't
+// take more messages
+type popFunc func(queue chan []byte, first []byte, revoked <-chan struct{}) ([]byte, bool)
+
+// partitionMember is a /popmsg consumer as the partitions see it
+type partitionMember struct {
+	info    *connInfo
+	pop     popFunc
+	running sync.WaitGroup
+}
+
+// partitionTable holds the queues of the partitions and the consumers they're
+// assigned to. Each partition is popped by one consumer at a time, and moving it
+// to another one waits until the previous one has written what it popped. A
+// message the previous one failed to write is held, and sent first by the next
+type partitionTable struct {
+	queues  []chan []byte
+	held    [][]byte
+	members []*partitionMember
+	owners  []*partitionMember
+	popping []*partitionMember
+	revoked []chan struct{}
+	mux     sync.Mutex
+}
+
+var partitions = newPartitionTable(8, 100)
+
+func newPartitionTable(count int, size int) *partitionTable {
+	t := &partitionTable{
+		queues:  make([]chan []byte, count),
+		held:    make([][]byte, count),
+		owners:  make([]*partitionMember, count),
+		popping: make([]*partitionMember, count),
+		revoked: make([]chan struct{}, count),
+	}
+
+	for i := range t.queues {
+		t.queues[i] = make(chan []byte, size)
+	}
+
+	return t
+}
+
+// partitionKey returns the partition key of a message, if it has one
+func partitionKey(msg []byte) (string, bool) {
+	if !bytes.Contains(msg, []byte(partitionHeader)) {
+		return "", false
+	}
+
+	var m struct{ Headers map[string]string }
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil || m.Headers[partitionHeader] == "" {
+		return "", false
+	}
+
+	return m.Headers[partitionHeader], true
+}
+
+// index returns the partition of a key
+func (t *partitionTable) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(len(t.queues)))
+}
+
+// queueOf returns the queue a message goes to, the one of its partition or the
+// shared one, which every consumer takes from, for messages without a key
+func queueOf(msg []byte) chan []byte {
+	if key, ok := partitionKey(msg); ok {
+		return partitions.queues[partitions.index(key)]
+	}
+
+	return messageQueue
+}
+
+// depth returns the messages waiting on every partition
+func (t *partitionTable) depth() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	depth := 0
+
+	for i, queue := range t.queues {
+		depth += len(queue)
+
+		if t.held[i] != nil {
+			depth++
+		}
+	}
+
+	return depth
+}
+
+// take empties a partition and returns its messages in order, the held one first
+func (t *partitionTable) take(i int) [][]byte {
+	t.mux.Lock()
+	held := t.held[i]
+	t.held[i] = nil
+	t.mux.Unlock()
+
+	if held == nil {
+		return shutdown.TakeAll(t.queues[i])
+	}
+
+	return append([][]byte{held}, shutdown.TakeAll(t.queues[i])...)
+}
+
+// takeAll empties every partition
+func (t *partitionTable) takeAll() [][]byte {
+	var taken [][]byte
+
+	for i := range t.queues {
+		taken = append(taken, t.take(i)...)
+	}
+
+	return taken
+}
+
+// consumers returns how many consumers share the partitions
+func (t *partitionTable) consumers() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return len(t.members)
+}
+
+// join adds a consumer and gives it its share of the partitions
+func (t *partitionTable) join(info *connInfo, pop popFunc) *partitionMember {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	member := &partitionMember{info: info, pop: pop}
+	t.members = append(t.members, member)
+	t.rebalance()
+
+	return member
+}
+
+// leave gives the partitions of a consumer to the rest, it can be called more
+// than once. Its running goroutines stop after writing what they popped
+func (t *partitionTable) leave(member *partitionMember) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for i, m := range t.members {
+		if m == member {
+			t.members = append(t.members[:i], t.members[i+1:]...)
+			t.rebalance()
+			return
+		}
+	}
+}
+
+// rebalance spreads the partitions among the consumers in the order they
+// joined. The partitions that change hands are revoked from the consumer
+// popping them, and the new one starts when it stops. The caller holds the lock
+func (t *partitionTable) rebalance() {
+	moved := false
+
+	for i := range t.owners {
+		var owner *partitionMember
+
+		if len(t.members) > 0 {
+			owner = t.members[i%len(t.members)]
+		}
+
+		if owner != t.owners[i] {
+			moved = true
+		}
+
+		t.owners[i] = owner
+
+		switch {
+		case t.popping[i] == nil && owner != nil:
+			t.start(i)
+		case t.popping[i] != nil && t.popping[i] != owner && t.revoked[i] != nil:
+			close(t.revoked[i])
+			t.revoked[i] = nil
+		}
+	}
+
+	if moved {
+		rebalances.Inc()
+	}
+}
+
+// start has the owner of a partition pop it, unless the consumers were stopped.
+// An owner that stops taking messages leaves. The caller holds the lock
+func (t *partitionTable) start(i int) {
+	select {
+	case <-stopPopping:
+		return
+	default:
+	}
+
+	member := t.owners[i]
+	revoked := make(chan struct{})
+	first := t.held[i]
+	t.held[i] = nil
+	t.popping[i] = member
+	t.revoked[i] = revoked
+	member.running.Add(1)
+
+	go func() {
+		unsent, done := member.pop(t.queues[i], first, revoked)
+
+		if done {
+			t.leave(member)
+		}
+
+		t.stopped(i, unsent)
+		member.running.Done()
+	}()
+}
+
+// stopped hands a partition to its owner once the previous one stops popping it,
+// with the message it couldn't write to be sent first
+func (t *partitionTable) stopped(i int, unsent []byte) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.popping[i] = nil
+	t.revoked[i] = nil
+	t.held[i] = unsent
+
+	if t.owners[i] != nil {
+		t.start(i)
+	}
+}
+
+// partitionStats is a partition as the admin API shows it
+type partitionStats struct {
+	Partition int    `json:"partition"`
+	Depth     int    `json:"depth"`
+	Consumer  string `json:"consumer,omitempty"`
+}
+
+func (t *partitionTable) stats() []partitionStats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	stats := make([]partitionStats, len(t.queues))
+
+	for i, queue := range t.queues {
+		stats[i] = partitionStats{Partition: i, Depth: len(queue)}
+
+		if t.owners[i] != nil {
+			stats[i].Consumer = t.owners[i].info.ID
+		}
+	}
+
+	return stats
+}
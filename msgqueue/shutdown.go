@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// Closed when the service has been asked to stop, stopDeadline is set before
+var stopping = make(chan struct{})
+var stopDeadline time.Time
+
+// Closed when the consumers have to stop taking messages from the queue
+var stopPopping = make(chan struct{})
+
+// Connections on /pushmsg and /popmsg
+var publishers = admin.NewConnSet(logs)
+var consumers = admin.NewConnSet(logs)
+
+// drain stops the publishers, gives the consumers until the deadline to empty
+// the queue, closes them and spools whatever is left. It returns the exit status,
+// after trying to save everything even when some of it fails
+func drain() int {
+	status := shutdown.ExitOK
+
+	publishers.CloseAll(websocket.CloseGoingAway, "server shutting down", stopDeadline)
+
+	for len(messageQueue)+partitions.depth()+interests.depth() > 0 && consumers.Count() > 0 && time.Now().Before(stopDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stopPopping)
+
+	// The messages of open transactions were never visible, they're dropped
+	// like the transactions of a publisher that goes away
+	if open := transactions.count(); open > 0 {
+		logs.Warn("Aborting open transactions", "count", open)
+	}
+
+	consumers.CloseAll(websocket.CloseGoingAway, "server shutting down", stopDeadline)
+
+	spooled, err := shutdown.Spool(cfg.SpoolFile, append(shutdown.TakeAll(messageQueue), partitions.takeAll()...))
+
+	if err != nil {
+		logs.Error("Error spooling pending messages", "file", cfg.SpoolFile, "error", err)
+		status = shutdown.ExitMessagesLost
+	} else if spooled > 0 {
+		logs.Info("Spooled pending messages", "file", cfg.SpoolFile, "count", spooled)
+	}
+
+	// The instances are saved with their interest and messages, for when they
+	// reconnect after the restart
+	if cfg.SpoolFile != "" {
+		saved, err := interests.save(cfg.SpoolFile + instancesFileSuffix)
+
+		if err != nil {
+			logs.Error("Error saving the instances", "file", cfg.SpoolFile+instancesFileSuffix, "error", err)
+			status = shutdown.ExitMessagesLost
+		} else if saved > 0 {
+			logs.Info("Saved messages of instances", "file", cfg.SpoolFile+instancesFileSuffix, "count", saved)
+		}
+	} else if pending := interests.depth(); pending > 0 {
+		logs.Error("Messages of instances lost, there's no spool file configured", "count", pending)
+		status = shutdown.ExitMessagesLost
+	}
+
+	// The keys are kept with the messages, so the repeats of the ones queued
+	// before the restart are still dropped. Losing them is an error, as repeats
+	// would be queued again
+	if cfg.SpoolFile != "" {
+		saved, err := dedup.save(cfg.SpoolFile+dedupFileSuffix, cfg.Dedup)
+
+		if err != nil {
+			logs.Error("Error saving the dedup index", "file", cfg.SpoolFile+dedupFileSuffix, "error", err)
+
+			if status == shutdown.ExitOK {
+				status = shutdown.ExitError
+			}
+		} else if saved > 0 {
+			logs.Info("Saved idempotency keys", "file", cfg.SpoolFile+dedupFileSuffix, "count", saved)
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Header of the messages published in a transaction, with its ID
+const transactionHeader = "transaction"
+
+// transactionFrame begins, commits or aborts a transaction, it's pushed by the
+// publisher between the messages
+type transactionFrame struct {
+	Transaction string
+	Action      string
+}
+
+// transaction holds the messages published in it until it's committed. A full
+// transaction dropped a message and can only be aborted
+type transaction struct {
+	messages [][]byte
+	full     bool
+	timer    *time.Timer
+}
+
+// transactionSet holds the open transactions by their ID, which the publisher
+// makes unique
+type transactionSet struct {
+	open map[string]*transaction
+	mux  sync.Mutex
+}
+
+var transactions = &transactionSet{open: make(map[string]*transaction)}
+
+// begin opens a transaction, which is aborted if it isn't ended before the
+// timeout. Beginning one that's open does nothing
+func (s *transactionSet) begin(id string, timeout time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.open[id]; ok {
+		return
+	}
+
+	t := &transaction{}
+	s.open[id] = t
+
+	t.timer = time.AfterFunc(timeout, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if s.open[id] == t {
+			delete(s.open, id)
+			transactionsEnded.Inc("expired")
+			logs.Warn("Transaction expired", "transaction", id, "count", len(t.messages))
+		}
+	})
+}
+
+// add keeps a message of an open transaction, unless it already holds max of
+// them. It tells whether the transaction is open and the message was kept
+func (s *transactionSet) add(id string, msg []byte, max int) (bool, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t, ok := s.open[id]
+
+	if !ok {
+		return false, false
+	}
+
+	if len(t.messages) >= max {
+		t.full = true
+		return true, false
+	}
+
+	t.messages = append(t.messages, msg)
+
+	return true, true
+}
+
+// end closes a transaction and returns it, or false if it isn't open
+func (s *transactionSet) end(id string) (*transaction, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t, ok := s.open[id]
+
+	if !ok {
+		return nil, false
+	}
+
+	t.timer.Stop()
+	delete(s.open, id)
+
+	return t, true
+}
+
+func (s *transactionSet) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.open)
+}
+
+// transactionOf tells the frames that begin, commit or abort a transaction,
+// which have no topic, apart from the messages published in one, for which it
+// returns the ID of the transaction
+func transactionOf(msg []byte) (transactionFrame, string) {
+	if !bytes.Contains(msg, []byte("ransaction")) {
+		return transactionFrame{}, ""
+	}
+
+	var m struct {
+		Topic       string
+		Transaction string
+		Action      string
+		Headers     map[string]string
+	}
+
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil {
+		return transactionFrame{}, ""
+	}
+
+	if m.Topic == "" && m.Transaction != "" && m.Action != "" {
+		return transactionFrame{Transaction: m.Transaction, Action: m.Action}, ""
+	}
+
+	return transactionFrame{}, m.Headers[transactionHeader]
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+type connInfo = admin.Conn
+
+// Stops the messages from being pushed to msgqueue while it's paused
+var pushing = admin.NewPauseGate()
+
+func adminConnSets() []*admin.ConnSet {
+	return []*admin.ConnSet{clients}
+}
+
+// drainConn asks a client to close, the messages it already sent are still pushed
+func drainConn(info connInfo) {
+	admin.CloseConn(info.WS, websocket.CloseGoingAway, "drained by admin", false, cfg.KeepAlive.WriteTimeout)
+}
+
+type queueStats struct {
+	Depth    int  `json:"depth"`
+	Capacity int  `json:"capacity"`
+	Paused   bool `json:"paused"`
+}
+
+type topicStats struct {
+	Received float64 `json:"received"`
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	paused, _ := pushing.State()
+	topicCounts := make(map[string]topicStats)
+
+	for topic, count := range received.Snapshot() {
+		topicCounts[topic] = topicStats{Received: count}
+	}
+
+	admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{
+		"queue":       queueStats{Depth: len(thingsToPush), Capacity: cap(thingsToPush), Paused: paused},
+		"connections": map[string]int{"/publish": clients.Count()},
+		"upstream":    atomic.LoadInt32(&upstreamConnected) == 1,
+		"topics":      topicCounts,
+		"pushed":      pushed.Snapshot()[""],
+		"dropped":     dropped.Snapshot(),
+	})
+}
+
+// purgeQueue drops every message waiting to be pushed
+func purgeQueue(w http.ResponseWriter, r *http.Request) {
+	purged := 0
+
+purging:
+	for {
+		select {
+		case <-thingsToPush:
+			purged++
+		default:
+			break purging
+		}
+	}
+
+	dropped.Add(float64(purged), "purged")
+	admin.ReplyJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func pauseQueue(w http.ResponseWriter, r *http.Request) {
+	pushing.Set(strings.HasSuffix(r.URL.Path, "/pause"))
+	showStats(w, r)
+}
+
+// adminServer is the admin API with the credentials and connections of the
+// service
+func adminServer() *admin.Server {
+	return &admin.Server{
+		Username:     cfg.Admin.Username,
+		Password:     cfg.Admin.Password,
+		Sets:         adminConnSets(),
+		Drain:        drainConn,
+		WriteTimeout: cfg.KeepAlive.WriteTimeout,
+		Logs:         logs,
+		AuthFailures: authFailures,
+	}
+}
+
+// initAdmin serves the admin API on its own listener, with the same server
+// certificate as the websockets
+func initAdmin(addr string, certDir string, adminReady chan<- bool) error {
+	server := adminServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", server.Handler(server.ListConnections, "GET"))
+	mux.HandleFunc("/connections/", server.Handler(server.ManageConnection, "DELETE", "POST"))
+	mux.HandleFunc("/log/level", server.Handler(admin.LogLevel, "GET", "PUT"))
+	mux.HandleFunc("/stats", server.Handler(showStats, "GET"))
+	mux.HandleFunc("/queue/purge", server.Handler(purgeQueue, "POST"))
+	mux.HandleFunc("/queue/pause", server.Handler(pauseQueue, "POST"))
+	mux.HandleFunc("/queue/resume", server.Handler(pauseQueue, "POST"))
+	mux.HandleFunc("/schemas", server.Handler(listSchemas, "GET"))
+	mux.HandleFunc("/schemas/", server.Handler(manageSchemas, "GET", "POST", "DELETE"))
+
+	return server.Serve(addr, certDir, mux, adminReady, stopping, &stopDeadline)
+}
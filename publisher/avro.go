@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var avroPrimitives = map[string]bool{"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true}
+
+// avroType is a parsed Avro schema. Named types keep their full name, and
+// logical types are checked as their underlying type
+type avroType struct {
+	kind     string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	size     int
+	branches []*avroType
+
+	// Enums with a default read symbols they don't know
+	hasDefault bool
+}
+
+type avroField struct {
+	name       string
+	aliases    []string
+	typ        *avroType
+	hasDefault bool
+}
+
+// avroSchema checks payloads in the JSON encoding of Avro, where unions other
+// than null are written as an object with the name of the branch as its key
+type avroSchema struct {
+	root *avroType
+}
+
+func compileAvroSchema(text string) (schemaValidator, error) {
+	definition, err := decodeJSONNumbers([]byte(text))
+
+	if err != nil {
+		return nil, fmt.Errorf("the schema isn't JSON: %s", err)
+	}
+
+	root, err := parseAvro(definition, "", make(map[string]*avroType))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &avroSchema{root: root}, nil
+}
+
+// avroFullName qualifies a name with the namespace, unless it already has one
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+
+	return namespace + "." + name
+}
+
+// avroShortName is the name without namespace, the one compared when reading
+func avroShortName(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// parseAvro parses a type of a schema, names has the named types defined so
+// far so they can be referred to
+func parseAvro(definition interface{}, namespace string, names map[string]*avroType) (*avroType, error) {
+	switch d := definition.(type) {
+	case string:
+		if avroPrimitives[d] {
+			return &avroType{kind: d}, nil
+		}
+
+		for _, name := range []string{avroFullName(d, namespace), d} {
+			if named, ok := names[name]; ok {
+				return named, nil
+			}
+		}
+
+		return nil, fmt.Errorf("unknown type %q", d)
+	case []interface{}:
+		union := &avroType{kind: "union"}
+
+		for _, branch := range d {
+			parsed, err := parseAvro(branch, namespace, names)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if parsed.kind == "union" {
+				return nil, errors.New("unions can't have unions as branches")
+			}
+
+			for _, other := range union.branches {
+				if other.branchName() == parsed.branchName() {
+					return nil, fmt.Errorf("the union has %s more than once", parsed.branchName())
+				}
+			}
+
+			union.branches = append(union.branches, parsed)
+		}
+
+		return union, nil
+	case map[string]interface{}:
+		return parseAvroObject(d, namespace, names)
+	}
+
+	return nil, errors.New("a type must be a name, an object or a list")
+}
+
+func parseAvroObject(d map[string]interface{}, namespace string, names map[string]*avroType) (*avroType, error) {
+	kind, ok := d["type"].(string)
+
+	if !ok {
+		// {"type": {...}} only wraps another type
+		if inner, exists := d["type"]; exists {
+			return parseAvro(inner, namespace, names)
+		}
+
+		return nil, errors.New("a type object needs a type")
+	}
+
+	if avroPrimitives[kind] {
+		return &avroType{kind: kind}, nil
+	}
+
+	t := &avroType{kind: kind}
+
+	switch kind {
+	case "array":
+		items, err := parseAvro(d["items"], namespace, names)
+
+		if err != nil {
+			return nil, fmt.Errorf("array items: %s", err)
+		}
+
+		t.items = items
+
+		return t, nil
+	case "map":
+		values, err := parseAvro(d["values"], namespace, names)
+
+		if err != nil {
+			return nil, fmt.Errorf("map values: %s", err)
+		}
+
+		t.items = values
+
+		return t, nil
+	case "record", "error", "enum", "fixed":
+	default:
+		return parseAvro(kind, namespace, names)
+	}
+
+	name, _ := d["name"].(string)
+
+	if name == "" {
+		return nil, fmt.Errorf("a %s needs a name", kind)
+	}
+
+	if ns, ok := d["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+
+	t.name = avroFullName(name, namespace)
+
+	if _, exists := names[t.name]; exists {
+		return nil, fmt.Errorf("type %s is defined twice", t.name)
+	}
+
+	names[t.name] = t
+
+	// Names inside a type are relative to its namespace
+	if i := strings.LastIndex(t.name, "."); i >= 0 {
+		namespace = t.name[:i]
+	}
+
+	switch kind {
+	case "enum":
+		symbols, _ := d["symbols"].([]interface{})
+
+		for _, symbol := range symbols {
+			text, ok := symbol.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("the symbols of %s must be strings", t.name)
+			}
+
+			t.symbols = append(t.symbols, text)
+		}
+
+		_, t.hasDefault = d["default"]
+	case "fixed":
+		size, ok := jsonNumber(d["size"])
+
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("%s needs a size", t.name)
+		}
+
+		t.size = int(size)
+	default:
+		t.kind = "record"
+		fields, ok := d["fields"].([]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("%s needs a list of fields", t.name)
+		}
+
+		for _, field := range fields {
+			f, _ := field.(map[string]interface{})
+			fieldName, _ := f["name"].(string)
+
+			if fieldName == "" {
+				return nil, fmt.Errorf("the fields of %s need a name", t.name)
+			}
+
+			fieldType, err := parseAvro(f["type"], namespace, names)
+
+			if err != nil {
+				return nil, fmt.Errorf("field %s of %s: %s", fieldName, t.name, err)
+			}
+
+			parsed := avroField{name: fieldName, typ: fieldType}
+			_, parsed.hasDefault = f["default"]
+			aliases, _ := f["aliases"].([]interface{})
+
+			for _, alias := range aliases {
+				if text, ok := alias.(string); ok {
+					parsed.aliases = append(parsed.aliases, text)
+				}
+			}
+
+			t.fields = append(t.fields, parsed)
+		}
+	}
+
+	return t, nil
+}
+
+// branchName is the key of a union branch in the JSON encoding
+func (t *avroType) branchName() string {
+	if t.name != "" {
+		return t.name
+	}
+
+	return t.kind
+}
+
+func (s *avroSchema) validate(payload []byte) error {
+	value, err := decodeJSONNumbers(payload)
+
+	if err != nil {
+		return fmt.Errorf("the payload isn't JSON: %s", err)
+	}
+
+	return s.root.check(value, "")
+}
+
+// avroBytes tells whether a string holds bytes as the JSON encoding writes
+// them, one code point up to 255 for each
+func avroBytes(value string) ([]rune, bool) {
+	runes := []rune(value)
+
+	for _, r := range runes {
+		if r > 0xff {
+			return nil, false
+		}
+	}
+
+	return runes, true
+}
+
+func (t *avroType) check(value interface{}, at string) error {
+	mismatch := func() error {
+		return fmt.Errorf("%s: expected %s, got %s", pointer(at), t.branchName(), jsonType(value))
+	}
+
+	switch t.kind {
+	case "null":
+		if value != nil {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch()
+		}
+	case "int", "long":
+		number, ok := value.(json.Number)
+
+		if !ok {
+			return mismatch()
+		}
+
+		bits := 64
+
+		if t.kind == "int" {
+			bits = 32
+		}
+
+		if _, err := strconv.ParseInt(string(number), 10, bits); err != nil {
+			return fmt.Errorf("%s: %s isn't a %d bit integer", pointer(at), number, bits)
+		}
+	case "float", "double":
+		if _, ok := value.(json.Number); !ok {
+			return mismatch()
+		}
+	case "string", "bytes", "enum", "fixed":
+		text, ok := value.(string)
+
+		if !ok {
+			return mismatch()
+		}
+
+		return t.checkText(text, at)
+	case "array":
+		items, ok := value.([]interface{})
+
+		if !ok {
+			return mismatch()
+		}
+
+		for i, item := range items {
+			err := t.items.check(item, at+"/"+strconv.Itoa(i))
+
+			if err != nil {
+				return err
+			}
+		}
+	case "map":
+		values, ok := value.(map[string]interface{})
+
+		if !ok {
+			return mismatch()
+		}
+
+		for _, key := range sortedKeys(values) {
+			err := t.items.check(values[key], at+"/"+key)
+
+			if err != nil {
+				return err
+			}
+		}
+	case "record":
+		return t.checkRecord(value, at)
+	case "union":
+		return t.checkUnion(value, at)
+	}
+
+	return nil
+}
+
+func (t *avroType) hasSymbol(symbol string) bool {
+	for _, known := range t.symbols {
+		if known == symbol {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *avroType) checkText(text string, at string) error {
+	switch t.kind {
+	case "bytes":
+		if _, ok := avroBytes(text); !ok {
+			return fmt.Errorf("%s: bytes can only have code points up to 255", pointer(at))
+		}
+	case "fixed":
+		if runes, ok := avroBytes(text); !ok || len(runes) != t.size {
+			return fmt.Errorf("%s: expected %d bytes", pointer(at), t.size)
+		}
+	case "enum":
+		if t.hasSymbol(text) {
+			return nil
+		}
+
+		return fmt.Errorf("%s: %q isn't a symbol of %s", pointer(at), text, t.name)
+	}
+
+	return nil
+}
+
+func (t *avroType) checkRecord(value interface{}, at string) error {
+	object, ok := value.(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("%s: expected %s, got %s", pointer(at), t.name, jsonType(value))
+	}
+
+	known := make(map[string]bool)
+
+	for _, field := range t.fields {
+		known[field.name] = true
+		fieldValue, ok := object[field.name]
+
+		if !ok {
+			if field.hasDefault {
+				continue
+			}
+
+			return fmt.Errorf("%s: missing field %q of %s", pointer(at), field.name, t.name)
+		}
+
+		err := field.typ.check(fieldValue, at+"/"+field.name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(object) {
+		if !known[name] {
+			return fmt.Errorf("%s: %s has no field %q", pointer(at), t.name, name)
+		}
+	}
+
+	return nil
+}
+
+func (t *avroType) checkUnion(value interface{}, at string) error {
+	if value == nil {
+		for _, branch := range t.branches {
+			if branch.kind == "null" {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s: null isn't a branch of the union", pointer(at))
+	}
+
+	object, ok := value.(map[string]interface{})
+
+	if !ok || len(object) != 1 {
+		return fmt.Errorf("%s: a union value must be null or an object with the name of its branch", pointer(at))
+	}
+
+	for name, branchValue := range object {
+		for _, branch := range t.branches {
+			if branch.branchName() == name {
+				return branch.check(branchValue, at+"/"+name)
+			}
+		}
+
+		return fmt.Errorf("%s: %s isn't a branch of the union", pointer(at), name)
+	}
+
+	return nil
+}
+
+// readsFrom applies the rules of Avro schema resolution, with this schema as
+// the reader and the older one as the writer
+func (s *avroSchema) readsFrom(old schemaValidator) error {
+	writer, ok := old.(*avroSchema)
+
+	if !ok {
+		return errors.New("the older schema isn't an Avro schema")
+	}
+
+	return avroResolve(s.root, writer.root, "", make(map[[2]*avroType]bool))
+}
+
+// Types the writer's can be promoted to when reading
+var avroPromotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+func avroResolve(reader *avroType, writer *avroType, at string, seen map[[2]*avroType]bool) error {
+	if writer.kind == "union" {
+		for _, branch := range writer.branches {
+			err := avroResolve(reader, branch, at, seen)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if reader.kind == "union" {
+		for _, branch := range reader.branches {
+			if avroResolve(branch, writer, at, seen) == nil {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s: no branch of the union reads %s", pointer(at), writer.branchName())
+	}
+
+	if reader.kind != writer.kind {
+		for _, promoted := range avroPromotions[writer.kind] {
+			if promoted == reader.kind {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s: %s can't be read as %s", pointer(at), writer.branchName(), reader.branchName())
+	}
+
+	if reader.name != "" && avroShortName(reader.name) != avroShortName(writer.name) {
+		return fmt.Errorf("%s: %s can't be read as %s", pointer(at), writer.name, reader.name)
+	}
+
+	switch reader.kind {
+	case "array", "map":
+		return avroResolve(reader.items, writer.items, at+"/"+reader.kind, seen)
+	case "fixed":
+		if reader.size != writer.size {
+			return fmt.Errorf("%s: the size of %s changed", pointer(at), reader.name)
+		}
+	case "enum":
+		if reader.hasDefault {
+			return nil
+		}
+
+		for _, symbol := range writer.symbols {
+			if !reader.hasSymbol(symbol) {
+				return fmt.Errorf("%s: symbol %s of %s was removed without a default", pointer(at), symbol, reader.name)
+			}
+		}
+	case "record":
+		pair := [2]*avroType{reader, writer}
+
+		// Recursive records are compatible if nothing else says otherwise
+		if seen[pair] {
+			return nil
+		}
+
+		seen[pair] = true
+
+		return avroResolveRecord(reader, writer, at, seen)
+	}
+
+	return nil
+}
+
+func avroResolveRecord(reader *avroType, writer *avroType, at string, seen map[[2]*avroType]bool) error {
+	written := make(map[string]avroField)
+
+	for _, field := range writer.fields {
+		written[field.name] = field
+	}
+
+	for _, field := range reader.fields {
+		previous, ok := written[field.name]
+
+		for _, alias := range field.aliases {
+			if !ok {
+				previous, ok = written[alias]
+			}
+		}
+
+		if !ok {
+			if !field.hasDefault {
+				return fmt.Errorf("%s: field %s of %s was added without a default", pointer(at), field.name, reader.name)
+			}
+
+			continue
+		}
+
+		err := avroResolve(field.typ, previous.typ, at+"/"+field.name, seen)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// Websocket subprotocol of /pushmsg connections that accept batches, sent as
+// binary frames. Text frames are still single messages
+const batchProtocol = "ws-go.batch"
+
+// Bytes before each message of a batch with its length
+const batchLengthSize = 4
+
+// batchConfig is how many messages the publisher puts together in a frame to
+// msgqueue, and for how long it waits for more before sending what it has
+type batchConfig struct {
+	MaxMessages int           `yaml:"max_messages"`
+	MaxBytes    int           `yaml:"max_bytes"`
+	Linger      time.Duration `yaml:"linger"`
+}
+
+func (c batchConfig) validate() error {
+	if c.MaxMessages < 1 {
+		return errors.New("batch max messages must be at least 1")
+	}
+
+	if c.MaxBytes < 1 {
+		return errors.New("batch max bytes must be at least 1")
+	}
+
+	if c.Linger < 0 {
+		return errors.New("batch linger can't be negative")
+	}
+
+	return nil
+}
+
+// Messages taken from thingsToPush that haven't been written yet, so drain
+// waits for the batch being filled
+var unpushed int32
+
+// encodeBatch writes every message after its length, as a big endian uint32
+func encodeBatch(batch [][]byte) []byte {
+	size := 0
+
+	for _, msg := range batch {
+		size += batchLengthSize + len(msg)
+	}
+
+	out := make([]byte, 0, size)
+	length := make([]byte, batchLengthSize)
+
+	for _, msg := range batch {
+		binary.BigEndian.PutUint32(length, uint32(len(msg)))
+		out = append(out, length...)
+		out = append(out, msg...)
+	}
+
+	return out
+}
+
+// collectBatch adds to the first message the ones that arrive before the linger
+// time passes, until the batch is full. A message that doesn't fit in max bytes
+// is returned to start the next batch
+func collectBatch(first []byte, settings batchConfig) ([][]byte, []byte) {
+	batch := [][]byte{first}
+	size := batchLengthSize + len(first)
+
+	if settings.MaxMessages == 1 {
+		return batch, nil
+	}
+
+	linger := time.NewTimer(settings.Linger)
+	defer linger.Stop()
+
+	for len(batch) < settings.MaxMessages {
+		select {
+		case msg := <-thingsToPush:
+			atomic.AddInt32(&unpushed, 1)
+
+			if size+batchLengthSize+len(msg) > settings.MaxBytes {
+				return batch, msg
+			}
+
+			batch = append(batch, msg)
+			size += batchLengthSize + len(msg)
+		case <-linger.C:
+			return batch, nil
+		}
+	}
+
+	return batch, nil
+}
+
+// pushBatch writes a batch to msgqueue, in a single text frame when it only has
+// one message. When it fails the connection is closed, so it's dialed again, and
+// the batch is kept to be pushed on the new one
+func pushBatch(conn *websocket.Conn, batch [][]byte) bool {
+	kind, frame := websocket.TextMessage, batch[0]
+
+	if len(batch) > 1 {
+		kind, frame = websocket.BinaryMessage, encodeBatch(batch)
+	}
+
+	start := time.Now()
+	conn.SetWriteDeadline(time.Now().Add(cfg.Upstream.WriteTimeout))
+	compression.MeterWrite(conn, len(frame))
+	err := conn.WriteMessage(kind, frame)
+	writeDuration.Observe(time.Since(start))
+
+	if err != nil {
+		logs.Warn("Error pushing messages, they're pushed again once msgqueue is back", "id", logging.MessageID(batch[0]), "count", len(batch), "error", err)
+		conn.Close()
+		return false
+	}
+
+	atomic.AddInt32(&unpushed, -int32(len(batch)))
+	pushed.Add(float64(len(batch)))
+
+	if len(batch) > 1 {
+		batches.Inc()
+	}
+
+	for _, msg := range batch {
+		logs.Sample().Debug("Pushing message", "id", logging.MessageID(msg), "size", len(msg), "payload", msg)
+	}
+
+	return true
+}
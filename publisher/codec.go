@@ -0,0 +1,7 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/codec"
+)
+
+type envelope = codec.Envelope
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Header of a message with the key a producer gives to every attempt to send
+// it. msgqueue drops the repeats and tells which message was queued instead
+const idempotencyHeader = "idempotency-key"
+
+// pushAck is what msgqueue answers for a message with an idempotency key, its
+// ID and the one of the message queued with the key, which differ for a repeat,
+// and for the end of a transaction, its status and the messages queued
+type pushAck struct {
+	ID          string
+	Original    string
+	Duplicate   bool
+	Transaction string
+	Status      string
+	Count       int
+}
+
+// waitKey is what the answer for a message or a transaction is awaited by
+func (a pushAck) waitKey() string {
+	if a.Transaction != "" {
+		return transactionWaitKey(a.Transaction)
+	}
+
+	return a.ID
+}
+
+// ackWaiters holds what's awaited from msgqueue: the messages with a key, by the
+// ID they were pushed with, and the transactions being ended
+type ackWaiters struct {
+	waiting map[string]func(pushAck)
+	mux     sync.Mutex
+}
+
+var acks = &ackWaiters{waiting: make(map[string]func(pushAck))}
+
+// expect calls done with the answer for a message, or with the message as its
+// own original if msgqueue doesn't answer in time
+func (a *ackWaiters) expect(id string, timeout time.Duration, done func(pushAck)) {
+	a.mux.Lock()
+	a.waiting[id] = done
+	a.mux.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		if done, ok := a.take(id); ok {
+			done(pushAck{ID: id, Original: id})
+		}
+	})
+}
+
+// take removes the waiter of a message, so it's only called once
+func (a *ackWaiters) take(id string) (func(pushAck), bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	done, ok := a.waiting[id]
+	delete(a.waiting, id)
+
+	return done, ok
+}
+
+// resolve hands the answers in a frame from msgqueue to whoever waits for them
+func (a *ackWaiters) resolve(frame []byte) {
+	var answers []pushAck
+	err := json.Unmarshal(frame, &answers)
+
+	if err != nil {
+		logs.Warn("Ignoring unexpected frame from msgqueue", "size", len(frame), "error", err)
+		return
+	}
+
+	for _, ack := range answers {
+		if ack.Duplicate {
+			duplicates.Inc()
+		}
+
+		if done, ok := a.take(ack.waitKey()); ok {
+			done(ack)
+		}
+	}
+}
+
+// await returns where the answer for id will be sent, which has to be asked
+// for before pushing what it's about
+func (a *ackWaiters) await(id string, timeout time.Duration) <-chan pushAck {
+	answer := make(chan pushAck, 1)
+
+	a.expect(id, timeout, func(ack pushAck) {
+		answer <- ack
+	})
+
+	return answer
+}
+
+// idempotencyKey returns the key of a message, if it's an envelope with one
+func idempotencyKey(msg []byte) string {
+	var m struct{ Headers map[string]string }
+	json.Unmarshal(msg, &m)
+
+	return m.Headers[idempotencyHeader]
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Nesting allowed when following $ref, so schemas that refer to themselves
+// can't loop forever
+const maxSchemaDepth = 64
+
+// jsonSchema is a JSON Schema (draft 7) that only refers to its own
+// definitions. Formats, if/then/else and the other keywords it doesn't know
+// are ignored, as the draft allows
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// decodeJSONNumbers decodes a JSON document keeping the numbers as they were
+// written, so large integers aren't rounded
+func decodeJSONNumbers(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	return value, nil
+}
+
+func compileJSONSchema(text string) (schemaValidator, error) {
+	root, err := decodeJSONNumbers([]byte(text))
+
+	if err != nil {
+		return nil, fmt.Errorf("the schema isn't JSON: %s", err)
+	}
+
+	s := &jsonSchema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	err = s.compile(root, "#")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// compile checks the keywords whose mistakes would only show when validating,
+// and compiles the regular expressions
+func (s *jsonSchema) compile(schema interface{}, at string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+
+	node, ok := schema.(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("%s: a schema must be an object or a boolean", at)
+	}
+
+	if ref, ok := node["$ref"]; ok {
+		text, isString := ref.(string)
+
+		if !isString {
+			return fmt.Errorf("%s: $ref must be a string", at)
+		}
+
+		_, err := s.resolve(text)
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", at, err)
+		}
+	}
+
+	for _, name := range typeNames(node) {
+		switch name {
+		case "null", "boolean", "integer", "number", "string", "array", "object":
+		default:
+			return fmt.Errorf("%s: unknown type %q", at, name)
+		}
+	}
+
+	if pattern, ok := node["pattern"].(string); ok {
+		compiled, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %s", at, err)
+		}
+
+		s.patterns[pattern] = compiled
+	}
+
+	for pattern := range mapKeyword(node, "patternProperties") {
+		compiled, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern property: %s", at, err)
+		}
+
+		s.patterns[pattern] = compiled
+	}
+
+	// Keywords whose value is a schema, items can also be a list of the schemas
+	// of each position
+	for _, keyword := range []string{"items", "additionalItems", "additionalProperties", "not", "contains", "propertyNames"} {
+		sub, ok := node[keyword]
+
+		if _, isList := sub.([]interface{}); !ok || (isList && keyword == "items") {
+			continue
+		}
+
+		err := s.compile(sub, at+"/"+keyword)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, keyword := range []string{"items", "allOf", "anyOf", "oneOf"} {
+		list, isList := node[keyword].([]interface{})
+
+		if _, ok := node[keyword]; ok && !isList && keyword != "items" {
+			return fmt.Errorf("%s: %s must be a list of schemas", at, keyword)
+		}
+
+		for i, item := range list {
+			err := s.compile(item, at+"/"+keyword+"/"+strconv.Itoa(i))
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range []string{"properties", "patternProperties", "definitions", "$defs"} {
+		for name, sub := range mapKeyword(node, keyword) {
+			err := s.compile(sub, at+"/"+keyword+"/"+name)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolve follows a reference to a part of the schema itself, written as a
+// JSON pointer after #
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only references within the schema are supported, not %q", ref)
+	}
+
+	node := s.root
+
+	for _, token := range strings.Split(ref, "/")[1:] {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+
+		switch parent := node.(type) {
+		case map[string]interface{}:
+			child, ok := parent[token]
+
+			if !ok {
+				return nil, fmt.Errorf("reference %q doesn't exist", ref)
+			}
+
+			node = child
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+
+			if err != nil || index < 0 || index >= len(parent) {
+				return nil, fmt.Errorf("reference %q doesn't exist", ref)
+			}
+
+			node = parent[index]
+		default:
+			return nil, fmt.Errorf("reference %q doesn't exist", ref)
+		}
+	}
+
+	return node, nil
+}
+
+func mapKeyword(node map[string]interface{}, keyword string) map[string]interface{} {
+	value, _ := node[keyword].(map[string]interface{})
+	return value
+}
+
+func listKeyword(node map[string]interface{}, keyword string) []interface{} {
+	value, _ := node[keyword].([]interface{})
+	return value
+}
+
+// typeNames returns the types of the type keyword, which can be a name or a list
+func typeNames(node map[string]interface{}) []string {
+	switch types := node["type"].(type) {
+	case string:
+		return []string{types}
+	case []interface{}:
+		names := make([]string, 0, len(types))
+
+		for _, name := range types {
+			text, _ := name.(string)
+			names = append(names, text)
+		}
+
+		return names
+	}
+
+	return nil
+}
+
+func jsonNumber(value interface{}) (float64, bool) {
+	number, ok := value.(json.Number)
+
+	if !ok {
+		return 0, false
+	}
+
+	f, err := number.Float64()
+
+	return f, err == nil
+}
+
+// isWhole tells whether a quotient has no fraction, allowing for the rounding
+// of floating point
+func isWhole(f float64) bool {
+	return math.Abs(f-math.Floor(f+0.5)) <= 1e-9
+}
+
+// jsonType names the type of a decoded value, numbers without fraction are integers
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if f, ok := jsonNumber(v); ok && f == math.Trunc(f) {
+			return "integer"
+		}
+
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+
+	return "object"
+}
+
+// equalJSON compares decoded values, numbers by their value
+func equalJSON(a interface{}, b interface{}) bool {
+	if x, ok := jsonNumber(a); ok {
+		y, ok := jsonNumber(b)
+		return ok && x == y
+	}
+
+	switch x := a.(type) {
+	case []interface{}:
+		y, ok := b.([]interface{})
+
+		if !ok || len(x) != len(y) {
+			return false
+		}
+
+		for i := range x {
+			if !equalJSON(x[i], y[i]) {
+				return false
+			}
+		}
+
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+
+		if !ok || len(x) != len(y) {
+			return false
+		}
+
+		for key, value := range x {
+			other, ok := y[key]
+
+			if !ok || !equalJSON(value, other) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return a == b
+}
+
+// pointer names where a value is for the errors, the payload itself is /
+func pointer(at string) string {
+	if at == "" {
+		return "/"
+	}
+
+	return at
+}
+
+func (s *jsonSchema) validate(payload []byte) error {
+	value, err := decodeJSONNumbers(payload)
+
+	if err != nil {
+		return fmt.Errorf("the payload isn't JSON: %s", err)
+	}
+
+	return s.check(s.root, value, "", 0)
+}
+
+// check validates a value against a part of the schema, at is the JSON pointer
+// of the value in the payload
+func (s *jsonSchema) check(schema interface{}, value interface{}, at string, depth int) error {
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: the schema nests too deep", pointer(at))
+	}
+
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			return fmt.Errorf("%s: no value is allowed", pointer(at))
+		}
+
+		return nil
+	}
+
+	node, _ := schema.(map[string]interface{})
+
+	// Other keywords next to $ref are ignored in draft 7
+	if ref, ok := node["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+
+		if err != nil {
+			return err
+		}
+
+		return s.check(target, value, at, depth+1)
+	}
+
+	kind := jsonType(value)
+
+	if types := typeNames(node); len(types) > 0 {
+		matched := false
+
+		for _, name := range types {
+			matched = matched || name == kind || (name == "number" && kind == "integer")
+		}
+
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", pointer(at), strings.Join(types, " or "), kind)
+		}
+	}
+
+	if options, ok := node["enum"].([]interface{}); ok {
+		matched := false
+
+		for _, option := range options {
+			matched = matched || equalJSON(option, value)
+		}
+
+		if !matched {
+			return fmt.Errorf("%s: the value isn't one of the allowed ones", pointer(at))
+		}
+	}
+
+	if constant, ok := node["const"]; ok && !equalJSON(constant, value) {
+		return fmt.Errorf("%s: the value isn't the allowed one", pointer(at))
+	}
+
+	var err error
+
+	switch v := value.(type) {
+	case json.Number:
+		err = s.checkNumber(node, v, at)
+	case string:
+		err = s.checkString(node, v, at)
+	case []interface{}:
+		err = s.checkArray(node, v, at, depth)
+	case map[string]interface{}:
+		err = s.checkObject(node, v, at, depth)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.checkCombinations(node, value, at, depth)
+}
+
+func (s *jsonSchema) checkNumber(node map[string]interface{}, number json.Number, at string) error {
+	value, _ := jsonNumber(number)
+
+	if limit, ok := jsonNumber(node["minimum"]); ok && value < limit {
+		return fmt.Errorf("%s: %s is less than the minimum %g", pointer(at), number, limit)
+	}
+
+	if limit, ok := jsonNumber(node["maximum"]); ok && value > limit {
+		return fmt.Errorf("%s: %s is more than the maximum %g", pointer(at), number, limit)
+	}
+
+	if limit, ok := jsonNumber(node["exclusiveMinimum"]); ok && value <= limit {
+		return fmt.Errorf("%s: %s must be more than %g", pointer(at), number, limit)
+	}
+
+	if limit, ok := jsonNumber(node["exclusiveMaximum"]); ok && value >= limit {
+		return fmt.Errorf("%s: %s must be less than %g", pointer(at), number, limit)
+	}
+
+	if divisor, ok := jsonNumber(node["multipleOf"]); ok && divisor > 0 {
+		if !isWhole(value / divisor) {
+			return fmt.Errorf("%s: %s isn't a multiple of %g", pointer(at), number, divisor)
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) checkString(node map[string]interface{}, value string, at string) error {
+	length := utf8.RuneCountInString(value)
+
+	if limit, ok := jsonNumber(node["minLength"]); ok && float64(length) < limit {
+		return fmt.Errorf("%s: the string is shorter than %g characters", pointer(at), limit)
+	}
+
+	if limit, ok := jsonNumber(node["maxLength"]); ok && float64(length) > limit {
+		return fmt.Errorf("%s: the string is longer than %g characters", pointer(at), limit)
+	}
+
+	if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+		return fmt.Errorf("%s: the string doesn't match %s", pointer(at), pattern)
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) checkArray(node map[string]interface{}, items []interface{}, at string, depth int) error {
+	if limit, ok := jsonNumber(node["minItems"]); ok && float64(len(items)) < limit {
+		return fmt.Errorf("%s: the array has less than %g items", pointer(at), limit)
+	}
+
+	if limit, ok := jsonNumber(node["maxItems"]); ok && float64(len(items)) > limit {
+		return fmt.Errorf("%s: the array has more than %g items", pointer(at), limit)
+	}
+
+	if unique, _ := node["uniqueItems"].(bool); unique {
+		for i := range items {
+			for j := i + 1; j < len(items); j++ {
+				if equalJSON(items[i], items[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", pointer(at), i, j)
+				}
+			}
+		}
+	}
+
+	for i, item := range items {
+		itemSchema, ok := node["items"]
+
+		// A list of schemas is checked position by position, the items after it
+		// with additionalItems
+		if tuple, isTuple := itemSchema.([]interface{}); isTuple {
+			itemSchema, ok = node["additionalItems"]
+
+			if i < len(tuple) {
+				itemSchema, ok = tuple[i], true
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		err := s.check(itemSchema, item, at+"/"+strconv.Itoa(i), depth+1)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if contains, ok := node["contains"]; ok {
+		for i, item := range items {
+			if s.check(contains, item, at+"/"+strconv.Itoa(i), depth+1) == nil {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s: no item matches contains", pointer(at))
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) checkObject(node map[string]interface{}, object map[string]interface{}, at string, depth int) error {
+	if limit, ok := jsonNumber(node["minProperties"]); ok && float64(len(object)) < limit {
+		return fmt.Errorf("%s: the object has less than %g properties", pointer(at), limit)
+	}
+
+	if limit, ok := jsonNumber(node["maxProperties"]); ok && float64(len(object)) > limit {
+		return fmt.Errorf("%s: the object has more than %g properties", pointer(at), limit)
+	}
+
+	for _, name := range listKeyword(node, "required") {
+		if property, _ := name.(string); property != "" {
+			if _, ok := object[property]; !ok {
+				return fmt.Errorf("%s: missing required property %q", pointer(at), property)
+			}
+		}
+	}
+
+	properties := mapKeyword(node, "properties")
+	patterns := mapKeyword(node, "patternProperties")
+
+	for _, name := range sortedKeys(object) {
+		value := object[name]
+		described := false
+
+		if propertyNames, ok := node["propertyNames"]; ok {
+			err := s.check(propertyNames, name, at+"/"+name, depth+1)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if property, ok := properties[name]; ok {
+			described = true
+			err := s.check(property, value, at+"/"+name, depth+1)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for pattern, property := range patterns {
+			if s.patterns[pattern].MatchString(name) {
+				described = true
+				err := s.check(property, value, at+"/"+name, depth+1)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if additional, ok := node["additionalProperties"]; ok && !described {
+			if allowed, isBool := additional.(bool); isBool && !allowed {
+				return fmt.Errorf("%s: property %q isn't allowed", pointer(at), name)
+			}
+
+			err := s.check(additional, value, at+"/"+name, depth+1)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) checkCombinations(node map[string]interface{}, value interface{}, at string, depth int) error {
+	for _, sub := range listKeyword(node, "allOf") {
+		err := s.check(sub, value, at, depth+1)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if options := listKeyword(node, "anyOf"); len(options) > 0 {
+		matched := false
+
+		for _, sub := range options {
+			matched = matched || s.check(sub, value, at, depth+1) == nil
+		}
+
+		if !matched {
+			return fmt.Errorf("%s: the value matches none of anyOf", pointer(at))
+		}
+	}
+
+	if options := listKeyword(node, "oneOf"); len(options) > 0 {
+		matches := 0
+
+		for _, sub := range options {
+			if s.check(sub, value, at, depth+1) == nil {
+				matches++
+			}
+		}
+
+		if matches != 1 {
+			return fmt.Errorf("%s: the value matches %d of oneOf instead of one", pointer(at), matches)
+		}
+	}
+
+	if not, ok := node["not"]; ok && s.check(not, value, at, depth+1) == nil {
+		return fmt.Errorf("%s: the value matches not", pointer(at))
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of an object in order
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+
+	for key := range object {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// readsFrom tells whether every payload valid under the older schema is valid
+// under this one. It's a conservative comparison of the structure: keywords
+// it can't compare have to be left as they were. Optional properties can be
+// added even when the older schema allowed any other property, as payloads
+// aren't expected to have properties that weren't described
+func (s *jsonSchema) readsFrom(old schemaValidator) error {
+	writer, ok := old.(*jsonSchema)
+
+	if !ok {
+		return errors.New("the older schema isn't a JSON schema")
+	}
+
+	return jsonCompatibility{reader: s, writer: writer}.check(s.root, writer.root, "", 0)
+}
+
+type jsonCompatibility struct {
+	reader *jsonSchema
+	writer *jsonSchema
+}
+
+// deref follows the references of a part of a schema
+func deref(s *jsonSchema, schema interface{}, depth int) (map[string]interface{}, bool, error) {
+	for ; depth <= maxSchemaDepth; depth++ {
+		switch node := schema.(type) {
+		case bool:
+			if node {
+				return map[string]interface{}{}, true, nil
+			}
+
+			return nil, false, nil
+		case map[string]interface{}:
+			ref, ok := node["$ref"].(string)
+
+			if !ok {
+				return node, true, nil
+			}
+
+			target, err := s.resolve(ref)
+
+			if err != nil {
+				return nil, false, err
+			}
+
+			schema = target
+		default:
+			return nil, false, errors.New("invalid schema")
+		}
+	}
+
+	return nil, false, errors.New("the schema nests too deep")
+}
+
+// check tells whether every value accepted by the writer part is accepted by
+// the reader one
+func (c jsonCompatibility) check(reader interface{}, writer interface{}, at string, depth int) error {
+	if depth > maxSchemaDepth {
+		return nil
+	}
+
+	r, readerAllows, err := deref(c.reader, reader, depth)
+
+	if err != nil {
+		return err
+	}
+
+	w, writerAllows, err := deref(c.writer, writer, depth)
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !writerAllows || (readerAllows && len(r) == 0) || reflect.DeepEqual(r, w):
+		return nil
+	case !readerAllows:
+		return fmt.Errorf("%s: no value is allowed anymore", pointer(at))
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf", "not", "if", "then", "else", "patternProperties", "dependencies", "propertyNames", "contains", "additionalItems", "pattern", "format"} {
+		if value, ok := r[keyword]; ok && !reflect.DeepEqual(value, w[keyword]) {
+			return fmt.Errorf("%s: %s changed", pointer(at), keyword)
+		}
+	}
+
+	err = c.checkValues(r, w, at)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.checkLimits(r, w, at)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.checkProperties(r, w, at, depth)
+
+	if err != nil {
+		return err
+	}
+
+	readerItems, ok := r["items"]
+
+	if !ok {
+		return nil
+	}
+
+	writerItems, ok := w["items"]
+
+	if !ok {
+		writerItems = true
+	}
+
+	_, readerTuple := readerItems.([]interface{})
+	_, writerTuple := writerItems.([]interface{})
+
+	if readerTuple || writerTuple {
+		if !reflect.DeepEqual(readerItems, writerItems) {
+			return fmt.Errorf("%s: items changed", pointer(at))
+		}
+
+		return nil
+	}
+
+	return c.check(readerItems, writerItems, at+"/items", depth+1)
+}
+
+// checkValues compares the types and the allowed values
+func (c jsonCompatibility) checkValues(r map[string]interface{}, w map[string]interface{}, at string) error {
+	if readerTypes := typeNames(r); len(readerTypes) > 0 {
+		writerTypes := typeNames(w)
+
+		if len(writerTypes) == 0 {
+			return fmt.Errorf("%s: only %s is accepted now", pointer(at), strings.Join(readerTypes, " or "))
+		}
+
+		for _, writerType := range writerTypes {
+			accepted := false
+
+			for _, readerType := range readerTypes {
+				accepted = accepted || readerType == writerType || (readerType == "number" && writerType == "integer")
+			}
+
+			if !accepted {
+				return fmt.Errorf("%s: %s isn't accepted anymore", pointer(at), writerType)
+			}
+		}
+	}
+
+	allowed := func(node map[string]interface{}) ([]interface{}, bool) {
+		if constant, ok := node["const"]; ok {
+			return []interface{}{constant}, true
+		}
+
+		options, ok := node["enum"].([]interface{})
+
+		return options, ok
+	}
+
+	readerValues, restricted := allowed(r)
+
+	if !restricted {
+		return nil
+	}
+
+	writerValues, ok := allowed(w)
+
+	if !ok {
+		return fmt.Errorf("%s: the values are restricted now", pointer(at))
+	}
+
+	for _, value := range writerValues {
+		found := false
+
+		for _, option := range readerValues {
+			found = found || equalJSON(value, option)
+		}
+
+		if !found {
+			return fmt.Errorf("%s: a value that was allowed isn't anymore", pointer(at))
+		}
+	}
+
+	return nil
+}
+
+// checkLimits compares the bounds of numbers, strings, arrays and objects, the
+// reader can't be narrower than the writer
+func (c jsonCompatibility) checkLimits(r map[string]interface{}, w map[string]interface{}, at string) error {
+	for _, keyword := range []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"} {
+		if limit, ok := jsonNumber(r[keyword]); ok {
+			if previous, ok := jsonNumber(w[keyword]); !ok || previous < limit {
+				return fmt.Errorf("%s: %s was raised", pointer(at), keyword)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"} {
+		if limit, ok := jsonNumber(r[keyword]); ok {
+			if previous, ok := jsonNumber(w[keyword]); !ok || previous > limit {
+				return fmt.Errorf("%s: %s was lowered", pointer(at), keyword)
+			}
+		}
+	}
+
+	if divisor, ok := jsonNumber(r["multipleOf"]); ok {
+		if previous, ok := jsonNumber(w["multipleOf"]); !ok || !isWhole(previous/divisor) {
+			return fmt.Errorf("%s: multipleOf changed", pointer(at))
+		}
+	}
+
+	if unique, _ := r["uniqueItems"].(bool); unique {
+		if previous, _ := w["uniqueItems"].(bool); !previous {
+			return fmt.Errorf("%s: items must be unique now", pointer(at))
+		}
+	}
+
+	return nil
+}
+
+func (c jsonCompatibility) checkProperties(r map[string]interface{}, w map[string]interface{}, at string, depth int) error {
+	required := make(map[string]bool)
+
+	for _, name := range listKeyword(w, "required") {
+		if property, ok := name.(string); ok {
+			required[property] = true
+		}
+	}
+
+	for _, name := range listKeyword(r, "required") {
+		if property, ok := name.(string); ok && !required[property] {
+			return fmt.Errorf("%s: property %q is required now", pointer(at), property)
+		}
+	}
+
+	readerProperties := mapKeyword(r, "properties")
+	writerProperties := mapKeyword(w, "properties")
+	// Properties that aren't described are allowed when additionalProperties
+	// is missing or true
+	readerAdditional, readerRestricts := r["additionalProperties"]
+	writerAdditional, writerRestricts := w["additionalProperties"]
+	readerRestricts = readerRestricts && readerAdditional != true
+	writerRestricts = writerRestricts && writerAdditional != true
+
+	for _, name := range sortedKeys(readerProperties) {
+		property := readerProperties[name]
+
+		if previous, ok := writerProperties[name]; ok {
+			err := c.check(property, previous, at+"/"+name, depth+1)
+
+			if err != nil {
+				return err
+			}
+		} else if writerRestricts {
+			err := c.check(property, writerAdditional, at+"/"+name, depth+1)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !readerRestricts {
+		return nil
+	}
+
+	for _, name := range sortedKeys(writerProperties) {
+		if _, ok := readerProperties[name]; !ok {
+			err := c.check(readerAdditional, writerProperties[name], at+"/"+name, depth+1)
+
+			if err != nil {
+				return fmt.Errorf("%s: property %q isn't accepted anymore: %s", pointer(at), name, err)
+			}
+		}
+	}
+
+	if !writerRestricts {
+		writerAdditional = true
+	}
+
+	err := c.check(readerAdditional, writerAdditional, at, depth+1)
+
+	if err != nil {
+		return fmt.Errorf("%s: other properties aren't accepted anymore", pointer(at))
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/logging"
+)
+
+type logger = logging.Logger
+
+var logs = logging.New("publisher")
+
+// logSettings picks the logging options out of the configuration
+func (c config) logSettings() logging.Settings {
+	return logging.Settings{
+		Level:            c.LogLevel,
+		Format:           c.LogFormat,
+		Output:           c.LogOutput,
+		Payloads:         c.LogPayloads,
+		SampleInitial:    c.LogSampleInitial,
+		SampleThereafter: c.LogSampleThereafter,
+	}
+}
+
+// reloadLogs applies the logging settings again on SIGHUP, reading the
+// configuration with the same arguments
+func reloadLogs(args []string) {
+	logs.Reload(func() (logging.Settings, error) {
+		c, _, err := loadConfig(args)
+
+		return c.logSettings(), err
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"strconv"
+	"sync"
+)
+
+// topicLabels bounds the number of different topics used as label values, the
+// ones seen once the limit is reached are reported as "other"
+type topicLabels struct {
+	seen map[string]bool
+	mux  sync.Mutex
+}
+
+var topics = topicLabels{seen: make(map[string]bool)}
+
+func (t *topicLabels) label(topic string) string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.seen[topic] {
+		return topic
+	}
+
+	if len(t.seen) >= cfg.MetricsMaxTopics {
+		return "other"
+	}
+
+	t.seen[topic] = true
+
+	return topic
+}
+
+var (
+	received           = metrics.NewCounterVec("publisher_messages_received_total", "Messages received on /publish by topic", "topic")
+	pushed             = metrics.NewCounterVec("publisher_messages_pushed_total", "Messages pushed to msgqueue")
+	batches            = metrics.NewCounterVec("publisher_batches_pushed_total", "Frames to msgqueue with more than one message")
+	dropped            = metrics.NewCounterVec("publisher_messages_dropped_total", "Messages lost by reason", "reason")
+	duplicates         = metrics.NewCounterVec("publisher_duplicates_total", "Messages msgqueue dropped as repeats of one with the same idempotency key")
+	transactions       = metrics.NewCounterVec("publisher_transactions_total", "Transactions ended by how they ended: committed, aborted, unknown to msgqueue, unconfirmed or abandoned by the client", "result")
+	requests           = metrics.NewCounterVec("publisher_requests_total", "Messages with a reply-to inbox by whether they were accepted or refused as invalid", "result")
+	rejected           = metrics.NewCounterVec("publisher_messages_rejected_total", "Messages refused because they don't match the schema of their topic", "topic")
+	authFailures       = metrics.NewCounterVec("publisher_auth_failures_total", "Rejected credentials by endpoint", "endpoint")
+	compressionBytes   = metrics.NewCounterVec("publisher_compression_bytes_total", "Size of the messages written to compressed websockets and bytes written for them, by endpoint", "endpoint", "stage")
+	compressedMessages = metrics.NewCounterVec("publisher_compression_messages_total", "Messages written to compressed websockets by endpoint and whether they were compressed", "endpoint", "compressed")
+	writeDuration      = metrics.NewHistogram("publisher_write_duration_seconds", "Time taken to push a message to msgqueue", metrics.LatencyBuckets)
+)
+
+func init() {
+	compression.CountBytes = func(size int, endpoint string, stage string) {
+		compressionBytes.Add(float64(size), endpoint, stage)
+	}
+	compression.CountMessage = func(endpoint string, compressed bool) {
+		compressedMessages.Inc(endpoint, strconv.FormatBool(compressed))
+	}
+	metrics.NewGaugeFunc("publisher_queue_depth", "Messages waiting to be pushed to msgqueue", "", func() map[string]float64 {
+		return map[string]float64{"": float64(len(thingsToPush))}
+	})
+	metrics.NewGaugeFunc("publisher_queue_capacity", "Messages that can wait to be pushed to msgqueue", "", func() map[string]float64 {
+		return map[string]float64{"": float64(cap(thingsToPush))}
+	})
+	metrics.NewGaugeFunc("publisher_connections_active", "Open websockets by endpoint", "endpoint", func() map[string]float64 {
+		return map[string]float64{"/publish": float64(clients.Count())}
+	})
+}
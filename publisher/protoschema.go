@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Wire types of protobuf fields
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Wire type of each scalar type, enums are varints and messages bytes
+var protoScalars = map[string]int{
+	"int32": wireVarint, "int64": wireVarint, "uint32": wireVarint, "uint64": wireVarint,
+	"sint32": wireVarint, "sint64": wireVarint, "bool": wireVarint,
+	"fixed64": wireFixed64, "sfixed64": wireFixed64, "double": wireFixed64,
+	"string": wireBytes, "bytes": wireBytes,
+	"fixed32": wireFixed32, "sfixed32": wireFixed32, "float": wireFixed32,
+}
+
+// Types whose values can be read as each other's, as the protobuf
+// documentation lists them
+var protoFamilies = map[string]string{
+	"int32": "varint", "int64": "varint", "uint32": "varint", "uint64": "varint", "bool": "varint", "enum": "varint",
+	"sint32": "zigzag", "sint64": "zigzag",
+	"string": "bytes", "bytes": "bytes",
+	"fixed32": "fixed32", "sfixed32": "fixed32",
+	"fixed64": "fixed64", "sfixed64": "fixed64",
+	"float": "float", "double": "double",
+	"message": "message",
+}
+
+type protoField struct {
+	name     string
+	number   int
+	typeName string
+	repeated bool
+	required bool
+
+	// kind is the scalar type, "enum" or "message"
+	kind    string
+	message *protoMessage
+}
+
+type protoMessage struct {
+	name   string
+	fields map[int]*protoField
+}
+
+// protoSchema is a .proto file without imports, payloads are checked against
+// its first message. Unknown fields are allowed, as protobuf keeps them
+type protoSchema struct {
+	root   *protoMessage
+	proto3 bool
+}
+
+// protoParser reads the tokens of a .proto file
+type protoParser struct {
+	tokens   []string
+	pos      int
+	pkg      string
+	proto3   bool
+	messages map[string]*protoMessage
+	enums    map[string]bool
+	order    []*protoMessage
+}
+
+func tokenizeProto(text string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(text[i:], "//"):
+			end := strings.IndexByte(text[i:], '\n')
+
+			if end < 0 {
+				end = len(text) - i
+			}
+
+			i += end
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+
+			i += end + 4
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], c)
+
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+
+			tokens = append(tokens, text[i:i+end+2])
+			i += end + 2
+		case c == '_' || c == '.' || c == '-' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			start := i
+
+			for i < len(text) && (text[i] == '_' || text[i] == '.' || text[i] == '-' || unicode.IsLetter(rune(text[i])) || unicode.IsDigit(rune(text[i]))) {
+				i++
+			}
+
+			tokens = append(tokens, text[start:i])
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	p.pos++
+
+	return p.tokens[p.pos-1]
+}
+
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+
+	return nil
+}
+
+// skipStatement skips to the end of a statement, or of the block it opens
+func (p *protoParser) skipStatement() error {
+	depth := 0
+
+	for {
+		switch p.next() {
+		case "":
+			return errors.New("unexpected end of the file")
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth == 0 {
+				return nil
+			}
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func compileProtoSchema(text string) (schemaValidator, error) {
+	tokens, err := tokenizeProto(text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &protoParser{tokens: tokens, messages: make(map[string]*protoMessage), enums: make(map[string]bool)}
+	err = p.parseFile()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.order) == 0 {
+		return nil, errors.New("the schema has no message")
+	}
+
+	for _, message := range p.order {
+		for _, field := range message.fields {
+			err := p.resolve(message, field)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &protoSchema{root: p.order[0], proto3: p.proto3}, nil
+}
+
+func (p *protoParser) parseFile() error {
+	for p.peek() != "" {
+		var err error
+
+		switch p.next() {
+		case "syntax":
+			if err = p.expect("="); err == nil {
+				p.proto3 = strings.Trim(p.next(), `"'`) == "proto3"
+				err = p.expect(";")
+			}
+		case "package":
+			p.pkg = p.next()
+			err = p.expect(";")
+		case "import":
+			err = errors.New("imports aren't supported, the schema must have every message it uses")
+		case "message":
+			_, err = p.parseMessage(p.pkg)
+		case "enum":
+			err = p.parseEnum(p.pkg)
+		case "option", "service", "extend":
+			err = p.skipStatement()
+		case ";":
+		default:
+			err = fmt.Errorf("unexpected %q", p.tokens[p.pos-1])
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func qualify(scope string, name string) string {
+	if scope == "" {
+		return name
+	}
+
+	return scope + "." + name
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	p.enums[qualify(scope, p.next())] = true
+
+	return p.skipStatement()
+}
+
+func (p *protoParser) parseMessage(scope string) (*protoMessage, error) {
+	message := &protoMessage{name: qualify(scope, p.next()), fields: make(map[int]*protoField)}
+	p.messages[message.name] = message
+	p.order = append(p.order, message)
+
+	err := p.expect("{")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return message, p.parseBody(message, false)
+}
+
+// parseBody reads the fields and nested types of a message, or of one of its
+// oneofs until the closing brace
+func (p *protoParser) parseBody(message *protoMessage, oneof bool) error {
+	for {
+		var err error
+		token := p.next()
+
+		switch token {
+		case "":
+			return errors.New("unexpected end of the file")
+		case "}":
+			return nil
+		case ";":
+		case "message":
+			_, err = p.parseMessage(message.name)
+		case "enum":
+			err = p.parseEnum(message.name)
+		case "option", "reserved", "extensions", "extend":
+			err = p.skipStatement()
+		case "oneof":
+			p.next()
+
+			if err = p.expect("{"); err == nil {
+				err = p.parseBody(message, true)
+			}
+		case "map":
+			if err = p.parseMap(message); err != nil {
+				err = fmt.Errorf("%s: %s", message.name, err)
+			}
+		default:
+			p.pos--
+
+			if err = p.parseField(message, oneof); err != nil {
+				err = fmt.Errorf("%s: %s", message.name, err)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseField reads [label] type name = number [options];
+func (p *protoParser) parseField(message *protoMessage, oneof bool) error {
+	field := &protoField{}
+
+	switch p.peek() {
+	case "repeated", "optional", "required":
+		if oneof {
+			return errors.New("fields of a oneof can't have a label")
+		}
+
+		label := p.next()
+		field.repeated = label == "repeated"
+		field.required = label == "required"
+	}
+
+	field.typeName = p.next()
+	field.name = p.next()
+
+	return p.finishField(message, field)
+}
+
+// parseMap reads map<key, value> name = number, which is written as a repeated
+// entry with the key in field 1 and the value in field 2
+func (p *protoParser) parseMap(message *protoMessage) error {
+	err := p.expect("<")
+
+	if err != nil {
+		return err
+	}
+
+	key := p.next()
+
+	if err = p.expect(","); err != nil {
+		return err
+	}
+
+	value := p.next()
+
+	if err = p.expect(">"); err != nil {
+		return err
+	}
+
+	field := &protoField{name: p.next(), repeated: true, kind: "message"}
+	field.message = &protoMessage{name: qualify(message.name, field.name+"Entry"), fields: map[int]*protoField{
+		1: {name: "key", number: 1, typeName: key},
+		2: {name: "value", number: 2, typeName: value},
+	}}
+	p.order = append(p.order, field.message)
+
+	return p.finishField(message, field)
+}
+
+func (p *protoParser) finishField(message *protoMessage, field *protoField) error {
+	err := p.expect("=")
+
+	if err != nil {
+		return err
+	}
+
+	number, err := strconv.Atoi(p.next())
+
+	if err != nil || number < 1 || number > 1<<29-1 {
+		return fmt.Errorf("invalid number for field %s", field.name)
+	}
+
+	field.number = number
+
+	if p.peek() == "[" {
+		for p.next() != "]" {
+			if p.peek() == "" {
+				return errors.New("unexpected end of the file")
+			}
+		}
+	}
+
+	if _, exists := message.fields[number]; exists {
+		return fmt.Errorf("field number %d is used twice", number)
+	}
+
+	message.fields[number] = field
+
+	return p.expect(";")
+}
+
+// resolve finds the type of a field, names are looked up from the scope of the
+// message outwards as protoc does
+func (p *protoParser) resolve(message *protoMessage, field *protoField) error {
+	if field.kind != "" {
+		return nil
+	}
+
+	if _, ok := protoScalars[field.typeName]; ok {
+		field.kind = field.typeName
+		return nil
+	}
+
+	candidates := []string{strings.TrimPrefix(field.typeName, ".")}
+
+	if !strings.HasPrefix(field.typeName, ".") {
+		candidates = nil
+
+		for scope := message.name; ; scope = scope[:strings.LastIndex(scope, ".")] {
+			candidates = append(candidates, qualify(scope, field.typeName))
+
+			if !strings.Contains(scope, ".") {
+				break
+			}
+		}
+
+		candidates = append(candidates, field.typeName)
+	}
+
+	for _, name := range candidates {
+		if nested, ok := p.messages[name]; ok {
+			field.kind, field.message = "message", nested
+			return nil
+		}
+
+		if p.enums[name] {
+			field.kind = "enum"
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: unknown type %s of field %s", message.name, field.typeName, field.name)
+}
+
+// wireType is the wire type of the values of a field when they aren't packed
+func (f *protoField) wireType() int {
+	if wire, ok := protoScalars[f.kind]; ok {
+		return wire
+	}
+
+	if f.kind == "enum" {
+		return wireVarint
+	}
+
+	return wireBytes
+}
+
+// readWireValue splits the value of a field of the given wire type from the
+// rest of the message
+func readWireValue(data []byte, wire int) ([]byte, []byte, error) {
+	size := 0
+
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return nil, nil, errors.New("truncated varint")
+		}
+
+		size = n
+	case wireFixed64:
+		size = 8
+	case wireFixed32:
+		size = 4
+	case wireBytes:
+		length, n := binary.Uvarint(data)
+
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, nil, errors.New("truncated length delimited value")
+		}
+
+		data = data[n:]
+		size = int(length)
+	default:
+		return nil, nil, fmt.Errorf("unsupported wire type %d", wire)
+	}
+
+	if size > len(data) {
+		return nil, nil, errors.New("truncated value")
+	}
+
+	return data[:size], data[size:], nil
+}
+
+func (s *protoSchema) validate(payload []byte) error {
+	return s.check(s.root, payload, "", 0)
+}
+
+func (s *protoSchema) check(message *protoMessage, data []byte, at string, depth int) error {
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: the message nests too deep", pointer(at))
+	}
+
+	seen := make(map[int]bool)
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+
+		if n <= 0 {
+			return fmt.Errorf("%s: truncated field key", pointer(at))
+		}
+
+		wire := int(key & 7)
+		value, rest, err := readWireValue(data[n:], wire)
+
+		if err != nil {
+			return fmt.Errorf("%s: field %d: %s", pointer(at), key>>3, err)
+		}
+
+		data = rest
+		field, ok := message.fields[int(key>>3)]
+
+		if !ok {
+			continue
+		}
+
+		seen[field.number] = true
+		fieldAt := at + "/" + field.name
+		expected := field.wireType()
+
+		switch {
+		case wire == expected:
+		case field.repeated && wire == wireBytes && expected != wireBytes:
+			// Packed repeated scalars are a run of values in a single field
+			for packed := value; len(packed) > 0; {
+				_, packed, err = readWireValue(packed, expected)
+
+				if err != nil {
+					return fmt.Errorf("%s: %s", pointer(fieldAt), err)
+				}
+			}
+
+			continue
+		default:
+			return fmt.Errorf("%s: wire type %d doesn't match %s", pointer(fieldAt), wire, field.typeName)
+		}
+
+		if field.kind == "string" && s.proto3 && !utf8.Valid(value) {
+			return fmt.Errorf("%s: the string isn't valid UTF-8", pointer(fieldAt))
+		}
+
+		if field.kind == "message" {
+			err := s.check(field.message, value, fieldAt, depth+1)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for number := range message.fields {
+		if field := message.fields[number]; field.required && !seen[number] {
+			return fmt.Errorf("%s: missing required field %s", pointer(at), field.name)
+		}
+	}
+
+	return nil
+}
+
+// readsFrom compares the fields with the same number of both schemas, which
+// have to keep types whose values can be read as each other's. Fields can be
+// added and removed, but new ones can't be required
+func (s *protoSchema) readsFrom(old schemaValidator) error {
+	writer, ok := old.(*protoSchema)
+
+	if !ok {
+		return errors.New("the older schema isn't a protobuf schema")
+	}
+
+	return protoCompatibility(s.root, writer.root, "", make(map[[2]*protoMessage]bool))
+}
+
+func protoCompatibility(reader *protoMessage, writer *protoMessage, at string, seen map[[2]*protoMessage]bool) error {
+	pair := [2]*protoMessage{reader, writer}
+
+	if seen[pair] {
+		return nil
+	}
+
+	seen[pair] = true
+
+	numbers := make([]int, 0, len(reader.fields))
+
+	for number := range reader.fields {
+		numbers = append(numbers, number)
+	}
+
+	sort.Ints(numbers)
+
+	for _, number := range numbers {
+		field := reader.fields[number]
+		fieldAt := at + "/" + field.name
+		previous, ok := writer.fields[number]
+
+		if !ok {
+			if field.required {
+				return fmt.Errorf("%s: required field %d was added", pointer(fieldAt), number)
+			}
+
+			continue
+		}
+
+		if protoFamilies[field.kind] != protoFamilies[previous.kind] {
+			return fmt.Errorf("%s: field %d changed from %s to %s", pointer(fieldAt), number, previous.typeName, field.typeName)
+		}
+
+		// Only strings, bytes and messages can change between single and repeated
+		if field.repeated != previous.repeated && protoFamilies[field.kind] != "bytes" && field.kind != "message" {
+			return fmt.Errorf("%s: field %d changed between single and repeated", pointer(fieldAt), number)
+		}
+
+		if field.required && !previous.required {
+			return fmt.Errorf("%s: field %d became required", pointer(fieldAt), number)
+		}
+
+		if field.kind == "message" {
+			err := protoCompatibility(field.message, previous.message, fieldAt, seen)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
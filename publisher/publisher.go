@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
-	"fmt"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/codec"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/Javivi/ws-go/internal/tracing"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"sync/atomic"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    append([]string{stompProtocol}, codec.Names...),
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -20,94 +39,514 @@ var upgrader = websocket.Upgrader{
 
 var thingsToPush = make(chan []byte, 10)
 
+// Client certificate and CA used when dialing to other services
+var clientCerts = certstore.New(os.Getenv("WS_CERT_DIR"), certstore.ClientCertFile, certstore.ClientKeyFile, false, logs)
+
 func main() {
-	pushConn, err := dialToService("localhost:8080", "/pushmsg", "hello", "test")
+	c, printOnly, err := loadConfig(os.Args[1:])
+
+	if err == flag.ErrHelp {
+		return
+	}
+
+	if err != nil {
+		logs.Error("Error loading configuration", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	if printOnly {
+		err = printConfig(c)
+
+		if err != nil {
+			logs.Error("Error printing configuration", "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		return
+	}
+
+	applyConfig(c)
+	err = logging.Configure(c.logSettings())
 
 	if err != nil {
-		fmt.Printf("[publisher] Error dialing server\n%s", err)
-		os.Exit(1)
+		logs.Error("Error configuring logs", "error", err)
+		os.Exit(shutdown.ExitConfig)
 	}
 
-	go pushMessages(pushConn)
+	err = tracing.Configure(c.traceSettings(), logs)
+
+	if err != nil {
+		logs.Error("Error configuring tracing", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
 
-	err = initServer("localhost:8081", os.Getenv("WS_CERT_DIR"), nil)
+	err = schemas.load(cfg.Schemas.File)
 
 	if err != nil {
-		fmt.Printf("[publisher] Error initialising server\n%s", err)
-		os.Exit(1)
+		logs.Error("Error loading the schema registry", "file", cfg.Schemas.File, "error", err)
+		os.Exit(shutdown.ExitConfig)
 	}
+
+	go reloadLogs(os.Args[1:])
+	pushConn, err := dialToService(cfg.Upstream.Addr, "/pushmsg", cfg.Upstream.Username, cfg.Upstream.Password, cfg.Upstream.Compression, batchProtocol)
+
+	if err != nil {
+		logs.Error("Error dialing server", "upstream", cfg.Upstream.Addr, "error", err)
+		os.Exit(shutdown.ExitError)
+	}
+
+	if cfg.SpoolFile != "" {
+		restored, err := shutdown.Restore(cfg.SpoolFile, func([]byte) chan []byte { return thingsToPush })
+
+		if err != nil {
+			logs.Error("Error restoring spooled messages", "file", cfg.SpoolFile, "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		if restored > 0 {
+			logs.Info("Restored spooled messages", "file", cfg.SpoolFile, "count", restored)
+		}
+	}
+
+	go maintainUpstream(pushConn)
+	go pushMessages()
+	go shutdown.HandleSignals(stopping, &stopDeadline, cfg.ShutdownTimeout, logs)
+
+	if cfg.Admin.Listen != "" {
+		go func() {
+			err := initAdmin(cfg.Admin.Listen, cfg.CertDir, nil)
+
+			if err != nil {
+				logs.Error("Error initialising admin API", "error", err)
+				os.Exit(shutdown.ExitError)
+			}
+		}()
+	}
+
+	err = initServer(cfg.Listen, cfg.CertDir, nil)
+
+	if err != nil {
+		logs.Error("Error initialising server", "error", err)
+		os.Exit(shutdown.ExitError)
+	}
+
+	status := drain()
+	tracing.Flush()
+	os.Exit(status)
 }
 
-func dialToService(addr string, path string, username string, password string) (*websocket.Conn, error) {
-	serviceURL := url.URL{Scheme: "wss", Host: addr, Path: path}
+// dialToService opens a websocket to another service, compressed when the
+// settings and the service allow it, offering the given subprotocols. TLS is set
+// up when dialing, instead of by the websocket dialer, so the connection metered
+// is the one under the frames
+func dialToService(addr string, path string, username string, password string, settings compression.Config, subprotocols ...string) (*websocket.Conn, error) {
+	serviceURL := url.URL{Scheme: "ws", Host: addr, Path: path}
 	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = settings.Enabled
+	dialer.Subprotocols = subprotocols
+	var metered *compression.MeteredConn
+
+	dialer.NetDial = func(network string, address string) (net.Conn, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialer.HandshakeTimeout}, network, address, clientCerts.ClientConfig())
 
-	serviceConn, _, err := websocket.DefaultDialer.Dial(serviceURL.String(), authHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		metered = &compression.MeteredConn{Conn: conn}
+
+		return metered, nil
+	}
+
+	serviceConn, response, err := dialer.Dial(serviceURL.String(), authHeader)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if settings.Enabled && compression.Offered(response.Header) {
+		compression.Start(serviceConn, metered, path, settings)
+	}
+
 	return serviceConn, nil
 }
 
-func pushMessages(conn *websocket.Conn) {
+// pushMessages pushes the queued messages to msgqueue in batches. While the
+// connection is being dialed again nothing is taken from the queue, and the batch
+// that couldn't be written is pushed again on the new one. On shutdown it hands
+// the messages it holds to drain
+func pushMessages() {
+	var batch [][]byte
+	var next []byte
+
 	for {
 		select {
-		case msg := <-thingsToPush:
-			err := conn.WriteMessage(websocket.TextMessage, msg)
+		case <-stopPushing:
+			if next != nil {
+				batch = append(batch, next)
+			}
 
-			if err != nil {
-				fmt.Printf("[publisher] Error sending msg: %s\n%s", msg, err)
-				continue
+			leftover <- batch
+			return
+		default:
+		}
+
+		conn, reconnected := upstream.current()
+
+		if conn == nil {
+			select {
+			case <-reconnected:
+			case <-stopPushing:
+			}
+
+			continue
+		}
+
+		settings := cfg.Upstream.Batch
+
+		// msgqueue versions without batches get every message on its own
+		if conn.Subprotocol() != batchProtocol {
+			settings.MaxMessages = 1
+		}
+
+		if batch != nil {
+			if pushBatch(conn, batch) {
+				batch = nil
+			} else {
+				select {
+				case <-reconnected:
+				case <-stopPushing:
+				}
 			}
 
-			fmt.Printf("[publisher] Pushing %s\n", msg)
+			continue
+		}
+
+		if next != nil {
+			batch, next = collectBatch(next, settings)
+			continue
+		}
+
+		paused, changed := pushing.State()
+		queue := thingsToPush
+
+		if paused {
+			queue = nil
+		}
+
+		select {
+		case <-changed:
+		case <-reconnected:
+		case <-stopPushing:
+		case msg := <-queue:
+			atomic.AddInt32(&unpushed, 1)
+			batch, next = collectBatch(msg, settings)
 		}
 	}
 }
 
+// messageTopic returns the topic of a message, only used to label the metrics
+func messageTopic(msg []byte) string {
+	var m struct{ Topic string }
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil {
+		return "invalid"
+	}
+
+	return m.Topic
+}
+
+// Message IDs are a prefix picked when the process starts and a counter
+var (
+	idPrefix      = newIDPrefix()
+	lastMessageID uint64
+)
+
+func newIDPrefix() string {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+
+	return hex.EncodeToString(prefix)
+}
+
+// assignID adds an ID field to JSON object messages that don't have one, so the
+// entries of every service about the same message can be matched. Anything else
+// is pushed untouched and gets no ID
+func assignID(msg []byte) ([]byte, string) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(msg, &fields)
+
+	if err != nil || fields == nil {
+		return msg, ""
+	}
+
+	if id := logging.MessageID(msg); id != "" {
+		return msg, id
+	}
+
+	id := idPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&lastMessageID, 1), 10)
+	fields["ID"], _ = json.Marshal(id)
+	withID, err := json.Marshal(fields)
+
+	if err != nil {
+		return msg, ""
+	}
+
+	return withID, id
+}
+
+// receiptHeader asks for an answer to a message of /publish, with the header
+// value as "receipt", once it's queued or refused. It isn't pushed to msgqueue
+const receiptHeader = "receipt"
+
+// takeReceipt removes the receipt header of a message and returns its value
+func takeReceipt(msg []byte) ([]byte, string) {
+	var fields map[string]json.RawMessage
+	var headers map[string]string
+	err := json.Unmarshal(msg, &fields)
+
+	if err == nil {
+		err = json.Unmarshal(fields["Headers"], &headers)
+	}
+
+	receipt, ok := headers[receiptHeader]
+
+	if err != nil || !ok {
+		return msg, ""
+	}
+
+	delete(headers, receiptHeader)
+	fields["Headers"], _ = json.Marshal(headers)
+
+	if len(headers) == 0 {
+		delete(fields, "Headers")
+	}
+
+	withoutReceipt, err := json.Marshal(fields)
+
+	if err != nil {
+		return msg, ""
+	}
+
+	return withoutReceipt, receipt
+}
+
+// publishMessage queues a message received from a client to be pushed to
+// msgqueue, and returns the ID given to it
+func publishMessage(msg []byte, log logger, remoteAddr string) string {
+	span := tracing.StartMessage("publish receive", tracing.Server, msg)
+	msg, id := assignID(msg)
+	msg = tracing.WithTrace(msg, span)
+	topic := messageTopic(msg)
+	span.Set("messaging.message.id", id, "messaging.destination.name", topic, "messaging.message.body.size", len(msg), "net.peer.name", remoteAddr)
+
+	thingsToPush <- msg
+	received.Inc(topics.label(topic))
+	span.Finish()
+
+	log.Sample().Debug("Received message", "id", id, "topic", topic, "size", len(msg), "payload", msg)
+
+	return id
+}
+
+// authenticate accepts either a verified client certificate or the basic auth
+// credentials, and returns the identity of the client
+func authenticate(r *http.Request) (string, bool) {
+	if identity, ok := certstore.Identity(r.TLS); ok {
+		return identity, identity == cfg.Username
+	}
+
+	username, password, ok := r.BasicAuth()
+
+	return username, ok && username == cfg.Username && password == cfg.Password
+}
+
 func initServer(addr string, certDir string, serverReady chan<- bool) error {
-	cert, err := tls.LoadX509KeyPair(certDir+"server.crt", certDir+"server.key")
+	clientAuth, err := certstore.ParseClientAuth(cfg.ClientAuth)
+
+	if err != nil {
+		return err
+	}
+
+	certs := certstore.New(certDir, certstore.ServerCertFile, certstore.ServerKeyFile, true, logs)
+	err = certs.Load()
 
 	if err != nil {
 		return err
 	}
 
-	http.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
+	if clientAuth != tls.NoClientCert {
+		_, caPool := certs.Current()
+
+		if caPool == nil {
+			return errors.New("client certificates can't be verified without " + certDir + certstore.CACertFile)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		log, connID := logs.Conn(r.RemoteAddr, "/publish")
+		identity, ok := authenticate(r)
+		stomp := wantsSTOMP(r)
 
-		if !ok || username != "hello" || password != "test" {
-			fmt.Printf("[publisher] Error validating credentials [%s:%s]\n", username, password)
+		// STOMP clients can authenticate with the login and passcode of CONNECT
+		if !ok && stomp {
+			identity = ""
+		} else if !ok {
+			log.Warn("Error validating credentials", "identity", identity)
+			authFailures.Inc("/publish")
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := compression.Upgrade(&upgrader, w, r, "/publish", cfg.Compression)
 
 		if err != nil {
-			fmt.Printf("[publisher] Error upgrading connection\n%s", err)
+			log.Warn("Error upgrading connection", "error", err)
 			return
 		}
 
+		log = log.With("identity", identity)
+		log.Info("Connection opened")
+		info := admin.NewConn(connID, "/publish", r, identity, conn)
+		clients.Add(info)
+		alive := keepalive.Start(conn, cfg.KeepAlive, logs)
+		conn.SetReadLimit(int64(cfg.MaxMessageSize))
+
 		go func() {
+			defer clients.Remove(conn)
+			defer conn.Close()
+			defer alive.Stop()
+
+			if stomp {
+				serveSTOMP(conn, alive, info, log, identity)
+				return
+			}
+
+			enc := codec.For(conn.Subprotocol())
+			txs := newTxSession(connID, log)
+			defer txs.abortAll()
+
 			for {
 				_, msg, err := conn.ReadMessage()
 
 				if err != nil {
-					fmt.Println(err)
+					log.Info("Connection closed", "reason", err)
 					return
 				}
 
-				thingsToPush <- msg
+				alive.Received()
+
+				// Messages of a codec are pushed to msgqueue as JSON
+				if enc != nil {
+					m, err := enc.Decode(msg)
+
+					if err != nil {
+						log.Warn("Dropping message that can't be decoded", "codec", conn.Subprotocol(), "size", len(msg), "error", err)
+						dropped.Inc("invalid")
+						continue
+					}
+
+					msg, _ = json.Marshal(m)
+				}
+
+				// Frames of transactions are answered with how they went
+				if frame, ok := parseTransactionFrame(msg); ok {
+					txs.handle(frame, func(ack pushAck, err error) {
+						reply, _ := json.Marshal(map[string]interface{}{"transaction": frame.Transaction, "status": ack.Status, "count": ack.Count})
+
+						if err != nil {
+							reply, _ = json.Marshal(map[string]string{"error": err.Error(), "transaction": frame.Transaction})
+						}
+
+						alive.Write(websocket.TextMessage, reply)
+					})
+
+					continue
+				}
+
+				// A message with a receipt header is answered with the receipt
+				// once it's queued, and so is the error when it's refused
+				msg, receipt := takeReceipt(msg)
+
+				refuse := func(err error) {
+					reply := map[string]string{"error": err.Error(), "topic": messageTopic(msg)}
+
+					if receipt != "" {
+						reply[receiptHeader] = receipt
+					}
+
+					encoded, _ := json.Marshal(reply)
+					alive.Write(websocket.TextMessage, encoded)
+				}
+
+				// Messages are refused while msgqueue is dialed again
+				if err := upstream.available(); err != nil {
+					refuse(err)
+					continue
+				}
+
+				// The client is told about messages that don't match their
+				// schema, the connection stays open
+				if err := schemas.validateMessage(msg); err != nil {
+					log.Warn("Message rejected", "topic", messageTopic(msg), "error", err)
+					rejected.Inc(topics.label(messageTopic(msg)))
+					refuse(err)
+					continue
+				}
+
+				// Requests must name an inbox to reply to and a correlation ID
+				if err := checkRequestMessage(msg); err != nil {
+					log.Warn("Request rejected", "topic", messageTopic(msg), "error", err)
+					refuse(err)
+					continue
+				}
+
+				// Messages of a transaction are pushed with the ID it has on msgqueue
+				msg, err = txs.rewrite(msg)
+
+				if err != nil {
+					log.Warn("Message rejected", "topic", messageTopic(msg), "error", err)
+					refuse(err)
+					continue
+				}
 
-				fmt.Printf("[publisher] Received %s\n", msg)
+				// The client is told when msgqueue drops the message as the
+				// repeat of another one with the same key. The answer comes on the
+				// goroutine reading msgqueue, alive.write keeps its reply from
+				// being written at once with the ones of this loop
+				if key := idempotencyKey(msg); key != "" {
+					var id string
+					msg, id = assignID(msg)
+					acks.expect(id, cfg.Upstream.AckTimeout, func(ack pushAck) {
+						if ack.Duplicate {
+							reply, _ := json.Marshal(map[string]interface{}{"duplicate": true, "id": ack.Original, "key": key})
+							alive.Write(websocket.TextMessage, reply)
+						}
+					})
+				}
+
+				id := publishMessage(msg, log, r.RemoteAddr)
+
+				if receipt != "" {
+					reply, _ := json.Marshal(map[string]string{receiptHeader: receipt, "id": id})
+					alive.Write(websocket.TextMessage, reply)
+				}
 			}
 		}()
 	})
 
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
-	listener, err := tls.Listen("tcp", addr, config)
+	mux.HandleFunc("/topics/", publishHTTP)
+
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/healthz", health.Handler(livenessChecks))
+	mux.HandleFunc("/readyz", health.Handler(func() []check {
+		return readinessChecks(certs)
+	}))
+
+	listener, err := tls.Listen("tcp", addr, certs.ServerConfig(clientAuth))
 
 	if err != nil {
 		return err
@@ -119,8 +558,21 @@ func initServer(addr string, certDir string, serverReady chan<- bool) error {
 		serverReady <- true
 	}
 
-	fmt.Println("[publisher] Server running")
-	http.Serve(listener, nil)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-stopping
+		ctx, cancel := context.WithDeadline(context.Background(), stopDeadline)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	logs.Info("Server running", "addr", addr)
+	err = server.Serve(listener)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
 
-	return nil
+	return err
 }
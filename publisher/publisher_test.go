@@ -3,17 +3,47 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/codec"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/shutdown"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var serverRunning = false
 
+// Password of the admin API in the tests, the one of the demo credentials is
+// refused
+const adminPassword = "admin-tests"
+
 func TestMain(m *testing.M) {
+	cfg.Admin.Password = adminPassword
+
+	// Compression is enabled before the server starts, clients that don't ask
+	// for it aren't affected
+	cfg.Compression.Enabled = true
+	cfg.Compression.MinSize = 64
+	upgrader.EnableCompression = true
+
+	// msgqueue is only played by TestReconnect, and dialed again quickly
+	cfg.Upstream.Addr = "localhost:8086"
+	cfg.Upstream.ReconnectBackoff = 10 * time.Millisecond
+	cfg.Upstream.ReconnectMaxBackoff = 50 * time.Millisecond
 	ready := make(chan bool)
 
 	go func() {
@@ -59,14 +89,14 @@ func TestInitServer(t *testing.T) {
 }
 
 func TestInvalidCredentials(t *testing.T) {
-	_, err := dialToService("localhost:8081", "/publish", "fail", "test")
+	_, err := dialToService("localhost:8081", "/publish", "fail", "test", compression.Config{})
 	if err != websocket.ErrBadHandshake {
 		t.Fatal("[test] Successfully authenticated with bad credentials")
 	}
 }
 
 func TestDialerFail(t *testing.T) {
-	_, err := dialToService("invalid addr", "", "fail", "test")
+	_, err := dialToService("invalid addr", "", "fail", "test", compression.Config{})
 
 	if err == nil {
 		t.Fatal("[test] Successfully dialed to a wrong address")
@@ -147,7 +177,7 @@ func TestRoundtrip(t *testing.T) {
 
 	go http.Serve(listener, nil)
 
-	pushConn, err := dialToService("localhost:8081", "/publish", "hello", "test")
+	pushConn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
 
 	if err != nil {
 		t.Fatal(err)
@@ -159,13 +189,15 @@ func TestRoundtrip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	replyConn, err := dialToService("localhost:8089", "/test", "hello", "test")
+	replyConn, err := dialToService("localhost:8089", "/test", "hello", "test", compression.Config{})
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	go pushMessages(replyConn)
+	upstream.set(replyConn)
+	defer upstream.set(nil)
+	go pushMessages()
 
 	replyConn.SetReadDeadline(time.Now().Add(time.Second * 10))
 	_, msg, err := replyConn.ReadMessage()
@@ -178,3 +210,1378 @@ func TestRoundtrip(t *testing.T) {
 		t.Fatal("[tests] Messages don't match")
 	}
 }
+
+func TestUntrustedServer(t *testing.T) {
+	pubURL := url.URL{Scheme: "wss", Host: "localhost:8081", Path: "/publish"}
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+
+	_, _, err := dialer.Dial(pubURL.String(), authHeader)
+
+	if err == nil {
+		t.Fatal("[tests] Trusted a server certificate that isn't signed by the CA")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, _, err := loadConfig([]string{"-queue-size", "many"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted a queue size that isn't a number")
+	}
+
+	_, _, err = loadConfig([]string{"-upstream", "localhost"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an upstream address without a port")
+	}
+
+	_, _, err = loadConfig([]string{"-client-auth", "maybe"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an invalid client auth mode")
+	}
+
+	_, _, err = loadConfig([]string{"-log-level", "verbose"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an invalid log level")
+	}
+
+	_, _, err = loadConfig([]string{"-trace-exporter", "file"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted the file trace exporter without a file")
+	}
+
+	_, _, err = loadConfig([]string{"-upstream-compression-level", "10"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted a compression level over 9")
+	}
+
+	_, _, err = loadConfig([]string{"-schema-compatibility", "sometimes"})
+
+	if err == nil {
+		t.Fatal("[tests] Accepted an invalid schema compatibility")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, caPool := clientCerts.Current()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+
+	response, err := client.Get("https://localhost:8081/metrics")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range []string{
+		"publisher_auth_failures_total{endpoint=\"/publish\"} 1\n",
+		"publisher_messages_received_total{topic=\"invalid\"} 1\n",
+		"publisher_connections_active{endpoint=\"/publish\"}",
+		"publisher_queue_capacity 10\n",
+		"publisher_write_duration_seconds_bucket{le=\"+Inf\"}",
+	} {
+		if !bytes.Contains(body, []byte(sample)) {
+			t.Fatalf("[tests] Metrics don't contain %s\n%s", sample, body)
+		}
+	}
+}
+
+func TestNotReadyWithoutUpstream(t *testing.T) {
+	_, caPool := clientCerts.Current()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+
+	response, err := client.Get("https://localhost:8081/readyz")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tests never dial to msgqueue
+	if response.StatusCode != http.StatusServiceUnavailable || !bytes.Contains(body, []byte(`"name":"upstream","ok":false`)) {
+		t.Fatalf("[tests] Ready without a connection to msgqueue: %d %s", response.StatusCode, body)
+	}
+
+	if !bytes.Contains(body, []byte(`"name":"certificate","ok":true`)) {
+		t.Fatalf("[tests] Valid certificate reported as invalid: %s", body)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	recorder := httptest.NewRecorder()
+	handler := health.Handler(func() []check {
+		return readinessChecks(certstore.New(dir+"/", certstore.ServerCertFile, certstore.ServerKeyFile, true, logs))
+	})
+	handler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	body := recorder.Body.String()
+
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(body, `"name":"certificate","ok":false,"detail":"no certificate loaded"`) {
+		t.Fatalf("[tests] Missing certificate wasn't reported: %d %s", recorder.Code, body)
+	}
+
+	if !strings.Contains(body, `"name":"upstream","ok":false`) {
+		t.Fatalf("[tests] Missing connection to msgqueue wasn't reported: %s", body)
+	}
+
+	// The queue stops being ready at cfg.ReadyQueueUsage, 0.9 by default
+	if queueCheck("queue", 9, 10).OK || !queueCheck("queue", 8, 10).OK {
+		t.Fatal("[tests] Wrong readiness for the queue usage", cfg.ReadyQueueUsage)
+	}
+
+	if c := queueCheck("queue", 10, 10); c.OK || c.Detail != "10 of 10 messages" {
+		t.Fatal("[tests] Full queue wasn't reported", c)
+	}
+
+	// Losing msgqueue doesn't need a restart
+	recorder = httptest.NewRecorder()
+	health.Handler(livenessChecks)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("[tests] Not alive without a connection to msgqueue: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestAssignID(t *testing.T) {
+	msg, id := assignID([]byte("hello team!"))
+
+	if id != "" || !bytes.Equal(msg, []byte("hello team!")) {
+		t.Fatal("[tests] A message that isn't JSON was changed")
+	}
+
+	msg, id = assignID([]byte(`{"Topic":"test","Content":"message"}`))
+
+	if id == "" || logging.MessageID(msg) != id || messageTopic(msg) != "test" {
+		t.Fatal("[tests] No ID was added to a JSON message", string(msg))
+	}
+
+	other, otherID := assignID([]byte(`{"Topic":"test","Content":"message"}`))
+
+	if otherID == id {
+		t.Fatal("[tests] Two messages got the same ID", string(other))
+	}
+
+	again, againID := assignID(msg)
+
+	if againID != id || !bytes.Equal(again, msg) {
+		t.Fatal("[tests] The ID of a message was replaced")
+	}
+}
+
+func restPublish(t *testing.T, path string, contentType string, body string, password string) (int, []byte) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, err := http.NewRequest("POST", "https://localhost:8081"+path, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.SetBasicAuth("hello", password)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Message-Priority", "high")
+	response, err := client.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+	reply, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, reply
+}
+
+func TestRESTPublish(t *testing.T) {
+	// Keeps the messages on the queue, as the roundtrip test left a pusher running
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	status, _ := restPublish(t, "/topics/news/messages", "text/plain", "hello team!", "fail")
+
+	if status != http.StatusUnauthorized {
+		t.Fatal("[tests] Published with bad credentials")
+	}
+
+	status, _ = restPublish(t, "/topics/news/messages", "application/json", "{hello", "test")
+
+	if status != http.StatusBadRequest {
+		t.Fatal("[tests] Published an invalid JSON body")
+	}
+
+	status, reply := restPublish(t, "/topics/news/messages", "text/plain", "hello team!", "test")
+
+	var single struct{ ID string }
+	json.Unmarshal(reply, &single)
+
+	if status != http.StatusAccepted || single.ID == "" {
+		t.Fatal("[tests] Message wasn't published", string(reply))
+	}
+
+	var m envelope
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Topic != "news" || m.Content != "hello team!" || m.Headers["priority"] != "high" || m.Headers["content-type"] != "text/plain" {
+		t.Fatal("[tests] Published message doesn't match the request", m)
+	}
+
+	status, reply = restPublish(t, "/topics/news/messages/batch", "application/json", `[{"Content":"first"},{"Content":"second","Headers":{"Priority":"low"}}]`, "test")
+
+	var batch struct{ IDs []string }
+	json.Unmarshal(reply, &batch)
+
+	if status != http.StatusAccepted || len(batch.IDs) != 2 {
+		t.Fatal("[tests] Batch wasn't published", string(reply))
+	}
+
+	<-thingsToPush
+	msg := <-thingsToPush
+	json.Unmarshal(msg, &m)
+
+	if m.Content != "second" || m.Headers["priority"] != "low" || logging.MessageID(msg) != batch.IDs[1] {
+		t.Fatal("[tests] Batch entry headers don't override the request ones", m)
+	}
+
+	status, _ = restPublish(t, "/topics/news/messages/batch", "application/json", "["+strings.Repeat(`{"Content":"x"},`, cap(thingsToPush))+`{"Content":"x"}]`, "test")
+
+	if status != http.StatusServiceUnavailable {
+		t.Fatal("[tests] Accepted a batch larger than the queue")
+	}
+}
+
+// dialSTOMP opens a websocket with the STOMP subprotocol and without basic auth
+func dialSTOMP(t *testing.T) *websocket.Conn {
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), Subprotocols: []string{"v12.stomp"}}
+	conn, _, err := dialer.Dial("wss://localhost:8081/publish", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.Subprotocol() != "v12.stomp" {
+		t.Fatal("[tests] STOMP wasn't negotiated", conn.Subprotocol())
+	}
+
+	return conn
+}
+
+func readSTOMP(t *testing.T, conn *websocket.Conn) stompFrame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := parseSTOMP(data)
+
+	if err != nil {
+		t.Fatal("[tests] Invalid STOMP frame", string(data))
+	}
+
+	return frame
+}
+
+func TestSTOMP(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	conn := dialSTOMP(t)
+	conn.WriteMessage(websocket.TextMessage, []byte("CONNECT\naccept-version:1.2\nlogin:hello\npasscode:fail\n\n\x00"))
+
+	if frame := readSTOMP(t, conn); frame.command != "ERROR" || frame.headers["message"] != "invalid credentials" {
+		t.Fatal("[tests] Connected with bad credentials", frame)
+	}
+
+	conn.Close()
+
+	conn = dialSTOMP(t)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("CONNECT\r\naccept-version:1.1,1.2\r\nlogin:hello\r\npasscode:test\r\n\r\n\x00"))
+
+	if frame := readSTOMP(t, conn); frame.command != "CONNECTED" || frame.headers["version"] != "1.2" {
+		t.Fatal("[tests] STOMP session wasn't connected", frame)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("\n"))
+	conn.WriteMessage(websocket.TextMessage, []byte("SEND\ndestination:/topic/news\nreceipt:r1\nPriority:high\nnote:a\\cb\nnote:ignored\ncontent-length:11\n\nhello team!\x00\n"))
+
+	if frame := readSTOMP(t, conn); frame.command != "RECEIPT" || frame.headers["receipt-id"] != "r1" {
+		t.Fatal("[tests] SEND wasn't acknowledged", frame)
+	}
+
+	var m envelope
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Topic != "news" || m.Content != "hello team!" || m.Headers["priority"] != "high" || m.Headers["note"] != "a:b" || m.Headers["receipt"] != "" {
+		t.Fatal("[tests] Published message doesn't match the SEND frame", m)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("SUBSCRIBE\nid:0\ndestination:/topic/news\n\n\x00"))
+
+	if frame := readSTOMP(t, conn); frame.command != "ERROR" {
+		t.Fatal("[tests] Publisher accepted SUBSCRIBE", frame)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), Subprotocols: []string{"cbor"}}
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	conn, _, err := dialer.Dial("wss://localhost:8081/publish", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if conn.Subprotocol() != "cbor" {
+		t.Fatal("[tests] Codec wasn't negotiated", conn.Subprotocol())
+	}
+
+	before := dropped.Snapshot()["invalid"]
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0xff})
+	conn.WriteMessage(websocket.BinaryMessage, codec.For("cbor").Encode(envelope{Topic: "binary", Data: []byte{0, 0xff}}))
+
+	var m envelope
+	msg := <-thingsToPush
+	json.Unmarshal(msg, &m)
+
+	if m.Topic != "binary" || !bytes.Equal(m.Data, []byte{0, 0xff}) || logging.MessageID(msg) == "" {
+		t.Fatal("[tests] Binary message wasn't pushed as JSON", string(msg))
+	}
+
+	if dropped.Snapshot()["invalid"] != before+1 {
+		t.Fatal("[tests] Undecodable message wasn't dropped")
+	}
+
+	status, _ := restPublish(t, "/topics/binary/messages", "application/octet-stream", "\x00\xff", "test")
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if status != http.StatusAccepted || m.Content != "" || !bytes.Equal(m.Data, []byte{0, 0xff}) {
+		t.Fatal("[tests] Binary body wasn't published as Data", m)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{Enabled: true, Level: 9, MinSize: 64})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	before := compressionBytes.Snapshot()
+	large := []byte(`{"Topic":"compressed","Content":"` + strings.Repeat("compress me ", 100) + `"}`)
+	compression.MeterWrite(conn, len(large))
+	conn.WriteMessage(websocket.TextMessage, large)
+
+	var m envelope
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Topic != "compressed" || m.Content != strings.Repeat("compress me ", 100) {
+		t.Fatal("[tests] Compressed message wasn't received", m)
+	}
+
+	after := compressionBytes.Snapshot()
+	message, wire := after["/publish message"]-before["/publish message"], after["/publish wire"]-before["/publish wire"]
+
+	if message != float64(len(large)) || wire == 0 || wire >= message {
+		t.Fatal("[tests] Message wasn't compressed", message, wire)
+	}
+
+	uncompressed := compressedMessages.Snapshot()["/publish false"]
+	small := []byte(`{"Topic":"compressed","Content":"small"}`)
+	compression.MeterWrite(conn, len(small))
+	conn.WriteMessage(websocket.TextMessage, small)
+	<-thingsToPush
+
+	if compressedMessages.Snapshot()["/publish false"] != uncompressed+1 {
+		t.Fatal("[tests] Message under the min size was compressed")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	if !bytes.Equal(encodeBatch([][]byte{[]byte("a"), []byte("bc")}), []byte("\x00\x00\x00\x01a\x00\x00\x00\x02bc")) {
+		t.Fatal("[tests] Batch encoding doesn't match the format")
+	}
+
+	frames := make(chan []byte, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pushmsg", func(w http.ResponseWriter, r *http.Request) {
+		batchUpgrader := websocket.Upgrader{Subprotocols: []string{batchProtocol}}
+		conn, err := batchUpgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		kind, frame, err := conn.ReadMessage()
+
+		if err == nil && kind == websocket.BinaryMessage {
+			frames <- frame
+		}
+
+		close(frames)
+	})
+
+	cert, err := tls.LoadX509KeyPair(os.Getenv("WS_CERT_DIR")+"server.crt", os.Getenv("WS_CERT_DIR")+"server.key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "localhost:8087", &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go http.Serve(listener, mux)
+
+	conn, err := dialToService("localhost:8087", "/pushmsg", "hello", "test", compression.Config{}, batchProtocol)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if conn.Subprotocol() != batchProtocol {
+		t.Fatal("[tests] Batches weren't negotiated", conn.Subprotocol())
+	}
+
+	// The linger time ends the first batch, and max bytes leaves the last
+	// message for the next one
+	settings := batchConfig{MaxMessages: 10, MaxBytes: 24, Linger: 50 * time.Millisecond}
+	thingsToPush <- []byte("two")
+	thingsToPush <- []byte("three")
+	atomic.AddInt32(&unpushed, 1)
+	batch, next := collectBatch([]byte("one"), settings)
+
+	if len(batch) != 3 || next != nil {
+		t.Fatal("[tests] Batch wasn't filled until the linger time", len(batch), next)
+	}
+
+	thingsToPush <- []byte("too large")
+	_, next = collectBatch([]byte("0123456789"), settings)
+
+	if string(next) != "too large" {
+		t.Fatal("[tests] Batch went over max bytes", string(next))
+	}
+
+	before := pushed.Snapshot()[""]
+	if !pushBatch(conn, batch) {
+		t.Fatal("[tests] Batch wasn't pushed")
+	}
+
+	if frame := <-frames; !bytes.Equal(frame, encodeBatch(batch)) {
+		t.Fatal("[tests] Batch wasn't pushed in a binary frame", frame)
+	}
+
+	if pushed.Snapshot()[""] != before+3 || atomic.LoadInt32(&unpushed) != 1 {
+		t.Fatal("[tests] Pushed messages weren't counted", pushed.Snapshot()[""], atomic.LoadInt32(&unpushed))
+	}
+
+	// The message left for the next batch
+	atomic.AddInt32(&unpushed, -1)
+}
+
+func TestReconnect(t *testing.T) {
+	var refusing int32
+	conns := make(chan *websocket.Conn, 2)
+	frames := make(chan string, 10)
+	mux := http.NewServeMux()
+
+	// msgqueue is played by the test, it refuses connections while it's down
+	mux.HandleFunc("/pushmsg", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&refusing) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		conns <- conn
+
+		for {
+			_, frame, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			frames <- logging.MessageID(frame)
+		}
+	})
+
+	cert, err := tls.LoadX509KeyPair(os.Getenv("WS_CERT_DIR")+"server.crt", os.Getenv("WS_CERT_DIR")+"server.key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", cfg.Upstream.Addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go http.Serve(listener, mux)
+
+	conn, err := dialToService(cfg.Upstream.Addr, "/pushmsg", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go maintainUpstream(conn)
+	go pushMessages()
+	defer upstream.set(nil)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	publish := func() int {
+		req, _ := http.NewRequest("POST", "https://localhost:8081/topics/orders/messages", strings.NewReader("reconnect"))
+		req.SetBasicAuth("hello", "test")
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	// waitStatus publishes until the publisher answers with a status
+	waitStatus := func(status int) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if publish() == status {
+				return
+			}
+		}
+
+		t.Fatal("[tests] Publisher didn't answer with", status)
+	}
+
+	nextFrame := func() string {
+		select {
+		case id := <-frames:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("[tests] Message wasn't pushed to msgqueue")
+		}
+
+		return ""
+	}
+
+	thingsToPush <- []byte(`{"ID":"r-1","Topic":"orders"}`)
+
+	if id := nextFrame(); id != "r-1" {
+		t.Fatal("[tests] Message wasn't pushed before losing msgqueue", id)
+	}
+
+	// Publishes are refused while msgqueue is dialed again, and the messages
+	// already queued wait for it
+	atomic.StoreInt32(&refusing, 1)
+	(<-conns).Close()
+	waitStatus(http.StatusServiceUnavailable)
+	thingsToPush <- []byte(`{"ID":"r-2","Topic":"orders"}`)
+
+	if atomic.LoadInt32(&upstreamConnected) != 0 {
+		t.Fatal("[tests] Lost connection to msgqueue was reported as connected")
+	}
+
+	atomic.StoreInt32(&refusing, 0)
+	<-conns
+	waitStatus(http.StatusAccepted)
+
+	if id := nextFrame(); id != "r-2" {
+		t.Fatal("[tests] Message queued while msgqueue was away wasn't pushed", id)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	file, err := ioutil.TempFile("", "spool")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	// The messages held by pushMessages go before the ones still queued
+	queue := make(chan []byte, 10)
+	queue <- []byte("queued")
+	spooled, err := shutdown.Spool(file.Name(), append([][]byte{[]byte("batch"), []byte("next")}, shutdown.TakeAll(queue)...))
+
+	if err != nil || spooled != 3 || len(queue) != 0 {
+		t.Fatal("[tests] Held messages weren't spooled", spooled, err)
+	}
+
+	restored, err := shutdown.Restore(file.Name(), func([]byte) chan []byte { return queue })
+
+	if err != nil || restored != 3 {
+		t.Fatal("[tests] Spooled messages weren't restored", restored, err)
+	}
+
+	for _, expected := range []string{"batch", "next", "queued"} {
+		if msg := <-queue; string(msg) != expected {
+			t.Fatal("[tests] Spooled messages were restored out of order", string(msg), expected)
+		}
+	}
+
+	_, err = shutdown.Spool("", append([][]byte{[]byte("batch")}, shutdown.TakeAll(queue)...))
+
+	if err == nil {
+		t.Fatal("[tests] Held messages were lost without an error")
+	}
+}
+
+// adminSchemas sends a request to the schema routes of the admin API
+func adminSchemas(method string, path string, body string) (int, string) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth("admin", adminPassword)
+	w := httptest.NewRecorder()
+
+	if path == "/schemas" {
+		adminServer().Handler(listSchemas, "GET")(w, r)
+	} else {
+		adminServer().Handler(manageSchemas, "GET", "POST", "DELETE")(w, r)
+	}
+
+	return w.Code, w.Body.String()
+}
+
+func TestSchemas(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+	defer schemas.load("")
+
+	validators := []struct {
+		kind    string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{"json", `{"type":"object","required":["id"],"properties":{"id":{"type":"integer","minimum":1},"tags":{"type":"array","items":{"$ref":"#/definitions/tag"}}},"definitions":{"tag":{"type":"string","pattern":"^[a-z]+$"}}}`,
+			[]string{`{"id":1}`, `{"id":2.0,"tags":["a","b"]}`},
+			[]string{`{}`, `{"id":0}`, `{"id":1.5}`, `{"id":1,"tags":["A"]}`, `not json`}},
+		{"avro", `{"type":"record","name":"Order","fields":[{"name":"id","type":"long"},{"name":"note","type":["null","string"],"default":null}]}`,
+			[]string{`{"id":1}`, `{"id":1,"note":{"string":"x"}}`, `{"id":1,"note":null}`},
+			[]string{`{"id":"1"}`, `{"id":1,"note":"x"}`, `{"id":1,"extra":true}`}},
+		{"protobuf", `syntax = "proto3"; message Order { int32 id = 1; string name = 2; repeated Line lines = 3; message Line { uint64 qty = 1; } }`,
+			[]string{"\x08\x07\x12\x02ab", "\x1a\x02\x08\x05", ""},
+			[]string{"\x0a\x01x", "\x12\x01\xff", "\x08", "\x1a\x02\x0a\x00"}},
+	}
+
+	for _, v := range validators {
+		validator, err := schemaTypes[v.kind](v.schema)
+
+		if err != nil {
+			t.Fatal("[tests] Error compiling the "+v.kind+" schema", err)
+		}
+
+		for _, payload := range v.valid {
+			if err := validator.validate([]byte(payload)); err != nil {
+				t.Fatal("[tests] Valid "+v.kind+" payload was refused", payload, err)
+			}
+		}
+
+		for _, payload := range v.invalid {
+			if err := validator.validate([]byte(payload)); err == nil {
+				t.Fatal("[tests] Invalid "+v.kind+" payload was accepted", payload)
+			}
+		}
+	}
+
+	for kind, schema := range map[string]string{"json": `{"type":"nope"}`, "avro": `{"type":"record","name":"x"}`, "protobuf": `message A { int32 a = 1; int32 b = 1; }`} {
+		if _, err := schemaTypes[kind](schema); err == nil {
+			t.Fatal("[tests] Invalid " + kind + " schema was compiled")
+		}
+	}
+
+	evolutions := []struct {
+		kind       string
+		old        string
+		new        string
+		compatible bool
+	}{
+		{"json", `{"type":"object","properties":{"a":{"type":"integer"}}}`, `{"type":"object","properties":{"a":{"type":"number"}}}`, true},
+		{"json", `{"type":"object","properties":{"a":{"type":"number"}}}`, `{"type":"object","properties":{"a":{"type":"integer"}}}`, false},
+		{"avro", `{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`, `{"type":"record","name":"R","fields":[{"name":"a","type":"long"},{"name":"b","type":"string","default":""}]}`, true},
+		{"avro", `{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`, `{"type":"record","name":"R","fields":[{"name":"a","type":"int"},{"name":"b","type":"string"}]}`, false},
+		{"protobuf", `message M { int32 a = 1; }`, `message M { int64 a = 1; string b = 2; }`, true},
+		{"protobuf", `message M { int32 a = 1; }`, `message M { string a = 1; }`, false},
+	}
+
+	for _, e := range evolutions {
+		old, _ := schemaTypes[e.kind](e.old)
+		updated, _ := schemaTypes[e.kind](e.new)
+
+		if err := updated.readsFrom(old); (err == nil) != e.compatible {
+			t.Fatal("[tests] Wrong compatibility of "+e.kind+" schemas", e.old, e.new, err)
+		}
+	}
+
+	file, err := ioutil.TempFile("", "schemas")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+	schemas.load(file.Name())
+
+	order := `{"type":"object","required":["id"],"properties":{"id":{"type":"integer"}}}`
+	status, reply := adminSchemas("POST", "/schemas/orders.%2A/versions", `{"schema":`+order+`}`)
+
+	if status != http.StatusCreated || !strings.Contains(reply, `"version":1`) {
+		t.Fatal("[tests] Schema wasn't registered", status, reply)
+	}
+
+	status, _ = adminSchemas("POST", "/schemas/orders.%2A/versions", `{"schema":`+order+`}`)
+
+	if status != http.StatusOK {
+		t.Fatal("[tests] Registering the same schema again made a new version", status)
+	}
+
+	// A new required property can't read the messages of version 1
+	breaking := `{"type":"object","required":["id","total"],"properties":{"id":{"type":"integer"},"total":{"type":"number"}}}`
+	status, reply = adminSchemas("POST", "/schemas/orders.%2A/compatibility", `{"schema":`+breaking+`}`)
+
+	if status != http.StatusOK || !strings.Contains(reply, `"compatible":false`) {
+		t.Fatal("[tests] Breaking change was reported as compatible", status, reply)
+	}
+
+	status, _ = adminSchemas("POST", "/schemas/orders.%2A/versions", `{"schema":`+breaking+`}`)
+
+	if status != http.StatusConflict {
+		t.Fatal("[tests] Breaking change was registered", status)
+	}
+
+	status, _ = adminSchemas("POST", "/schemas/orders.%2A/versions", `{"type":"avro","schema":"\"string\"","compatibility":"none"}`)
+
+	if status != http.StatusCreated {
+		t.Fatal("[tests] Schema wasn't registered without compatibility checks", status)
+	}
+
+	// The compatibility given with a version is kept until another one is
+	status, _ = adminSchemas("POST", "/schemas/orders.%2A/versions", `{"type":"avro","schema":"\"long\"","compatibility":"backward"}`)
+
+	if status != http.StatusConflict {
+		t.Fatal("[tests] A string schema was changed to long")
+	}
+
+	status, _ = adminSchemas("POST", "/schemas/orders.eu/versions", `{"schema":{"type":"string","maxLength":5}}`)
+
+	if status != http.StatusCreated {
+		t.Fatal("[tests] Schema of a single topic wasn't registered", status)
+	}
+
+	status, reply = adminSchemas("GET", "/schemas/orders.%2A/versions/1", "")
+
+	if status != http.StatusOK || !strings.Contains(reply, `"type":"json"`) {
+		t.Fatal("[tests] First version wasn't kept", status, reply)
+	}
+
+	status, _ = adminSchemas("POST", "/schemas/orders.%2A/versions", `{"type":"xml","schema":"<a/>"}`)
+
+	if status != http.StatusBadRequest {
+		t.Fatal("[tests] Registered a schema of an unknown type", status)
+	}
+
+	// The registry is read back from its file
+	schemas.load(file.Name())
+	status, reply = adminSchemas("GET", "/schemas", "")
+
+	if status != http.StatusOK || strings.Count(reply, `"version":`) != 3 {
+		t.Fatal("[tests] Registry wasn't saved", status, reply)
+	}
+
+	// orders.us matches the pattern, whose latest version is an Avro string,
+	// and orders.eu has its own schema
+	for _, c := range []struct {
+		topic   string
+		body    string
+		headers map[string]string
+		valid   bool
+	}{
+		{"orders.us", `"hello"`, nil, true},
+		{"orders.us", `{"id":1}`, nil, false},
+		{"orders.us", `{"id":1}`, map[string]string{schemaVersionHeader: "1"}, true},
+		{"orders.us", `{"id":1}`, map[string]string{schemaVersionHeader: "9"}, false},
+		{"orders.eu", `"short"`, nil, true},
+		{"orders.eu", `"too long"`, nil, false},
+		{"misc", `not checked`, nil, true},
+	} {
+		err := schemas.validate(envelope{Topic: c.topic, Content: c.body, Headers: c.headers})
+
+		if (err == nil) != c.valid {
+			t.Fatal("[tests] Wrong validation result", c.topic, c.body, c.headers, err)
+		}
+	}
+
+	status, body := restPublish(t, "/topics/orders.us/messages/batch", "application/json", `[{"Content":"\"ok\""},{"Content":"5"}]`, "test")
+
+	if status != http.StatusUnprocessableEntity || !bytes.Contains(body, []byte("message 1")) || len(thingsToPush) != 0 {
+		t.Fatal("[tests] Batch with an invalid message wasn't refused", status, string(body))
+	}
+
+	status, _ = restPublish(t, "/topics/orders.us/messages", "application/json", `"ok"`, "test")
+
+	if status != http.StatusAccepted {
+		t.Fatal("[tests] Valid message wasn't published", status)
+	}
+
+	<-thingsToPush
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders.eu","Content":"\"too long\""}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders.eu","Content":"\"fine\""}`))
+
+	var rejection struct{ Error, Topic string }
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = conn.ReadJSON(&rejection)
+
+	if err != nil || rejection.Topic != "orders.eu" || !strings.Contains(rejection.Error, "orders.eu") {
+		t.Fatal("[tests] Invalid message wasn't reported to the client", rejection, err)
+	}
+
+	var m envelope
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Content != `"fine"` {
+		t.Fatal("[tests] Message after the invalid one wasn't published", m)
+	}
+
+	if rejected.Snapshot()["orders.eu"] != 1 || rejected.Snapshot()["orders.us"] != 1 {
+		t.Fatal("[tests] Rejected messages weren't counted", rejected.Snapshot())
+	}
+
+	status, _ = adminSchemas("DELETE", "/schemas/orders.%2A", "")
+
+	if status != http.StatusOK || schemas.validate(envelope{Topic: "orders.us", Content: "5"}) != nil {
+		t.Fatal("[tests] Schema wasn't removed", status)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	publish := func(path string, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "https://localhost:8081"+path, strings.NewReader(body))
+		req.SetBasicAuth("hello", "test")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "order-42")
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer response.Body.Close()
+		var reply map[string]interface{}
+		json.NewDecoder(response.Body).Decode(&reply)
+
+		return response.StatusCode, reply
+	}
+
+	// msgqueue is played by the test, answering what's pushed
+	answer := func(duplicate bool, original string) string {
+		msg := <-thingsToPush
+		var m envelope
+		json.Unmarshal(msg, &m)
+
+		if original == "" {
+			original = m.ID
+		}
+
+		ack, _ := json.Marshal([]pushAck{{ID: m.ID, Original: original, Duplicate: duplicate}})
+		acks.resolve(ack)
+
+		return m.Headers[idempotencyHeader]
+	}
+
+	go answer(true, "first-id")
+	status, reply := publish("/topics/orders/messages", `{"total":10}`)
+
+	if status != http.StatusOK || reply["id"] != "first-id" || reply["duplicate"] != true {
+		t.Fatal("[tests] Repeat wasn't answered with the original ID", status, reply)
+	}
+
+	keys := make(chan string, 2)
+
+	go func() {
+		keys <- answer(false, "")
+		keys <- answer(true, "first-entry")
+	}()
+
+	status, reply = publish("/topics/orders/messages/batch", `[{"Content":"a"},{"Content":"b"}]`)
+	ids, _ := reply["ids"].([]interface{})
+	repeated, _ := reply["duplicates"].([]interface{})
+
+	if status != http.StatusAccepted || len(ids) != 2 || ids[1] != "first-entry" || len(repeated) != 1 || repeated[0] != 1.0 {
+		t.Fatal("[tests] Batch repeats weren't reported", status, reply)
+	}
+
+	if <-keys != "order-42/0" || <-keys != "order-42/1" {
+		t.Fatal("[tests] Batch entries didn't get their own keys")
+	}
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders","Content":"again","Headers":{"idempotency-key":"ws-1"}}`))
+	answer(true, "ws-original")
+
+	var notice struct {
+		Duplicate bool
+		ID, Key   string
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = conn.ReadJSON(&notice)
+
+	if err != nil || !notice.Duplicate || notice.ID != "ws-original" || notice.Key != "ws-1" {
+		t.Fatal("[tests] Client wasn't told about the repeat", notice, err)
+	}
+
+	if duplicates.Snapshot()[""] < 3 {
+		t.Fatal("[tests] Repeats weren't counted", duplicates.Snapshot())
+	}
+}
+
+func TestConcurrentReplies(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// Repeats are answered by another goroutine while the reader loop rejects
+	// messages of a transaction that isn't open, the race detector catches
+	// the replies being written at once
+	const count = 50
+	answered := make(chan bool)
+
+	go func() {
+		for i := 0; i < count; i++ {
+			var m envelope
+			json.Unmarshal(<-thingsToPush, &m)
+			ack, _ := json.Marshal([]pushAck{{ID: m.ID, Original: "original", Duplicate: true}})
+			acks.resolve(ack)
+		}
+
+		close(answered)
+	}()
+
+	for i := 0; i < count; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"Topic":"orders","Headers":{"idempotency-key":"concurrent-%d"}}`, i)))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders","Headers":{"transaction":"unknown"}}`))
+	}
+
+	repeats, rejections := 0, 0
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i < 2*count; i++ {
+		var reply struct {
+			Duplicate bool
+			Error     string
+		}
+
+		err = conn.ReadJSON(&reply)
+
+		if err != nil {
+			t.Fatal("[tests] Replies weren't all received", repeats, rejections, err)
+		}
+
+		if reply.Duplicate {
+			repeats++
+		} else if reply.Error != "" {
+			rejections++
+		}
+	}
+
+	<-answered
+
+	if repeats != count || rejections != count {
+		t.Fatal("[tests] Replies were lost or mixed up", repeats, rejections)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	// msgqueue is played by the test, answering the end of the transaction
+	nextFrame := func() transactionFrame {
+		select {
+		case msg := <-thingsToPush:
+			frame, ok := parseTransactionFrame(msg)
+
+			if !ok {
+				t.Fatal("[tests] Expected a transaction frame", string(msg))
+			}
+
+			return frame
+		case <-time.After(5 * time.Second):
+			t.Fatal("[tests] Nothing was pushed")
+		}
+
+		return transactionFrame{}
+	}
+
+	answer := func(status string, count int) {
+		frame := nextFrame()
+		ack, _ := json.Marshal([]pushAck{{Transaction: frame.Transaction, Status: status, Count: count}})
+		acks.resolve(ack)
+	}
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply map[string]interface{}
+	read := func() map[string]interface{} {
+		reply = nil
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := conn.ReadJSON(&reply)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return reply
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Transaction":"t1","Action":"begin"}`))
+
+	if read()["status"] != "open" {
+		t.Fatal("[tests] Transaction wasn't begun", reply)
+	}
+
+	begin := nextFrame()
+
+	if begin.Action != "begin" || !strings.HasSuffix(begin.Transaction, "-t1") || begin.Transaction == "t1" {
+		t.Fatal("[tests] Transaction wasn't begun on msgqueue with its own ID", begin)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders","Content":"created","Headers":{"transaction":"t1"}}`))
+
+	var m envelope
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Headers[transactionHeader] != begin.Transaction {
+		t.Fatal("[tests] Message wasn't pushed in the transaction", m)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders","Content":"lost","Headers":{"transaction":"t9"}}`))
+
+	if !strings.Contains(fmt.Sprint(read()["error"]), "t9") || len(thingsToPush) != 0 {
+		t.Fatal("[tests] Message of a transaction that isn't open was published", reply)
+	}
+
+	// The client can go on publishing while msgqueue answers the commit
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Transaction":"t1","Action":"commit"}`))
+	commit := nextFrame()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"orders","Content":"after the commit"}`))
+
+	select {
+	case msg := <-thingsToPush:
+		if json.Unmarshal(msg, &m); m.Content != "after the commit" {
+			t.Fatal("[tests] Message after the commit wasn't pushed", string(msg))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Waiting for the commit blocked the connection")
+	}
+
+	answered, _ := json.Marshal([]pushAck{{Transaction: commit.Transaction, Status: "committed", Count: 1}})
+	acks.resolve(answered)
+
+	if read(); reply["transaction"] != "t1" || reply["status"] != "committed" || reply["count"] != 1.0 {
+		t.Fatal("[tests] Commit wasn't answered", reply)
+	}
+
+	// Transactions left open are aborted when the client goes away
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Transaction":"t2","Action":"begin"}`))
+	read()
+	nextFrame()
+	conn.Close()
+
+	if frame := nextFrame(); frame.Action != "abort" || !strings.HasSuffix(frame.Transaction, "-t2") {
+		t.Fatal("[tests] Abandoned transaction wasn't aborted", frame)
+	}
+
+	stomp := dialSTOMP(t)
+	defer stomp.Close()
+
+	stomp.WriteMessage(websocket.TextMessage, []byte("CONNECT\naccept-version:1.2\nlogin:hello\npasscode:test\n\n\x00"))
+	readSTOMP(t, stomp)
+	stomp.WriteMessage(websocket.TextMessage, []byte("BEGIN\ntransaction:s1\nreceipt:r1\n\n\x00"))
+
+	if frame := readSTOMP(t, stomp); frame.command != "RECEIPT" || nextFrame().Action != "begin" {
+		t.Fatal("[tests] BEGIN wasn't acknowledged", frame)
+	}
+
+	stomp.WriteMessage(websocket.TextMessage, []byte("SEND\ndestination:/topic/orders\ntransaction:s1\n\ncreated\x00"))
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if !strings.HasSuffix(m.Headers[transactionHeader], "-s1") {
+		t.Fatal("[tests] SEND wasn't pushed in the transaction", m)
+	}
+
+	stomp.WriteMessage(websocket.TextMessage, []byte("COMMIT\ntransaction:s1\nreceipt:r2\n\n\x00"))
+	answer("committed", 1)
+
+	if frame := readSTOMP(t, stomp); frame.command != "RECEIPT" || frame.headers["receipt-id"] != "r2" {
+		t.Fatal("[tests] COMMIT wasn't acknowledged", frame)
+	}
+
+	stomp.WriteMessage(websocket.TextMessage, []byte("BEGIN\ntransaction:s2\n\n\x00"))
+	nextFrame()
+	stomp.WriteMessage(websocket.TextMessage, []byte("COMMIT\ntransaction:s2\n\n\x00"))
+	answer("unknown", 0)
+
+	if frame := readSTOMP(t, stomp); frame.command != "ERROR" || frame.headers["message"] != "transaction not committed" {
+		t.Fatal("[tests] Failed COMMIT wasn't reported", frame)
+	}
+
+	// Messages published over HTTP have no session to hold a transaction, so
+	// naming one is refused instead of msgqueue dropping them
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for path, body := range map[string]string{"messages": "created", "messages/batch": `[{"Content":"a"},{"Content":"b","Headers":{"Transaction":"s1"}}]`} {
+		req, _ := http.NewRequest("POST", "https://localhost:8081/topics/orders/"+path, strings.NewReader(body))
+		req.SetBasicAuth("hello", "test")
+
+		if path == "messages" {
+			req.Header.Set("X-Message-Transaction", "s1")
+		}
+
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusBadRequest || len(thingsToPush) != 0 {
+			t.Fatal("[tests] REST message in a transaction was accepted", path, response.StatusCode)
+		}
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"rpc.time","Content":"now?","Headers":{"reply-to":"_inbox.abc","correlation-id":"c-1"}}`))
+
+	var m envelope
+
+	select {
+	case msg := <-thingsToPush:
+		json.Unmarshal(msg, &m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Request wasn't pushed")
+	}
+
+	if m.Headers[replyToHeader] != "_inbox.abc" || m.Headers[correlationHeader] != "c-1" {
+		t.Fatal("[tests] Request was pushed without its reply-to and correlation ID", m)
+	}
+
+	var reply map[string]string
+
+	for _, headers := range []string{`{"reply-to":"rpc.replies","correlation-id":"c-2"}`, `{"reply-to":"_inbox.","correlation-id":"c-3"}`, `{"reply-to":"_inbox.abc"}`} {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"rpc.time","Content":"now?","Headers":`+headers+`}`))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err = conn.ReadJSON(&reply)
+
+		if err != nil || reply["error"] == "" || reply["topic"] != "rpc.time" || len(thingsToPush) != 0 {
+			t.Fatal("[tests] Invalid request was published", headers, reply, err)
+		}
+	}
+
+	// Replies are plain messages published to the inbox
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"_inbox.abc","Content":"noon","Headers":{"correlation-id":"c-1"}}`))
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Topic != "_inbox.abc" || m.Content != "noon" {
+		t.Fatal("[tests] Reply wasn't pushed", m)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for replyTo, status := range map[string]int{"_inbox.rest": http.StatusAccepted, "rpc.replies": http.StatusBadRequest} {
+		req, _ := http.NewRequest("POST", "https://localhost:8081/topics/rpc.time/messages", strings.NewReader("now?"))
+		req.SetBasicAuth("hello", "test")
+		req.Header.Set("X-Message-Reply-To", replyTo)
+		req.Header.Set("X-Message-Correlation-Id", "c-4")
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+
+		if response.StatusCode != status {
+			t.Fatal("[tests] Wrong status for a REST request", replyTo, response.StatusCode)
+		}
+	}
+
+	json.Unmarshal(<-thingsToPush, &m)
+
+	if m.Headers[replyToHeader] != "_inbox.rest" || m.Headers[correlationHeader] != "c-4" {
+		t.Fatal("[tests] REST request was pushed without its headers", m)
+	}
+
+	stomp := dialSTOMP(t)
+	defer stomp.Close()
+
+	stomp.WriteMessage(websocket.TextMessage, []byte("CONNECT\naccept-version:1.2\nlogin:hello\npasscode:test\n\n\x00"))
+	readSTOMP(t, stomp)
+	stomp.WriteMessage(websocket.TextMessage, []byte("SEND\ndestination:/topic/rpc.time\nreply-to:/topic/rpc.replies\ncorrelation-id:c-5\n\nnow?\x00"))
+
+	if frame := readSTOMP(t, stomp); frame.command != "ERROR" || frame.headers["message"] != "invalid request" || len(thingsToPush) != 0 {
+		t.Fatal("[tests] Invalid STOMP request was published", frame)
+	}
+
+	if requests.Snapshot()["invalid"] < 5 || requests.Snapshot()["accepted"] < 2 {
+		t.Fatal("[tests] Requests weren't counted", requests.Snapshot())
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	pushing.Set(true)
+	defer pushing.Set(false)
+
+	conn, err := dialToService("localhost:8081", "/publish", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"receipts","Content":"queued","Headers":{"receipt":"r-1","priority":"low"}}`))
+
+	var m envelope
+
+	select {
+	case msg := <-thingsToPush:
+		json.Unmarshal(msg, &m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] Message with a receipt wasn't pushed")
+	}
+
+	if _, ok := m.Headers[receiptHeader]; ok || m.Headers["priority"] != "low" {
+		t.Fatal("[tests] The receipt header was pushed or the other headers were lost", m.Headers)
+	}
+
+	var reply map[string]string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = conn.ReadJSON(&reply)
+
+	if err != nil || reply[receiptHeader] != "r-1" || reply["id"] != m.ID || reply["error"] != "" {
+		t.Fatal("[tests] Queued message wasn't answered with its receipt", reply, err)
+	}
+
+	// Refused messages carry the receipt in the error
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"receipts","Content":"refused","Headers":{"receipt":"r-2","reply-to":"_inbox.abc"}}`))
+	reply = nil
+	err = conn.ReadJSON(&reply)
+
+	if err != nil || reply[receiptHeader] != "r-2" || reply["error"] == "" || len(thingsToPush) != 0 {
+		t.Fatal("[tests] Refused message wasn't answered with its receipt", reply, err)
+	}
+
+	// Without a receipt nothing is answered for a queued message
+	msg, receipt := takeReceipt([]byte(`{"Topic":"receipts","Content":"plain"}`))
+
+	if receipt != "" || string(msg) != `{"Topic":"receipts","Content":"plain"}` {
+		t.Fatal("[tests] Message without a receipt was changed", string(msg))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Headers of a request, the inbox its replies go to and the ID they carry back
+// so the client can tell which request they answer
+const (
+	replyToHeader     = "reply-to"
+	correlationHeader = "correlation-id"
+)
+
+// Prefix of the topics of the inboxes the subscriber gives to its connections
+const inboxPrefix = "_inbox."
+
+// checkRequest refuses the requests whose replies couldn't be delivered or told
+// apart: a reply-to that isn't an inbox, or one without a correlation ID.
+// Messages without reply-to aren't requests and always pass
+func checkRequest(m envelope) error {
+	replyTo, ok := m.Headers[replyToHeader]
+
+	if !ok {
+		return nil
+	}
+
+	var err error
+
+	if !strings.HasPrefix(replyTo, inboxPrefix) || len(replyTo) == len(inboxPrefix) {
+		err = fmt.Errorf("reply-to must be an inbox given by the subscriber (%s...), not %q", inboxPrefix, replyTo)
+	} else if m.Headers[correlationHeader] == "" {
+		err = errors.New("a request with reply-to needs a correlation-id header")
+	}
+
+	if err != nil {
+		requests.Inc("invalid")
+		return err
+	}
+
+	requests.Inc("accepted")
+
+	return nil
+}
+
+// checkRequestMessage checks a message as it will be pushed, the ones that
+// aren't envelopes can't be requests
+func checkRequestMessage(msg []byte) error {
+	var m envelope
+
+	if json.Unmarshal(msg, &m) != nil {
+		return nil
+	}
+
+	return checkRequest(m)
+}
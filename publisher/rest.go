@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Prefix of the request headers that are copied to the headers of the message
+const messageHeaderPrefix = "X-Message-"
+
+// batchEntry is one message of a batch, its headers are added to the ones of
+// the request
+type batchEntry struct {
+	Content string
+	Data    []byte
+	Headers map[string]string
+}
+
+// messageHeaders returns the X-Message-* request headers, lower cased and
+// without the prefix
+func messageHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+
+	for name, values := range header {
+		if strings.HasPrefix(name, messageHeaderPrefix) && len(name) > len(messageHeaderPrefix) {
+			headers[strings.ToLower(strings.TrimPrefix(name, messageHeaderPrefix))] = strings.Join(values, ", ")
+		}
+	}
+
+	return headers
+}
+
+// publishHTTP queues the body of POST /topics/{topic}/messages as a message, or
+// each entry of the JSON array sent to POST /topics/{topic}/messages/batch, and
+// answers with the IDs given to them
+func publishHTTP(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/topics")
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		admin.ReplyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	identity, ok := authenticate(r)
+
+	if !ok {
+		log.Warn("Error validating credentials", "identity", identity)
+		authFailures.Inc("/topics")
+		w.Header().Set("WWW-Authenticate", `Basic realm="publisher"`)
+		admin.ReplyError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	log = log.With("identity", identity)
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/topics/"), "/")
+	batch := len(parts) == 3 && parts[2] == "batch"
+
+	if (len(parts) != 2 && !batch) || parts[1] != "messages" {
+		admin.ReplyError(w, http.StatusNotFound, "use POST /topics/{topic}/messages or POST /topics/{topic}/messages/batch")
+		return
+	}
+
+	topic, err := url.PathUnescape(parts[0])
+
+	if err != nil || topic == "" {
+		admin.ReplyError(w, http.StatusBadRequest, "invalid topic")
+		return
+	}
+
+	select {
+	case <-stopping:
+		admin.ReplyError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	default:
+	}
+
+	if err := upstream.available(); err != nil {
+		w.Header().Set("Retry-After", "1")
+		admin.ReplyError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(cfg.MaxMessageSize)))
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusRequestEntityTooLarge, "the body can't be larger than max_message_size")
+		return
+	}
+
+	headers := messageHeaders(r.Header)
+	key := r.Header.Get("Idempotency-Key")
+	var messages []envelope
+
+	if batch {
+		var entries []batchEntry
+		err = json.Unmarshal(body, &entries)
+
+		if err != nil || len(entries) == 0 {
+			admin.ReplyError(w, http.StatusBadRequest, "the body must be a JSON array of messages with a Content or Data and optional Headers")
+			return
+		}
+
+		for _, entry := range entries {
+			entryHeaders := make(map[string]string)
+
+			for name, value := range headers {
+				entryHeaders[name] = value
+			}
+
+			// Each entry gets its own key from the one of the request, so a
+			// retried batch is deduplicated entry by entry
+			if key != "" {
+				entryHeaders[idempotencyHeader] = key + "/" + strconv.Itoa(len(messages))
+			}
+
+			for name, value := range entry.Headers {
+				entryHeaders[strings.ToLower(name)] = value
+			}
+
+			messages = append(messages, envelope{Topic: topic, Content: entry.Content, Data: entry.Data, Headers: entryHeaders})
+		}
+	} else {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		if mediaType == "application/json" && !json.Valid(body) {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		if mediaType != "" {
+			headers["content-type"] = r.Header.Get("Content-Type")
+		}
+
+		if key != "" {
+			headers[idempotencyHeader] = key
+		}
+
+		// Bodies that aren't text are kept as they are in Data
+		message := envelope{Topic: topic, Content: string(body), Headers: headers}
+
+		if !utf8.Valid(body) {
+			message.Content, message.Data = "", body
+		}
+
+		messages = append(messages, message)
+	}
+
+	// A batch is only queued when every message in it is outside of a
+	// transaction, a valid request, if it's one, and matches its schema
+	for i, m := range messages {
+		err = checkNoTransaction(m)
+
+		if err == nil {
+			err = checkRequest(m)
+		}
+
+		if err != nil {
+			log.Warn("Request rejected", "topic", topic, "error", err)
+
+			if batch {
+				err = fmt.Errorf("message %d: %s", i, err)
+			}
+
+			admin.ReplyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = schemas.validate(m)
+
+		if err == nil {
+			continue
+		}
+
+		log.Warn("Message rejected", "topic", topic, "error", err)
+		rejected.Inc(topics.label(topic))
+
+		if batch {
+			err = fmt.Errorf("message %d: %s", i, err)
+		}
+
+		admin.ReplyError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// The whole request is refused instead of waiting for room on the queue
+	if len(messages) > cap(thingsToPush)-len(thingsToPush) {
+		w.Header().Set("Retry-After", "1")
+		admin.ReplyError(w, http.StatusServiceUnavailable, "the queue is full")
+		return
+	}
+
+	ids := make([]string, len(messages))
+	answers := make(chan pushAck, len(messages))
+	expected := 0
+
+	for i, m := range messages {
+		m.Traceparent = r.Header.Get("Traceparent")
+		msg, _ := json.Marshal(m)
+
+		// Messages with a key get their ID before they're queued, so the answer
+		// from msgqueue can't arrive before it's expected
+		if m.Headers[idempotencyHeader] != "" {
+			var id string
+			msg, id = assignID(msg)
+			acks.expect(id, cfg.Upstream.AckTimeout, func(ack pushAck) {
+				answers <- ack
+			})
+			expected++
+		}
+
+		ids[i] = publishMessage(msg, log, r.RemoteAddr)
+	}
+
+	originals := make(map[string]string)
+
+	for ; expected > 0; expected-- {
+		ack := <-answers
+
+		if ack.Duplicate {
+			originals[ack.ID] = ack.Original
+		}
+	}
+
+	// Repeats answer with the ID of the message that was queued
+	repeated := []int{}
+
+	for i, id := range ids {
+		if original, ok := originals[id]; ok {
+			ids[i] = original
+			repeated = append(repeated, i)
+		}
+	}
+
+	if batch {
+		admin.ReplyJSON(w, http.StatusAccepted, map[string]interface{}{"ids": ids, "duplicates": repeated})
+		return
+	}
+
+	if len(repeated) > 0 {
+		admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{"id": ids[0], "duplicate": true})
+		return
+	}
+
+	admin.ReplyJSON(w, http.StatusAccepted, map[string]string{"id": ids[0]})
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header of a message that picks the version of the schema it's checked
+// against, instead of the latest one
+const schemaVersionHeader = "schema-version"
+
+// schemaValidator is a compiled schema of one of the supported types
+type schemaValidator interface {
+	validate(payload []byte) error
+
+	// readsFrom tells whether every payload valid under an older schema of the
+	// same type is still understood with this one
+	readsFrom(old schemaValidator) error
+}
+
+var schemaTypes = map[string]func(text string) (schemaValidator, error){
+	"json":     compileJSONSchema,
+	"avro":     compileAvroSchema,
+	"protobuf": compileProtoSchema,
+}
+
+// Compatibility modes: backward checks that the new schema reads what the older
+// one accepted, forward the other way around and full both. The transitive
+// ones check every older version instead of only the latest
+var compatibilityModes = []string{"backward", "backward_transitive", "forward", "forward_transitive", "full", "full_transitive", "none"}
+
+func validCompatibility(mode string) bool {
+	for _, known := range compatibilityModes {
+		if mode == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// schemaConfig is where the registry is kept and the compatibility of the topic
+// patterns that don't set their own
+type schemaConfig struct {
+	File          string `yaml:"file"`
+	Compatibility string `yaml:"compatibility"`
+}
+
+type schemaVersion struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Schema  string    `json:"schema"`
+	Created time.Time `json:"created"`
+
+	validator schemaValidator
+}
+
+// schemaSubject is the list of schemas bound to a topic pattern, which uses the
+// syntax of path.Match as subscriptions do
+type schemaSubject struct {
+	Pattern       string           `json:"pattern"`
+	Compatibility string           `json:"compatibility"`
+	Versions      []*schemaVersion `json:"versions"`
+}
+
+func (s *schemaSubject) latest() *schemaVersion {
+	return s.Versions[len(s.Versions)-1]
+}
+
+// schemaConflict is the error of a schema that breaks the compatibility of its
+// topic pattern
+type schemaConflict struct {
+	reason string
+}
+
+func (e schemaConflict) Error() string {
+	return e.reason
+}
+
+type schemaRegistry struct {
+	subjects map[string]*schemaSubject
+	file     string
+	mux      sync.Mutex
+}
+
+var schemas = newSchemaRegistry()
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{subjects: make(map[string]*schemaSubject)}
+}
+
+// load reads the registry from its file, if there's one, and compiles every
+// schema in it
+func (r *schemaRegistry) load(file string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.file = file
+	r.subjects = make(map[string]*schemaSubject)
+
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var subjects []*schemaSubject
+	err = json.Unmarshal(data, &subjects)
+
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range subjects {
+		if len(subject.Versions) == 0 {
+			continue
+		}
+
+		for _, version := range subject.Versions {
+			compile, ok := schemaTypes[version.Type]
+
+			if !ok {
+				return fmt.Errorf("%s version %d: unknown schema type %q", subject.Pattern, version.Version, version.Type)
+			}
+
+			version.validator, err = compile(version.Schema)
+
+			if err != nil {
+				return fmt.Errorf("%s version %d: %s", subject.Pattern, version.Version, err)
+			}
+		}
+
+		r.subjects[subject.Pattern] = subject
+	}
+
+	return nil
+}
+
+// save writes the registry to a new file that then replaces the old one, so
+// it's never left half written
+func (r *schemaRegistry) save() error {
+	if r.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.list(), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(r.file+".tmp", data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(r.file+".tmp", r.file)
+}
+
+// list returns the subjects in order of pattern, the caller holds the lock
+func (r *schemaRegistry) list() []*schemaSubject {
+	patterns := make([]string, 0, len(r.subjects))
+
+	for pattern := range r.subjects {
+		patterns = append(patterns, pattern)
+	}
+
+	sort.Strings(patterns)
+	subjects := make([]*schemaSubject, len(patterns))
+
+	for i, pattern := range patterns {
+		subjects[i] = r.subjects[pattern]
+	}
+
+	return subjects
+}
+
+// compatible checks a schema against the versions its compatibility mode asks for
+func compatible(subject *schemaSubject, kind string, validator schemaValidator) error {
+	mode := subject.Compatibility
+
+	if mode == "none" || len(subject.Versions) == 0 {
+		return nil
+	}
+
+	previous := subject.Versions[len(subject.Versions)-1:]
+
+	if strings.HasSuffix(mode, "_transitive") {
+		previous = subject.Versions
+	}
+
+	for _, old := range previous {
+		if old.Type != kind {
+			return schemaConflict{fmt.Sprintf("version %d is a %s schema, the type can't change", old.Version, old.Type)}
+		}
+
+		if !strings.HasPrefix(mode, "forward") {
+			if err := validator.readsFrom(old.validator); err != nil {
+				return schemaConflict{fmt.Sprintf("messages of version %d can't be read with the new schema: %s", old.Version, err)}
+			}
+		}
+
+		if !strings.HasPrefix(mode, "backward") {
+			if err := old.validator.readsFrom(validator); err != nil {
+				return schemaConflict{fmt.Sprintf("version %d can't read messages of the new schema: %s", old.Version, err)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepare compiles a schema for a pattern and checks its compatibility. The
+// caller holds the lock
+func (r *schemaRegistry) prepare(pattern string, kind string, text string, mode string) (*schemaSubject, *schemaVersion, error) {
+	compile, ok := schemaTypes[kind]
+
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown schema type %q, it must be json, avro or protobuf", kind)
+	}
+
+	validator, err := compile(text)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s schema: %s", kind, err)
+	}
+
+	subject, ok := r.subjects[pattern]
+
+	if !ok {
+		subject = &schemaSubject{Pattern: pattern, Compatibility: cfg.Schemas.Compatibility}
+	}
+
+	if mode != "" {
+		copied := *subject
+		copied.Compatibility = mode
+		subject = &copied
+	}
+
+	return subject, &schemaVersion{Type: kind, Schema: text, validator: validator}, compatible(subject, kind, validator)
+}
+
+// register adds a version to a pattern, unless it's the same as the latest one.
+// It returns the version and whether it's new
+func (r *schemaRegistry) register(pattern string, kind string, text string, mode string) (*schemaVersion, bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if subject, ok := r.subjects[pattern]; ok && subject.latest().Type == kind && subject.latest().Schema == text {
+		return subject.latest(), false, nil
+	}
+
+	subject, version, err := r.prepare(pattern, kind, text, mode)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	version.Version = 1
+	version.Created = time.Now().UTC()
+
+	if len(subject.Versions) > 0 {
+		version.Version = subject.latest().Version + 1
+	}
+
+	previous, existed := r.subjects[pattern]
+	updated := *subject
+	updated.Versions = append(append([]*schemaVersion{}, subject.Versions...), version)
+	r.subjects[pattern] = &updated
+	err = r.save()
+
+	if err != nil {
+		if existed {
+			r.subjects[pattern] = previous
+		} else {
+			delete(r.subjects, pattern)
+		}
+
+		return nil, false, err
+	}
+
+	return version, true, nil
+}
+
+// remove deletes every version of a pattern
+func (r *schemaRegistry) remove(pattern string) (bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	subject, ok := r.subjects[pattern]
+
+	if !ok {
+		return false, nil
+	}
+
+	delete(r.subjects, pattern)
+	err := r.save()
+
+	if err != nil {
+		r.subjects[pattern] = subject
+		return false, err
+	}
+
+	return true, nil
+}
+
+// match finds the subject of a topic: the one of the topic itself, or else the
+// longest pattern that matches it. The caller holds the lock
+func (r *schemaRegistry) match(topic string) *schemaSubject {
+	if subject, ok := r.subjects[topic]; ok {
+		return subject
+	}
+
+	var best *schemaSubject
+
+	for pattern, subject := range r.subjects {
+		if matched, _ := path.Match(pattern, topic); !matched || !isPattern(pattern) {
+			continue
+		}
+
+		if best == nil || len(pattern) > len(best.Pattern) || (len(pattern) == len(best.Pattern) && pattern < best.Pattern) {
+			best = subject
+		}
+	}
+
+	return best
+}
+
+// validate checks a message against the schema of its topic, if it has one.
+// Binary payloads are checked instead of the content when there's one
+func (r *schemaRegistry) validate(m envelope) error {
+	r.mux.Lock()
+	subject := r.match(m.Topic)
+
+	if subject == nil {
+		r.mux.Unlock()
+		return nil
+	}
+
+	version := subject.latest()
+
+	if requested, ok := m.Headers[schemaVersionHeader]; ok {
+		version = nil
+
+		for _, candidate := range subject.Versions {
+			if strconv.Itoa(candidate.Version) == requested {
+				version = candidate
+			}
+		}
+	}
+
+	pattern := subject.Pattern
+	r.mux.Unlock()
+
+	if version == nil {
+		return fmt.Errorf("the schema for %s has no version %s", pattern, m.Headers[schemaVersionHeader])
+	}
+
+	payload := m.Data
+
+	if len(payload) == 0 {
+		payload = []byte(m.Content)
+	}
+
+	err := version.validator.validate(payload)
+
+	if err != nil {
+		return fmt.Errorf("the message doesn't match version %d of the %s schema for %s: %s", version.Version, version.Type, pattern, err)
+	}
+
+	return nil
+}
+
+// validateMessage checks a message as it will be pushed. Messages that aren't
+// envelopes are only refused when their topic has a schema
+func (r *schemaRegistry) validateMessage(msg []byte) error {
+	var m envelope
+	err := json.Unmarshal(msg, &m)
+
+	if err == nil {
+		return r.validate(m)
+	}
+
+	r.mux.Lock()
+	subject := r.match(messageTopic(msg))
+	r.mux.Unlock()
+
+	if subject != nil {
+		return fmt.Errorf("the topic has a schema and the message isn't an envelope: %s", err)
+	}
+
+	return nil
+}
+
+// isPattern tells apart the patterns of path.Match from single topics
+func isPattern(topic string) bool {
+	return strings.ContainsAny(topic, "*?[")
+}
+
+// schemaRequest is the body of a new version, the schema can be given as a
+// string or, for JSON and Avro, as the JSON of the schema itself
+type schemaRequest struct {
+	Type          string          `json:"type"`
+	Schema        json.RawMessage `json:"schema"`
+	Compatibility string          `json:"compatibility"`
+}
+
+func (req schemaRequest) text() (string, error) {
+	var text string
+	err := json.Unmarshal(req.Schema, &text)
+
+	if err == nil {
+		return text, nil
+	}
+
+	if len(req.Schema) == 0 || req.Type == "protobuf" {
+		return "", errors.New("the body needs the schema")
+	}
+
+	return string(req.Schema), nil
+}
+
+func listSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas.mux.Lock()
+	defer schemas.mux.Unlock()
+
+	admin.ReplyJSON(w, http.StatusOK, schemas.list())
+}
+
+// manageSchemas serves GET and DELETE /schemas/{pattern}, GET and POST
+// /schemas/{pattern}/versions, GET /schemas/{pattern}/versions/{version|latest}
+// and POST /schemas/{pattern}/compatibility, which checks a schema without
+// registering it
+func manageSchemas(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/schemas/"), "/")
+	pattern, err := url.PathUnescape(parts[0])
+
+	if _, badPattern := path.Match(pattern, ""); err != nil || pattern == "" || badPattern != nil {
+		admin.ReplyError(w, http.StatusBadRequest, "invalid topic pattern")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		showSchemaVersion(w, pattern, "")
+	case len(parts) == 1 && r.Method == "DELETE":
+		removed, err := schemas.remove(pattern)
+
+		if err != nil {
+			admin.ReplyError(w, http.StatusInternalServerError, err.Error())
+		} else if !removed {
+			admin.ReplyError(w, http.StatusNotFound, "no schema for "+pattern)
+		} else {
+			admin.ReplyJSON(w, http.StatusOK, map[string]string{"removed": pattern})
+		}
+	case len(parts) == 2 && parts[1] == "versions" && r.Method == "POST":
+		registerSchema(w, r, pattern)
+	case len(parts) == 2 && parts[1] == "versions" && r.Method == "GET":
+		showSchemaVersion(w, pattern, "all")
+	case len(parts) == 3 && parts[1] == "versions" && r.Method == "GET":
+		showSchemaVersion(w, pattern, parts[2])
+	case len(parts) == 2 && parts[1] == "compatibility" && r.Method == "POST":
+		checkSchema(w, r, pattern)
+	default:
+		admin.ReplyError(w, http.StatusNotFound, "use /schemas/{pattern}, /schemas/{pattern}/versions, /schemas/{pattern}/versions/{version} or /schemas/{pattern}/compatibility")
+	}
+}
+
+// showSchemaVersion replies with the whole subject when version is empty, its
+// versions for "all", or one of them
+func showSchemaVersion(w http.ResponseWriter, pattern string, version string) {
+	schemas.mux.Lock()
+	defer schemas.mux.Unlock()
+
+	subject, ok := schemas.subjects[pattern]
+
+	if !ok {
+		admin.ReplyError(w, http.StatusNotFound, "no schema for "+pattern)
+		return
+	}
+
+	switch version {
+	case "":
+		admin.ReplyJSON(w, http.StatusOK, subject)
+		return
+	case "all":
+		admin.ReplyJSON(w, http.StatusOK, subject.Versions)
+		return
+	case "latest":
+		admin.ReplyJSON(w, http.StatusOK, subject.latest())
+		return
+	}
+
+	for _, candidate := range subject.Versions {
+		if strconv.Itoa(candidate.Version) == version {
+			admin.ReplyJSON(w, http.StatusOK, candidate)
+			return
+		}
+	}
+
+	admin.ReplyError(w, http.StatusNotFound, "no version "+version+" of the schema for "+pattern)
+}
+
+func readSchemaRequest(w http.ResponseWriter, r *http.Request) (schemaRequest, string, bool) {
+	var req schemaRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, err.Error())
+		return req, "", false
+	}
+
+	if req.Type == "" {
+		req.Type = "json"
+	}
+
+	if req.Compatibility != "" && !validCompatibility(req.Compatibility) {
+		admin.ReplyError(w, http.StatusBadRequest, "compatibility must be one of "+strings.Join(compatibilityModes, ", "))
+		return req, "", false
+	}
+
+	text, err := req.text()
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, err.Error())
+		return req, "", false
+	}
+
+	return req, text, true
+}
+
+func registerSchema(w http.ResponseWriter, r *http.Request, pattern string) {
+	req, text, ok := readSchemaRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	version, created, err := schemas.register(pattern, req.Type, text, req.Compatibility)
+
+	if _, conflict := err.(schemaConflict); conflict {
+		admin.ReplyError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !created {
+		admin.ReplyJSON(w, http.StatusOK, version)
+		return
+	}
+
+	logs.Info("Schema registered", "pattern", pattern, "version", version.Version, "type", version.Type)
+	admin.ReplyJSON(w, http.StatusCreated, version)
+}
+
+func checkSchema(w http.ResponseWriter, r *http.Request, pattern string) {
+	req, text, ok := readSchemaRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	schemas.mux.Lock()
+	_, _, err := schemas.prepare(pattern, req.Type, text, req.Compatibility)
+	schemas.mux.Unlock()
+
+	if _, conflict := err.(schemaConflict); conflict {
+		admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{"compatible": false, "error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{"compatible": true})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// Closed when the service has been asked to stop, stopDeadline is set before
+var stopping = make(chan struct{})
+var stopDeadline time.Time
+
+// Connections on /publish
+var clients = admin.NewConnSet(logs)
+
+// Closing stopPushing has pushMessages stop and hand the messages it holds,
+// the batch it couldn't push and the one it was filling, to leftover
+var (
+	stopPushing = make(chan struct{})
+	leftover    = make(chan [][]byte, 1)
+)
+
+// drain closes the clients, gives pushMessages until the deadline to send the
+// pending messages to msgqueue, unless it's unreachable, and spools whatever is
+// left. It returns the exit status
+func drain() int {
+	clients.CloseAll(websocket.CloseGoingAway, "server shutting down", stopDeadline)
+
+	for (len(thingsToPush) > 0 || atomic.LoadInt32(&unpushed) > 0) && upstream.available() == nil && time.Now().Before(stopDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// pushMessages may be writing a batch, which can take the write timeout
+	close(stopPushing)
+	var held [][]byte
+
+	select {
+	case held = <-leftover:
+	case <-time.After(cfg.Upstream.WriteTimeout):
+		logs.Error("Messages lost, pushMessages didn't stop in time", "count", atomic.LoadInt32(&unpushed))
+		return shutdown.ExitMessagesLost
+	}
+
+	spooled, err := shutdown.Spool(cfg.SpoolFile, append(held, shutdown.TakeAll(thingsToPush)...))
+
+	if pushConn, _ := upstream.current(); pushConn != nil {
+		pushConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), stopDeadline)
+	}
+
+	if err != nil {
+		logs.Error("Error spooling pending messages", "file", cfg.SpoolFile, "error", err)
+		return shutdown.ExitMessagesLost
+	}
+
+	if spooled > 0 {
+		logs.Info("Spooled pending messages", "file", cfg.SpoolFile, "count", spooled)
+	}
+
+	return shutdown.ExitOK
+}
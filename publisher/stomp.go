@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Websocket subprotocol of STOMP 1.2, clients that don't ask for it use JSON
+const stompProtocol = "v12.stomp"
+
+// Headers of SEND that aren't copied to the message
+var stompReserved = map[string]bool{"destination": true, "content-length": true, "receipt": true, "transaction": true}
+
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+var errSTOMPMalformed = errors.New("malformed STOMP frame")
+
+var stompEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+// stompUnescape decodes a header of a frame, other escapes than the ones of
+// stompEscaper are an error
+func stompUnescape(s string) (string, error) {
+	var out bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		if i++; i == len(s) {
+			return "", errSTOMPMalformed
+		}
+
+		switch s[i] {
+		case '\\':
+			out.WriteByte('\\')
+		case 'r':
+			out.WriteByte('\r')
+		case 'n':
+			out.WriteByte('\n')
+		case 'c':
+			out.WriteByte(':')
+		default:
+			return "", errSTOMPMalformed
+		}
+	}
+
+	return out.String(), nil
+}
+
+// parseSTOMP reads the frame of a websocket message. A message with only end of
+// lines is a heart-beat, and is returned as a frame without command
+func parseSTOMP(data []byte) (stompFrame, error) {
+	frame := stompFrame{headers: make(map[string]string)}
+	data = bytes.TrimLeft(data, "\r\n")
+
+	if len(data) == 0 {
+		return frame, nil
+	}
+
+	readLine := func() (string, bool) {
+		end := bytes.IndexByte(data, '\n')
+
+		if end < 0 {
+			return "", false
+		}
+
+		line := strings.TrimSuffix(string(data[:end]), "\r")
+		data = data[end+1:]
+
+		return line, true
+	}
+
+	command, ok := readLine()
+	frame.command = command
+
+	if !ok {
+		return frame, errSTOMPMalformed
+	}
+
+	// CONNECT and CONNECTED don't escape their headers, for older clients
+	escaped := command != "CONNECT" && command != "CONNECTED"
+
+	for {
+		line, ok := readLine()
+
+		if !ok {
+			return frame, errSTOMPMalformed
+		}
+
+		if line == "" {
+			break
+		}
+
+		colon := strings.Index(line, ":")
+
+		if colon < 0 {
+			return frame, errSTOMPMalformed
+		}
+
+		name, value := line[:colon], line[colon+1:]
+
+		if escaped {
+			var nameErr, valueErr error
+			name, nameErr = stompUnescape(name)
+			value, valueErr = stompUnescape(value)
+
+			if nameErr != nil || valueErr != nil {
+				return frame, errSTOMPMalformed
+			}
+		}
+
+		// Only the first of repeated headers counts
+		if _, repeated := frame.headers[name]; !repeated {
+			frame.headers[name] = value
+		}
+	}
+
+	length := bytes.IndexByte(data, 0)
+
+	if value, ok := frame.headers["content-length"]; ok {
+		var err error
+		length, err = strconv.Atoi(value)
+
+		if err != nil || length < 0 || length >= len(data) || data[length] != 0 {
+			return frame, errSTOMPMalformed
+		}
+	}
+
+	if length < 0 || len(bytes.Trim(data[length+1:], "\r\n")) > 0 {
+		return frame, errSTOMPMalformed
+	}
+
+	frame.body = data[:length]
+
+	return frame, nil
+}
+
+// encode writes a frame with its headers in order of name
+func (f stompFrame) encode() []byte {
+	var out bytes.Buffer
+	names := make([]string, 0, len(f.headers))
+
+	for name := range f.headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	out.WriteString(f.command + "\n")
+
+	for _, name := range names {
+		if f.command == "CONNECTED" {
+			out.WriteString(name + ":" + f.headers[name] + "\n")
+		} else {
+			out.WriteString(stompEscaper.Replace(name) + ":" + stompEscaper.Replace(f.headers[name]) + "\n")
+		}
+	}
+
+	if len(f.body) > 0 {
+		out.WriteString("content-length:" + strconv.Itoa(len(f.body)) + "\n")
+	}
+
+	out.WriteString("\n")
+	out.Write(f.body)
+	out.WriteByte(0)
+
+	return out.Bytes()
+}
+
+// wantsSTOMP tells whether a websocket request offers the STOMP subprotocol
+func wantsSTOMP(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == stompProtocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stompSession is a STOMP client on /publish, which can only send messages,
+// on their own or in transactions
+type stompSession struct {
+	alive    *keepalive.Conn
+	info     *connInfo
+	log      logger
+	remote   string
+	identity string
+	txs      *txSession
+	ending   sync.WaitGroup
+}
+
+func (s *stompSession) write(frame stompFrame) error {
+	return s.alive.Write(websocket.TextMessage, frame.encode())
+}
+
+// fail sends an ERROR frame, after which the connection is closed
+func (s *stompSession) fail(request stompFrame, message string, detail string) {
+	headers := map[string]string{"message": message, "content-type": "text/plain"}
+
+	if receipt, ok := request.headers["receipt"]; ok {
+		headers["receipt-id"] = receipt
+	}
+
+	s.log.Warn("STOMP error", "command", request.command, "error", message, "detail", detail)
+	s.write(stompFrame{command: "ERROR", headers: headers, body: []byte(detail)})
+}
+
+func (s *stompSession) receipt(request stompFrame) {
+	if receipt, ok := request.headers["receipt"]; ok {
+		s.write(stompFrame{command: "RECEIPT", headers: map[string]string{"receipt-id": receipt}})
+	}
+}
+
+// connect checks the version and the credentials of CONNECT. Clients that
+// weren't authenticated by the websocket request have to send login and passcode
+func (s *stompSession) connect(frame stompFrame) bool {
+	if versions, ok := frame.headers["accept-version"]; ok && !strings.Contains(","+versions+",", ",1.2,") {
+		s.fail(frame, "unsupported version", "only STOMP 1.2 is supported")
+		return false
+	}
+
+	if login, ok := frame.headers["login"]; ok {
+		if login != cfg.Username || frame.headers["passcode"] != cfg.Password {
+			s.identity = ""
+		} else {
+			s.identity = login
+		}
+	}
+
+	if s.identity == "" {
+		authFailures.Inc("/publish")
+		s.fail(frame, "invalid credentials", "send a valid login and passcode")
+		return false
+	}
+
+	clients.SetIdentity(s.info, s.identity)
+
+	s.log = s.log.With("identity", s.identity)
+	s.txs.log = s.log
+	s.log.Info("STOMP session connected")
+
+	return s.write(stompFrame{command: "CONNECTED", headers: map[string]string{"version": "1.2", "heart-beat": "0,0", "server": "ws-go-publisher", "session": s.info.ID}}) == nil
+}
+
+// send publishes the body of SEND to the topic of its destination, with the
+// rest of its headers as the headers of the message
+func (s *stompSession) send(frame stompFrame) bool {
+	topic := strings.TrimPrefix(frame.headers["destination"], "/topic/")
+
+	if topic == "" {
+		s.fail(frame, "missing destination", "SEND needs a destination header")
+		return false
+	}
+
+	headers := make(map[string]string)
+
+	for name, value := range frame.headers {
+		if !stompReserved[name] {
+			headers[strings.ToLower(name)] = value
+		}
+	}
+
+	m := envelope{Topic: topic, Content: string(frame.body), Headers: headers}
+
+	// Bodies that aren't text are kept as they are in Data
+	if !utf8.Valid(frame.body) {
+		m.Content, m.Data = "", frame.body
+	}
+
+	if id, ok := frame.headers["transaction"]; ok {
+		m.Headers[transactionHeader] = id
+
+		if err := s.txs.member(&m); err != nil {
+			s.fail(frame, "unknown transaction", err.Error())
+			return false
+		}
+	}
+
+	if err := upstream.available(); err != nil {
+		s.fail(frame, "msgqueue unreachable", err.Error())
+		return false
+	}
+
+	if err := checkRequest(m); err != nil {
+		s.log.Warn("Request rejected", "topic", topic, "error", err)
+		s.fail(frame, "invalid request", err.Error())
+		return false
+	}
+
+	if err := schemas.validate(m); err != nil {
+		s.log.Warn("Message rejected", "topic", topic, "error", err)
+		rejected.Inc(topics.label(topic))
+		s.fail(frame, "invalid payload", err.Error())
+		return false
+	}
+
+	msg, _ := json.Marshal(m)
+	publishMessage(msg, s.log, s.remote)
+	s.receipt(frame)
+
+	return true
+}
+
+// transaction runs BEGIN, COMMIT and ABORT. The receipt of COMMIT is only sent
+// once msgqueue has queued the messages, and a failed COMMIT closes the
+// connection then
+func (s *stompSession) transaction(frame stompFrame) bool {
+	id := frame.headers["transaction"]
+
+	if id == "" {
+		s.fail(frame, "missing transaction", frame.command+" needs a transaction header")
+		return false
+	}
+
+	if frame.command == "BEGIN" {
+		if err := s.txs.begin(id); err != nil {
+			s.fail(frame, "invalid transaction", err.Error())
+			return false
+		}
+
+		s.receipt(frame)
+		return true
+	}
+
+	s.ending.Add(1)
+	err := s.txs.end(id, strings.ToLower(frame.command), func(ack pushAck) {
+		defer s.ending.Done()
+
+		if frame.command == "COMMIT" && ack.Status != "committed" {
+			s.fail(frame, "transaction not committed", "msgqueue answered "+ack.Status+" for transaction "+id)
+			s.info.WS.Close()
+			return
+		}
+
+		s.receipt(frame)
+	})
+
+	if err != nil {
+		s.ending.Done()
+		s.fail(frame, "unknown transaction", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// serveSTOMP reads the frames of a STOMP client until it disconnects or sends
+// something wrong
+func serveSTOMP(conn *websocket.Conn, alive *keepalive.Conn, info *connInfo, log logger, identity string) {
+	s := &stompSession{alive: alive, info: info, log: log, remote: info.Remote, identity: identity}
+	s.txs = newTxSession(info.ID, log)
+	defer s.txs.abortAll()
+	connected := false
+
+	for {
+		_, data, err := conn.ReadMessage()
+
+		if err != nil {
+			s.log.Info("Connection closed", "reason", err)
+			return
+		}
+
+		alive.Received()
+		frame, err := parseSTOMP(data)
+
+		if err != nil {
+			s.fail(frame, "malformed frame", err.Error())
+			return
+		}
+
+		switch {
+		case frame.command == "":
+			continue
+		case frame.command == "CONNECT" || frame.command == "STOMP":
+			if connected {
+				s.fail(frame, "already connected", "CONNECT can only be sent once")
+				return
+			}
+
+			connected = s.connect(frame)
+
+			if !connected {
+				return
+			}
+		case !connected:
+			s.fail(frame, "not connected", "the first frame must be CONNECT")
+			return
+		case frame.command == "SEND":
+			if !s.send(frame) {
+				return
+			}
+		case frame.command == "BEGIN" || frame.command == "COMMIT" || frame.command == "ABORT":
+			if !s.transaction(frame) {
+				return
+			}
+		case frame.command == "DISCONNECT":
+			s.ending.Wait()
+			s.receipt(frame)
+			s.log.Info("STOMP session disconnected")
+			return
+		default:
+			s.fail(frame, "unsupported command", "the publisher only accepts SEND, BEGIN, COMMIT and ABORT, "+frame.command+" must be sent to the subscriber")
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Header of the messages published in a transaction, with its ID
+const transactionHeader = "transaction"
+
+// Most transactions a client can have open at once
+const maxOpenTransactions = 16
+
+// transactionFrame begins, commits or aborts a transaction. Clients send it on
+// /publish with the ID they picked, and it's pushed to msgqueue with the one
+// given by the publisher
+type transactionFrame struct {
+	Transaction string
+	Action      string
+}
+
+// parseTransactionFrame tells apart the frames of a transaction from messages,
+// which always have a topic
+func parseTransactionFrame(msg []byte) (transactionFrame, bool) {
+	var frame struct {
+		Topic       string
+		Transaction string
+		Action      string
+	}
+
+	err := json.Unmarshal(msg, &frame)
+
+	if err != nil || frame.Topic != "" || frame.Transaction == "" || frame.Action == "" {
+		return transactionFrame{}, false
+	}
+
+	return transactionFrame{Transaction: frame.Transaction, Action: frame.Action}, true
+}
+
+// checkNoTransaction refuses the messages naming a transaction where there's no
+// session to hold it, like the ones published over HTTP, as msgqueue would drop them
+func checkNoTransaction(m envelope) error {
+	if _, ok := m.Headers[transactionHeader]; ok {
+		return errors.New("transactions can only be used on /publish websockets")
+	}
+
+	return nil
+}
+
+// transactionWaitKey is what the answer to the end of a transaction is awaited
+// by, apart from the IDs of the messages
+func transactionWaitKey(id string) string {
+	return "transaction " + id
+}
+
+// txSession holds the transactions a client has open, by the ID the client gave
+// them, with the ID they have on msgqueue, which is unique across clients
+type txSession struct {
+	prefix string
+	open   map[string]string
+	log    logger
+}
+
+// newTxSession gives the IDs on msgqueue a random part, so the transactions of a
+// connection can't be guessed from its ID
+func newTxSession(connID string, log logger) *txSession {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return &txSession{prefix: idPrefix + "-" + connID + "-" + hex.EncodeToString(secret) + "-", open: make(map[string]string), log: log}
+}
+
+// pushTransactionFrame queues a frame for msgqueue, between the messages of the
+// client so it keeps their order
+func pushTransactionFrame(id string, action string) {
+	frame, _ := json.Marshal(transactionFrame{Transaction: id, Action: action})
+	thingsToPush <- frame
+}
+
+func (s *txSession) begin(id string) error {
+	if _, ok := s.open[id]; ok {
+		return fmt.Errorf("transaction %s is already open", id)
+	}
+
+	if len(s.open) >= maxOpenTransactions {
+		return fmt.Errorf("no more than %d transactions can be open at once", maxOpenTransactions)
+	}
+
+	s.open[id] = s.prefix + id
+	pushTransactionFrame(s.open[id], "begin")
+	s.log.Debug("Transaction begun", "transaction", id)
+
+	return nil
+}
+
+// member gives a message published in a transaction the ID the transaction has
+// on msgqueue. Messages outside of one are left as they are
+func (s *txSession) member(m *envelope) error {
+	id, ok := m.Headers[transactionHeader]
+
+	if !ok {
+		return nil
+	}
+
+	upstream, ok := s.open[id]
+
+	if !ok {
+		return fmt.Errorf("transaction %s isn't open", id)
+	}
+
+	m.Headers[transactionHeader] = upstream
+
+	return nil
+}
+
+// end commits or aborts a transaction and gives done what msgqueue tells about
+// it. The answer is waited for on its own goroutine, so the client can go on
+// publishing meanwhile. Commits that aren't answered in time are reported as
+// unconfirmed
+func (s *txSession) end(id string, action string, done func(ack pushAck)) error {
+	upstream, ok := s.open[id]
+
+	if !ok {
+		return fmt.Errorf("transaction %s isn't open", id)
+	}
+
+	delete(s.open, id)
+	answer := acks.await(transactionWaitKey(upstream), cfg.Upstream.AckTimeout)
+	pushTransactionFrame(upstream, action)
+	log := s.log
+
+	go func() {
+		ack := <-answer
+		ack.Transaction = id
+
+		if ack.Status == "" {
+			ack.Status = "unconfirmed"
+		}
+
+		log.Debug("Transaction ended", "transaction", id, "action", action, "status", ack.Status, "count", ack.Count)
+		transactions.Inc(ack.Status)
+		done(ack)
+	}()
+
+	return nil
+}
+
+// abortAll aborts the transactions left open when the client goes away
+func (s *txSession) abortAll() {
+	for id, upstream := range s.open {
+		pushTransactionFrame(upstream, "abort")
+		transactions.Inc("abandoned")
+		s.log.Info("Transaction abandoned", "transaction", id)
+	}
+
+	s.open = make(map[string]string)
+}
+
+// handle runs a frame of a transaction sent on /publish and gives done how it
+// went, once msgqueue answers for commit and abort
+func (s *txSession) handle(frame transactionFrame, done func(ack pushAck, err error)) {
+	var err error
+
+	switch frame.Action {
+	case "begin":
+		err = s.begin(frame.Transaction)
+		done(pushAck{Transaction: frame.Transaction, Status: "open"}, err)
+		return
+	case "commit", "abort":
+		err = s.end(frame.Transaction, frame.Action, func(ack pushAck) { done(ack, nil) })
+	default:
+		err = errors.New("the action of a transaction must be begin, commit or abort")
+	}
+
+	if err != nil {
+		done(pushAck{}, err)
+	}
+}
+
+// rewrite gives a message of /publish published in a transaction the ID the
+// transaction has on msgqueue
+func (s *txSession) rewrite(msg []byte) ([]byte, error) {
+	var m envelope
+
+	if json.Unmarshal(msg, &m) != nil || m.Headers[transactionHeader] == "" {
+		return msg, nil
+	}
+
+	err := s.member(&m)
+
+	if err != nil {
+		return msg, err
+	}
+
+	return json.Marshal(m)
+}
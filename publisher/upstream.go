@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/gorilla/websocket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Answer to the publishes made while msgqueue is being dialed again
+var errUpstreamLost = errors.New("msgqueue is unreachable, try again later")
+
+// upstreamLink holds the connection to msgqueue, which is nil until it's dialed
+// and while it's dialed again after being lost
+type upstreamLink struct {
+	conn    *websocket.Conn
+	lost    bool
+	changed chan struct{}
+	mux     sync.Mutex
+}
+
+var upstream = &upstreamLink{changed: make(chan struct{})}
+
+// current returns the connection, and a channel closed when it changes
+func (u *upstreamLink) current() (*websocket.Conn, <-chan struct{}) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.conn, u.changed
+}
+
+// set replaces the connection, nil when it's lost
+func (u *upstreamLink) set(conn *websocket.Conn) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.conn = conn
+	close(u.changed)
+	u.changed = make(chan struct{})
+
+	if conn != nil {
+		atomic.StoreInt32(&upstreamConnected, 1)
+	} else {
+		atomic.StoreInt32(&upstreamConnected, 0)
+	}
+}
+
+// setLost tells whether the connection was lost and is being dialed again
+func (u *upstreamLink) setLost(lost bool) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.lost = lost
+}
+
+// available fails while the connection is being dialed again, so publishes are
+// refused instead of piling up
+func (u *upstreamLink) available() error {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if u.lost {
+		return errUpstreamLost
+	}
+
+	return nil
+}
+
+// maintainUpstream watches the connection to msgqueue and dials it again with
+// backoff when it's lost, until the service stops
+func maintainUpstream(conn *websocket.Conn) {
+	for conn != nil {
+		upstream.set(conn)
+		upstream.setLost(false)
+		watchUpstream(conn)
+		upstream.setLost(true)
+		upstream.set(nil)
+		conn = redialUpstream()
+	}
+}
+
+// redialUpstream dials msgqueue until it answers, waiting reconnect_backoff and
+// then twice as long each time up to reconnect_max_backoff. It gives up when the
+// service stops
+func redialUpstream() *websocket.Conn {
+	backoff := cfg.Upstream.ReconnectBackoff
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-stopping:
+			return nil
+		}
+
+		conn, err := dialToService(cfg.Upstream.Addr, "/pushmsg", cfg.Upstream.Username, cfg.Upstream.Password, cfg.Upstream.Compression, batchProtocol)
+
+		if err == nil {
+			logs.Info("Reconnected to msgqueue", "upstream", cfg.Upstream.Addr, "attempts", attempt)
+			return conn
+		}
+
+		logs.Warn("Error dialing msgqueue again", "upstream", cfg.Upstream.Addr, "attempt", attempt, "backoff", backoff, "error", err)
+		backoff *= 2
+
+		if backoff > cfg.Upstream.ReconnectMaxBackoff {
+			backoff = cfg.Upstream.ReconnectMaxBackoff
+		}
+	}
+}
+
+// watchUpstream reads from the msgqueue connection until it fails, so pongs get
+// processed and a dead msgqueue is noticed. The only messages on it are the
+// answers for the messages with an idempotency key and the transactions
+func watchUpstream(conn *websocket.Conn) {
+	alive := keepalive.Start(conn, cfg.Upstream.keepAlive(), logs)
+	defer alive.Stop()
+
+	for {
+		kind, frame, err := conn.ReadMessage()
+
+		if err != nil {
+			logs.Error("Lost connection to msgqueue", "upstream", cfg.Upstream.Addr, "error", err)
+			conn.Close()
+			return
+		}
+
+		if kind == websocket.TextMessage {
+			acks.resolve(frame)
+		}
+	}
+}
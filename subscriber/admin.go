@@ -0,0 +1,151 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+type connInfo = admin.Conn
+
+// connListing is a connection as listed by the admin API, with the topics and
+// groups it's subscribed to
+type connListing struct {
+	admin.Conn
+	Subscriptions []string    `json:"subscriptions,omitempty"`
+	Groups        []groupInfo `json:"groups,omitempty"`
+}
+
+// groupInfo is a group joined by a connection and its topic or pattern
+type groupInfo struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+}
+
+func adminConnSets() []*admin.ConnSet {
+	return []*admin.ConnSet{clients}
+}
+
+// drainConn unsubscribes a client from every topic, so no more messages are
+// sent to it, and then asks it to close
+func drainConn(info connInfo) {
+	unsubscribeAll(info.WS)
+	admin.CloseConn(info.WS, websocket.CloseGoingAway, "drained by admin", false, cfg.KeepAlive.WriteTimeout)
+}
+
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	infos := []connListing{}
+
+	for _, c := range adminServer().Connections() {
+		infos = append(infos, connListing{Conn: c})
+	}
+
+	subscribers.mux.Lock()
+
+	for i := range infos {
+		for topic, subs := range subscribers.subs {
+			for key := range subs {
+				if owns(key, infos[i].WS) {
+					infos[i].Subscriptions = append(infos[i].Subscriptions, topic)
+					break
+				}
+			}
+		}
+
+		sort.Strings(infos[i].Subscriptions)
+
+		for topic, groups := range subscribers.groups {
+			for name, g := range groups {
+				for _, member := range g.members {
+					if owns(member.key, infos[i].WS) {
+						infos[i].Groups = append(infos[i].Groups, groupInfo{topic, name})
+						break
+					}
+				}
+			}
+		}
+
+		sort.Slice(infos[i].Groups, func(a, b int) bool {
+			return infos[i].Groups[a].Topic+"\x00"+infos[i].Groups[a].Group < infos[i].Groups[b].Topic+"\x00"+infos[i].Groups[b].Group
+		})
+	}
+
+	subscribers.mux.Unlock()
+	admin.ReplyJSON(w, http.StatusOK, infos)
+}
+
+type topicStats struct {
+	Subscribers int     `json:"subscribers"`
+	Groups      int     `json:"groups,omitempty"`
+	Delivered   float64 `json:"delivered"`
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	topicCounts := make(map[string]topicStats)
+
+	for topic, count := range delivered.Snapshot() {
+		topicCounts[topic] = topicStats{Delivered: count}
+	}
+
+	subscribers.mux.Lock()
+
+	for topic, subs := range subscribers.subs {
+		if len(subs) > 0 {
+			stats := topicCounts[topic]
+			stats.Subscribers = len(subs)
+			topicCounts[topic] = stats
+		}
+	}
+
+	for filter, subs := range subscribers.filters {
+		stats := topicCounts[filter]
+		stats.Subscribers += len(subs)
+		topicCounts[filter] = stats
+	}
+
+	for topic, groups := range subscribers.groups {
+		stats := topicCounts[topic]
+		stats.Groups = len(groups)
+		topicCounts[topic] = stats
+	}
+
+	subscribers.mux.Unlock()
+
+	admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": map[string]int{"/subscribe": clients.Count(), "/events": int(atomic.LoadInt32(&eventStreams)), "/sessions": sessions.count(), "mqtt": mqttConns.count("mqtt"), "/mqtt": mqttConns.count("/mqtt")},
+		"webhooks":    webhooks.count(),
+		"upstream":    atomic.LoadInt32(&upstreamConnected) == 1,
+		"topics":      topicCounts,
+		"received":    received.Snapshot()[""],
+		"dropped":     dropped.Snapshot(),
+	})
+}
+
+// adminServer is the admin API with the credentials and connections of the
+// service
+func adminServer() *admin.Server {
+	return &admin.Server{
+		Username:     cfg.Admin.Username,
+		Password:     cfg.Admin.Password,
+		Sets:         adminConnSets(),
+		Drain:        drainConn,
+		WriteTimeout: cfg.KeepAlive.WriteTimeout,
+		Logs:         logs,
+		AuthFailures: authFailures,
+	}
+}
+
+// initAdmin serves the admin API on its own listener, with the same server
+// certificate as the websockets
+func initAdmin(addr string, certDir string, adminReady chan<- bool) error {
+	server := adminServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", server.Handler(listConnections, "GET"))
+	mux.HandleFunc("/connections/", server.Handler(server.ManageConnection, "DELETE", "POST"))
+	mux.HandleFunc("/log/level", server.Handler(admin.LogLevel, "GET", "PUT"))
+	mux.HandleFunc("/stats", server.Handler(showStats, "GET"))
+
+	return server.Serve(addr, certDir, mux, adminReady, stopping, &stopDeadline)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Javivi/ws-go/internal/codec"
+	"github.com/Javivi/ws-go/internal/keepalive"
+)
+
+type envelope = codec.Envelope
+
+// codecSink delivers the messages of a subscription encoded with a codec
+type codecSink struct {
+	alive *keepalive.Conn
+	codec codec.Codec
+}
+
+func (c codecSink) deliver(msg []byte, id string) error {
+	var m envelope
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil {
+		return err
+	}
+
+	return c.alive.Write(c.codec.FrameType(), c.codec.Encode(m))
+}
+
+func (c codecSink) remoteAddr() string {
+	return c.alive.RemoteAddr()
+}
+
+func (c codecSink) load() int {
+	return c.alive.Pending()
+}
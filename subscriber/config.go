@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/settings"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// config holds every setting of the service. The values are taken, in order of
+// precedence, from the command line flags, the environment, the configuration
+// file and the defaults
+type config struct {
+	Listen          string `yaml:"listen"`
+	CertDir         string `yaml:"cert_dir"`
+	ClientAuth      string `yaml:"client_auth"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	ReadBufferSize  int    `yaml:"read_buffer_size"`
+	WriteBufferSize int    `yaml:"write_buffer_size"`
+
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`
+	MetricsMaxTopics int           `yaml:"metrics_max_topics"`
+	EventHistory     int           `yaml:"event_history"`
+	EventHeartbeat   time.Duration `yaml:"event_heartbeat"`
+
+	SessionTimeout    time.Duration `yaml:"session_timeout"`
+	SessionBufferSize int           `yaml:"session_buffer_size"`
+	PollMaxWait       time.Duration `yaml:"poll_max_wait"`
+
+	WebhookAttempts     int           `yaml:"webhook_attempts"`
+	WebhookBackoff      time.Duration `yaml:"webhook_backoff"`
+	WebhookMaxBackoff   time.Duration `yaml:"webhook_max_backoff"`
+	WebhookTimeout      time.Duration `yaml:"webhook_timeout"`
+	WebhookBufferSize   int           `yaml:"webhook_buffer_size"`
+	WebhookAllowPrivate bool          `yaml:"webhook_allow_private"`
+	WebhookHostLimit    int           `yaml:"webhook_host_limit"`
+	WebhookFile         string        `yaml:"webhook_file"`
+
+	STOMPMaxUnacked int    `yaml:"stomp_max_unacked"`
+	GroupStrategy   string `yaml:"group_strategy"`
+	Instance        string `yaml:"instance"`
+
+	LogLevel            string `yaml:"log_level"`
+	LogFormat           string `yaml:"log_format"`
+	LogOutput           string `yaml:"log_output"`
+	LogPayloads         bool   `yaml:"log_payloads"`
+	LogSampleInitial    int    `yaml:"log_sample_initial"`
+	LogSampleThereafter int    `yaml:"log_sample_thereafter"`
+
+	TraceExporter    string  `yaml:"trace_exporter"`
+	TraceFile        string  `yaml:"trace_file"`
+	TraceEndpoint    string  `yaml:"trace_endpoint"`
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio"`
+
+	KeepAlive   keepalive.Config   `yaml:"keepalive"`
+	Compression compression.Config `yaml:"compression"`
+	Admin       adminConfig        `yaml:"admin"`
+	MQTT        mqttConfig         `yaml:"mqtt"`
+	Upstream    upstreamConfig     `yaml:"upstream"`
+	Publisher   upstreamConfig     `yaml:"publisher"`
+}
+
+// upstreamConfig is where the service dials to and the credentials it uses
+type upstreamConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	PingInterval time.Duration `yaml:"ping_interval"`
+	PongTimeout  time.Duration `yaml:"pong_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// Only msgqueue is dialed again with backoff, the publisher when it's needed
+	ReconnectBackoff    time.Duration `yaml:"reconnect_backoff,omitempty"`
+	ReconnectMaxBackoff time.Duration `yaml:"reconnect_max_backoff,omitempty"`
+
+	Compression compression.Config `yaml:"compression"`
+}
+
+// keepAlive returns the settings for the upstream connection, which is never
+// closed for being idle
+func (u upstreamConfig) keepAlive() keepalive.Config {
+	return keepalive.Config{PingInterval: u.PingInterval, PongTimeout: u.PongTimeout, WriteTimeout: u.WriteTimeout}
+}
+
+// adminConfig is where the admin API listens and the credentials it accepts,
+// which are separate from the ones of the clients
+type adminConfig struct {
+	Listen   string `yaml:"listen"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// mqttConfig is where the MQTT gateway listens and the limits of its clients
+type mqttConfig struct {
+	Listen        string        `yaml:"listen"`
+	MaxPacketSize int           `yaml:"max_packet_size"`
+	MaxInflight   int           `yaml:"max_inflight"`
+	QueueSize     int           `yaml:"queue_size"`
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+	MaxRetained   int           `yaml:"max_retained"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() config {
+	return config{
+		Listen:              "localhost:8082",
+		ClientAuth:          "none",
+		Username:            "hello",
+		Password:            "test",
+		ReadBufferSize:      1024,
+		WriteBufferSize:     1024,
+		ShutdownTimeout:     10 * time.Second,
+		MetricsMaxTopics:    100,
+		EventHistory:        1000,
+		EventHeartbeat:      15 * time.Second,
+		SessionTimeout:      time.Minute,
+		SessionBufferSize:   1000,
+		PollMaxWait:         30 * time.Second,
+		WebhookAttempts:     5,
+		WebhookBackoff:      time.Second,
+		WebhookMaxBackoff:   time.Minute,
+		WebhookTimeout:      10 * time.Second,
+		WebhookBufferSize:   1000,
+		WebhookHostLimit:    8,
+		STOMPMaxUnacked:     1000,
+		GroupStrategy:       "round-robin",
+		LogLevel:            "info",
+		LogFormat:           "logfmt",
+		LogOutput:           "stdout",
+		LogSampleInitial:    10,
+		LogSampleThereafter: 100,
+		TraceExporter:       "none",
+		TraceEndpoint:       "http://localhost:4318/v1/traces",
+		TraceSampleRatio:    1,
+		Admin: adminConfig{
+			Username: "admin",
+		},
+		KeepAlive: keepalive.Config{
+			PingInterval: 30 * time.Second,
+			PongTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		MQTT: mqttConfig{
+			Listen:        "localhost:8883",
+			MaxPacketSize: 1 << 20,
+			MaxInflight:   100,
+			QueueSize:     1000,
+			SessionExpiry: time.Hour,
+			MaxRetained:   10000,
+		},
+		Compression: compression.Config{
+			Level:   1,
+			MinSize: 256,
+		},
+		Upstream: upstreamConfig{
+			Addr:                "localhost:8080",
+			Username:            "hello",
+			Password:            "test",
+			PingInterval:        30 * time.Second,
+			PongTimeout:         10 * time.Second,
+			WriteTimeout:        10 * time.Second,
+			ReconnectBackoff:    time.Second,
+			ReconnectMaxBackoff: 30 * time.Second,
+			Compression: compression.Config{
+				Level:   1,
+				MinSize: 256,
+			},
+		},
+		Publisher: upstreamConfig{
+			Addr:         "localhost:8081",
+			Username:     "hello",
+			Password:     "test",
+			PingInterval: 30 * time.Second,
+			PongTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			Compression: compression.Config{
+				Level:   1,
+				MinSize: 256,
+			},
+		},
+	}
+}
+
+func (c *config) options() []settings.Option {
+	return []settings.Option{
+		{Flag: "listen", Env: "WS_LISTEN", Usage: "address to listen on", Value: &c.Listen},
+		{Flag: "cert-dir", Env: "WS_CERT_DIR", Usage: "directory with the certificates", Value: &c.CertDir},
+		{Flag: "client-auth", Env: "WS_CLIENT_AUTH", Usage: "client certificates: none, request or require", Value: &c.ClientAuth},
+		{Flag: "username", Env: "WS_USERNAME", Usage: "username accepted from clients", Value: &c.Username},
+		{Flag: "password", Env: "WS_PASSWORD", Usage: "password accepted from clients", Value: &c.Password},
+		{Flag: "read-buffer-size", Env: "WS_READ_BUFFER_SIZE", Usage: "websocket read buffer size in bytes", Value: &c.ReadBufferSize},
+		{Flag: "write-buffer-size", Env: "WS_WRITE_BUFFER_SIZE", Usage: "websocket write buffer size in bytes", Value: &c.WriteBufferSize},
+		{Flag: "shutdown-timeout", Env: "WS_SHUTDOWN_TIMEOUT", Usage: "time given to close the connections on shutdown", Value: &c.ShutdownTimeout},
+		{Flag: "event-history", Env: "WS_EVENT_HISTORY", Usage: "messages kept to resume event streams from their Last-Event-ID", Value: &c.EventHistory},
+		{Flag: "event-heartbeat", Env: "WS_EVENT_HEARTBEAT", Usage: "time between heartbeat comments on idle event streams", Value: &c.EventHeartbeat},
+		{Flag: "session-timeout", Env: "WS_SESSION_TIMEOUT", Usage: "time after which an unused long polling session is removed", Value: &c.SessionTimeout},
+		{Flag: "session-buffer-size", Env: "WS_SESSION_BUFFER_SIZE", Usage: "unacked messages a long polling session can hold", Value: &c.SessionBufferSize},
+		{Flag: "poll-max-wait", Env: "WS_POLL_MAX_WAIT", Usage: "longest time a poll waits for messages", Value: &c.PollMaxWait},
+		{Flag: "webhook-attempts", Env: "WS_WEBHOOK_ATTEMPTS", Usage: "times a message is posted to a webhook before it's kept as a dead letter", Value: &c.WebhookAttempts},
+		{Flag: "webhook-backoff", Env: "WS_WEBHOOK_BACKOFF", Usage: "wait before the first retry of a webhook, doubled after each one", Value: &c.WebhookBackoff},
+		{Flag: "webhook-max-backoff", Env: "WS_WEBHOOK_MAX_BACKOFF", Usage: "longest wait between retries of a webhook", Value: &c.WebhookMaxBackoff},
+		{Flag: "webhook-timeout", Env: "WS_WEBHOOK_TIMEOUT", Usage: "time given to a webhook to answer", Value: &c.WebhookTimeout},
+		{Flag: "webhook-buffer-size", Env: "WS_WEBHOOK_BUFFER_SIZE", Usage: "messages waiting to be posted to a webhook, more are dropped", Value: &c.WebhookBufferSize},
+		{Flag: "webhook-allow-private", Env: "WS_WEBHOOK_ALLOW_PRIVATE", Usage: "allow webhooks on loopback, private and link-local addresses", Value: &c.WebhookAllowPrivate},
+		{Flag: "webhook-host-limit", Env: "WS_WEBHOOK_HOST_LIMIT", Usage: "posts running at once to the host of webhooks, shared by all of its webhooks", Value: &c.WebhookHostLimit},
+		{Flag: "webhook-file", Env: "WS_WEBHOOK_FILE", Usage: "file where the webhooks are kept between restarts, empty keeps them in memory", Value: &c.WebhookFile},
+		{Flag: "stomp-max-unacked", Env: "WS_STOMP_MAX_UNACKED", Usage: "messages a STOMP subscription with client acks can have unacked, more are dropped", Value: &c.STOMPMaxUnacked},
+		{Flag: "group-strategy", Env: "WS_GROUP_STRATEGY", Usage: "how the member of a group that gets each message is picked: round-robin or least-load", Value: &c.GroupStrategy},
+		{Flag: "metrics-max-topics", Env: "WS_METRICS_MAX_TOPICS", Usage: "different topics reported in the metrics, the rest are reported as other", Value: &c.MetricsMaxTopics},
+		{Flag: "log-level", Env: "WS_LOG_LEVEL", Usage: "lowest level logged: debug, info, warn or error", Value: &c.LogLevel},
+		{Flag: "log-format", Env: "WS_LOG_FORMAT", Usage: "log format: json or logfmt", Value: &c.LogFormat},
+		{Flag: "log-output", Env: "WS_LOG_OUTPUT", Usage: "where logs are written: stdout, stderr or a file path", Value: &c.LogOutput},
+		{Flag: "log-payloads", Env: "WS_LOG_PAYLOADS", Usage: "log the content of the messages instead of their size", Value: &c.LogPayloads},
+		{Flag: "log-sample-initial", Env: "WS_LOG_SAMPLE_INITIAL", Usage: "per message entries logged each second before sampling, 0 disables sampling", Value: &c.LogSampleInitial},
+		{Flag: "log-sample-thereafter", Env: "WS_LOG_SAMPLE_THEREAFTER", Usage: "once sampling, log one of every this many entries, 0 drops them all", Value: &c.LogSampleThereafter},
+		{Flag: "trace-exporter", Env: "WS_TRACE_EXPORTER", Usage: "where spans are sent: none, stdout, file or otlp", Value: &c.TraceExporter},
+		{Flag: "trace-file", Env: "WS_TRACE_FILE", Usage: "file the spans are appended to with the file exporter", Value: &c.TraceFile},
+		{Flag: "trace-endpoint", Env: "WS_TRACE_ENDPOINT", Usage: "OTLP/HTTP traces URL of the collector with the otlp exporter", Value: &c.TraceEndpoint},
+		{Flag: "trace-sample-ratio", Env: "WS_TRACE_SAMPLE_RATIO", Usage: "fraction of the new traces that are recorded", Value: &c.TraceSampleRatio},
+		{Flag: "admin-listen", Env: "WS_ADMIN_LISTEN", Usage: "address of the admin API, empty disables it, it needs a password other than test", Value: &c.Admin.Listen},
+		{Flag: "admin-username", Env: "WS_ADMIN_USERNAME", Usage: "username accepted by the admin API", Value: &c.Admin.Username},
+		{Flag: "admin-password", Env: "WS_ADMIN_PASSWORD", Usage: "password accepted by the admin API", Value: &c.Admin.Password},
+		{Flag: "mqtt-listen", Env: "WS_MQTT_LISTEN", Usage: "address of the MQTT gateway, empty disables it", Value: &c.MQTT.Listen},
+		{Flag: "mqtt-max-packet-size", Env: "WS_MQTT_MAX_PACKET_SIZE", Usage: "largest MQTT packet accepted from a client in bytes", Value: &c.MQTT.MaxPacketSize},
+		{Flag: "mqtt-max-inflight", Env: "WS_MQTT_MAX_INFLIGHT", Usage: "QoS 1 messages sent to an MQTT client before it acks them", Value: &c.MQTT.MaxInflight},
+		{Flag: "mqtt-queue-size", Env: "WS_MQTT_QUEUE_SIZE", Usage: "QoS 1 messages queued for an MQTT client that's away or busy", Value: &c.MQTT.QueueSize},
+		{Flag: "mqtt-session-expiry", Env: "WS_MQTT_SESSION_EXPIRY", Usage: "longest time the session of an MQTT client is kept after it disconnects", Value: &c.MQTT.SessionExpiry},
+		{Flag: "mqtt-max-retained", Env: "WS_MQTT_MAX_RETAINED", Usage: "topics with a retained message", Value: &c.MQTT.MaxRetained},
+		{Flag: "ping-interval", Env: "WS_PING_INTERVAL", Usage: "time between pings to the clients", Value: &c.KeepAlive.PingInterval},
+		{Flag: "pong-timeout", Env: "WS_PONG_TIMEOUT", Usage: "time a client has to answer a ping after the interval", Value: &c.KeepAlive.PongTimeout},
+		{Flag: "write-timeout", Env: "WS_WRITE_TIMEOUT", Usage: "time allowed to write a message to a client", Value: &c.KeepAlive.WriteTimeout},
+		{Flag: "idle-timeout", Env: "WS_IDLE_TIMEOUT", Usage: "close clients without messages for this long, 0 disables it", Value: &c.KeepAlive.IdleTimeout},
+		{Flag: "compression", Env: "WS_COMPRESSION", Usage: "accept permessage-deflate from the clients that ask for it", Value: &c.Compression.Enabled},
+		{Flag: "compression-level", Env: "WS_COMPRESSION_LEVEL", Usage: "deflate level for the clients, from 1 (fastest) to 9 (smallest)", Value: &c.Compression.Level},
+		{Flag: "compression-min-size", Env: "WS_COMPRESSION_MIN_SIZE", Usage: "messages to the clients smaller than this many bytes aren't compressed", Value: &c.Compression.MinSize},
+		{Flag: "upstream", Env: "WS_UPSTREAM", Usage: "address of the msgqueue service", Value: &c.Upstream.Addr},
+		{Flag: "instance", Env: "WS_INSTANCE", Usage: "name of this instance when several share msgqueue, empty for a single one", Value: &c.Instance},
+		{Flag: "upstream-username", Env: "WS_UPSTREAM_USERNAME", Usage: "username used with the msgqueue service", Value: &c.Upstream.Username},
+		{Flag: "upstream-password", Env: "WS_UPSTREAM_PASSWORD", Usage: "password used with the msgqueue service", Value: &c.Upstream.Password},
+		{Flag: "upstream-ping-interval", Env: "WS_UPSTREAM_PING_INTERVAL", Usage: "time between pings to the msgqueue service", Value: &c.Upstream.PingInterval},
+		{Flag: "upstream-pong-timeout", Env: "WS_UPSTREAM_PONG_TIMEOUT", Usage: "time msgqueue has to answer a ping after the interval", Value: &c.Upstream.PongTimeout},
+		{Flag: "upstream-write-timeout", Env: "WS_UPSTREAM_WRITE_TIMEOUT", Usage: "time allowed to write a message to msgqueue", Value: &c.Upstream.WriteTimeout},
+		{Flag: "upstream-reconnect-backoff", Env: "WS_UPSTREAM_RECONNECT_BACKOFF", Usage: "wait before dialing msgqueue again after losing it, doubled after each failure", Value: &c.Upstream.ReconnectBackoff},
+		{Flag: "upstream-reconnect-max-backoff", Env: "WS_UPSTREAM_RECONNECT_MAX_BACKOFF", Usage: "longest wait between attempts to dial msgqueue", Value: &c.Upstream.ReconnectMaxBackoff},
+		{Flag: "upstream-compression", Env: "WS_UPSTREAM_COMPRESSION", Usage: "ask msgqueue for permessage-deflate", Value: &c.Upstream.Compression.Enabled},
+		{Flag: "upstream-compression-level", Env: "WS_UPSTREAM_COMPRESSION_LEVEL", Usage: "deflate level for msgqueue, from 1 (fastest) to 9 (smallest)", Value: &c.Upstream.Compression.Level},
+		{Flag: "upstream-compression-min-size", Env: "WS_UPSTREAM_COMPRESSION_MIN_SIZE", Usage: "messages to msgqueue smaller than this many bytes aren't compressed", Value: &c.Upstream.Compression.MinSize},
+		{Flag: "publisher", Env: "WS_PUBLISHER", Usage: "address of the publisher service, used for the messages of MQTT clients", Value: &c.Publisher.Addr},
+		{Flag: "publisher-username", Env: "WS_PUBLISHER_USERNAME", Usage: "username used with the publisher service", Value: &c.Publisher.Username},
+		{Flag: "publisher-password", Env: "WS_PUBLISHER_PASSWORD", Usage: "password used with the publisher service", Value: &c.Publisher.Password},
+		{Flag: "publisher-ping-interval", Env: "WS_PUBLISHER_PING_INTERVAL", Usage: "time between pings to the publisher service", Value: &c.Publisher.PingInterval},
+		{Flag: "publisher-pong-timeout", Env: "WS_PUBLISHER_PONG_TIMEOUT", Usage: "time the publisher has to answer a ping after the interval", Value: &c.Publisher.PongTimeout},
+		{Flag: "publisher-write-timeout", Env: "WS_PUBLISHER_WRITE_TIMEOUT", Usage: "time allowed to write a message to the publisher, and for it to confirm the QoS 1 ones", Value: &c.Publisher.WriteTimeout},
+		{Flag: "publisher-compression", Env: "WS_PUBLISHER_COMPRESSION", Usage: "ask the publisher for permessage-deflate", Value: &c.Publisher.Compression.Enabled},
+		{Flag: "publisher-compression-level", Env: "WS_PUBLISHER_COMPRESSION_LEVEL", Usage: "deflate level for the publisher, from 1 (fastest) to 9 (smallest)", Value: &c.Publisher.Compression.Level},
+		{Flag: "publisher-compression-min-size", Env: "WS_PUBLISHER_COMPRESSION_MIN_SIZE", Usage: "messages to the publisher smaller than this many bytes aren't compressed", Value: &c.Publisher.Compression.MinSize},
+	}
+}
+
+func (c *config) validate() error {
+	_, _, err := net.SplitHostPort(c.Listen)
+
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %s", c.Listen, err)
+	}
+
+	_, err = certstore.ParseClientAuth(c.ClientAuth)
+
+	if err != nil {
+		return err
+	}
+
+	if c.Username == "" {
+		return errors.New("username can't be empty")
+	}
+
+	if c.Admin.Listen != "" {
+		_, _, err = net.SplitHostPort(c.Admin.Listen)
+
+		if err != nil {
+			return fmt.Errorf("invalid admin listen address %q: %s", c.Admin.Listen, err)
+		}
+
+		if c.Admin.Username == "" {
+			return errors.New("admin username can't be empty")
+		}
+
+		err = admin.CheckPassword(c.Admin.Password)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0 {
+		return errors.New("buffer sizes must be positive")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+
+	if c.EventHistory < 0 {
+		return errors.New("event history can't be negative")
+	}
+
+	if c.EventHeartbeat <= 0 {
+		return errors.New("event heartbeat must be positive")
+	}
+
+	if c.SessionBufferSize <= 0 {
+		return errors.New("session buffer size must be positive")
+	}
+
+	if c.PollMaxWait <= 0 || c.SessionTimeout <= c.PollMaxWait {
+		return errors.New("poll max wait must be positive and shorter than the session timeout")
+	}
+
+	if c.WebhookAttempts <= 0 || c.WebhookBufferSize <= 0 || c.WebhookHostLimit <= 0 {
+		return errors.New("webhook attempts, buffer size and host limit must be positive")
+	}
+
+	if c.STOMPMaxUnacked <= 0 {
+		return errors.New("STOMP max unacked must be positive")
+	}
+
+	err = validGroupStrategy(c.GroupStrategy)
+
+	if err != nil {
+		return err
+	}
+
+	if c.WebhookBackoff <= 0 || c.WebhookMaxBackoff < c.WebhookBackoff || c.WebhookTimeout <= 0 {
+		return errors.New("webhook timeout and backoff must be positive, and the max backoff can't be shorter than the backoff")
+	}
+
+	if c.MQTT.Listen != "" {
+		_, _, err = net.SplitHostPort(c.MQTT.Listen)
+
+		if err != nil {
+			return fmt.Errorf("invalid MQTT listen address %q: %s", c.MQTT.Listen, err)
+		}
+	}
+
+	if c.MQTT.MaxPacketSize <= 0 || c.MQTT.QueueSize <= 0 || c.MQTT.MaxRetained < 0 || c.MQTT.SessionExpiry < 0 {
+		return errors.New("MQTT max packet size and queue size must be positive, and max retained and session expiry can't be negative")
+	}
+
+	if c.MQTT.MaxInflight <= 0 || c.MQTT.MaxInflight > 65535 {
+		return errors.New("MQTT max inflight must be between 1 and 65535")
+	}
+
+	_, _, err = net.SplitHostPort(c.Publisher.Addr)
+
+	if err != nil {
+		return fmt.Errorf("invalid publisher address %q: %s", c.Publisher.Addr, err)
+	}
+
+	if c.MetricsMaxTopics < 0 {
+		return errors.New("metrics max topics can't be negative")
+	}
+
+	if len(c.Instance) > maxInstanceName {
+		return fmt.Errorf("instance names can't be longer than %d characters", maxInstanceName)
+	}
+
+	_, _, err = net.SplitHostPort(c.Upstream.Addr)
+
+	if err != nil {
+		return fmt.Errorf("invalid upstream address %q: %s", c.Upstream.Addr, err)
+	}
+
+	_, err = logging.ParseLevel(c.LogLevel)
+
+	if err != nil {
+		return err
+	}
+
+	if c.LogFormat != "json" && c.LogFormat != "logfmt" {
+		return fmt.Errorf("invalid log format %q, it must be json or logfmt", c.LogFormat)
+	}
+
+	if c.LogSampleInitial < 0 || c.LogSampleThereafter < 0 {
+		return errors.New("log sampling counts can't be negative")
+	}
+
+	switch c.TraceExporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		if c.TraceFile == "" {
+			return errors.New("the file trace exporter needs a trace file")
+		}
+	default:
+		return fmt.Errorf("invalid trace exporter %q, it must be none, stdout, file or otlp", c.TraceExporter)
+	}
+
+	endpoint, err := url.Parse(c.TraceEndpoint)
+
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid trace endpoint %q, it must be an http or https URL", c.TraceEndpoint)
+	}
+
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return errors.New("trace sample ratio must be between 0 and 1")
+	}
+
+	err = c.KeepAlive.Validate()
+
+	if err != nil {
+		return err
+	}
+
+	for _, settings := range []compression.Config{c.Compression, c.Upstream.Compression, c.Publisher.Compression} {
+		err = settings.Validate()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Upstream.keepAlive().Validate()
+
+	if err != nil {
+		return err
+	}
+
+	if c.Upstream.ReconnectBackoff <= 0 || c.Upstream.ReconnectMaxBackoff < c.Upstream.ReconnectBackoff {
+		return errors.New("upstream reconnect backoff must be positive, and the max backoff can't be shorter than the backoff")
+	}
+
+	return c.Publisher.keepAlive().Validate()
+}
+
+// loadConfig builds the configuration from the defaults, the file given with
+// -config or WS_CONFIG, the environment and the flags, and validates it. It also
+// reports whether -print-config was requested
+func loadConfig(args []string) (config, bool, error) {
+	c := defaultConfig()
+	printOnly, err := settings.Load(args, &c, c.options())
+
+	if err != nil {
+		return c, false, err
+	}
+
+	if c.CertDir != "" && !strings.HasSuffix(c.CertDir, "/") {
+		c.CertDir += "/"
+	}
+
+	return c, printOnly, c.validate()
+}
+
+// printConfig writes the configuration as YAML with the secrets redacted
+func printConfig(c config) error {
+	if c.Password != "" {
+		c.Password = "REDACTED"
+	}
+
+	if c.Admin.Password != "" {
+		c.Admin.Password = "REDACTED"
+	}
+
+	if c.Upstream.Password != "" {
+		c.Upstream.Password = "REDACTED"
+	}
+
+	if c.Publisher.Password != "" {
+		c.Publisher.Password = "REDACTED"
+	}
+
+	return settings.Print(c)
+}
+
+// applyConfig makes the configuration the one used by the service
+func applyConfig(c config) {
+	cfg = c
+	upgrader.ReadBufferSize = c.ReadBufferSize
+	upgrader.WriteBufferSize = c.WriteBufferSize
+	upgrader.EnableCompression = c.Compression.Enabled
+	mqttUpgrader.EnableCompression = c.Compression.Enabled
+	clientCerts = certstore.New(c.CertDir, certstore.ClientCertFile, certstore.ClientKeyFile, false, logs)
+}
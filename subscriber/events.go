@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events waiting to be written to a stream, more than these are dropped
+const eventBufferSize = 100
+
+// Open event streams, reported in the metrics and the admin API
+var eventStreams int32
+
+type event struct {
+	id   string
+	data []byte
+}
+
+// formatEvent writes a message as a server-sent event, the ID is left out if
+// the message doesn't have a valid one
+func formatEvent(id string, msg []byte) event {
+	var data bytes.Buffer
+
+	if strings.ContainsAny(id, "\r\n") {
+		id = ""
+	}
+
+	if id != "" {
+		data.WriteString("id: " + id + "\n")
+	}
+
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		data.WriteString("data: ")
+		data.Write(bytes.TrimSuffix(line, []byte("\r")))
+		data.WriteString("\n")
+	}
+
+	data.WriteString("\n")
+
+	return event{id: id, data: data.Bytes()}
+}
+
+// eventStream is a subscriber on /events. Messages are queued to be written by
+// the handler of the request, so a slow client doesn't hold back the others
+type eventStream struct {
+	remote string
+	events chan event
+}
+
+func (e *eventStream) deliver(msg []byte, id string) error {
+	select {
+	case e.events <- formatEvent(id, msg):
+		return nil
+	default:
+		return errors.New("event stream buffer is full")
+	}
+}
+
+func (e *eventStream) remoteAddr() string {
+	return e.remote
+}
+
+type historyEntry struct {
+	id    string
+	topic string
+	msg   []byte
+}
+
+// eventHistory keeps the last messages with an ID, so event streams can resume
+// from the last one they received
+type eventHistory struct {
+	entries []historyEntry
+	next    int
+	mux     sync.Mutex
+}
+
+var history = &eventHistory{}
+
+func (h *eventHistory) add(id string, topic string, msg []byte) {
+	if id == "" || cfg.EventHistory == 0 {
+		return
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if len(h.entries) < cfg.EventHistory {
+		h.entries = append(h.entries, historyEntry{id, topic, msg})
+		return
+	}
+
+	h.entries[h.next] = historyEntry{id, topic, msg}
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// since returns the messages after the one with the given ID whose topic matches
+// one of the patterns, and whether that ID is still in the history
+func (h *eventHistory) since(id string, patterns []string) ([]historyEntry, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	ordered := append(append([]historyEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+
+	for i, entry := range ordered {
+		if entry.id != id {
+			continue
+		}
+
+		var missed []historyEntry
+
+		for _, entry := range ordered[i+1:] {
+			if matchesAny(patterns, entry.topic) {
+				missed = append(missed, entry)
+			}
+		}
+
+		return missed, true
+	}
+
+	return nil, false
+}
+
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, topic); pattern == topic || (isPattern(pattern) && matched) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamEvents serves GET /events?topic=... as server-sent events. Streams that
+// send a Last-Event-ID header first get the messages they missed
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/events")
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := authenticate(r)
+
+	if !ok {
+		log.Warn("Error validating credentials", "identity", identity)
+		authFailures.Inc("/events")
+		w.Header().Set("WWW-Authenticate", `Basic realm="subscriber"`)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var patterns []string
+
+	for _, param := range r.URL.Query()["topic"] {
+		for _, topic := range strings.Split(param, ",") {
+			if _, err := path.Match(topic, ""); topic == "" || err != nil {
+				http.Error(w, "invalid topic "+topic, http.StatusBadRequest)
+				return
+			}
+
+			patterns = append(patterns, topic)
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if len(patterns) == 0 || !ok {
+		http.Error(w, "at least one topic is needed, e.g. /events?topic=news", http.StatusBadRequest)
+		return
+	}
+
+	log = log.With("identity", identity, "topics", strings.Join(patterns, ","))
+	stream := &eventStream{remote: r.RemoteAddr, events: make(chan event, eventBufferSize)}
+
+	for _, pattern := range patterns {
+		subscribers.subscribe(pattern, stream, stream)
+	}
+
+	defer unsubscribeAll(stream)
+	atomic.AddInt32(&eventStreams, 1)
+	defer atomic.AddInt32(&eventStreams, -1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	log.Info("Event stream opened")
+
+	// Messages that arrive while resuming may be both replayed and queued
+	replayed := make(map[string]bool)
+	lastID := r.Header.Get("Last-Event-ID")
+
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	if lastID != "" {
+		missed, found := history.since(lastID, patterns)
+
+		if !found {
+			w.Write([]byte(": last event ID not found, some messages may have been missed\n\n"))
+		}
+
+		for _, entry := range missed {
+			replayed[entry.id] = true
+			w.Write(formatEvent(entry.id, entry.msg).data)
+		}
+	}
+
+	flusher.Flush()
+	heartbeat := time.NewTicker(cfg.EventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case e := <-stream.events:
+			if replayed[e.id] {
+				continue
+			}
+
+			_, err = w.Write(e.data)
+		case <-heartbeat.C:
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		case <-r.Context().Done():
+			log.Info("Event stream closed", "reason", r.Context().Err())
+			return
+		case <-stopping:
+			return
+		}
+
+		if err != nil {
+			log.Info("Event stream closed", "reason", err)
+			return
+		}
+
+		flusher.Flush()
+	}
+}
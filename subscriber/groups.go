@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+)
+
+// Ways of picking the member of a group that gets a message
+var groupStrategies = map[string]bool{"round-robin": true, "least-load": true}
+
+// Longest name of a group
+const maxGroupName = 128
+
+// groupMember is a connection, or any other owner of subscriptions, that joined
+// a group
+type groupMember struct {
+	key  interface{}
+	sink sink
+}
+
+// group is a queue group: the members that joined a topic or pattern with the
+// same group name share its messages, each one goes to only one of them
+type group struct {
+	members []groupMember
+	next    int
+}
+
+// loaded is a sink that holds the messages it hasn't finished with, and tells
+// how many there are. For websockets they're the writes still running
+type loaded interface {
+	load() int
+}
+
+func validGroup(name string) error {
+	if name == "" || len(name) > maxGroupName {
+		return fmt.Errorf("group names must have between 1 and %d characters", maxGroupName)
+	}
+
+	return nil
+}
+
+func validGroupStrategy(strategy string) error {
+	if !groupStrategies[strategy] {
+		return errors.New("group strategy must be round-robin or least-load")
+	}
+
+	return nil
+}
+
+// pick returns the member that gets the next message. Round-robin takes turns,
+// least-load takes the member holding the fewest messages, and the next one in
+// turn among the ones holding as few
+func (g *group) pick(strategy string) groupMember {
+	chosen := g.next % len(g.members)
+
+	if strategy == "least-load" {
+		least := -1
+
+		for i := range g.members {
+			candidate := (g.next + i) % len(g.members)
+			load := 0
+
+			if l, ok := g.members[candidate].sink.(loaded); ok {
+				load = l.load()
+			}
+
+			if least == -1 || load < least {
+				chosen, least = candidate, load
+			}
+		}
+	}
+
+	g.next = chosen + 1
+
+	return g.members[chosen]
+}
+
+// pickInTurn returns the member picked for the next message followed by the rest
+// in turn, which get it when the ones before fail
+func (g *group) pickInTurn(strategy string) groupSink {
+	members := groupSink{g.pick(strategy)}
+
+	for i := 0; i < len(g.members)-1; i++ {
+		members = append(members, g.members[(g.next+i)%len(g.members)])
+	}
+
+	return members
+}
+
+// groupSink delivers a message to the first member of a group that takes it
+type groupSink []groupMember
+
+func (g groupSink) deliver(msg []byte, id string) error {
+	var err error
+
+	for i, member := range g {
+		err = member.sink.deliver(msg, id)
+
+		if err == nil {
+			return nil
+		}
+
+		if i < len(g)-1 {
+			logs.Warn("Error sending message to a member of a group, trying the next one", "remote", member.sink.remoteAddr(), "error", err)
+		}
+	}
+
+	return err
+}
+
+func (g groupSink) remoteAddr() string {
+	return g[0].sink.remoteAddr()
+}
+
+// joinGroup adds a member to the group of a topic or pattern, joining again
+// only updates its sink
+func (s *safeSubscribe) joinGroup(topic string, name string, key interface{}, sub sink) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.groups[topic] == nil {
+		s.groups[topic] = make(map[string]*group)
+	}
+
+	g := s.groups[topic][name]
+
+	if g == nil {
+		g = &group{}
+		s.groups[topic][name] = g
+	}
+
+	for i, member := range g.members {
+		if member.key == key {
+			g.members[i].sink = sub
+			return
+		}
+	}
+
+	g.members = append(g.members, groupMember{key: key, sink: sub})
+	touchInterest()
+}
+
+func (s *safeSubscribe) leaveGroup(topic string, name string, key interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.removeMembers(topic, name, func(member interface{}) bool {
+		return member == key
+	})
+}
+
+// removeMembers drops the members of a group that leave, and the group and
+// the topic when they're left empty. The caller holds the lock
+func (s *safeSubscribe) removeMembers(topic string, name string, leaves func(member interface{}) bool) {
+	g := s.groups[topic][name]
+
+	if g == nil {
+		return
+	}
+
+	members := g.members[:0]
+
+	for _, member := range g.members {
+		if !leaves(member.key) {
+			members = append(members, member)
+		}
+	}
+
+	for i := len(members); i < len(g.members); i++ {
+		g.members[i] = groupMember{}
+	}
+
+	g.members = members
+
+	if len(g.members) == 0 {
+		delete(s.groups[topic], name)
+	}
+
+	if len(s.groups[topic]) == 0 {
+		delete(s.groups, topic)
+	}
+
+	touchInterest()
+}
+
+// joinOrLeave runs a sub or unsub request of a /subscribe websocket that names a
+// group
+func joinOrLeave(msg request, conn *websocket.Conn, sub sink, log logger) {
+	if err := validGroup(msg.Group); err != nil {
+		log.Warn("Ignoring invalid request", "topic", msg.Topic, "group", msg.Group, "error", err)
+		return
+	}
+
+	if msg.Content == "sub" {
+		subscribers.joinGroup(msg.Topic, msg.Group, conn, sub)
+		log.Info("Joined group", "topic", msg.Topic, "group", msg.Group)
+		return
+	}
+
+	subscribers.leaveGroup(msg.Topic, msg.Group, conn)
+	log.Info("Left group", "topic", msg.Topic, "group", msg.Group)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/health"
+	"sync/atomic"
+)
+
+type check = health.Check
+
+// Whether the connection to msgqueue is up, accessed atomically
+var upstreamConnected int32
+
+func upstreamCheck() check {
+	if atomic.LoadInt32(&upstreamConnected) == 0 {
+		return check{Name: "upstream", Detail: "not connected to msgqueue at " + cfg.Upstream.Addr}
+	}
+
+	return check{Name: "upstream", OK: true, Detail: cfg.Upstream.Addr}
+}
+
+// livenessChecks only fail when restarting the service is the way to recover.
+// Losing msgqueue isn't one, it's dialed again
+func livenessChecks() []check {
+	return []check{{Name: "server", OK: true}}
+}
+
+// readinessChecks fail while the service can't take more work
+func readinessChecks(certs *certstore.Store) []check {
+	return []check{
+		health.Shutdown(stopping),
+		health.Certificate(certs),
+		upstreamCheck(),
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Prefix of the topics of inboxes, where the replies to the requests of a
+// connection are published
+const inboxPrefix = "_inbox."
+
+// inbox is the topic a connection gets the replies to its requests on. Only the
+// connection that opened it receives its messages, subscriptions to it, either
+// direct or through a pattern, are ignored
+type inbox struct {
+	owner interface{}
+	sink  sink
+}
+
+func isInbox(topic string) bool {
+	return strings.HasPrefix(topic, inboxPrefix)
+}
+
+// openInbox gives a connection a new inbox and returns its topic, which is
+// random so other clients can't guess it
+func (s *safeSubscribe) openInbox(key interface{}, sub sink) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	topic := inboxPrefix + hex.EncodeToString(id)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.inboxes[topic] = inbox{owner: key, sink: sub}
+	touchInterest()
+
+	return topic
+}
+
+func (s *safeSubscribe) inboxCount() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.inboxes)
+}
+
+// inboxReply is what a connection that asks for its inbox is answered with, a
+// message without ID whose topic is the inbox and whose content is "inbox"
+func inboxReply(topic string) []byte {
+	reply, _ := json.Marshal(message{topic, "inbox"})
+
+	return reply
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/gorilla/websocket"
+	"net/url"
+	"sort"
+)
+
+// Longest name of an instance
+const maxInstanceName = 128
+
+// Field msgqueue adds to the messages for an instance with groups on their
+// topic, with the ones the instance was picked for
+const groupsField = "Groups"
+
+// interestFrame tells msgqueue the topics, patterns and MQTT filters the clients
+// of an instance subscribed to, and the groups they joined, so it only gets
+// their messages. Each one replaces the previous
+type interestFrame struct {
+	Topics  []string
+	Filters []string
+	Groups  []groupInterest
+}
+
+// groupInterest is a group joined on a topic or pattern. msgqueue gives each
+// message of the topic to one of the instances with the group
+type groupInterest struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+}
+
+// Signalled when the subscriptions change, so the interest is sent again
+var interestChanged = make(chan struct{}, 1)
+
+// touchInterest tells sendInterest that the subscriptions changed, it never
+// blocks and can be called with the lock held
+func touchInterest() {
+	select {
+	case interestChanged <- struct{}{}:
+	default:
+	}
+}
+
+// interest returns the topics and patterns subscribed to, directly or as an
+// inbox, the MQTT filters and the groups, sorted
+func (s *safeSubscribe) interest() interestFrame {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	frame := interestFrame{Topics: []string{}, Filters: []string{}, Groups: []groupInterest{}}
+
+	for topic := range s.subs {
+		frame.Topics = append(frame.Topics, topic)
+	}
+
+	for topic, groups := range s.groups {
+		for name := range groups {
+			frame.Groups = append(frame.Groups, groupInterest{Topic: topic, Group: name})
+		}
+	}
+
+	for topic := range s.inboxes {
+		frame.Topics = append(frame.Topics, topic)
+	}
+
+	for filter := range s.filters {
+		frame.Filters = append(frame.Filters, filter)
+	}
+
+	sort.Strings(frame.Topics)
+	sort.Strings(frame.Filters)
+	sort.Slice(frame.Groups, func(i, j int) bool {
+		if frame.Groups[i].Topic != frame.Groups[j].Topic {
+			return frame.Groups[i].Topic < frame.Groups[j].Topic
+		}
+
+		return frame.Groups[i].Group < frame.Groups[j].Group
+	})
+
+	return frame
+}
+
+// instancePath is the /popmsg path of an instance, msgqueue keeps a queue for
+// each name with the messages of its interest
+func instancePath(name string) string {
+	if name == "" {
+		return "/popmsg"
+	}
+
+	return "/popmsg?" + url.Values{"instance": {name}}.Encode()
+}
+
+// sendInterest tells msgqueue the interest of the instance when it connects and
+// every time it changes, until the connection is closed
+func sendInterest(alive *keepalive.Conn) {
+	var last []byte
+
+	for {
+		frame, _ := json.Marshal(subscribers.interest())
+
+		if !bytes.Equal(frame, last) {
+			err := alive.Write(websocket.TextMessage, frame)
+
+			if err != nil {
+				logs.Warn("Error sending the interest to msgqueue", "error", err)
+				return
+			}
+
+			last = frame
+		}
+
+		select {
+		case <-interestChanged:
+		case <-alive.Done():
+			return
+		}
+	}
+}
+
+// routedGroups returns the groups msgqueue picked the instance for, and the
+// message without them. The groups are nil for the messages that weren't routed
+// by group, where every group picks a member
+func routedGroups(msg []byte) (map[groupInterest]bool, []byte) {
+	if !bytes.Contains(msg, []byte(groupsField)) {
+		return nil, msg
+	}
+
+	var fields map[string]json.RawMessage
+
+	if json.Unmarshal(msg, &fields) != nil || fields[groupsField] == nil {
+		return nil, msg
+	}
+
+	var groups []groupInterest
+	json.Unmarshal(fields[groupsField], &groups)
+	picked := make(map[groupInterest]bool)
+
+	for _, g := range groups {
+		picked[g] = true
+	}
+
+	delete(fields, groupsField)
+	stripped, err := json.Marshal(fields)
+
+	if err != nil {
+		return nil, msg
+	}
+
+	return picked, stripped
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// topicLabels bounds the number of different topics used as label values, the
+// ones seen once the limit is reached are reported as "other". Every inbox is
+// reported as "_inbox", as each one is only used by one connection
+type topicLabels struct {
+	seen map[string]bool
+	mux  sync.Mutex
+}
+
+var topics = topicLabels{seen: make(map[string]bool)}
+
+func (t *topicLabels) label(topic string) string {
+	if isInbox(topic) {
+		return "_inbox"
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.seen[topic] {
+		return topic
+	}
+
+	if len(t.seen) >= cfg.MetricsMaxTopics {
+		return "other"
+	}
+
+	t.seen[topic] = true
+
+	return topic
+}
+
+var (
+	received           = metrics.NewCounterVec("subscriber_messages_received_total", "Messages received from msgqueue")
+	delivered          = metrics.NewCounterVec("subscriber_messages_delivered_total", "Messages written to subscribers by topic", "topic")
+	dropped            = metrics.NewCounterVec("subscriber_messages_dropped_total", "Messages or deliveries lost by reason", "reason")
+	mqttPublished      = metrics.NewCounterVec("subscriber_mqtt_messages_published_total", "Messages published by MQTT clients")
+	webhookRequests    = metrics.NewCounterVec("subscriber_webhook_requests_total", "Messages posted to webhooks by result", "result")
+	authFailures       = metrics.NewCounterVec("subscriber_auth_failures_total", "Rejected credentials by endpoint", "endpoint")
+	compressionBytes   = metrics.NewCounterVec("subscriber_compression_bytes_total", "Size of the messages written to compressed websockets and bytes written for them, by endpoint", "endpoint", "stage")
+	compressedMessages = metrics.NewCounterVec("subscriber_compression_messages_total", "Messages written to compressed websockets by endpoint and whether they were compressed", "endpoint", "compressed")
+	writeDuration      = metrics.NewHistogram("subscriber_write_duration_seconds", "Time taken to write a message to a subscriber", metrics.LatencyBuckets)
+)
+
+func init() {
+	compression.CountBytes = func(size int, endpoint string, stage string) {
+		compressionBytes.Add(float64(size), endpoint, stage)
+	}
+	compression.CountMessage = func(endpoint string, compressed bool) {
+		compressedMessages.Inc(endpoint, strconv.FormatBool(compressed))
+	}
+	metrics.NewGaugeFunc("subscriber_subscriptions", "Subscribed connections by topic", "topic", func() map[string]float64 {
+		counts := make(map[string]float64)
+
+		subscribers.mux.Lock()
+		defer subscribers.mux.Unlock()
+
+		for topic, subs := range subscribers.subs {
+			if len(subs) > 0 {
+				counts[topics.label(topic)] += float64(len(subs))
+			}
+		}
+
+		for filter, subs := range subscribers.filters {
+			counts[topics.label(filter)] += float64(len(subs))
+		}
+
+		return counts
+	})
+	metrics.NewGaugeFunc("subscriber_group_members", "Members of the groups of each topic", "topic", func() map[string]float64 {
+		counts := make(map[string]float64)
+
+		subscribers.mux.Lock()
+		defer subscribers.mux.Unlock()
+
+		for topic, groups := range subscribers.groups {
+			for _, g := range groups {
+				counts[topics.label(topic)] += float64(len(g.members))
+			}
+		}
+
+		return counts
+	})
+	metrics.NewGaugeFunc("subscriber_inboxes", "Inboxes open for the replies to requests", "", func() map[string]float64 {
+		return map[string]float64{"": float64(subscribers.inboxCount())}
+	})
+	metrics.NewGaugeFunc("subscriber_connections_active", "Open websockets, event streams, long polling sessions and MQTT clients by endpoint", "endpoint", func() map[string]float64 {
+		return map[string]float64{"/subscribe": float64(clients.Count()), "/events": float64(atomic.LoadInt32(&eventStreams)), "/sessions": float64(sessions.count()), "mqtt": float64(mqttConns.count("mqtt")), "/mqtt": float64(mqttConns.count("/mqtt"))}
+	})
+}
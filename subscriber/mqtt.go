@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// Protocol levels in CONNECT, 3.1.1 and 5.0
+const (
+	mqttV311 = 4
+	mqttV5   = 5
+)
+
+// CONNACK return codes of MQTT 3.1.1 and the reason codes of MQTT 5 used here
+const (
+	mqttRefusedVersion     = 0x01
+	mqttRefusedIdentifier  = 0x02
+	mqttRefusedCredentials = 0x04
+
+	mqttReasonNoSubscription     = 0x11
+	mqttReasonDisconnectWithWill = 0x04
+	mqttReasonUnspecified        = 0x80
+	mqttReasonMalformed          = 0x81
+	mqttReasonProtocolError      = 0x82
+	mqttReasonBadVersion         = 0x84
+	mqttReasonBadIdentifier      = 0x85
+	mqttReasonBadCredentials     = 0x86
+	mqttReasonShuttingDown       = 0x8B
+	mqttReasonKeepAliveTimeout   = 0x8D
+	mqttReasonTakenOver          = 0x8E
+	mqttReasonBadFilter          = 0x8F
+	mqttReasonTooLarge           = 0x95
+	mqttReasonPayloadFormat      = 0x99
+	mqttReasonQoSNotSupported    = 0x9B
+	mqttReasonSharedNotSupported = 0x9E
+)
+
+// MQTT 5 properties read or sent by the gateway
+const (
+	mqttPropPayloadFormat    = 0x01
+	mqttPropSessionExpiry    = 0x11
+	mqttPropAssignedClientID = 0x12
+	mqttPropReceiveMaximum   = 0x21
+	mqttPropMaximumQoS       = 0x24
+	mqttPropMaximumPacket    = 0x27
+	mqttPropSharedAvailable  = 0x2A
+)
+
+var errMQTTMalformed = errors.New("malformed MQTT packet")
+var errMQTTTooLarge = errors.New("MQTT packet larger than max_packet_size")
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readMQTTPacket reads the fixed header and the body of the next packet
+func readMQTTPacket(r *bufio.Reader, maxSize int) (mqttPacket, error) {
+	first, err := r.ReadByte()
+
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length := 0
+
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return mqttPacket{}, errMQTTMalformed
+		}
+
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return mqttPacket{}, err
+		}
+
+		length |= int(b&0x7f) << shift
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length+5 > maxSize {
+		return mqttPacket{}, errMQTTTooLarge
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+
+	return mqttPacket{kind: first >> 4, flags: first & 0x0f, body: body}, err
+}
+
+// encode returns the packet with its fixed header, ready to be written at once
+func (p mqttPacket) encode() []byte {
+	out := []byte{p.kind<<4 | p.flags}
+	out = appendVarint(out, len(p.body))
+
+	return append(out, p.body...)
+}
+
+func appendVarint(out []byte, n int) []byte {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+
+		if n > 0 {
+			b |= 0x80
+		}
+
+		out = append(out, b)
+
+		if n == 0 {
+			return out
+		}
+	}
+}
+
+func appendUint16(out []byte, n uint16) []byte {
+	return append(out, byte(n>>8), byte(n))
+}
+
+func appendMQTTString(out []byte, s string) []byte {
+	return append(appendUint16(out, uint16(len(s))), s...)
+}
+
+// mqttReader reads the fields of a packet body, the first error is kept and
+// every read after it returns zero values
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqttReader) take(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errMQTTMalformed
+		return nil
+	}
+
+	taken := r.data[:n]
+	r.data = r.data[n:]
+
+	return taken
+}
+
+func (r *mqttReader) byte() byte {
+	b := r.take(1)
+
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *mqttReader) uint16() uint16 {
+	b := r.take(2)
+
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *mqttReader) uint32() uint32 {
+	b := r.take(4)
+
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *mqttReader) varint() int {
+	n := 0
+
+	for shift := uint(0); shift <= 21; shift += 7 {
+		b := r.byte()
+		n |= int(b&0x7f) << shift
+
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+
+	r.err = errMQTTMalformed
+
+	return 0
+}
+
+func (r *mqttReader) binary() []byte {
+	return r.take(int(r.uint16()))
+}
+
+// string reads a UTF-8 string, which can't hold the null character
+func (r *mqttReader) string() string {
+	s := r.binary()
+
+	if r.err == nil && (!utf8.Valid(s) || strings.ContainsRune(string(s), 0)) {
+		r.err = errMQTTMalformed
+	}
+
+	return string(s)
+}
+
+// properties reads the properties of an MQTT 5 packet, keeping the integer
+// ones and skipping the rest
+func (r *mqttReader) properties() map[byte]uint32 {
+	props := make(map[byte]uint32)
+	length := r.varint()
+	block := &mqttReader{data: r.take(length)}
+
+	for r.err == nil && block.err == nil && len(block.data) > 0 {
+		id := block.byte()
+
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+			props[id] = uint32(block.byte())
+		case 0x13, 0x21, 0x22, 0x23:
+			props[id] = uint32(block.uint16())
+		case 0x02, 0x11, 0x18, 0x27:
+			props[id] = block.uint32()
+		case 0x0B:
+			props[id] = uint32(block.varint())
+		case 0x03, 0x08, 0x12, 0x15, 0x1A, 0x1C, 0x1F, 0x09, 0x16:
+			block.binary()
+		case 0x26:
+			block.binary()
+			block.binary()
+		default:
+			block.err = errMQTTMalformed
+		}
+	}
+
+	if r.err == nil {
+		r.err = block.err
+	}
+
+	return props
+}
+
+// mqttWill is the message published for a client that goes away without
+// disconnecting
+type mqttWill struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type mqttConnectRequest struct {
+	version     byte
+	clientID    string
+	cleanStart  bool
+	keepAlive   uint16
+	username    string
+	password    string
+	hasUsername bool
+	will        *mqttWill
+	props       map[byte]uint32
+}
+
+// parseConnect decodes a CONNECT packet, the return code tells why it's refused
+// when it's well formed but can't be accepted
+func parseConnect(p mqttPacket) (mqttConnectRequest, byte, error) {
+	var c mqttConnectRequest
+	r := &mqttReader{data: p.body}
+	name := r.string()
+	c.version = r.byte()
+
+	if r.err != nil || name != "MQTT" {
+		return c, 0, errMQTTMalformed
+	}
+
+	if c.version != mqttV311 && c.version != mqttV5 {
+		return c, mqttRefusedVersion, nil
+	}
+
+	flags := r.byte()
+	c.cleanStart = flags&0x02 != 0
+	c.keepAlive = r.uint16()
+
+	if flags&0x01 != 0 {
+		return c, 0, errMQTTMalformed
+	}
+
+	if c.version == mqttV5 {
+		c.props = r.properties()
+	}
+
+	c.clientID = r.string()
+
+	if flags&0x04 != 0 {
+		if c.version == mqttV5 {
+			r.properties()
+		}
+
+		c.will = &mqttWill{topic: r.string(), payload: append([]byte{}, r.binary()...), retain: flags&0x20 != 0}
+	}
+
+	if flags&0x80 != 0 {
+		c.username = r.string()
+		c.hasUsername = true
+	}
+
+	if flags&0x40 != 0 {
+		c.password = string(r.binary())
+	}
+
+	if r.err != nil || len(r.data) > 0 || (c.will != nil && !validTopicName(c.will.topic)) {
+		return c, 0, errMQTTMalformed
+	}
+
+	return c, 0, nil
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	retain   bool
+	dup      bool
+	payload  []byte
+	props    map[byte]uint32
+}
+
+func parsePublish(p mqttPacket, version byte) (mqttPublishPacket, error) {
+	pub := mqttPublishPacket{qos: (p.flags >> 1) & 0x03, retain: p.flags&0x01 != 0, dup: p.flags&0x08 != 0}
+	r := &mqttReader{data: p.body}
+	pub.topic = r.string()
+
+	if pub.qos > 0 {
+		pub.packetID = r.uint16()
+	}
+
+	if version == mqttV5 {
+		pub.props = r.properties()
+	}
+
+	pub.payload = r.data
+
+	if r.err != nil || pub.qos == 3 || !validTopicName(pub.topic) {
+		return pub, errMQTTMalformed
+	}
+
+	return pub, nil
+}
+
+func (pub mqttPublishPacket) encode(version byte) []byte {
+	flags := pub.qos << 1
+
+	if pub.retain {
+		flags |= 0x01
+	}
+
+	if pub.dup {
+		flags |= 0x08
+	}
+
+	body := appendMQTTString(nil, pub.topic)
+
+	if pub.qos > 0 {
+		body = appendUint16(body, pub.packetID)
+	}
+
+	if version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	return mqttPacket{kind: mqttPublish, flags: flags, body: append(body, pub.payload...)}.encode()
+}
+
+// mqttAck encodes a PUBACK, or an MQTT 5 one with a reason code when it's not
+// a success
+func mqttAck(packetID uint16, version byte, reason byte) []byte {
+	body := appendUint16(nil, packetID)
+
+	if version == mqttV5 && reason != 0 {
+		body = append(body, reason, 0)
+	}
+
+	return mqttPacket{kind: mqttPuback, body: body}.encode()
+}
+
+type mqttSubscription struct {
+	filter         string
+	qos            byte
+	retainHandling byte
+}
+
+// parseSubscribe decodes SUBSCRIBE and UNSUBSCRIBE packets, the latter have no
+// options after each filter
+func parseSubscribe(p mqttPacket, version byte) (uint16, []mqttSubscription, error) {
+	r := &mqttReader{data: p.body}
+	packetID := r.uint16()
+	var subs []mqttSubscription
+
+	if version == mqttV5 {
+		r.properties()
+	}
+
+	for r.err == nil && len(r.data) > 0 {
+		sub := mqttSubscription{filter: r.string()}
+
+		if p.kind == mqttSubscribe {
+			options := r.byte()
+			sub.qos = options & 0x03
+			sub.retainHandling = (options >> 4) & 0x03
+
+			if sub.qos == 3 || options&0xC0 != 0 {
+				return packetID, nil, errMQTTMalformed
+			}
+		}
+
+		subs = append(subs, sub)
+	}
+
+	if r.err != nil || len(subs) == 0 || p.flags != 0x02 || packetID == 0 {
+		return packetID, nil, errMQTTMalformed
+	}
+
+	return packetID, subs, nil
+}
+
+// validTopicName tells whether a topic can be published to, it can't be empty
+// or have wildcards
+func validTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// validTopicFilter checks that + only takes whole levels and that # is the last
+// level of the filter
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchFilter tells whether a topic matches an MQTT filter, where + is any
+// single level and # any number of levels. Topics starting with $ are only
+// matched by filters that start with the same level
+func matchFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/tracing"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Time given to a new MQTT connection to send its CONNECT
+const mqttConnectTimeout = 10 * time.Second
+
+var mqttUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{"mqtt"},
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// mqttStream is the connection of an MQTT client, a TLS socket or a websocket
+type mqttStream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// wsStream reads and writes MQTT over a websocket. Packets can be split across
+// binary messages when they're read, and each one is written as a message
+type wsStream struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.reader == nil {
+			kind, reader, err := s.conn.NextReader()
+
+			if err != nil {
+				return 0, err
+			}
+
+			if kind != websocket.BinaryMessage {
+				return 0, errors.New("MQTT must be sent in binary messages")
+			}
+
+			s.reader = reader
+		}
+
+		n, err := s.reader.Read(p)
+
+		if err == io.EOF {
+			s.reader = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	compression.MeterWrite(s.conn, len(p))
+	err := s.conn.WriteMessage(websocket.BinaryMessage, p)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return s.conn.Close()
+}
+
+func (s *wsStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *wsStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+// mqttConn is an MQTT client connected to the gateway. The PUBLISH packets of
+// its session go through outbox, so a slow client doesn't hold up the dispatch
+// of the messages to the others
+type mqttConn struct {
+	stream   mqttStream
+	version  byte
+	endpoint string
+	remote   string
+	outbox   chan []byte
+	done     chan struct{}
+	writeMux sync.Mutex
+}
+
+// newMQTTConn has room in its outbox for the messages in flight and the queue
+// of the session
+func newMQTTConn(stream mqttStream, version byte, endpoint string, remote string) *mqttConn {
+	return &mqttConn{
+		stream:   stream,
+		version:  version,
+		endpoint: endpoint,
+		remote:   remote,
+		outbox:   make(chan []byte, cfg.MQTT.MaxInflight+cfg.MQTT.QueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue hands a packet to writeOutbox, a full outbox means the client isn't
+// reading
+func (c *mqttConn) enqueue(packet []byte) error {
+	select {
+	case c.outbox <- packet:
+		return nil
+	default:
+		return errors.New("MQTT client isn't reading")
+	}
+}
+
+// writeOutbox writes the packets of the outbox until the connection is done. A
+// failed write closes the connection
+func (c *mqttConn) writeOutbox() {
+	for {
+		select {
+		case packet := <-c.outbox:
+			if c.write(packet) != nil {
+				c.stream.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *mqttConn) write(packet []byte) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	c.stream.SetWriteDeadline(time.Now().Add(cfg.KeepAlive.WriteTimeout))
+	_, err := c.stream.Write(packet)
+
+	return err
+}
+
+// disconnect closes the connection, telling MQTT 5 clients why
+func (c *mqttConn) disconnect(reason byte) {
+	if c.version == mqttV5 {
+		c.write(mqttPacket{kind: mqttDisconnect, body: []byte{reason}}.encode())
+	}
+
+	c.stream.Close()
+}
+
+type mqttConnSet struct {
+	conns map[*mqttConn]bool
+	mux   sync.Mutex
+}
+
+// Connected MQTT clients, over TLS and over websockets
+var mqttConns = &mqttConnSet{conns: make(map[*mqttConn]bool)}
+
+func (s *mqttConnSet) add(c *mqttConn) {
+	s.mux.Lock()
+	s.conns[c] = true
+	s.mux.Unlock()
+}
+
+func (s *mqttConnSet) remove(c *mqttConn) {
+	s.mux.Lock()
+	delete(s.conns, c)
+	s.mux.Unlock()
+}
+
+func (s *mqttConnSet) count(endpoint string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	count := 0
+
+	for c := range s.conns {
+		if c.endpoint == endpoint {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (s *mqttConnSet) closeAll(reason byte) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for c := range s.conns {
+		c.disconnect(reason)
+	}
+}
+
+// mqttOutgoing is a message on its way to an MQTT client, seq keeps the order
+// of the ones resent when the client comes back
+type mqttOutgoing struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	seq     uint64
+}
+
+// mqttSession is the state of an MQTT client ID: its subscriptions and the QoS 1
+// messages it hasn't acked yet or that arrived while it was away. It's the
+// subscriber in the fan-out, so it outlives the connections of the client
+type mqttSession struct {
+	clientID     string
+	identity     string
+	filters      map[string]byte
+	conn         *mqttConn
+	inflight     map[uint16]mqttOutgoing
+	queue        []mqttOutgoing
+	nextID       uint16
+	seq          uint64
+	receiveMax   int
+	expiry       time.Duration
+	offlineSince time.Time
+	mux          sync.Mutex
+}
+
+func (s *mqttSession) deliver(msg []byte, id string) error {
+	var m envelope
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	qos := byte(0)
+	matched := false
+
+	for filter, granted := range s.filters {
+		if matchFilter(filter, m.Topic) {
+			matched = true
+
+			if granted > qos {
+				qos = granted
+			}
+		}
+	}
+
+	if !matched {
+		return nil
+	}
+
+	return s.send(mqttOutgoing{topic: m.Topic, payload: m.Payload(), qos: qos})
+}
+
+func (s *mqttSession) remoteAddr() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		return "mqtt:" + s.clientID
+	}
+
+	return s.conn.remote
+}
+
+// send hands a message to the outbox of the client, or queues it when the client
+// is away or has too many unacked messages. QoS 0 messages are never queued
+func (s *mqttSession) send(out mqttOutgoing) error {
+	s.seq++
+	out.seq = s.seq
+
+	if s.conn == nil && out.qos == 0 {
+		return errors.New("MQTT client is offline")
+	}
+
+	if out.qos == 0 {
+		return s.conn.enqueue(mqttPublishPacket{topic: out.topic, retain: out.retain, payload: out.payload}.encode(s.conn.version))
+	}
+
+	if s.conn == nil || len(s.inflight) >= s.receiveMax || len(s.queue) > 0 {
+		if len(s.queue) >= cfg.MQTT.QueueSize {
+			return errors.New("MQTT session queue is full")
+		}
+
+		s.queue = append(s.queue, out)
+		return nil
+	}
+
+	s.transmit(out)
+
+	return nil
+}
+
+// transmit sends a QoS 1 message and keeps it until it's acked
+func (s *mqttSession) transmit(out mqttOutgoing) {
+	for {
+		s.nextID++
+
+		if _, used := s.inflight[s.nextID]; s.nextID != 0 && !used {
+			break
+		}
+	}
+
+	s.inflight[s.nextID] = out
+	s.write(s.nextID, out, false)
+}
+
+// write sends a QoS 1 message with its packet ID. A client whose outbox is full
+// is disconnected, the message is sent again when the client is back
+func (s *mqttSession) write(packetID uint16, out mqttOutgoing, dup bool) {
+	packet := mqttPublishPacket{topic: out.topic, packetID: packetID, qos: 1, retain: out.retain, dup: dup, payload: out.payload}
+	err := s.conn.enqueue(packet.encode(s.conn.version))
+
+	if err != nil {
+		s.conn.stream.Close()
+	}
+}
+
+// flush moves queued messages in flight while the client has room for them
+func (s *mqttSession) flush() {
+	for s.conn != nil && len(s.queue) > 0 && len(s.inflight) < s.receiveMax {
+		out := s.queue[0]
+		s.queue = s.queue[1:]
+		s.transmit(out)
+	}
+}
+
+func (s *mqttSession) ack(packetID uint16) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.inflight, packetID)
+	s.flush()
+}
+
+// attach makes a connection the one of the session, and sends it the messages
+// that weren't acked by the previous one and the ones that arrived meanwhile
+func (s *mqttSession) attach(c *mqttConn, receiveMax int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.conn = c
+	s.receiveMax = receiveMax
+	ids := make([]uint16, 0, len(s.inflight))
+
+	for id := range s.inflight {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return s.inflight[ids[i]].seq < s.inflight[ids[j]].seq })
+
+	for _, id := range ids {
+		s.write(id, s.inflight[id], true)
+	}
+
+	s.flush()
+}
+
+// detach tells whether the connection was still the one of the session
+func (s *mqttSession) detach(c *mqttConn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn != c {
+		return false
+	}
+
+	s.conn = nil
+	s.offlineSince = time.Now()
+
+	return true
+}
+
+type mqttSessionStore struct {
+	sessions map[string]*mqttSession
+	mux      sync.Mutex
+}
+
+var mqttSessions = &mqttSessionStore{sessions: make(map[string]*mqttSession)}
+
+// open returns the session of a client ID, a new one when it asks for a clean
+// start or doesn't have one. The connection holding it before is returned to be
+// closed, and a client ID can't be taken by another identity
+func (s *mqttSessionStore) open(clientID string, identity string, cleanStart bool, expiry time.Duration) (*mqttSession, bool, *mqttConn, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	session := s.sessions[clientID]
+	var previous *mqttConn
+
+	if session != nil {
+		if session.identity != identity {
+			return nil, false, nil, errors.New("client ID used by another identity")
+		}
+
+		session.mux.Lock()
+		previous = session.conn
+		session.expiry = expiry
+		session.mux.Unlock()
+	}
+
+	if session != nil && !cleanStart {
+		return session, true, previous, nil
+	}
+
+	if session != nil {
+		unsubscribeAll(session)
+	}
+
+	session = &mqttSession{clientID: clientID, identity: identity, filters: make(map[string]byte), inflight: make(map[uint16]mqttOutgoing), expiry: expiry}
+	s.sessions[clientID] = session
+
+	return session, false, previous, nil
+}
+
+func (s *mqttSessionStore) remove(session *mqttSession) {
+	s.mux.Lock()
+
+	if s.sessions[session.clientID] == session {
+		delete(s.sessions, session.clientID)
+	}
+
+	s.mux.Unlock()
+	unsubscribeAll(session)
+}
+
+// expire removes the sessions whose clients have been away for longer than
+// their expiry interval
+func (s *mqttSessionStore) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*mqttSession
+
+		s.mux.Lock()
+
+		for _, session := range s.sessions {
+			session.mux.Lock()
+
+			if session.conn == nil && time.Since(session.offlineSince) > session.expiry {
+				expired = append(expired, session)
+			}
+
+			session.mux.Unlock()
+		}
+
+		s.mux.Unlock()
+
+		for _, session := range expired {
+			s.remove(session)
+			logs.Info("MQTT session expired", "client_id", session.clientID, "identity", session.identity)
+		}
+	}
+}
+
+// retainedStore keeps the last message sent with Retain on each topic, to be
+// given to the MQTT clients that subscribe to it later
+type retainedStore struct {
+	messages map[string]envelope
+	mux      sync.Mutex
+}
+
+var retained = &retainedStore{messages: make(map[string]envelope)}
+
+// update keeps a message if it was retained, an empty one clears the topic
+func (r *retainedStore) update(topic string, msg []byte) {
+	var m struct {
+		Content string
+		Data    []byte
+		Retain  bool
+	}
+
+	if json.Unmarshal(msg, &m) != nil || !m.Retain {
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	_, exists := r.messages[topic]
+
+	switch {
+	case m.Content == "" && len(m.Data) == 0:
+		delete(r.messages, topic)
+	case exists || len(r.messages) < cfg.MQTT.MaxRetained:
+		r.messages[topic] = envelope{Topic: topic, Content: m.Content, Data: m.Data}
+	default:
+		logs.Warn("Not retaining message, there are already max_retained", "topic", topic)
+	}
+}
+
+// matching returns the retained messages whose topic matches a filter, in the
+// order of their topics
+func (r *retainedStore) matching(filter string) []envelope {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var matched []envelope
+
+	for topic, m := range r.messages {
+		if matchFilter(filter, topic) {
+			matched = append(matched, m)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Topic < matched[j].Topic })
+
+	return matched
+}
+
+// publisherLink is the websocket to the publisher's /publish, where the
+// messages of the MQTT clients go. It's dialed when it's first needed and
+// again after it's lost
+type publisherLink struct {
+	conn        *websocket.Conn
+	alive       *keepalive.Conn
+	waiting     map[string]pendingReceipt
+	lastReceipt uint64
+	mux         sync.Mutex
+}
+
+// pendingReceipt is a message waiting for the publisher to answer whether it was
+// queued, with the connection it was sent on
+type pendingReceipt struct {
+	conn   *websocket.Conn
+	answer chan error
+}
+
+var publisherUpstream = &publisherLink{waiting: make(map[string]pendingReceipt)}
+
+// receiptHeader asks the publisher to answer whether a message was queued, the
+// answer carries the header value
+const receiptHeader = "receipt"
+
+var (
+	errPublisherLost = errors.New("connection to the publisher lost before it answered")
+	errNoReceipt     = errors.New("the publisher didn't answer in time")
+)
+
+// nextReceipt returns a receipt for a message that has to be confirmed
+func (p *publisherLink) nextReceipt() string {
+	return "mqtt-" + strconv.FormatUint(atomic.AddUint64(&p.lastReceipt, 1), 10)
+}
+
+// send writes a message to the publisher. A message with a receipt waits for the
+// publisher to answer, and fails if it's refused or there's no answer in time
+func (p *publisherLink) send(msg []byte, receipt string) error {
+	answer := make(chan error, 1)
+	err := p.write(msg, receipt, answer)
+
+	if err != nil || receipt == "" {
+		return err
+	}
+
+	defer func() {
+		p.mux.Lock()
+		delete(p.waiting, receipt)
+		p.mux.Unlock()
+	}()
+
+	select {
+	case err = <-answer:
+		return err
+	case <-time.After(cfg.Publisher.WriteTimeout):
+		return errNoReceipt
+	}
+}
+
+func (p *publisherLink) write(msg []byte, receipt string, answer chan error) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var err error
+
+	// A connection lost since the last message is only noticed when writing
+	for attempt := 0; attempt < 2; attempt++ {
+		if p.conn == nil {
+			conn, err := dialToService(cfg.Publisher.Addr, "/publish", cfg.Publisher.Username, cfg.Publisher.Password, cfg.Publisher.Compression)
+
+			if err != nil {
+				return err
+			}
+
+			p.conn = conn
+			p.alive = keepalive.Start(conn, cfg.Publisher.keepAlive(), logs)
+			go p.read(conn, p.alive)
+		}
+
+		err = p.alive.Write(websocket.TextMessage, msg)
+
+		// The answer can't be read before the lock is released
+		if err == nil {
+			if receipt != "" {
+				p.waiting[receipt] = pendingReceipt{conn: p.conn, answer: answer}
+			}
+
+			return nil
+		}
+
+		p.alive.Stop()
+		p.conn.Close()
+		p.conn = nil
+	}
+
+	return err
+}
+
+// read hands the answers of the publisher to the messages waiting for them
+// until the connection is lost, and then fails the ones still waiting
+func (p *publisherLink) read(conn *websocket.Conn, alive *keepalive.Conn) {
+	for {
+		_, frame, err := conn.ReadMessage()
+
+		if err != nil {
+			break
+		}
+
+		alive.Received()
+
+		var reply struct {
+			Receipt string `json:"receipt"`
+			Error   string `json:"error"`
+		}
+
+		if json.Unmarshal(frame, &reply) == nil && reply.Receipt != "" {
+			var err error
+
+			if reply.Error != "" {
+				err = errors.New(reply.Error)
+			}
+
+			p.answer(reply.Receipt, err)
+		}
+	}
+
+	alive.Stop()
+	conn.Close()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.conn == conn {
+		p.conn = nil
+	}
+
+	for receipt, pending := range p.waiting {
+		if pending.conn == conn {
+			delete(p.waiting, receipt)
+			pending.answer <- errPublisherLost
+		}
+	}
+}
+
+func (p *publisherLink) answer(receipt string, err error) {
+	p.mux.Lock()
+	pending, ok := p.waiting[receipt]
+	delete(p.waiting, receipt)
+	p.mux.Unlock()
+
+	if ok {
+		pending.answer <- err
+	}
+}
+
+func (p *publisherLink) close(deadline time.Time) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.conn != nil {
+		p.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), deadline)
+	}
+}
+
+var errPayloadFormat = errors.New("MQTT payload marked as UTF-8 isn't valid text")
+
+// publishMQTT sends a message of an MQTT client to the publisher, which is how
+// it reaches the other subscribers after going through msgqueue. Payloads that
+// aren't text go in Data, unless the client said they were text. A confirmed
+// message only succeeds once the publisher answers that it was queued
+func publishMQTT(topic string, payload []byte, retain bool, text bool, confirmed bool) error {
+	valid := utf8.Valid(payload)
+
+	if text && !valid {
+		return errPayloadFormat
+	}
+
+	publish := tracing.Start("mqtt publish", tracing.Server, tracing.SpanContext{}, false)
+	publish.Set("messaging.destination.name", topic, "messaging.message.body.size", len(payload))
+	defer publish.Finish()
+
+	m := struct {
+		envelope
+		Retain bool `json:",omitempty"`
+	}{envelope{Topic: topic, Content: string(payload)}, retain}
+
+	if !valid {
+		m.Content, m.Data = "", payload
+	}
+
+	receipt := ""
+
+	if confirmed {
+		receipt = publisherUpstream.nextReceipt()
+		m.Headers = map[string]string{receiptHeader: receipt}
+	}
+
+	msg, _ := json.Marshal(m)
+
+	err := publisherUpstream.send(tracing.WithTrace(msg, publish), receipt)
+
+	if err != nil {
+		publish.Fail(err)
+		return err
+	}
+
+	mqttPublished.Inc()
+
+	return nil
+}
+
+// mqttAuthenticate accepts the credentials of CONNECT, or the identity already
+// proven by the client certificate or the websocket request
+func mqttAuthenticate(req mqttConnectRequest, transportIdentity string) (string, bool) {
+	if req.hasUsername {
+		return req.username, req.username == cfg.Username && req.password == cfg.Password
+	}
+
+	return transportIdentity, transportIdentity != ""
+}
+
+func connack(version byte, sessionPresent bool, code byte, assignedID string) []byte {
+	body := []byte{0, code}
+
+	if sessionPresent {
+		body[0] = 1
+	}
+
+	if version == mqttV5 {
+		switch code {
+		case mqttRefusedVersion:
+			body[1] = mqttReasonBadVersion
+		case mqttRefusedIdentifier:
+			body[1] = mqttReasonBadIdentifier
+		case mqttRefusedCredentials:
+			body[1] = mqttReasonBadCredentials
+		}
+
+		props := []byte{mqttPropMaximumQoS, 1, mqttPropSharedAvailable, 0, mqttPropMaximumPacket}
+		size := uint32(cfg.MQTT.MaxPacketSize)
+		props = append(props, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+
+		if assignedID != "" {
+			props = appendMQTTString(append(props, mqttPropAssignedClientID), assignedID)
+		}
+
+		body = append(appendVarint(body, len(props)), props...)
+	}
+
+	return mqttPacket{kind: mqttConnack, body: body}.encode()
+}
+
+// serveMQTT runs an MQTT connection from its CONNECT until it's closed
+func serveMQTT(stream mqttStream, remote string, endpoint string, transportIdentity string) {
+	defer stream.Close()
+
+	log, _ := logs.Conn(remote, endpoint)
+	reader := bufio.NewReader(stream)
+	stream.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	packet, err := readMQTTPacket(reader, cfg.MQTT.MaxPacketSize)
+
+	if err == nil && packet.kind != mqttConnect {
+		err = errors.New("the first packet must be CONNECT")
+	}
+
+	var req mqttConnectRequest
+	var code byte
+
+	if err == nil {
+		req, code, err = parseConnect(packet)
+	}
+
+	if err != nil {
+		log.Warn("Error reading MQTT CONNECT", "error", err)
+		return
+	}
+
+	conn := newMQTTConn(stream, req.version, endpoint, remote)
+
+	if code != 0 {
+		log.Warn("Refusing MQTT protocol version", "version", req.version)
+		conn.write(connack(mqttV311, false, code, ""))
+		return
+	}
+
+	identity, ok := mqttAuthenticate(req, transportIdentity)
+
+	if !ok {
+		log.Warn("Error validating credentials", "identity", identity)
+		authFailures.Inc(endpoint)
+		conn.write(connack(req.version, false, mqttRefusedCredentials, ""))
+		return
+	}
+
+	assignedID := ""
+
+	if req.clientID == "" && (req.cleanStart || req.version == mqttV5) {
+		id := make([]byte, 8)
+		rand.Read(id)
+		assignedID = "auto-" + hex.EncodeToString(id)
+		req.clientID = assignedID
+	}
+
+	// Sessions last until the client is back, up to session_expiry
+	expiry := cfg.MQTT.SessionExpiry
+
+	if req.version == mqttV5 {
+		if seconds, ok := req.props[mqttPropSessionExpiry]; !ok || time.Duration(seconds)*time.Second < expiry {
+			expiry = time.Duration(seconds) * time.Second
+		}
+	} else if req.cleanStart {
+		expiry = 0
+	}
+
+	session, present, previous, err := mqttSessions.open(req.clientID, identity, req.cleanStart, expiry)
+
+	if req.clientID == "" || err != nil {
+		log.Warn("Refusing MQTT client ID", "client_id", req.clientID, "identity", identity, "error", err)
+		conn.write(connack(req.version, false, mqttRefusedIdentifier, ""))
+		return
+	}
+
+	log = log.With("identity", identity, "client_id", req.clientID)
+	err = conn.write(connack(req.version, present, 0, assignedID))
+
+	if err != nil {
+		log.Warn("Error sending CONNACK", "error", err)
+		return
+	}
+
+	receiveMax := cfg.MQTT.MaxInflight
+
+	if limit, ok := req.props[mqttPropReceiveMaximum]; ok && int(limit) < receiveMax {
+		receiveMax = int(limit)
+	}
+
+	mqttConns.add(conn)
+	defer mqttConns.remove(conn)
+	go conn.writeOutbox()
+	defer close(conn.done)
+	session.attach(conn, receiveMax)
+
+	if previous != nil {
+		previous.disconnect(mqttReasonTakenOver)
+	}
+
+	log.Info("MQTT client connected", "version", req.version, "session_present", present)
+	will := req.will
+	reason := readMQTTPackets(conn, reader, session, time.Duration(req.keepAlive)*1500*time.Millisecond, &will, log)
+
+	if will != nil {
+		err := publishMQTT(will.topic, will.payload, will.retain, false, true)
+
+		if err != nil {
+			log.Warn("Error publishing MQTT will", "topic", will.topic, "error", err)
+		}
+	}
+
+	if session.detach(conn) && expiry == 0 {
+		mqttSessions.remove(session)
+	}
+
+	log.Info("MQTT client disconnected", "reason", reason)
+}
+
+// readMQTTPackets handles the packets of a connected client, and returns why it
+// stopped. The will is cleared when the client disconnects normally
+func readMQTTPackets(conn *mqttConn, reader *bufio.Reader, session *mqttSession, keepAlive time.Duration, will **mqttWill, log logger) string {
+	for {
+		deadline := time.Time{}
+
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive)
+		}
+
+		conn.stream.SetReadDeadline(deadline)
+		packet, err := readMQTTPacket(reader, cfg.MQTT.MaxPacketSize)
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				conn.disconnect(mqttReasonKeepAliveTimeout)
+			} else if err == errMQTTTooLarge {
+				conn.disconnect(mqttReasonTooLarge)
+			}
+
+			return err.Error()
+		}
+
+		switch packet.kind {
+		case mqttPublish:
+			pub, err := parsePublish(packet, conn.version)
+
+			if err != nil {
+				conn.disconnect(mqttReasonMalformed)
+				return err.Error()
+			}
+
+			if pub.qos > 1 {
+				conn.disconnect(mqttReasonQoSNotSupported)
+				return "QoS 2 isn't supported"
+			}
+
+			if !handleMQTTPublish(conn, pub, log) {
+				return "error publishing"
+			}
+		case mqttPuback:
+			r := &mqttReader{data: packet.body}
+			session.ack(r.uint16())
+		case mqttSubscribe, mqttUnsubscribe:
+			packetID, subs, err := parseSubscribe(packet, conn.version)
+
+			if err != nil {
+				conn.disconnect(mqttReasonMalformed)
+				return err.Error()
+			}
+
+			if packet.kind == mqttSubscribe {
+				subscribeMQTT(conn, session, packetID, subs, log)
+			} else {
+				unsubscribeMQTT(conn, session, packetID, subs, log)
+			}
+		case mqttPingreq:
+			conn.write(mqttPacket{kind: mqttPingresp}.encode())
+		case mqttDisconnect:
+			if len(packet.body) == 0 || packet.body[0] != mqttReasonDisconnectWithWill {
+				*will = nil
+			}
+
+			return "client disconnected"
+		default:
+			conn.disconnect(mqttReasonProtocolError)
+			return "unexpected packet type"
+		}
+	}
+}
+
+// handleMQTTPublish sends a message of the client on and acks it once the
+// publisher queued it. A QoS 1 message that can't be published or that the
+// publisher refuses closes 3.1.1 clients, which can't be told, and gets a PUBACK
+// with a failure reason on 5.0
+func handleMQTTPublish(conn *mqttConn, pub mqttPublishPacket, log logger) bool {
+	err := publishMQTT(pub.topic, pub.payload, pub.retain, pub.props[mqttPropPayloadFormat] == 1, pub.qos == 1)
+	reason := byte(0)
+
+	switch {
+	case err == errPayloadFormat:
+		log.Warn("Dropping MQTT message", "topic", pub.topic, "error", err)
+		dropped.Inc("invalid")
+		reason = mqttReasonPayloadFormat
+	case err != nil:
+		log.Error("Error publishing MQTT message", "topic", pub.topic, "error", err)
+
+		if pub.qos == 1 && conn.version != mqttV5 {
+			conn.stream.Close()
+			return false
+		}
+
+		reason = mqttReasonUnspecified
+	default:
+		log.Sample().Debug("Published MQTT message", "topic", pub.topic, "qos", pub.qos, "retain", pub.retain)
+	}
+
+	if pub.qos == 1 {
+		conn.write(mqttAck(pub.packetID, conn.version, reason))
+	}
+
+	return true
+}
+
+func subscribeMQTT(conn *mqttConn, session *mqttSession, packetID uint16, subs []mqttSubscription, log logger) {
+	body := appendUint16(nil, packetID)
+
+	if conn.version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	var retainedFor []mqttSubscription
+
+	for _, sub := range subs {
+		switch {
+		case strings.HasPrefix(sub.filter, "$share/"):
+			body = append(body, failureReason(conn.version, mqttReasonSharedNotSupported))
+			continue
+		case !validTopicFilter(sub.filter):
+			body = append(body, failureReason(conn.version, mqttReasonBadFilter))
+			continue
+		}
+
+		if sub.qos > 1 {
+			sub.qos = 1
+		}
+
+		session.mux.Lock()
+		_, existed := session.filters[sub.filter]
+		session.filters[sub.filter] = sub.qos
+		session.mux.Unlock()
+
+		subscribers.subscribeFilter(sub.filter, session, session)
+		log.Info("Subscribed", "topic", sub.filter, "qos", sub.qos)
+		body = append(body, sub.qos)
+
+		if sub.retainHandling == 0 || (sub.retainHandling == 1 && !existed) {
+			retainedFor = append(retainedFor, sub)
+		}
+	}
+
+	conn.write(mqttPacket{kind: mqttSuback, body: body}.encode())
+
+	for _, sub := range retainedFor {
+		for _, m := range retained.matching(sub.filter) {
+			session.mux.Lock()
+			session.send(mqttOutgoing{topic: m.Topic, payload: m.Payload(), qos: sub.qos, retain: true})
+			session.mux.Unlock()
+		}
+	}
+}
+
+func unsubscribeMQTT(conn *mqttConn, session *mqttSession, packetID uint16, subs []mqttSubscription, log logger) {
+	body := appendUint16(nil, packetID)
+
+	if conn.version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	for _, sub := range subs {
+		session.mux.Lock()
+		_, existed := session.filters[sub.filter]
+		delete(session.filters, sub.filter)
+		session.mux.Unlock()
+
+		subscribers.unsubscribeFilter(sub.filter, session)
+		log.Info("Unsubscribed", "topic", sub.filter)
+
+		if conn.version == mqttV5 && existed {
+			body = append(body, 0)
+		} else if conn.version == mqttV5 {
+			body = append(body, mqttReasonNoSubscription)
+		}
+	}
+
+	conn.write(mqttPacket{kind: mqttUnsuback, body: body}.encode())
+}
+
+// failureReason is the SUBACK code of a refused filter, MQTT 3.1.1 has a single one
+func failureReason(version byte, reason byte) byte {
+	if version == mqttV5 {
+		return reason
+	}
+
+	return 0x80
+}
+
+// serveMQTTWebsocket serves MQTT over websockets on /mqtt. Clients can prove
+// who they are with the request or in CONNECT
+func serveMQTTWebsocket(w http.ResponseWriter, r *http.Request) {
+	identity, ok := authenticate(r)
+
+	if !ok {
+		identity = ""
+	}
+
+	conn, err := compression.Upgrade(&mqttUpgrader, w, r, "/mqtt", cfg.Compression)
+
+	if err != nil {
+		logs.Warn("Error upgrading connection", "remote", r.RemoteAddr, "endpoint", "/mqtt", "error", err)
+		return
+	}
+
+	conn.SetReadLimit(int64(cfg.MQTT.MaxPacketSize))
+	serveMQTT(&wsStream{conn: conn}, r.RemoteAddr, "/mqtt", identity)
+}
+
+// initMQTT accepts MQTT clients over TLS, with the same certificates and client
+// authentication as the websockets
+func initMQTT(addr string, certDir string, mqttReady chan<- bool) error {
+	clientAuth, err := certstore.ParseClientAuth(cfg.ClientAuth)
+
+	if err != nil {
+		return err
+	}
+
+	certs := certstore.New(certDir, certstore.ServerCertFile, certstore.ServerKeyFile, true, logs)
+	err = certs.Load()
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", addr, certs.ServerConfig(clientAuth))
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-stopping
+		listener.Close()
+	}()
+
+	go mqttSessions.expire()
+
+	if mqttReady != nil {
+		mqttReady <- true
+	}
+
+	logs.Info("MQTT gateway running", "addr", addr)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			select {
+			case <-stopping:
+				return nil
+			default:
+			}
+
+			return err
+		}
+
+		go func() {
+			tlsConn := conn.(*tls.Conn)
+			tlsConn.SetDeadline(time.Now().Add(mqttConnectTimeout))
+			err := tlsConn.Handshake()
+
+			if err != nil {
+				logs.Warn("Error in TLS handshake", "remote", conn.RemoteAddr(), "endpoint", "mqtt", "error", err)
+				conn.Close()
+				return
+			}
+
+			identity := ""
+			state := tlsConn.ConnectionState()
+
+			if certID, ok := certstore.Identity(&state); ok && certID == cfg.Username {
+				identity = certID
+			}
+
+			serveMQTT(tlsConn, conn.RemoteAddr().String(), "mqtt", identity)
+		}()
+	}
+}
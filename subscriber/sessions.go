@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Javivi/ws-go/internal/admin"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages returned by a poll when the client doesn't ask for fewer
+const defaultPollMax = 100
+
+// pendingMessage is a message waiting on a session until it's acked. Seq
+// numbers the messages of each session in the order they arrived
+type pendingMessage struct {
+	Seq     uint64          `json:"seq"`
+	ID      string          `json:"id,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+// pollSession is a subscriber that fetches its messages with long polls on
+// /sessions/{id}/messages, they're returned again until they're acked
+type pollSession struct {
+	id       string
+	identity string
+	remote   string
+	lastUsed time.Time
+	pending  []pendingMessage
+	lastSeq  uint64
+	arrived  chan struct{}
+	mux      sync.Mutex
+}
+
+func (s *pollSession) deliver(msg []byte, id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.pending) >= cfg.SessionBufferSize {
+		return errors.New("session buffer is full")
+	}
+
+	s.lastSeq++
+	s.pending = append(s.pending, pendingMessage{Seq: s.lastSeq, ID: id, Message: msg})
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+
+	return nil
+}
+
+func (s *pollSession) remoteAddr() string {
+	return s.remote
+}
+
+func (s *pollSession) touch() {
+	s.mux.Lock()
+	s.lastUsed = time.Now()
+	s.mux.Unlock()
+}
+
+// next returns up to max pending messages, or a channel closed when more arrive
+// if there are none
+func (s *pollSession) next(max int) ([]pendingMessage, <-chan struct{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.lastUsed = time.Now()
+
+	if len(s.pending) == 0 {
+		return nil, s.arrived
+	}
+
+	if max > len(s.pending) {
+		max = len(s.pending)
+	}
+
+	return append([]pendingMessage{}, s.pending[:max]...), nil
+}
+
+// ack removes every pending message up to seq
+func (s *pollSession) ack(seq uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.lastUsed = time.Now()
+	acked := 0
+
+	for acked < len(s.pending) && s.pending[acked].Seq <= seq {
+		acked++
+	}
+
+	s.pending = s.pending[acked:]
+}
+
+type sessionStore struct {
+	sessions map[string]*pollSession
+	mux      sync.Mutex
+}
+
+var sessions = sessionStore{sessions: make(map[string]*pollSession)}
+
+func (s *sessionStore) create(identity string, remote string) *pollSession {
+	id := make([]byte, 16)
+	rand.Read(id)
+	session := &pollSession{id: hex.EncodeToString(id), identity: identity, remote: remote, lastUsed: time.Now(), arrived: make(chan struct{})}
+
+	s.mux.Lock()
+	s.sessions[session.id] = session
+	s.mux.Unlock()
+
+	return session
+}
+
+// find returns a session only to the identity that created it
+func (s *sessionStore) find(id string, identity string) (*pollSession, bool) {
+	s.mux.Lock()
+	session, ok := s.sessions[id]
+	s.mux.Unlock()
+
+	if !ok || session.identity != identity {
+		return nil, false
+	}
+
+	session.touch()
+
+	return session, true
+}
+
+func (s *sessionStore) remove(session *pollSession) {
+	s.mux.Lock()
+	delete(s.sessions, session.id)
+	s.mux.Unlock()
+
+	unsubscribeAll(session)
+}
+
+func (s *sessionStore) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.sessions)
+}
+
+// expire removes the sessions that haven't been used for session_timeout
+func (s *sessionStore) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*pollSession
+
+		s.mux.Lock()
+
+		for _, session := range s.sessions {
+			session.mux.Lock()
+
+			if time.Since(session.lastUsed) > cfg.SessionTimeout {
+				expired = append(expired, session)
+			}
+
+			session.mux.Unlock()
+		}
+
+		s.mux.Unlock()
+
+		for _, session := range expired {
+			s.remove(session)
+			logs.Info("Session expired", "session", session.id, "remote", session.remote, "identity", session.identity)
+		}
+	}
+}
+
+// createSession answers POST /sessions with the ID of a new session, which is
+// subscribed to the topics of the optional {"topics":[...]} body
+func createSession(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/sessions")
+	identity, ok := sessionAuth(w, r, log)
+
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		admin.ReplyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var body struct {
+		Topics []string `json:"topics"`
+	}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&body)
+
+		if err != nil {
+			admin.ReplyError(w, http.StatusBadRequest, "the body must be like {\"topics\":[\"news\"]}")
+			return
+		}
+	}
+
+	for _, topic := range body.Topics {
+		if _, err := path.Match(topic, ""); topic == "" || err != nil {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid topic "+topic)
+			return
+		}
+	}
+
+	session := sessions.create(identity, r.RemoteAddr)
+
+	for _, topic := range body.Topics {
+		subscribers.subscribe(topic, session, session)
+	}
+
+	log.Info("Session created", "session", session.id, "identity", identity, "topics", strings.Join(body.Topics, ","))
+	admin.ReplyJSON(w, http.StatusCreated, map[string]interface{}{"session": session.id, "topics": body.Topics})
+}
+
+// manageSession serves the requests on one session:
+//
+//	DELETE /sessions/{id}
+//	PUT or DELETE /sessions/{id}/topics/{topic}
+//	GET /sessions/{id}/messages?wait=30s&max=100
+//	POST /sessions/{id}/ack with {"seq":n}
+func manageSession(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/sessions")
+	identity, ok := sessionAuth(w, r, log)
+
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/sessions/"), "/")
+	session, ok := sessions.find(parts[0], identity)
+
+	if !ok {
+		admin.ReplyError(w, http.StatusNotFound, "no session "+parts[0])
+		return
+	}
+
+	log = log.With("session", session.id, "identity", identity)
+
+	switch {
+	case len(parts) == 1 && r.Method == "DELETE":
+		sessions.remove(session)
+		log.Info("Session closed")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[1] == "topics" && (r.Method == "PUT" || r.Method == "DELETE"):
+		topic, err := url.PathUnescape(parts[2])
+
+		if _, badPattern := path.Match(topic, ""); err != nil || topic == "" || badPattern != nil {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid topic")
+			return
+		}
+
+		if r.Method == "PUT" {
+			subscribers.subscribe(topic, session, session)
+			log.Info("Subscribed", "topic", topic)
+		} else {
+			subscribers.unsubscribe(topic, session)
+			log.Info("Unsubscribed", "topic", topic)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == "GET":
+		pollMessages(w, r, session)
+	case len(parts) == 2 && parts[1] == "ack" && r.Method == "POST":
+		var body struct {
+			Seq uint64 `json:"seq"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+
+		if err != nil {
+			admin.ReplyError(w, http.StatusBadRequest, "the body must be like {\"seq\":1}")
+			return
+		}
+
+		session.ack(body.Seq)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.ReplyError(w, http.StatusNotFound, "unknown session request")
+	}
+}
+
+// pollMessages answers with the pending messages of a session, waiting up to
+// the wait parameter, poll_max_wait at most, for one to arrive if there are none
+func pollMessages(w http.ResponseWriter, r *http.Request, session *pollSession) {
+	wait := cfg.PollMaxWait
+	max := defaultPollMax
+
+	if value := r.URL.Query().Get("wait"); value != "" {
+		parsed, err := time.ParseDuration(value)
+
+		if err != nil || parsed < 0 {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid wait "+value)
+			return
+		}
+
+		if parsed < wait {
+			wait = parsed
+		}
+	}
+
+	if value := r.URL.Query().Get("max"); value != "" {
+		parsed, err := strconv.Atoi(value)
+
+		if err != nil || parsed <= 0 {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid max "+value)
+			return
+		}
+
+		max = parsed
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	messages, arrived := session.next(max)
+
+	if messages == nil {
+		select {
+		case <-arrived:
+			messages, _ = session.next(max)
+		case <-timeout.C:
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+		}
+	}
+
+	session.touch()
+
+	if messages == nil {
+		messages = []pendingMessage{}
+	}
+
+	admin.ReplyJSON(w, http.StatusOK, map[string]interface{}{"messages": messages})
+}
+
+func sessionAuth(w http.ResponseWriter, r *http.Request, log logger) (string, bool) {
+	identity, ok := authenticate(r)
+
+	if !ok {
+		log.Warn("Error validating credentials", "identity", identity)
+		authFailures.Inc("/sessions")
+		w.Header().Set("WWW-Authenticate", `Basic realm="subscriber"`)
+		admin.ReplyError(w, http.StatusUnauthorized, "invalid credentials")
+	}
+
+	return identity, ok
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// Closed when the service has been asked to stop, stopDeadline is set before
+var stopping = make(chan struct{})
+var stopDeadline time.Time
+
+// Connections on /subscribe
+var clients = admin.NewConnSet(logs)
+
+// drain closes the clients and the connections to msgqueue and the publisher.
+// Messages are pushed to the subscribers as soon as they arrive, so there's
+// nothing pending to flush
+func drain() int {
+	clients.CloseAll(websocket.CloseGoingAway, "server shutting down", stopDeadline)
+	mqttConns.closeAll(mqttReasonShuttingDown)
+	publisherUpstream.close(stopDeadline)
+
+	if popConn := upstream.current(); popConn != nil {
+		popConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), stopDeadline)
+	}
+
+	return shutdown.ExitOK
+}
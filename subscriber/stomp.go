@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Websocket subprotocol of STOMP 1.2, clients that don't ask for it use JSON
+const stompProtocol = "v12.stomp"
+
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+var errSTOMPMalformed = errors.New("malformed STOMP frame")
+
+var stompEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+// stompUnescape decodes a header of a frame, other escapes than the ones of
+// stompEscaper are an error
+func stompUnescape(s string) (string, error) {
+	var out bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		if i++; i == len(s) {
+			return "", errSTOMPMalformed
+		}
+
+		switch s[i] {
+		case '\\':
+			out.WriteByte('\\')
+		case 'r':
+			out.WriteByte('\r')
+		case 'n':
+			out.WriteByte('\n')
+		case 'c':
+			out.WriteByte(':')
+		default:
+			return "", errSTOMPMalformed
+		}
+	}
+
+	return out.String(), nil
+}
+
+// parseSTOMP reads the frame of a websocket message. A message with only end of
+// lines is a heart-beat, and is returned as a frame without command
+func parseSTOMP(data []byte) (stompFrame, error) {
+	frame := stompFrame{headers: make(map[string]string)}
+	data = bytes.TrimLeft(data, "\r\n")
+
+	if len(data) == 0 {
+		return frame, nil
+	}
+
+	readLine := func() (string, bool) {
+		end := bytes.IndexByte(data, '\n')
+
+		if end < 0 {
+			return "", false
+		}
+
+		line := strings.TrimSuffix(string(data[:end]), "\r")
+		data = data[end+1:]
+
+		return line, true
+	}
+
+	command, ok := readLine()
+	frame.command = command
+
+	if !ok {
+		return frame, errSTOMPMalformed
+	}
+
+	// CONNECT and CONNECTED don't escape their headers, for older clients
+	escaped := command != "CONNECT" && command != "CONNECTED"
+
+	for {
+		line, ok := readLine()
+
+		if !ok {
+			return frame, errSTOMPMalformed
+		}
+
+		if line == "" {
+			break
+		}
+
+		colon := strings.Index(line, ":")
+
+		if colon < 0 {
+			return frame, errSTOMPMalformed
+		}
+
+		name, value := line[:colon], line[colon+1:]
+
+		if escaped {
+			var nameErr, valueErr error
+			name, nameErr = stompUnescape(name)
+			value, valueErr = stompUnescape(value)
+
+			if nameErr != nil || valueErr != nil {
+				return frame, errSTOMPMalformed
+			}
+		}
+
+		// Only the first of repeated headers counts
+		if _, repeated := frame.headers[name]; !repeated {
+			frame.headers[name] = value
+		}
+	}
+
+	length := bytes.IndexByte(data, 0)
+
+	if value, ok := frame.headers["content-length"]; ok {
+		var err error
+		length, err = strconv.Atoi(value)
+
+		if err != nil || length < 0 || length >= len(data) || data[length] != 0 {
+			return frame, errSTOMPMalformed
+		}
+	}
+
+	if length < 0 || len(bytes.Trim(data[length+1:], "\r\n")) > 0 {
+		return frame, errSTOMPMalformed
+	}
+
+	frame.body = data[:length]
+
+	return frame, nil
+}
+
+// encode writes a frame with its headers in order of name
+func (f stompFrame) encode() []byte {
+	var out bytes.Buffer
+	names := make([]string, 0, len(f.headers))
+
+	for name := range f.headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	out.WriteString(f.command + "\n")
+
+	for _, name := range names {
+		if f.command == "CONNECTED" {
+			out.WriteString(name + ":" + f.headers[name] + "\n")
+		} else {
+			out.WriteString(stompEscaper.Replace(name) + ":" + stompEscaper.Replace(f.headers[name]) + "\n")
+		}
+	}
+
+	if len(f.body) > 0 {
+		out.WriteString("content-length:" + strconv.Itoa(len(f.body)) + "\n")
+	}
+
+	out.WriteString("\n")
+	out.Write(f.body)
+	out.WriteByte(0)
+
+	return out.Bytes()
+}
+
+// wantsSTOMP tells whether a websocket request offers the STOMP subprotocol
+func wantsSTOMP(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == stompProtocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stompSession is a STOMP client on /subscribe. Its subscriptions are only
+// changed by the goroutine reading its frames, while the pending acks and the
+// writes are shared with the deliveries
+type stompSession struct {
+	alive    *keepalive.Conn
+	info     *connInfo
+	log      logger
+	identity string
+	subs     map[string]*stompSubscription
+	nextAck  int
+	mux      sync.Mutex
+	writeMux sync.Mutex
+}
+
+// stompSubscription is a subscription of a STOMP client, with the ids of the
+// messages it hasn't acked yet, oldest first, and the group it joined if any
+type stompSubscription struct {
+	session     *stompSession
+	id          string
+	destination string
+	ackMode     string
+	group       string
+	pending     []string
+}
+
+// stompKey is the subscription key of a STOMP subscription, a client can
+// subscribe to the same topic more than once with different ids
+type stompKey struct {
+	conn *websocket.Conn
+	id   string
+}
+
+// owns tells whether a subscription key belongs to a connection, or to any
+// other owner of subscriptions
+func owns(key interface{}, owner interface{}) bool {
+	if stomp, ok := key.(stompKey); ok {
+		return stomp.conn == owner
+	}
+
+	return key == owner
+}
+
+func (sub *stompSubscription) key() stompKey {
+	return stompKey{conn: sub.session.info.WS, id: sub.id}
+}
+
+func (s *stompSession) write(frame stompFrame) error {
+	s.writeMux.Lock()
+	defer s.writeMux.Unlock()
+
+	return s.alive.Write(websocket.TextMessage, frame.encode())
+}
+
+// fail sends an ERROR frame, after which the connection is closed
+func (s *stompSession) fail(request stompFrame, message string, detail string) {
+	headers := map[string]string{"message": message, "content-type": "text/plain"}
+
+	if receipt, ok := request.headers["receipt"]; ok {
+		headers["receipt-id"] = receipt
+	}
+
+	s.log.Warn("STOMP error", "command", request.command, "error", message, "detail", detail)
+	s.write(stompFrame{command: "ERROR", headers: headers, body: []byte(detail)})
+}
+
+func (s *stompSession) receipt(request stompFrame) {
+	if receipt, ok := request.headers["receipt"]; ok {
+		s.write(stompFrame{command: "RECEIPT", headers: map[string]string{"receipt-id": receipt}})
+	}
+}
+
+// connect checks the version and the credentials of CONNECT. Clients that
+// weren't authenticated by the websocket request have to send login and passcode
+func (s *stompSession) connect(frame stompFrame) bool {
+	if versions, ok := frame.headers["accept-version"]; ok && !strings.Contains(","+versions+",", ",1.2,") {
+		s.fail(frame, "unsupported version", "only STOMP 1.2 is supported")
+		return false
+	}
+
+	if login, ok := frame.headers["login"]; ok {
+		if login != cfg.Username || frame.headers["passcode"] != cfg.Password {
+			s.identity = ""
+		} else {
+			s.identity = login
+		}
+	}
+
+	if s.identity == "" {
+		authFailures.Inc("/subscribe")
+		s.fail(frame, "invalid credentials", "send a valid login and passcode")
+		return false
+	}
+
+	clients.SetIdentity(s.info, s.identity)
+
+	s.log = s.log.With("identity", s.identity)
+	s.log.Info("STOMP session connected")
+
+	return s.write(stompFrame{command: "CONNECTED", headers: map[string]string{"version": "1.2", "heart-beat": "0,0", "server": "ws-go-subscriber", "session": s.info.ID}}) == nil
+}
+
+// subscribe adds a subscription to the topic, or the pattern, of its destination
+func (s *stompSession) subscribe(frame stompFrame) bool {
+	id := frame.headers["id"]
+	topic := strings.TrimPrefix(frame.headers["destination"], "/topic/")
+	ackMode := frame.headers["ack"]
+
+	if ackMode == "" {
+		ackMode = "auto"
+	}
+
+	if id == "" || topic == "" {
+		s.fail(frame, "missing header", "SUBSCRIBE needs an id and a destination")
+		return false
+	}
+
+	if s.subs[id] != nil {
+		s.fail(frame, "duplicated subscription", "there's already a subscription "+id)
+		return false
+	}
+
+	if ackMode != "auto" && ackMode != "client" && ackMode != "client-individual" {
+		s.fail(frame, "invalid ack mode", "ack must be auto, client or client-individual")
+		return false
+	}
+
+	group, grouped := frame.headers["group"]
+
+	if err := validGroup(group); grouped && err != nil {
+		s.fail(frame, "invalid group", err.Error())
+		return false
+	}
+
+	sub := &stompSubscription{session: s, id: id, destination: topic, ackMode: ackMode, group: group}
+	s.subs[id] = sub
+
+	if grouped {
+		subscribers.joinGroup(topic, group, sub.key(), sub)
+	} else {
+		subscribers.subscribe(topic, sub.key(), sub)
+	}
+
+	s.log.Info("Subscribed", "topic", topic, "subscription", id, "ack", ackMode, "group", group)
+	s.receipt(frame)
+
+	return true
+}
+
+func (s *stompSession) unsubscribe(frame stompFrame) bool {
+	sub := s.subs[frame.headers["id"]]
+
+	if sub == nil {
+		s.fail(frame, "unknown subscription", "UNSUBSCRIBE needs the id of a subscription")
+		return false
+	}
+
+	delete(s.subs, sub.id)
+
+	if sub.group != "" {
+		subscribers.leaveGroup(sub.destination, sub.group, sub.key())
+	} else {
+		subscribers.unsubscribe(sub.destination, sub.key())
+	}
+
+	s.log.Info("Unsubscribed", "topic", sub.destination, "subscription", sub.id)
+	s.receipt(frame)
+
+	return true
+}
+
+// ack releases the message of an ACK or NACK, and with client acks every older
+// message of the same subscription too. Nacked messages aren't sent again
+func (s *stompSession) ack(frame stompFrame) bool {
+	id := frame.headers["id"]
+	released := 0
+
+	s.mux.Lock()
+
+	for _, sub := range s.subs {
+		for i, pending := range sub.pending {
+			if pending != id {
+				continue
+			}
+
+			if sub.ackMode == "client" {
+				released = i + 1
+				sub.pending = sub.pending[i+1:]
+			} else {
+				released = 1
+				sub.pending = append(sub.pending[:i], sub.pending[i+1:]...)
+			}
+
+			break
+		}
+	}
+
+	s.mux.Unlock()
+
+	if released == 0 {
+		s.fail(frame, "unknown ack", "there's no unacked message "+id)
+		return false
+	}
+
+	if frame.command == "NACK" {
+		dropped.Add(float64(released), "nacked")
+	}
+
+	s.receipt(frame)
+
+	return true
+}
+
+// deliver writes a message as a MESSAGE frame, its headers become headers of
+// the frame. With client acks it fails when too many messages are unacked
+func (sub *stompSubscription) deliver(msg []byte, id string) error {
+	var m envelope
+	json.Unmarshal(msg, &m)
+
+	headers := map[string]string{"content-type": "text/plain;charset=utf-8"}
+
+	if len(m.Data) > 0 {
+		headers["content-type"] = "application/octet-stream"
+	}
+
+	for name, value := range m.Headers {
+		headers[name] = value
+	}
+
+	headers["destination"] = "/topic/" + m.Topic
+	headers["message-id"] = id
+	headers["subscription"] = sub.id
+	frame := stompFrame{command: "MESSAGE", headers: headers, body: m.Payload()}
+
+	if sub.ackMode == "auto" {
+		return sub.session.write(frame)
+	}
+
+	// The ack is added while holding the lock, so the pending acks keep the
+	// order in which the messages are written
+	s := sub.session
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(sub.pending) >= cfg.STOMPMaxUnacked {
+		return errors.New("too many unacked STOMP messages")
+	}
+
+	s.nextAck++
+	ack := strconv.Itoa(s.nextAck)
+	frame.headers["ack"] = ack
+	err := s.write(frame)
+
+	if err == nil {
+		sub.pending = append(sub.pending, ack)
+	}
+
+	return err
+}
+
+// load is how many messages the subscription has unacked
+func (sub *stompSubscription) load() int {
+	sub.session.mux.Lock()
+	defer sub.session.mux.Unlock()
+
+	return len(sub.pending)
+}
+
+func (sub *stompSubscription) remoteAddr() string {
+	return sub.session.alive.RemoteAddr()
+}
+
+// serveSTOMP reads the frames of a STOMP client until it disconnects or sends
+// something wrong
+func serveSTOMP(conn *websocket.Conn, alive *keepalive.Conn, info *connInfo, log logger, identity string) {
+	s := &stompSession{alive: alive, info: info, log: log, identity: identity, subs: make(map[string]*stompSubscription)}
+	connected := false
+
+	for {
+		_, data, err := conn.ReadMessage()
+
+		if err != nil {
+			s.log.Info("Connection closed", "reason", err)
+			return
+		}
+
+		alive.Received()
+		frame, err := parseSTOMP(data)
+
+		if err != nil {
+			s.fail(frame, "malformed frame", err.Error())
+			return
+		}
+
+		ok := true
+
+		switch {
+		case frame.command == "":
+			continue
+		case frame.command == "CONNECT" || frame.command == "STOMP":
+			if connected {
+				s.fail(frame, "already connected", "CONNECT can only be sent once")
+				return
+			}
+
+			connected = s.connect(frame)
+			ok = connected
+		case !connected:
+			s.fail(frame, "not connected", "the first frame must be CONNECT")
+			return
+		case frame.command == "SUBSCRIBE":
+			ok = s.subscribe(frame)
+		case frame.command == "UNSUBSCRIBE":
+			ok = s.unsubscribe(frame)
+		case frame.command == "ACK" || frame.command == "NACK":
+			ok = s.ack(frame)
+		case frame.command == "DISCONNECT":
+			s.receipt(frame)
+			s.log.Info("STOMP session disconnected")
+			return
+		default:
+			s.fail(frame, "unsupported command", "the subscriber doesn't accept "+frame.command+", messages must be sent to the publisher")
+			return
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
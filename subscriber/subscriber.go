@@ -1,75 +1,217 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/codec"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/Javivi/ws-go/internal/logging"
+	"github.com/Javivi/ws-go/internal/metrics"
+	"github.com/Javivi/ws-go/internal/shutdown"
+	"github.com/Javivi/ws-go/internal/tracing"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"sync"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    append([]string{stompProtocol}, codec.Names...),
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// sink is where the messages of a subscription are delivered, a websocket or an
+// event stream
+type sink interface {
+	deliver(msg []byte, id string) error
+	remoteAddr() string
+}
+
+// safeSubscribe holds the subscriptions by topic or pattern, and then by the
+// connection they belong to. MQTT topic filters are kept apart, as they match
+// topics in their own way, and so are inboxes, which only have one recipient,
+// and groups, whose members share the messages of a topic or pattern
 type safeSubscribe struct {
-	subs map[string]map[*websocket.Conn]bool
-	mux  sync.Mutex
+	subs    map[string]map[interface{}]sink
+	filters map[string]map[interface{}]sink
+	inboxes map[string]inbox
+	groups  map[string]map[string]*group
+	mux     sync.Mutex
 }
 
-var subscribers = safeSubscribe{subs: make(map[string]map[*websocket.Conn]bool)}
+var subscribers = safeSubscribe{subs: make(map[string]map[interface{}]sink), filters: make(map[string]map[interface{}]sink), inboxes: make(map[string]inbox), groups: make(map[string]map[string]*group)}
+
+// Client certificate and CA used when dialing to other services
+var clientCerts = certstore.New(os.Getenv("WS_CERT_DIR"), certstore.ClientCertFile, certstore.ClientKeyFile, false, logs)
 
 type message struct {
 	Topic   string
 	Content string
 }
 
+// request is what /subscribe websockets send, a message with the topic and
+// sub, unsub or inbox as its content, and the group to join or leave if any
+type request struct {
+	message
+	Group string `json:",omitempty"`
+}
+
 func main() {
-	popConn, err := dialToService("localhost:8080", "/popmsg", "hello", "test")
+	c, printOnly, err := loadConfig(os.Args[1:])
+
+	if err == flag.ErrHelp {
+		return
+	}
 
 	if err != nil {
-		fmt.Printf("[subscriber] Error dialing server\n%s\n", err)
-		os.Exit(1)
+		logs.Error("Error loading configuration", "error", err)
+		os.Exit(shutdown.ExitConfig)
 	}
 
-	go popMessages(popConn, nil)
+	if printOnly {
+		err = printConfig(c)
 
-	err = initServer("localhost:8082", os.Getenv("WS_CERT_DIR"), nil)
+		if err != nil {
+			logs.Error("Error printing configuration", "error", err)
+			os.Exit(shutdown.ExitError)
+		}
+
+		return
+	}
+
+	applyConfig(c)
+	err = logging.Configure(c.logSettings())
 
 	if err != nil {
-		fmt.Printf("[subscriber] Error initialising server\n%s\n", err)
-		os.Exit(1)
+		logs.Error("Error configuring logs", "error", err)
+		os.Exit(shutdown.ExitConfig)
 	}
+
+	err = tracing.Configure(c.traceSettings(), logs)
+
+	if err != nil {
+		logs.Error("Error configuring tracing", "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	err = webhooks.load(cfg.WebhookFile)
+
+	if err != nil {
+		logs.Error("Error loading the webhooks", "file", cfg.WebhookFile, "error", err)
+		os.Exit(shutdown.ExitConfig)
+	}
+
+	go reloadLogs(os.Args[1:])
+	popConn, err := dialUpstream()
+
+	if err != nil {
+		logs.Error("Error dialing server", "upstream", cfg.Upstream.Addr, "error", err)
+		os.Exit(shutdown.ExitError)
+	}
+
+	go maintainUpstream(popConn)
+	go shutdown.HandleSignals(stopping, &stopDeadline, cfg.ShutdownTimeout, logs)
+
+	if cfg.MQTT.Listen != "" {
+		go func() {
+			err := initMQTT(cfg.MQTT.Listen, cfg.CertDir, nil)
+
+			if err != nil {
+				logs.Error("Error initialising MQTT gateway", "error", err)
+				os.Exit(shutdown.ExitError)
+			}
+		}()
+	}
+
+	if cfg.Admin.Listen != "" {
+		go func() {
+			err := initAdmin(cfg.Admin.Listen, cfg.CertDir, nil)
+
+			if err != nil {
+				logs.Error("Error initialising admin API", "error", err)
+				os.Exit(shutdown.ExitError)
+			}
+		}()
+	}
+
+	err = initServer(cfg.Listen, cfg.CertDir, nil)
+
+	if err != nil {
+		logs.Error("Error initialising server", "error", err)
+		os.Exit(shutdown.ExitError)
+	}
+
+	status := drain()
+	tracing.Flush()
+	os.Exit(status)
 }
 
-func dialToService(addr string, path string, username string, password string) (*websocket.Conn, error) {
-	serviceURL := url.URL{Scheme: "wss", Host: addr, Path: path}
+// dialToService opens a websocket to another service, compressed when the
+// settings and the service allow it. TLS is set up when dialing, instead of by
+// the websocket dialer, so the connection metered is the one under the frames.
+// The path can have a query
+func dialToService(addr string, path string, username string, password string, settings compression.Config) (*websocket.Conn, error) {
+	target, err := url.Parse(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceURL := url.URL{Scheme: "ws", Host: addr, Path: target.Path, RawQuery: target.RawQuery}
 	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}}
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = settings.Enabled
+	var metered *compression.MeteredConn
 
-	serviceConn, _, err := websocket.DefaultDialer.Dial(serviceURL.String(), authHeader)
+	dialer.NetDial = func(network string, address string) (net.Conn, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialer.HandshakeTimeout}, network, address, clientCerts.ClientConfig())
+
+		if err != nil {
+			return nil, err
+		}
+
+		metered = &compression.MeteredConn{Conn: conn}
+
+		return metered, nil
+	}
+
+	serviceConn, response, err := dialer.Dial(serviceURL.String(), authHeader)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if settings.Enabled && compression.Offered(response.Header) {
+		compression.Start(serviceConn, metered, target.Path, settings)
+	}
+
 	return serviceConn, nil
 }
 
+// popMessages delivers the messages of msgqueue until the connection is lost
 func popMessages(conn *websocket.Conn, connClosed chan bool) {
 	for {
 		_, msg, err := conn.ReadMessage()
 
 		if err != nil {
-			fmt.Printf("[subscriber] Error reading message\n%s\n", err)
+			logs.Error("Lost connection to msgqueue", "upstream", cfg.Upstream.Addr, "error", err)
 
 			if connClosed != nil {
 				close(connClosed)
@@ -78,96 +220,423 @@ func popMessages(conn *websocket.Conn, connClosed chan bool) {
 			return
 		}
 
-		fmt.Printf("[subscriber] Received %s\n", msg)
+		// Messages that can't be decoded are logged and counted by dispatch,
+		// the ones after them are still delivered
+		dispatch(msg)
+	}
+}
+
+// dispatch delivers a message from msgqueue to every subscription matching its
+// topic, it only fails when the message can't be decoded
+func dispatch(msg []byte) error {
+	received.Inc()
+	id := logging.MessageID(msg)
+	log := logs.With("id", id)
+	fanOut := tracing.StartMessage("fan-out", tracing.Consumer, msg)
+	msg = tracing.WithTrace(msg, fanOut)
+
+	// Messages routed by group to an instance say which groups it was picked for
+	var picked map[groupInterest]bool
+
+	if cfg.Instance != "" {
+		picked, msg = routedGroups(msg)
+	}
+
+	var m message
+	err := json.Unmarshal(msg, &m)
+
+	if err != nil {
+		log.Error("Error decoding message", "size", len(msg), "error", err)
+		dropped.Inc("invalid")
+		fanOut.Fail(err)
+		fanOut.Finish()
+		return err
+	}
+
+	log = log.With("topic", m.Topic)
+	fanOut.Set("messaging.message.id", id, "messaging.destination.name", m.Topic, "messaging.message.body.size", len(msg))
+	log.Sample().Debug("Received message", "size", len(msg), "payload", msg)
+
+	// Replies are only for the connection that owns the inbox
+	if !isInbox(m.Topic) {
+		history.add(id, m.Topic, msg)
+		retained.update(m.Topic, msg)
+	}
+
+	recipients := subscribers.matchingGroups(m.Topic, picked)
 
-		var m message
-		err = json.Unmarshal(msg, &m)
+	for _, sub := range recipients {
+		write := fanOut.Child("subscriber write", tracing.Producer)
+		write.Set("net.peer.name", sub.remoteAddr())
+		start := time.Now()
+		err := sub.deliver(msg, id)
+		writeDuration.Observe(time.Since(start))
 
 		if err != nil {
-			fmt.Printf("[subscriber] JSON unmarshal error %s\n", err)
-			return
+			write.Fail(err)
+			write.Finish()
+			log.Warn("Error sending message to one subscriber", "remote", sub.remoteAddr(), "error", err)
+			dropped.Inc("write_error")
+			continue
 		}
 
-		subscribers.mux.Lock()
-		for sub := range subscribers.subs[m.Topic] {
-			err := sub.WriteMessage(websocket.TextMessage, msg)
+		delivered.Inc(topics.label(m.Topic))
+		write.Finish()
+		log.Sample().Debug("Pushing message", "remote", sub.remoteAddr())
+	}
 
-			if err != nil {
-				fmt.Printf("[subscriber] Error sending message to one subscriber\n%s\n", err)
+	if len(recipients) == 0 {
+		log.Sample().Debug("Ignoring message for topic without subscribers")
+		dropped.Inc("no_subscribers")
+	}
+
+	fanOut.Finish()
+
+	return nil
+}
+
+// isPattern tells apart the subscriptions to every topic matching a pattern,
+// which use the syntax of path.Match, from the ones to a single topic
+func isPattern(topic string) bool {
+	return strings.ContainsAny(topic, "*?[")
+}
+
+// topicMatches tells whether a subscription to a topic or pattern gets the
+// messages of a topic
+func topicMatches(subscribed string, topic string) bool {
+	if subscribed == topic {
+		return true
+	}
+
+	matched, _ := path.Match(subscribed, topic)
+
+	return isPattern(subscribed) && matched
+}
+
+func (s *safeSubscribe) subscribe(topic string, key interface{}, sub sink) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.subs[topic] == nil {
+		s.subs[topic] = make(map[interface{}]sink)
+	}
+
+	s.subs[topic][key] = sub
+	touchInterest()
+}
+
+func (s *safeSubscribe) unsubscribe(topic string, key interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.subs[topic], key)
+
+	if len(s.subs[topic]) == 0 {
+		delete(s.subs, topic)
+	}
+
+	touchInterest()
+}
+
+// matching returns the subscribers to a topic, either directly or through a
+// pattern, each one only once, and the member picked by each group of the
+// topic. The topic of an inbox only matches its owner
+func (s *safeSubscribe) matching(topic string) map[interface{}]sink {
+	return s.matchingGroups(topic, nil)
+}
+
+// matchingGroups is matching for a message msgqueue routed by group, only the
+// picked groups of the instance pick a member. Every group does when picked is nil
+func (s *safeSubscribe) matchingGroups(topic string, picked map[groupInterest]bool) map[interface{}]sink {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	recipients := make(map[interface{}]sink)
+
+	if isInbox(topic) {
+		if box, ok := s.inboxes[topic]; ok {
+			recipients[box.owner] = box.sink
+		}
+
+		return recipients
+	}
+
+	for subscribed, subs := range s.subs {
+		if !topicMatches(subscribed, topic) {
+			continue
+		}
+
+		for key, sub := range subs {
+			recipients[key] = sub
+		}
+	}
+
+	for subscribed, groups := range s.groups {
+		if !topicMatches(subscribed, topic) {
+			continue
+		}
+
+		for name, g := range groups {
+			if picked != nil && !picked[groupInterest{Topic: subscribed, Group: name}] {
 				continue
 			}
 
-			fmt.Printf("[subscriber] Pushing %s\n", msg)
+			members := g.pickInTurn(cfg.GroupStrategy)
+			recipients[members[0].key] = members
 		}
+	}
 
-		if len(subscribers.subs[m.Topic]) == 0 {
-			fmt.Printf("[subscriber] Ignoring message for topic without subscribers %s\n", msg)
+	for filter, subs := range s.filters {
+		if matchFilter(filter, topic) {
+			for key, sub := range subs {
+				recipients[key] = sub
+			}
 		}
-		subscribers.mux.Unlock()
 	}
+
+	return recipients
+}
+
+func (s *safeSubscribe) subscribeFilter(filter string, key interface{}, sub sink) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.filters[filter] == nil {
+		s.filters[filter] = make(map[interface{}]sink)
+	}
+
+	s.filters[filter][key] = sub
+	touchInterest()
+}
+
+func (s *safeSubscribe) unsubscribeFilter(filter string, key interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.filters[filter], key)
+
+	if len(s.filters[filter]) == 0 {
+		delete(s.filters, filter)
+	}
+
+	touchInterest()
+}
+
+// unsubscribeAll removes a connection from every topic, filter and group, and
+// closes its inbox
+func unsubscribeAll(key interface{}) {
+	subscribers.mux.Lock()
+	defer subscribers.mux.Unlock()
+	defer touchInterest()
+
+	for topic, groups := range subscribers.groups {
+		for name := range groups {
+			subscribers.removeMembers(topic, name, func(member interface{}) bool {
+				return owns(member, key)
+			})
+		}
+	}
+
+	for topic, box := range subscribers.inboxes {
+		if owns(box.owner, key) {
+			delete(subscribers.inboxes, topic)
+		}
+	}
+
+	for _, set := range []map[string]map[interface{}]sink{subscribers.subs, subscribers.filters} {
+		for topic, subs := range set {
+			for subscribed := range subs {
+				if owns(subscribed, key) {
+					delete(subs, subscribed)
+				}
+			}
+
+			if len(subs) == 0 {
+				delete(set, topic)
+			}
+		}
+	}
+}
+
+// wsSink delivers the messages of a subscription as they are
+type wsSink struct {
+	alive *keepalive.Conn
+}
+
+func (w wsSink) deliver(msg []byte, id string) error {
+	return w.alive.Write(websocket.TextMessage, msg)
+}
+
+func (w wsSink) remoteAddr() string {
+	return w.alive.RemoteAddr()
+}
+
+func (w wsSink) load() int {
+	return w.alive.Pending()
+}
+
+// readRequest reads a request of a websocket, encoded with the codec of the
+// connection when it has one. Codecs carry the group in the group header
+func readRequest(conn *websocket.Conn, enc codec.Codec) (request, error) {
+	var msg request
+
+	if enc == nil {
+		err := conn.ReadJSON(&msg)
+		return msg, err
+	}
+
+	_, data, err := conn.ReadMessage()
+
+	if err != nil {
+		return msg, err
+	}
+
+	m, err := enc.Decode(data)
+
+	return request{message{m.Topic, m.Content}, m.Headers["group"]}, err
+}
+
+// authenticate accepts either a verified client certificate or the basic auth
+// credentials, and returns the identity of the client
+func authenticate(r *http.Request) (string, bool) {
+	if identity, ok := certstore.Identity(r.TLS); ok {
+		return identity, identity == cfg.Username
+	}
+
+	username, password, ok := r.BasicAuth()
+
+	return username, ok && username == cfg.Username && password == cfg.Password
 }
 
 func initServer(addr string, certDir string, serverReady chan<- bool) error {
-	cert, err := tls.LoadX509KeyPair(certDir+"server.crt", certDir+"server.key")
+	clientAuth, err := certstore.ParseClientAuth(cfg.ClientAuth)
+
+	if err != nil {
+		return err
+	}
+
+	certs := certstore.New(certDir, certstore.ServerCertFile, certstore.ServerKeyFile, true, logs)
+	err = certs.Load()
 
 	if err != nil {
 		return err
 	}
 
-	http.HandleFunc("/subscribe", func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
+	if clientAuth != tls.NoClientCert {
+		_, caPool := certs.Current()
+
+		if caPool == nil {
+			return errors.New("client certificates can't be verified without " + certDir + certstore.CACertFile)
+		}
+	}
+
+	mux := http.NewServeMux()
 
-		if !ok || username != "hello" || password != "test" {
-			fmt.Printf("[subscriber] Error validating credentials [%s:%s]\n", username, password)
+	mux.HandleFunc("/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		log, connID := logs.Conn(r.RemoteAddr, "/subscribe")
+		identity, ok := authenticate(r)
+		stomp := wantsSTOMP(r)
+
+		// STOMP clients can authenticate with the login and passcode of CONNECT
+		if !ok && stomp {
+			identity = ""
+		} else if !ok {
+			log.Warn("Error validating credentials", "identity", identity)
+			authFailures.Inc("/subscribe")
 			return
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := compression.Upgrade(&upgrader, w, r, "/subscribe", cfg.Compression)
 
 		if err != nil {
-			fmt.Printf("[subscriber] Error upgrading connection\n%s\n", err)
+			log.Warn("Error upgrading connection", "error", err)
 			return
 		}
 
+		log = log.With("identity", identity)
+		log.Info("Connection opened")
+		info := admin.NewConn(connID, "/subscribe", r, identity, conn)
+		clients.Add(info)
+		alive := keepalive.Start(conn, cfg.KeepAlive, logs)
+
 		go func() {
+			defer clients.Remove(conn)
+			defer conn.Close()
+			defer alive.Stop()
+			defer unsubscribeAll(conn)
+
+			if stomp {
+				serveSTOMP(conn, alive, info, log, identity)
+				return
+			}
+
+			enc := codec.For(conn.Subprotocol())
+			var sub sink = wsSink{alive}
+			var box string
+
+			if enc != nil {
+				sub = codecSink{alive, enc}
+			}
+
 			for {
-				msg := &message{}
-				err := conn.ReadJSON(msg)
+				msg, err := readRequest(conn, enc)
 
 				if err != nil {
-					fmt.Printf("[subscriber] Error reading JSON\n%s\n", err)
+					log.Info("Connection closed", "reason", err)
 					return
 				}
 
-				if subscribers.subs[msg.Topic] == nil {
-					subscribers.mux.Lock()
-					subscribers.subs[msg.Topic] = make(map[*websocket.Conn]bool)
-					subscribers.mux.Unlock()
+				alive.Received()
+
+				// Requests with a group join or leave it instead of the topic
+				if msg.Group != "" && (msg.Content == "sub" || msg.Content == "unsub") {
+					joinOrLeave(msg, conn, sub, log)
+					continue
 				}
 
 				if msg.Content == "sub" {
-					subscribers.mux.Lock()
-					subscribers.subs[msg.Topic][conn] = true
-					subscribers.mux.Unlock()
-					fmt.Printf("[subscriber] Subscribed to %s\n", msg.Topic)
+					subscribers.subscribe(msg.Topic, conn, sub)
+					log.Info("Subscribed", "topic", msg.Topic)
 					continue
 				}
 
 				if msg.Content == "unsub" {
-					subscribers.mux.Lock()
-					delete(subscribers.subs[msg.Topic], conn)
-					subscribers.mux.Unlock()
-					fmt.Printf("[subscriber] Unsubscribed from %s\n", msg.Topic)
+					subscribers.unsubscribe(msg.Topic, conn)
+					log.Info("Unsubscribed", "topic", msg.Topic)
+					continue
+				}
+
+				// The inbox is opened the first time it's asked for, and the
+				// same one is given to every later request
+				if msg.Content == "inbox" {
+					if box == "" {
+						box = subscribers.openInbox(conn, sub)
+						log.Info("Inbox opened", "inbox", box)
+					}
+
+					sub.deliver(inboxReply(box), "")
 					continue
 				}
 
-				fmt.Printf("[subscriber] Ignoring invalid message %s\n", msg)
+				log.Warn("Ignoring invalid request", "topic", msg.Topic, "content", []byte(msg.Content))
 			}
 		}()
 	})
 
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
-	listener, err := tls.Listen("tcp", addr, config)
+	mux.HandleFunc("/events", streamEvents)
+	mux.HandleFunc("/sessions", createSession)
+	mux.HandleFunc("/sessions/", manageSession)
+	mux.HandleFunc("/webhooks", registerWebhook)
+	mux.HandleFunc("/webhooks/", manageWebhook)
+	mux.HandleFunc("/mqtt", serveMQTTWebsocket)
+	go sessions.expire()
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/healthz", health.Handler(livenessChecks))
+	mux.HandleFunc("/readyz", health.Handler(func() []check {
+		return readinessChecks(certs)
+	}))
+
+	listener, err := tls.Listen("tcp", addr, certs.ServerConfig(clientAuth))
 
 	if err != nil {
 		return err
@@ -179,8 +648,21 @@ func initServer(addr string, certDir string, serverReady chan<- bool) error {
 		serverReady <- true
 	}
 
-	fmt.Println("[subscriber] Server running")
-	http.Serve(listener, nil)
+	server := &http.Server{Handler: mux}
 
-	return nil
+	go func() {
+		<-stopping
+		ctx, cancel := context.WithDeadline(context.Background(), stopDeadline)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	logs.Info("Server running", "addr", addr)
+	err = server.Serve(listener)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
 }
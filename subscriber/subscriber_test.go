@@ -1,19 +1,69 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Javivi/ws-go/internal/certstore"
+	"github.com/Javivi/ws-go/internal/codec"
+	"github.com/Javivi/ws-go/internal/compression"
+	"github.com/Javivi/ws-go/internal/health"
+	"github.com/Javivi/ws-go/internal/keepalive"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var serverRunning = false
 
+// Password of the admin API in the tests, the one of the demo credentials is
+// refused
+const adminPassword = "admin-tests"
+
 func TestMain(m *testing.M) {
+	cfg.Admin.Password = adminPassword
+
+	// Webhook retries are set before anything reads them, so the tests don't wait
+	cfg.WebhookBackoff = 10 * time.Millisecond
+	cfg.WebhookAllowPrivate = true
+	cfg.Publisher.Addr = "localhost:8998"
+
+	// msgqueue is only played by TestReconnect, which the subscriber dials as an
+	// instance, and dialed again quickly
+	cfg.Instance = "reconnect"
+	cfg.Upstream.Addr = "localhost:8996"
+	cfg.Upstream.ReconnectBackoff = 10 * time.Millisecond
+	cfg.Upstream.ReconnectMaxBackoff = 50 * time.Millisecond
+	cfg.Compression.Enabled = true
+	cfg.Compression.MinSize = 64
+	upgrader.EnableCompression = true
+	mqttUpgrader.EnableCompression = true
+	mqttReady := make(chan bool)
+
+	go func() {
+		err := initMQTT("localhost:8883", os.Getenv("WS_CERT_DIR"), mqttReady)
+
+		if err != nil {
+			fmt.Println(err)
+			close(mqttReady)
+		}
+	}()
+
+	<-mqttReady
 	ready := make(chan bool)
 
 	go func() {
@@ -59,14 +109,14 @@ func TestInitServer(t *testing.T) {
 }
 
 func TestInvalidCredentials(t *testing.T) {
-	_, err := dialToService("localhost:8082", "/subscribe", "fail", "test")
+	_, err := dialToService("localhost:8082", "/subscribe", "fail", "test", compression.Config{})
 	if err != websocket.ErrBadHandshake {
 		t.Fatal("[test] Successfully authenticated with bad credentials")
 	}
 }
 
 func TestDialerFail(t *testing.T) {
-	_, err := dialToService("invalid addr", "", "fail", "test")
+	_, err := dialToService("invalid addr", "", "fail", "test", compression.Config{})
 
 	if err == nil {
 		t.Fatal("[test] Successfully dialed to a wrong address")
@@ -160,7 +210,7 @@ func TestRoundtrip(t *testing.T) {
 
 	go http.Serve(listener, nil)
 
-	popConn, err := dialToService("localhost:8999", "/test", "hello", "test")
+	popConn, err := dialToService("localhost:8999", "/test", "hello", "test", compression.Config{})
 
 	if err != nil {
 		t.Fatal(err)
@@ -172,7 +222,7 @@ func TestRoundtrip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test")
+	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
 
 	if err != nil {
 		t.Fatal(err)
@@ -245,3 +295,1552 @@ func TestRoundtrip(t *testing.T) {
 		t.Fatal("[tests] Received a message after closing the websocket")
 	}
 }
+
+func TestHealth(t *testing.T) {
+	_, caPool := clientCerts.Current()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+
+	// The tests never dial to msgqueue, which is dialed again without a restart
+	for path, status := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		response, err := client.Get("https://localhost:8082" + path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != status {
+			t.Fatalf("[tests] Wrong %s status without a connection to msgqueue: %d %s", path, response.StatusCode, body)
+		}
+
+		if path == "/readyz" && (!strings.Contains(string(body), `"name":"upstream","ok":false`) || !strings.Contains(string(body), `"name":"certificate","ok":true`)) {
+			t.Fatalf("[tests] Wrong readiness checks: %s", body)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "certs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	recorder := httptest.NewRecorder()
+	handler := health.Handler(func() []check {
+		return readinessChecks(certstore.New(dir+"/", certstore.ServerCertFile, certstore.ServerKeyFile, true, logs))
+	})
+	handler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), `"name":"certificate","ok":false,"detail":"no certificate loaded"`) {
+		t.Fatalf("[tests] Missing certificate wasn't reported: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	cfg.ClientAuth = "require"
+	ready := make(chan bool)
+
+	go func() {
+		err := initServer("localhost:8898", os.Getenv("WS_CERT_DIR"), ready)
+
+		if err != nil {
+			fmt.Println(err)
+			close(ready)
+		}
+	}()
+
+	srv := <-ready
+	cfg.ClientAuth = "none"
+
+	if srv == false {
+		t.Fatal("[tests] Server not running")
+	}
+
+	subURL := url.URL{Scheme: "wss", Host: "localhost:8898", Path: "/subscribe"}
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig()}
+
+	// No basic auth header, the identity comes from client.crt
+	conn, _, err := dialer.Dial(subURL.String(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	_, caPool := clientCerts.Current()
+	dialer = websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: caPool}}
+	_, _, err = dialer.Dial(subURL.String(), nil)
+
+	if err == nil {
+		t.Fatal("[tests] Connected without a client certificate")
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = subConn.WriteJSON(message{"closing", "sub"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+	clients.CloseAll(websocket.CloseGoingAway, "server shutting down", time.Now().Add(time.Second))
+
+	subConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, _, err = subConn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatal("[tests] Didn't receive a going away close frame", err)
+	}
+
+	time.Sleep(time.Second)
+	subscribers.mux.Lock()
+	defer subscribers.mux.Unlock()
+
+	if len(subscribers.subs["closing"]) != 0 {
+		t.Fatal("[tests] Closed connection is still subscribed")
+	}
+}
+
+func TestTopicLabels(t *testing.T) {
+	defaults := cfg.MetricsMaxTopics
+	defer func() { cfg.MetricsMaxTopics = defaults }()
+
+	limited := topicLabels{seen: make(map[string]bool)}
+	cfg.MetricsMaxTopics = 2
+
+	if limited.label("a") != "a" || limited.label("b") != "b" {
+		t.Fatal("[tests] Topics under the limit weren't used as labels")
+	}
+
+	if limited.label("c") != "other" {
+		t.Fatal("[tests] Topic over the limit was used as a label")
+	}
+
+	if limited.label("a") != "a" {
+		t.Fatal("[tests] Known topic stopped being used as a label")
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	ready := make(chan bool)
+
+	go func() {
+		err := initAdmin("localhost:9082", os.Getenv("WS_CERT_DIR"), ready)
+
+		if err != nil {
+			fmt.Println(err)
+			close(ready)
+		}
+	}()
+
+	if !<-ready {
+		t.Fatal("[tests] Admin API not running")
+	}
+
+	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer subConn.Close()
+
+	err = subConn.WriteJSON(message{"kicked", "sub"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, _ := http.NewRequest("GET", "https://localhost:9082/connections", nil)
+	req.SetBasicAuth("admin", adminPassword)
+	response, err := client.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []connListing
+	err = json.NewDecoder(response.Body).Decode(&conns)
+	response.Body.Close()
+
+	if err != nil || len(conns) == 0 || len(conns[len(conns)-1].Subscriptions) != 1 || conns[len(conns)-1].Subscriptions[0] != "kicked" {
+		t.Fatal("[tests] Subscriptions of the new client aren't listed", conns, err)
+	}
+
+	req, _ = http.NewRequest("DELETE", "https://localhost:9082/connections/"+conns[len(conns)-1].ID, nil)
+	req.SetBasicAuth("admin", adminPassword)
+	response, err = client.Do(req)
+
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatal("[tests] Client wasn't kicked", err)
+	}
+
+	response.Body.Close()
+	subConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, _, err = subConn.ReadMessage()
+
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatal("[tests] Kicked client didn't receive a policy violation close frame", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dispatch([]byte(`{"ID":"e-0","Topic":"misc","Content":"before"}`))
+	dispatch([]byte(`{"ID":"e-1","Topic":"news.sports","Content":"missed"}`))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, _ := http.NewRequest("GET", "https://localhost:8082/events?topic=news.*&topic=weather", nil)
+	req.SetBasicAuth("hello", "test")
+	req.Header.Set("Last-Event-ID", "e-0")
+	response, err := client.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("[tests] Event stream wasn't opened", response.Status)
+	}
+
+	lines := make(chan string, 10)
+
+	go func() {
+		reader := bufio.NewReader(response.Body)
+
+		for {
+			line, err := reader.ReadString('\n')
+
+			if err != nil {
+				close(lines)
+				return
+			}
+
+			if line != "\n" {
+				lines <- strings.TrimSuffix(line, "\n")
+			}
+		}
+	}()
+
+	expect := func(want string) {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Fatal("[tests] Expected", want, "got", line)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("[tests] Timed out waiting for", want)
+		}
+	}
+
+	expect("id: e-1")
+	expect(`data: {"ID":"e-1","Topic":"news.sports","Content":"missed"}`)
+
+	time.Sleep(100 * time.Millisecond)
+	dispatch([]byte(`{"ID":"e-2","Topic":"misc","Content":"ignored"}`))
+	dispatch([]byte(`{"ID":"e-3","Topic":"weather","Content":"live"}`))
+
+	expect("id: e-3")
+	expect(`data: {"ID":"e-3","Topic":"weather","Content":"live"}`)
+}
+
+func TestLongPoll(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	request := func(method string, path string, body string, reply interface{}) int {
+		req, _ := http.NewRequest(method, "https://localhost:8082"+path, strings.NewReader(body))
+		req.SetBasicAuth("hello", "test")
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer response.Body.Close()
+
+		if reply != nil {
+			json.NewDecoder(response.Body).Decode(reply)
+		}
+
+		return response.StatusCode
+	}
+
+	var session struct {
+		Session string
+	}
+
+	if status := request("POST", "/sessions", `{"topics":["polls.*"]}`, &session); status != http.StatusCreated || session.Session == "" {
+		t.Fatal("[tests] Session wasn't created", status)
+	}
+
+	prefix := "/sessions/" + session.Session
+
+	if status := request("PUT", prefix+"/topics/alerts", "", nil); status != http.StatusNoContent {
+		t.Fatal("[tests] Couldn't subscribe the session", status)
+	}
+
+	var poll struct {
+		Messages []pendingMessage
+	}
+
+	start := time.Now()
+
+	if request("GET", prefix+"/messages?wait=200ms", "", &poll); len(poll.Messages) != 0 || time.Since(start) < 200*time.Millisecond {
+		t.Fatal("[tests] An empty poll didn't wait", poll.Messages, time.Since(start))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		dispatch([]byte(`{"ID":"p-1","Topic":"polls.a","Content":"one"}`))
+		dispatch([]byte(`{"ID":"p-2","Topic":"misc","Content":"ignored"}`))
+		dispatch([]byte(`{"ID":"p-3","Topic":"alerts","Content":"two"}`))
+	}()
+
+	request("GET", prefix+"/messages?wait=3s", "", &poll)
+
+	if len(poll.Messages) == 0 || poll.Messages[0].ID != "p-1" {
+		t.Fatal("[tests] Poll didn't return the first message", poll.Messages)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	request("GET", prefix+"/messages?wait=3s", "", &poll)
+
+	if len(poll.Messages) != 2 || poll.Messages[1].ID != "p-3" {
+		t.Fatal("[tests] Unacked messages weren't returned again", poll.Messages)
+	}
+
+	if status := request("POST", prefix+"/ack", `{"seq":`+strconv.FormatUint(poll.Messages[0].Seq, 10)+`}`, nil); status != http.StatusNoContent {
+		t.Fatal("[tests] Couldn't ack", status)
+	}
+
+	request("GET", prefix+"/messages?wait=0s", "", &poll)
+
+	if len(poll.Messages) != 1 || poll.Messages[0].ID != "p-3" {
+		t.Fatal("[tests] Acked message was returned again", poll.Messages)
+	}
+
+	idle, _ := sessions.find(session.Session, "hello")
+	idle.mux.Lock()
+	idle.lastUsed = time.Now().Add(-cfg.SessionTimeout)
+	idle.mux.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+
+	if status := request("GET", prefix+"/messages?wait=0s", "", nil); status != http.StatusNotFound {
+		t.Fatal("[tests] Session didn't expire", status)
+	}
+
+	if len(subscribers.matching("alerts")) != 0 {
+		t.Fatal("[tests] Expired session is still subscribed")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	request := func(method string, path string, body string, reply interface{}) int {
+		req, _ := http.NewRequest(method, "https://localhost:8082"+path, strings.NewReader(body))
+		req.SetBasicAuth("hello", "test")
+		response, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer response.Body.Close()
+
+		if reply != nil {
+			json.NewDecoder(response.Body).Decode(reply)
+		}
+
+		return response.StatusCode
+	}
+
+	received := make(chan string, 10)
+	var attempts sync.Map
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get("X-Webhook-Signature") != signature("shared", r.Header.Get("X-Webhook-Timestamp"), body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Every message fails the first time, and the ones on "broken" always do
+		id := r.Header.Get("X-Webhook-Message-ID")
+		_, retried := attempts.LoadOrStore(id, true)
+
+		if !retried || strings.Contains(string(body), "broken") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		received <- id + " " + r.Header.Get("X-Webhook-Attempt")
+	}))
+
+	defer receiver.Close()
+
+	var hook struct {
+		ID     string
+		Secret string
+	}
+
+	if status := request("POST", "/webhooks", `{"url":"`+receiver.URL+`","topics":["hooks.*"],"secret":"shared","concurrency":2}`, &hook); status != http.StatusCreated || hook.Secret != "shared" {
+		t.Fatal("[tests] Webhook wasn't registered", status, hook)
+	}
+
+	if status := request("POST", "/webhooks", `{"url":"ftp://example.com","topics":["hooks.*"]}`, nil); status != http.StatusBadRequest {
+		t.Fatal("[tests] Webhook with an invalid URL was registered", status)
+	}
+
+	dispatch([]byte(`{"ID":"w-1","Topic":"hooks.a","Content":"works"}`))
+	dispatch([]byte(`{"ID":"w-2","Topic":"hooks.broken","Content":"broken"}`))
+
+	select {
+	case got := <-received:
+		if got != "w-1 2" {
+			t.Fatal("[tests] Expected the second attempt of w-1, got", got)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("[tests] Webhook didn't receive the message")
+	}
+
+	var letters []deadLetter
+	deadline := time.Now().Add(3 * time.Second)
+
+	for len(letters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		request("GET", "/webhooks/"+hook.ID+"/dead-letters", "", &letters)
+	}
+
+	if len(letters) != 1 || letters[0].ID != "w-2" || letters[0].Attempts != cfg.WebhookAttempts {
+		t.Fatal("[tests] Failed message wasn't kept as a dead letter", letters)
+	}
+
+	var status struct {
+		Status webhookStatus
+	}
+
+	request("GET", "/webhooks/"+hook.ID, "", &status)
+
+	if status.Status.Delivered != 1 || status.Status.Retries != cfg.WebhookAttempts || status.Status.DeadLetters != 1 {
+		t.Fatal("[tests] Unexpected webhook status", status.Status)
+	}
+
+	// Only one of the requests removing the webhook at once does it
+	codes := make(chan int, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			codes <- request("DELETE", "/webhooks/"+hook.ID, "", nil)
+		}()
+	}
+
+	first, second := <-codes, <-codes
+
+	if first+second != http.StatusNoContent+http.StatusNotFound || len(subscribers.matching("hooks.a")) != 0 {
+		t.Fatal("[tests] Webhook wasn't removed once", first, second)
+	}
+
+	// Webhooks are kept in webhook_file and registered again from it
+	file, err := ioutil.TempFile("", "webhooks")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+	store := webhookStore{webhooks: make(map[string]*webhook)}
+
+	if err := store.load(file.Name()); err != nil {
+		t.Fatal("[tests] Missing webhook file wasn't empty", err)
+	}
+
+	kept := newWebhook(savedWebhook{ID: "kept", URL: receiver.URL, Topics: []string{"kept.*"}, Concurrency: 1, Created: time.Now(), Identity: "hello", Secret: "shared"})
+
+	if err := store.add(kept); err != nil {
+		t.Fatal("[tests] Webhook wasn't saved", err)
+	}
+
+	restored := webhookStore{webhooks: make(map[string]*webhook)}
+	err = restored.load(file.Name())
+	h, found := restored.find("kept", "hello")
+
+	if err != nil || !found || h.secret != "shared" || h.URL != receiver.URL || len(subscribers.matching("kept.a")) != 2 {
+		t.Fatal("[tests] Webhook wasn't registered again from the file", err, h)
+	}
+
+	// The webhooks of a host share its limit
+	if h.slots != kept.slots || cap(h.slots) != cfg.WebhookHostLimit {
+		t.Fatal("[tests] Webhooks of the same host don't share its limit")
+	}
+
+	restored.remove(h)
+	store.remove(kept)
+
+	if len(webhookHosts.slots) != 0 || len(subscribers.matching("kept.a")) != 0 {
+		t.Fatal("[tests] Host limit wasn't forgotten with its webhooks", webhookHosts.slots)
+	}
+
+	for address, private := range map[string]bool{"127.0.0.1": true, "10.1.2.3": true, "172.20.0.1": true, "192.168.1.1": true, "169.254.169.254": true, "0.0.0.0": true, "::1": true, "fd00::1": true, "fe80::1": true, "::ffff:127.0.0.1": true, "8.8.8.8": false, "2001:4860:4860::8888": false} {
+		if privateAddress(net.ParseIP(address)) != private {
+			t.Fatal("[tests] Wrong private check for", address)
+		}
+	}
+}
+
+// mqttClient is just enough of an MQTT client to test the gateway
+type mqttClient struct {
+	t       *testing.T
+	stream  mqttStream
+	reader  *bufio.Reader
+	version byte
+}
+
+func dialMQTT(t *testing.T, version byte, clientID string, clean bool, will *mqttWill) (*mqttClient, []byte) {
+	conn, err := tls.Dial("tcp", "localhost:8883", &tls.Config{InsecureSkipVerify: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return connectMQTT(t, conn, version, clientID, clean, will)
+}
+
+func connectMQTT(t *testing.T, stream mqttStream, version byte, clientID string, clean bool, will *mqttWill) (*mqttClient, []byte) {
+	c := &mqttClient{t: t, stream: stream, reader: bufio.NewReader(stream), version: version}
+	flags := byte(0xC0)
+
+	if clean {
+		flags |= 0x02
+	}
+
+	if will != nil {
+		flags |= 0x04
+	}
+
+	body := append(appendMQTTString(nil, "MQTT"), version, flags, 0, 30)
+
+	if version == mqttV5 {
+		body = append(body, 5, mqttPropSessionExpiry, 0, 0, 0, 60)
+	}
+
+	body = appendMQTTString(body, clientID)
+
+	if will != nil {
+		if version == mqttV5 {
+			body = append(body, 0)
+		}
+
+		body = append(appendMQTTString(body, will.topic), appendMQTTString(nil, string(will.payload))...)
+	}
+
+	body = appendMQTTString(appendMQTTString(body, "hello"), "test")
+	c.send(mqttPacket{kind: mqttConnect, body: body})
+
+	return c, c.expect(mqttConnack).body
+}
+
+func (c *mqttClient) send(p mqttPacket) {
+	_, err := c.stream.Write(p.encode())
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *mqttClient) expect(kind byte) mqttPacket {
+	c.stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := readMQTTPacket(c.reader, 1<<20)
+
+	if err != nil || p.kind != kind {
+		c.t.Fatal("[tests] Expected MQTT packet", kind, "got", p.kind, err)
+	}
+
+	return p
+}
+
+func (c *mqttClient) subscribe(filter string, qos byte) []byte {
+	body := appendUint16(nil, 1)
+
+	if c.version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	c.send(mqttPacket{kind: mqttSubscribe, flags: 0x02, body: append(appendMQTTString(body, filter), qos)})
+	suback := c.expect(mqttSuback)
+
+	return suback.body[len(suback.body)-1:]
+}
+
+func (c *mqttClient) receive() mqttPublishPacket {
+	pub, err := parsePublish(c.expect(mqttPublish), c.version)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return pub
+}
+
+func TestMQTT(t *testing.T) {
+	// Stands for the publisher, msgqueue and the upstream connection. It answers
+	// the receipts and refuses the messages of one topic
+	fakePublisher := http.NewServeMux()
+	fakePublisher.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		for {
+			_, msg, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			var m struct {
+				Topic   string
+				Headers map[string]string
+			}
+
+			json.Unmarshal(msg, &m)
+			receipt := m.Headers[receiptHeader]
+
+			if m.Topic == "sensors/refused/temp" {
+				conn.WriteJSON(map[string]string{"error": "refused", "topic": m.Topic, "receipt": receipt})
+				continue
+			}
+
+			var fields map[string]json.RawMessage
+			json.Unmarshal(msg, &fields)
+			delete(fields, "Headers")
+			msg, _ = json.Marshal(fields)
+			dispatch(msg)
+
+			if receipt != "" {
+				conn.WriteJSON(map[string]string{"receipt": receipt, "id": "fake"})
+			}
+		}
+	})
+
+	cert, err := tls.LoadX509KeyPair(os.Getenv("WS_CERT_DIR")+"server.crt", os.Getenv("WS_CERT_DIR")+"server.key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "localhost:8998", &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	go http.Serve(listener, fakePublisher)
+
+	sensor, _ := dialMQTT(t, mqttV311, "sensor", false, nil)
+
+	if granted := sensor.subscribe("sensors/+/temp", 2); granted[0] != 1 {
+		t.Fatal("[tests] Expected QoS 1 to be granted, got", granted)
+	}
+
+	// A device over websockets publishes a retained message, with a will
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer.Subprotocols = []string{"mqtt"}
+	wsConn, _, err := dialer.Dial("wss://localhost:8082/mqtt", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, connack := connectMQTT(t, &wsStream{conn: wsConn}, mqttV5, "device", true, &mqttWill{topic: "status/device", payload: []byte("gone")})
+
+	if connack[1] != 0 {
+		t.Fatal("[tests] MQTT 5 client wasn't accepted", connack)
+	}
+
+	body := appendUint16(appendMQTTString(nil, "sensors/1/temp"), 7)
+	device.send(mqttPacket{kind: mqttPublish, flags: 0x03, body: append(append(body, 0), "21"...)})
+
+	if ack := device.expect(mqttPuback); ack.body[1] != 7 {
+		t.Fatal("[tests] Wrong PUBACK", ack.body)
+	}
+
+	// Messages the publisher refuses aren't acked as published
+	body = appendUint16(appendMQTTString(nil, "sensors/refused/temp"), 8)
+	device.send(mqttPacket{kind: mqttPublish, flags: 0x02, body: append(append(body, 0), "22"...)})
+
+	if ack := device.expect(mqttPuback); ack.body[1] != 8 || len(ack.body) < 3 || ack.body[2] != mqttReasonUnspecified {
+		t.Fatal("[tests] Refused message was acked", ack.body)
+	}
+
+	refused, _ := dialMQTT(t, mqttV311, "refused", true, nil)
+	body = appendUint16(appendMQTTString(nil, "sensors/refused/temp"), 1)
+	refused.send(mqttPacket{kind: mqttPublish, flags: 0x02, body: append(body, "23"...)})
+	refused.stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	if p, err := readMQTTPacket(refused.reader, 1<<20); err == nil {
+		t.Fatal("[tests] MQTT 3.1.1 client wasn't closed after a refused message", p)
+	}
+
+	pub := sensor.receive()
+
+	if pub.topic != "sensors/1/temp" || string(pub.payload) != "21" || pub.qos != 1 || pub.retain {
+		t.Fatal("[tests] Unexpected MQTT message", pub)
+	}
+
+	sensor.send(mqttPacket{kind: mqttPuback, body: appendUint16(nil, pub.packetID)})
+
+	// Messages of the websocket clients reach MQTT clients on the same topics
+	dispatch([]byte(`{"Topic":"sensors/2/temp","Content":"from the web"}`))
+	dispatch([]byte(`{"Topic":"sensors/2/humidity","Content":"ignored"}`))
+
+	if pub = sensor.receive(); pub.topic != "sensors/2/temp" || string(pub.payload) != "from the web" {
+		t.Fatal("[tests] Unexpected MQTT message", pub)
+	}
+
+	// Unacked messages are sent again when a persistent session comes back
+	sensor.stream.Close()
+	time.Sleep(100 * time.Millisecond)
+	sensor, connack = dialMQTT(t, mqttV311, "sensor", false, nil)
+
+	if connack[0] != 1 {
+		t.Fatal("[tests] MQTT session wasn't kept", connack)
+	}
+
+	if pub = sensor.receive(); pub.topic != "sensors/2/temp" || !pub.dup {
+		t.Fatal("[tests] Unacked message wasn't sent again", pub)
+	}
+
+	monitor, _ := dialMQTT(t, mqttV5, "", true, nil)
+
+	if granted := monitor.subscribe("sensors/#", 0); granted[0] != 0 {
+		t.Fatal("[tests] Expected QoS 0 to be granted, got", granted)
+	}
+
+	if pub = monitor.receive(); pub.topic != "sensors/1/temp" || !pub.retain || string(pub.payload) != "21" {
+		t.Fatal("[tests] Retained message wasn't sent", pub)
+	}
+
+	monitor.subscribe("status/#", 0)
+	wsConn.Close()
+
+	if pub = monitor.receive(); pub.topic != "status/device" || string(pub.payload) != "gone" {
+		t.Fatal("[tests] Will wasn't published", pub)
+	}
+
+	if granted := monitor.subscribe("bad/#/filter", 0); granted[0] != mqttReasonBadFilter {
+		t.Fatal("[tests] Invalid filter was accepted", granted)
+	}
+
+	sensor.stream.Close()
+	monitor.stream.Close()
+
+	// A client that doesn't read doesn't hold up the dispatch, and messages that
+	// can't be decoded aren't sent to it
+	server, client := net.Pipe()
+	defer client.Close()
+	slow := newMQTTConn(server, mqttV311, "/mqtt", "pipe")
+	session := &mqttSession{clientID: "slow", filters: map[string]byte{"slow/#": 1}, inflight: make(map[uint16]mqttOutgoing)}
+	session.attach(slow, 10)
+	go slow.writeOutbox()
+	defer close(slow.done)
+	delivered := make(chan error, 1)
+
+	go func() {
+		var err error
+
+		for i := 0; i < 3 && err == nil; i++ {
+			err = session.deliver([]byte(`{"Topic":"slow/`+strconv.Itoa(i)+`","Content":"late"}`), "")
+		}
+
+		delivered <- err
+	}()
+
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatal("[tests] Message to a slow client wasn't queued", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("[tests] Slow client held up the dispatch")
+	}
+
+	if session.deliver([]byte(`{"Topic":`), "") == nil {
+		t.Fatal("[tests] Message that can't be decoded was delivered")
+	}
+
+	reader := &mqttClient{t: t, stream: client, reader: bufio.NewReader(client), version: mqttV311}
+
+	if pub := reader.receive(); pub.topic != "slow/0" || pub.qos != 1 {
+		t.Fatal("[tests] Queued message wasn't written", pub)
+	}
+}
+
+// stompClient reads and writes the frames of a STOMP session on /subscribe
+type stompClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func (c stompClient) send(frame string) {
+	err := c.conn.WriteMessage(websocket.TextMessage, []byte(frame+"\x00"))
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c stompClient) expect(command string) stompFrame {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	frame, err := parseSTOMP(data)
+
+	if err != nil || frame.command != command {
+		c.t.Fatal("[tests] Expected a "+command+" frame", string(data))
+	}
+
+	return frame
+}
+
+func TestSTOMP(t *testing.T) {
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), Subprotocols: []string{"v12.stomp"}}
+	conn, _, err := dialer.Dial("wss://localhost:8082/subscribe", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c := stompClient{t, conn}
+	c.send("SUBSCRIBE\nid:0\ndestination:/topic/stomp\n\n")
+	c.expect("ERROR")
+	conn.Close()
+
+	conn, _, err = dialer.Dial("wss://localhost:8082/subscribe", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c = stompClient{t, conn}
+	c.send("CONNECT\naccept-version:1.2\nlogin:hello\npasscode:test\n\n")
+	c.expect("CONNECTED")
+	c.send("SUBSCRIBE\nid:auto\ndestination:/topic/stomp.news\nreceipt:s1\n\n")
+
+	if frame := c.expect("RECEIPT"); frame.headers["receipt-id"] != "s1" {
+		t.Fatal("[tests] Wrong receipt", frame)
+	}
+
+	c.send("SUBSCRIBE\nid:acked\ndestination:/topic/stomp.*\nack:client-individual\nreceipt:s2\n\n")
+	c.expect("RECEIPT")
+
+	dispatch([]byte(`{"ID":"st-1","Topic":"stomp.news","Content":"hello team!","Headers":{"priority":"high"}}`))
+	frames := map[string]stompFrame{}
+
+	for i := 0; i < 2; i++ {
+		frame := c.expect("MESSAGE")
+		frames[frame.headers["subscription"]] = frame
+	}
+
+	auto, acked := frames["auto"], frames["acked"]
+
+	if string(auto.body) != "hello team!" || auto.headers["destination"] != "/topic/stomp.news" || auto.headers["message-id"] != "st-1" || auto.headers["priority"] != "high" || auto.headers["ack"] != "" {
+		t.Fatal("[tests] MESSAGE doesn't match the message", auto)
+	}
+
+	if acked.headers["ack"] == "" {
+		t.Fatal("[tests] MESSAGE of a subscription with client acks has no ack header", acked)
+	}
+
+	dispatch([]byte(`{"ID":"st-2","Topic":"stomp.weather","Content":"rain"}`))
+	nacked := c.expect("MESSAGE")
+
+	if nacked.headers["subscription"] != "acked" || nacked.headers["content-type"] != "text/plain;charset=utf-8" {
+		t.Fatal("[tests] Message delivered to the wrong subscription", nacked)
+	}
+
+	before := dropped.Snapshot()["nacked"]
+	c.send("NACK\nid:" + nacked.headers["ack"] + "\nreceipt:n1\n\n")
+	c.expect("RECEIPT")
+	c.send("ACK\nid:" + acked.headers["ack"] + "\nreceipt:a1\n\n")
+	c.expect("RECEIPT")
+
+	if dropped.Snapshot()["nacked"] != before+1 {
+		t.Fatal("[tests] NACK wasn't counted")
+	}
+
+	c.send("UNSUBSCRIBE\nid:acked\nreceipt:u1\n\n")
+	c.expect("RECEIPT")
+	dispatch([]byte(`{"ID":"st-3","Topic":"stomp.weather","Content":"ignored"}`))
+	dispatch([]byte(`{"ID":"st-4","Topic":"stomp.news","Content":"last"}`))
+
+	if frame := c.expect("MESSAGE"); frame.headers["message-id"] != "st-4" {
+		t.Fatal("[tests] Message delivered after UNSUBSCRIBE", frame)
+	}
+
+	c.send("ACK\nid:" + acked.headers["ack"] + "\n\n")
+	c.expect("ERROR")
+}
+
+func TestCodecs(t *testing.T) {
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+
+	for i, name := range []string{"msgpack", "cbor", "protobuf"} {
+		dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), Subprotocols: []string{name}}
+		conn, _, err := dialer.Dial("wss://localhost:8082/subscribe", authHeader)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		if conn.Subprotocol() != name {
+			t.Fatal("[tests] Codec wasn't negotiated", conn.Subprotocol())
+		}
+
+		enc := codec.For(name)
+		conn.WriteMessage(websocket.BinaryMessage, enc.Encode(envelope{Topic: "codec." + name, Content: "sub"}))
+		time.Sleep(100 * time.Millisecond)
+
+		id := "cd-" + strconv.Itoa(i)
+		dispatch([]byte(`{"ID":"` + id + `","Topic":"codec.` + name + `","Content":"","Data":"AP8=","Headers":{"type":"image/png"}}`))
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		kind, data, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := enc.Decode(data)
+
+		if err != nil || kind != websocket.BinaryMessage || m.ID != id || !bytes.Equal(m.Data, []byte{0, 0xff}) || m.Headers["type"] != "image/png" {
+			t.Fatal("[tests] Message wasn't delivered with "+name, m, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), EnableCompression: true}
+	authHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hello:test"))}}
+	conn, _, err := dialer.Dial("wss://localhost:8082/subscribe", authHeader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"Topic":"compressed","Content":"sub"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	before := compressionBytes.Snapshot()
+	content := strings.Repeat("compress me ", 100)
+	dispatch([]byte(`{"Topic":"compressed","Content":"` + content + `"}`))
+
+	var m envelope
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = conn.ReadJSON(&m)
+
+	if err != nil || m.Content != content {
+		t.Fatal("[tests] Compressed message wasn't delivered", m, err)
+	}
+
+	after := compressionBytes.Snapshot()
+	message, wire := after["/subscribe message"]-before["/subscribe message"], after["/subscribe wire"]-before["/subscribe wire"]
+
+	if message == 0 || wire == 0 || wire >= message {
+		t.Fatal("[tests] Message wasn't compressed", message, wire)
+	}
+}
+
+func TestInvalidMessage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		// The subscriber needs time to subscribe before the messages are sent
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+		conn.WriteMessage(websocket.BinaryMessage, []byte{0, 0xff})
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"ID":"i-1","Topic":"invalid.after","Content":"still delivered"}`))
+		conn.ReadMessage()
+	}))
+
+	defer upstream.Close()
+
+	popConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(upstream.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connClosed := make(chan bool)
+	go popMessages(popConn, connClosed)
+
+	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer subConn.Close()
+
+	subConn.WriteJSON(message{"invalid.after", "sub"})
+	time.Sleep(100 * time.Millisecond)
+	before := dropped.Snapshot()["invalid"]
+	popConn.WriteMessage(websocket.TextMessage, []byte("ready"))
+
+	var m message
+	subConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = subConn.ReadJSON(&m)
+
+	if err != nil || m.Content != "still delivered" {
+		t.Fatal("[tests] Message after invalid ones wasn't delivered", m, err)
+	}
+
+	if dropped.Snapshot()["invalid"]-before != 2 {
+		t.Fatal("[tests] Invalid messages weren't counted", dropped.Snapshot())
+	}
+
+	popConn.Close()
+	<-connClosed
+}
+
+func TestInbox(t *testing.T) {
+	owner, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer owner.Close()
+
+	other, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	askInbox := func(conn *websocket.Conn) string {
+		var m message
+		conn.WriteJSON(message{"", "inbox"})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := conn.ReadJSON(&m)
+
+		if err != nil || m.Content != "inbox" || !strings.HasPrefix(m.Topic, inboxPrefix) {
+			t.Fatal("[tests] Wrong answer when asking for the inbox", m, err)
+		}
+
+		return m.Topic
+	}
+
+	inbox := askInbox(owner)
+
+	if askInbox(owner) != inbox {
+		t.Fatal("[tests] A connection got two inboxes")
+	}
+
+	if askInbox(other) == inbox {
+		t.Fatal("[tests] Two connections share an inbox")
+	}
+
+	if subscribers.inboxCount() != 2 {
+		t.Fatal("[tests] Wrong number of inboxes", subscribers.inboxCount())
+	}
+
+	// Nobody else gets the replies, even subscribed to the inbox
+	other.WriteJSON(message{inbox, "sub"})
+	other.WriteJSON(message{"_inbox.*", "sub"})
+	other.WriteJSON(message{"*", "sub"})
+	other.WriteJSON(message{"inbox.after", "sub"})
+	time.Sleep(100 * time.Millisecond)
+	dispatch([]byte(`{"ID":"in-1","Topic":"` + inbox + `","Content":"reply","Headers":{"correlation-id":"c-1"}}`))
+	dispatch([]byte(`{"ID":"in-2","Topic":"inbox.after","Content":"after"}`))
+
+	var m envelope
+	owner.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = owner.ReadJSON(&m)
+
+	if err != nil || m.Content != "reply" || m.Headers["correlation-id"] != "c-1" {
+		t.Fatal("[tests] Reply wasn't delivered to the inbox", m, err)
+	}
+
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = other.ReadJSON(&m)
+
+	if err != nil || m.Content != "after" {
+		t.Fatal("[tests] Reply was delivered to another connection", m, err)
+	}
+
+	if _, found := history.since("in-1", []string{"*"}); found {
+		t.Fatal("[tests] Reply was kept in the event history")
+	}
+
+	// The inbox is closed with its connection, replies to it are dropped
+	owner.Close()
+	time.Sleep(100 * time.Millisecond)
+	before := dropped.Snapshot()["no_subscribers"]
+	dispatch([]byte(`{"ID":"in-3","Topic":"` + inbox + `","Content":"too late"}`))
+
+	if subscribers.inboxCount() != 1 || dropped.Snapshot()["no_subscribers"]-before != 1 {
+		t.Fatal("[tests] Inbox wasn't closed with its connection", subscribers.inboxCount())
+	}
+}
+
+// loadedSink is a member of a group that holds as many messages as it's told
+type loadedSink struct {
+	name    string
+	pending int
+}
+
+func (s *loadedSink) deliver(msg []byte, id string) error {
+	return nil
+}
+
+func (s *loadedSink) remoteAddr() string {
+	return s.name
+}
+
+func (s *loadedSink) load() int {
+	return s.pending
+}
+
+// failingSink is a member of a group whose connection is gone
+type failingSink struct {
+	loadedSink
+}
+
+func (s *failingSink) deliver(msg []byte, id string) error {
+	return errors.New("connection closed")
+}
+
+func TestGroups(t *testing.T) {
+	members := []*loadedSink{{"a", 3}, {"b", 0}, {"c", 0}}
+	g := &group{}
+
+	for _, member := range members {
+		g.members = append(g.members, groupMember{member, member})
+	}
+
+	picked := ""
+
+	for i := 0; i < 4; i++ {
+		picked += g.pick("round-robin").sink.remoteAddr()
+	}
+
+	if picked != "abca" {
+		t.Fatal("[tests] Round-robin didn't take turns", picked)
+	}
+
+	picked = ""
+
+	for i := 0; i < 4; i++ {
+		member := g.pick("least-load").sink.(*loadedSink)
+		picked += member.name
+		member.pending++
+	}
+
+	if picked != "bcbc" {
+		t.Fatal("[tests] Least load didn't pick the members holding the fewest messages", picked)
+	}
+
+	// The message goes to the next member in turn when the picked one fails
+	broken := &failingSink{loadedSink{"broken", 0}}
+	g = &group{members: []groupMember{{broken, broken}, {members[0], members[0]}, {members[1], members[1]}}}
+
+	if sinks := g.pickInTurn("round-robin"); len(sinks) != 3 || sinks.remoteAddr() != "broken" || sinks[1].sink != members[0] || sinks.deliver(nil, "") != nil {
+		t.Fatal("[tests] Failed delivery wasn't given to the other members", sinks)
+	}
+
+	if sinks := g.pickInTurn("round-robin"); sinks[0].sink != members[0] || sinks[2].sink != broken {
+		t.Fatal("[tests] Other members weren't in turn", sinks)
+	}
+
+	dial := func() *websocket.Conn {
+		conn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn
+	}
+
+	read := func(conn *websocket.Conn, count int) string {
+		var contents []string
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		for len(contents) < count {
+			var m message
+
+			if err := conn.ReadJSON(&m); err != nil {
+				t.Fatal("[tests] Expected more messages", contents, err)
+			}
+
+			contents = append(contents, m.Content)
+		}
+
+		return strings.Join(contents, ",")
+	}
+
+	first, second, everything := dial(), dial(), dial()
+	defer first.Close()
+	defer second.Close()
+	defer everything.Close()
+
+	first.WriteJSON(request{message{"jobs.*", "sub"}, "workers"})
+	second.WriteJSON(request{message{"jobs.*", "sub"}, "workers"})
+	second.WriteJSON(request{message{"jobs.*", "sub"}, strings.Repeat("x", maxGroupName+1)})
+	everything.WriteJSON(message{"jobs.build", "sub"})
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 1; i <= 4; i++ {
+		dispatch([]byte(`{"ID":"g-` + strconv.Itoa(i) + `","Topic":"jobs.build","Content":"job ` + strconv.Itoa(i) + `"}`))
+	}
+
+	firstJobs, secondJobs := read(first, 2), read(second, 2)
+
+	if firstJobs+","+secondJobs != "job 1,job 3,job 2,job 4" && firstJobs+","+secondJobs != "job 2,job 4,job 1,job 3" {
+		t.Fatal("[tests] The members of a group didn't take turns", firstJobs, secondJobs)
+	}
+
+	if jobs := read(everything, 4); jobs != "job 1,job 2,job 3,job 4" {
+		t.Fatal("[tests] Subscriber outside the group didn't get every message", jobs)
+	}
+
+	// A member that leaves stops getting messages, and closing the last one
+	// removes the group
+	second.WriteJSON(request{message{"jobs.*", "unsub"}, "workers"})
+	time.Sleep(100 * time.Millisecond)
+	dispatch([]byte(`{"ID":"g-5","Topic":"jobs.build","Content":"job 5"}`))
+	dispatch([]byte(`{"ID":"g-6","Topic":"jobs.test","Content":"job 6"}`))
+
+	if jobs := read(first, 2); jobs != "job 5,job 6" {
+		t.Fatal("[tests] Messages of the group weren't all sent to the member left", jobs)
+	}
+
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	subscribers.mux.Lock()
+	groups := len(subscribers.groups)
+	subscribers.mux.Unlock()
+
+	if groups != 0 {
+		t.Fatal("[tests] Group wasn't removed with its last member", groups)
+	}
+
+	// STOMP subscriptions join a group with a group header
+	dialer := websocket.Dialer{TLSClientConfig: clientCerts.ClientConfig(), Subprotocols: []string{"v12.stomp"}}
+	conn, _, err := dialer.Dial("wss://localhost:8082/subscribe", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c := stompClient{t, conn}
+	c.send("CONNECT\naccept-version:1.2\nlogin:hello\npasscode:test\n\n")
+	c.expect("CONNECTED")
+	c.send("SUBSCRIBE\nid:0\ndestination:/topic/jobs.build\ngroup:workers\nack:client\nreceipt:s1\n\n")
+	c.expect("RECEIPT")
+	dispatch([]byte(`{"ID":"g-7","Topic":"jobs.build","Content":"job 7"}`))
+
+	if frame := c.expect("MESSAGE"); frame.headers["message-id"] != "g-7" {
+		t.Fatal("[tests] STOMP member of a group didn't get the message", frame)
+	}
+
+	c.send("UNSUBSCRIBE\nid:0\nreceipt:u1\n\n")
+	c.expect("RECEIPT")
+	subscribers.mux.Lock()
+	groups = len(subscribers.groups)
+	subscribers.mux.Unlock()
+
+	if groups != 0 {
+		t.Fatal("[tests] STOMP subscription didn't leave its group", groups)
+	}
+
+	c.send("SUBSCRIBE\nid:1\ndestination:/topic/jobs.build\ngroup:\n\n")
+	c.expect("ERROR")
+}
+
+func TestInterest(t *testing.T) {
+	if instancePath("") != "/popmsg" || instancePath("eu 1") != "/popmsg?instance=eu+1" {
+		t.Fatal("[tests] Wrong /popmsg path for an instance", instancePath("eu 1"))
+	}
+
+	frames := make(chan interestFrame, 10)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for {
+			var frame interestFrame
+			err = conn.ReadJSON(&frame)
+
+			if err != nil {
+				return
+			}
+
+			frames <- frame
+		}
+	}))
+
+	defer upstream.Close()
+
+	popConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(upstream.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer popConn.Close()
+
+	// next waits for a frame that has or lacks a topic or filter
+	next := func(name string, present bool) interestFrame {
+		for {
+			select {
+			case frame := <-frames:
+				found := false
+
+				for _, subscribed := range append(frame.Topics, frame.Filters...) {
+					found = found || subscribed == name
+				}
+
+				for _, g := range frame.Groups {
+					found = found || g.Topic == name
+				}
+
+				if found == present {
+					return frame
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("[tests] Interest wasn't sent", name, present)
+			}
+		}
+	}
+
+	alive := keepalive.Start(popConn, cfg.Upstream.keepAlive(), logs)
+	defer alive.Stop()
+	go sendInterest(alive)
+	next("interest.topic", false)
+
+	worker := &loadedSink{"worker", 0}
+	subscribers.subscribe("interest.topic", worker, worker)
+	next("interest.topic", true)
+	subscribers.joinGroup("interest.jobs.*", "workers", worker, worker)
+
+	if frame := next("interest.jobs.*", true); len(frame.Groups) != 1 || frame.Groups[0].Group != "workers" {
+		t.Fatal("[tests] Group wasn't sent apart from the topics", frame)
+	}
+
+	subscribers.subscribeFilter("interest/+/temperature", worker, worker)
+	next("interest/+/temperature", true)
+	box := subscribers.openInbox(worker, worker)
+	next(box, true)
+
+	// Everything is withdrawn when the connection goes away
+	unsubscribeAll(worker)
+	frame := next("interest.topic", false)
+
+	for _, subscribed := range append(frame.Topics, frame.Filters...) {
+		if strings.HasPrefix(subscribed, "interest") || subscribed == box {
+			t.Fatal("[tests] Interest wasn't withdrawn", frame)
+		}
+	}
+
+	if len(frame.Groups) != 0 {
+		t.Fatal("[tests] Group wasn't withdrawn", frame)
+	}
+
+	// Messages routed by group only go to the members of the picked groups
+	picked, msg := routedGroups([]byte(`{"ID":"g-1","Topic":"routed.jobs","Groups":[{"topic":"routed.*","group":"picked"}]}`))
+
+	if !picked[groupInterest{Topic: "routed.*", Group: "picked"}] || bytes.Contains(msg, []byte(groupsField)) {
+		t.Fatal("[tests] Routed groups weren't read and stripped", picked, string(msg))
+	}
+
+	chosen, skipped := &loadedSink{"chosen", 0}, &loadedSink{"skipped", 0}
+	subscribers.joinGroup("routed.*", "picked", chosen, chosen)
+	subscribers.joinGroup("routed.*", "other", skipped, skipped)
+	defer unsubscribeAll(chosen)
+	defer unsubscribeAll(skipped)
+
+	if recipients := subscribers.matchingGroups("routed.jobs", picked); len(recipients) != 1 || recipients[chosen] == nil {
+		t.Fatal("[tests] Groups that weren't picked got the message", recipients)
+	}
+
+	if picked, _ := routedGroups([]byte(`{"ID":"g-2","Topic":"routed.jobs"}`)); picked != nil || len(subscribers.matchingGroups("routed.jobs", picked)) != 2 {
+		t.Fatal("[tests] Every group didn't pick a member for a message routed without groups")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	type interestOn struct {
+		conn  *websocket.Conn
+		frame interestFrame
+	}
+
+	conns := make(chan *websocket.Conn, 2)
+	frames := make(chan interestOn, 10)
+	mux := http.NewServeMux()
+
+	// msgqueue is played by the test, it only takes the instance
+	mux.HandleFunc("/popmsg", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("instance") != cfg.Instance {
+			http.Error(w, "not an instance", http.StatusBadRequest)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		conns <- conn
+
+		for {
+			var frame interestFrame
+			err := conn.ReadJSON(&frame)
+
+			if err != nil {
+				return
+			}
+
+			frames <- interestOn{conn, frame}
+		}
+	})
+
+	// interested waits for the interest sent on a connection to have a topic
+	interested := func(conn *websocket.Conn, topic string) {
+		for {
+			select {
+			case f := <-frames:
+				for _, subscribed := range f.frame.Topics {
+					if f.conn == conn && subscribed == topic {
+						return
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("[tests] Interest wasn't sent", topic)
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(os.Getenv("WS_CERT_DIR")+"server.crt", os.Getenv("WS_CERT_DIR")+"server.key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", cfg.Upstream.Addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	go http.Serve(listener, mux)
+
+	popConn, err := dialUpstream()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go maintainUpstream(popConn)
+
+	subConn, err := dialToService("localhost:8082", "/subscribe", "hello", "test", compression.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer subConn.Close()
+
+	first := <-conns
+	subConn.WriteJSON(message{"reconnect.news", "sub"})
+	interested(first, "reconnect.news")
+
+	// expect sends a message from msgqueue and waits for the subscriber to get it
+	expect := func(conn *websocket.Conn, content string) {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"ID":"rc-`+content+`","Topic":"reconnect.news","Content":"`+content+`"}`))
+
+		var m message
+		subConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := subConn.ReadJSON(&m)
+
+		if err != nil || m.Content != content {
+			t.Fatal("[tests] Message from msgqueue wasn't delivered", m, err)
+		}
+	}
+
+	expect(first, "before")
+
+	// Losing the connection, as when keepalive closes a dead one, dials it again
+	// and sends the whole interest, which msgqueue starts without
+	upstream.current().Close()
+
+	select {
+	case conn := <-conns:
+		defer conn.Close()
+		interested(conn, "reconnect.news")
+		expect(conn, "after")
+	case <-time.After(5 * time.Second):
+		t.Fatal("[tests] msgqueue wasn't dialed again")
+	}
+
+	if atomic.LoadInt32(&upstreamConnected) != 1 {
+		t.Fatal("[tests] Connection to msgqueue isn't reported again")
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/tracing"
+)
+
+// traceSettings picks the tracing options out of the configuration
+func (c config) traceSettings() tracing.Settings {
+	return tracing.Settings{
+		Service:     "subscriber",
+		Exporter:    c.TraceExporter,
+		File:        c.TraceFile,
+		Endpoint:    c.TraceEndpoint,
+		SampleRatio: c.TraceSampleRatio,
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/Javivi/ws-go/internal/keepalive"
+	"github.com/gorilla/websocket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamLink holds the connection to msgqueue, which is nil while it's dialed
+// again after being lost
+type upstreamLink struct {
+	conn *websocket.Conn
+	mux  sync.Mutex
+}
+
+var upstream = &upstreamLink{}
+
+// current returns the connection, nil while there's none
+func (u *upstreamLink) current() *websocket.Conn {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.conn
+}
+
+// set replaces the connection, nil when it's lost
+func (u *upstreamLink) set(conn *websocket.Conn) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.conn = conn
+
+	if conn != nil {
+		atomic.StoreInt32(&upstreamConnected, 1)
+	} else {
+		atomic.StoreInt32(&upstreamConnected, 0)
+	}
+}
+
+// dialUpstream opens the /popmsg websocket of the instance
+func dialUpstream() (*websocket.Conn, error) {
+	return dialToService(cfg.Upstream.Addr, instancePath(cfg.Instance), cfg.Upstream.Username, cfg.Upstream.Password, cfg.Upstream.Compression)
+}
+
+// maintainUpstream delivers the messages of msgqueue and dials it again with
+// backoff when the connection is lost, until the service stops. msgqueue keeps
+// the queue of an instance for instance_timeout, so it's reclaimed if the
+// connection comes back before that
+func maintainUpstream(conn *websocket.Conn) {
+	for conn != nil {
+		upstream.set(conn)
+		alive := keepalive.Start(conn, cfg.Upstream.keepAlive(), logs)
+
+		// A new connection starts without interest, it's sent in full
+		if cfg.Instance != "" {
+			go sendInterest(alive)
+		}
+
+		popMessages(conn, nil)
+		alive.Stop()
+		conn.Close()
+		upstream.set(nil)
+		conn = redialUpstream()
+	}
+}
+
+// redialUpstream dials msgqueue until it answers, waiting reconnect_backoff and
+// then twice as long each time up to reconnect_max_backoff. It gives up when the
+// service stops
+func redialUpstream() *websocket.Conn {
+	backoff := cfg.Upstream.ReconnectBackoff
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-stopping:
+			return nil
+		}
+
+		conn, err := dialUpstream()
+
+		if err == nil {
+			logs.Info("Reconnected to msgqueue", "upstream", cfg.Upstream.Addr, "attempts", attempt)
+			return conn
+		}
+
+		logs.Warn("Error dialing msgqueue again", "upstream", cfg.Upstream.Addr, "attempt", attempt, "backoff", backoff, "error", err)
+		backoff *= 2
+
+		if backoff > cfg.Upstream.ReconnectMaxBackoff {
+			backoff = cfg.Upstream.ReconnectMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Javivi/ws-go/internal/admin"
+	"github.com/Javivi/ws-go/internal/tracing"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Workers of a webhook when it's registered without a limit, and the highest
+	// limit it can ask for. The posts running at once to a host are also limited
+	// by webhook_host_limit, whatever the webhook
+	defaultWebhookConcurrency = 4
+	maxWebhookConcurrency     = 64
+
+	// Failed messages kept on each webhook, older ones are forgotten
+	webhookDeadLetters = 100
+)
+
+// Webhooks are posted with a dialer that refuses the addresses of the service's
+// own network, unless webhook_allow_private is set. Redirects are dialed the same way
+var webhookClient = &http.Client{Transport: &http.Transport{DialContext: dialWebhook, TLSHandshakeTimeout: 10 * time.Second}}
+
+// Networks webhooks can't post to: loopback, private, shared, link-local and
+// unique local addresses, and the unspecified ones
+var privateNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, networks[i], _ = net.ParseCIDR(cidr)
+	}
+
+	return networks
+}
+
+// privateAddress tells whether an address is on one of the private networks,
+// IPv4 addresses mapped to IPv6 included
+func privateAddress(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	if ip.IsMulticast() {
+		return true
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webhookAddresses resolves the host of a webhook, and fails when it has an
+// address webhooks can't post to
+func webhookAddresses(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.WebhookAllowPrivate {
+		return addrs, nil
+	}
+
+	for _, addr := range addrs {
+		if privateAddress(addr.IP) {
+			return nil, fmt.Errorf("%s has the private address %s", host, addr.IP)
+		}
+	}
+
+	return addrs, nil
+}
+
+// dialWebhook connects to the addresses checked by webhookAddresses, so a host
+// can't resolve to another one between the check and the connection
+func dialWebhook(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := webhookAddresses(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.WebhookTimeout}
+
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("no addresses for " + host)
+	}
+
+	return nil, err
+}
+
+// webhookDelivery is a message waiting to be posted to a webhook
+type webhookDelivery struct {
+	id  string
+	msg []byte
+}
+
+// deadLetter is a message that couldn't be posted to a webhook
+type deadLetter struct {
+	ID       string          `json:"id,omitempty"`
+	Message  json.RawMessage `json:"message"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Time     time.Time       `json:"time"`
+}
+
+// webhookStatus is how the deliveries to a webhook are going
+type webhookStatus struct {
+	Pending     int        `json:"pending"`
+	InFlight    int        `json:"in_flight"`
+	Delivered   int        `json:"delivered"`
+	Retries     int        `json:"retries"`
+	DeadLetters int        `json:"dead_letters"`
+	LastStatus  int        `json:"last_status,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// webhook is a subscriber that gets its messages as signed POST requests to a
+// URL, sent by its own workers so a slow endpoint doesn't hold back the others
+type webhook struct {
+	ID          string        `json:"id"`
+	URL         string        `json:"url"`
+	Topics      []string      `json:"topics"`
+	Group       string        `json:"group,omitempty"`
+	Concurrency int           `json:"concurrency"`
+	Created     time.Time     `json:"created"`
+	Status      webhookStatus `json:"status"`
+
+	identity    string
+	secret      string
+	host        string
+	slots       chan struct{}
+	deliveries  chan webhookDelivery
+	done        chan struct{}
+	deadLetters []deadLetter
+	mux         sync.Mutex
+}
+
+// savedWebhook is a webhook as it's kept in webhook_file, with the identity that
+// registered it and its secret
+type savedWebhook struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Topics      []string  `json:"topics"`
+	Group       string    `json:"group,omitempty"`
+	Concurrency int       `json:"concurrency"`
+	Created     time.Time `json:"created"`
+	Identity    string    `json:"identity"`
+	Secret      string    `json:"secret"`
+}
+
+func newWebhook(saved savedWebhook) *webhook {
+	host := saved.URL
+
+	if target, err := url.Parse(saved.URL); err == nil {
+		host = strings.ToLower(target.Host)
+	}
+
+	return &webhook{
+		ID:          saved.ID,
+		URL:         saved.URL,
+		Topics:      saved.Topics,
+		Group:       saved.Group,
+		Concurrency: saved.Concurrency,
+		Created:     saved.Created,
+		identity:    saved.Identity,
+		secret:      saved.Secret,
+		host:        host,
+		deliveries:  make(chan webhookDelivery, cfg.WebhookBufferSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func (h *webhook) saved() savedWebhook {
+	return savedWebhook{ID: h.ID, URL: h.URL, Topics: h.Topics, Group: h.Group, Concurrency: h.Concurrency, Created: h.Created, Identity: h.identity, Secret: h.secret}
+}
+
+// hostLimits holds the slots of the posts running at once to each host. They're
+// shared by the webhooks of the host, so registering more of them doesn't
+// multiply the requests it gets
+type hostLimits struct {
+	slots map[string]chan struct{}
+	users map[string]int
+	mux   sync.Mutex
+}
+
+var webhookHosts = hostLimits{slots: make(map[string]chan struct{}), users: make(map[string]int)}
+
+// join returns the slots of a host for a webhook that posts to it
+func (l *hostLimits) join(host string) chan struct{} {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.slots[host] == nil {
+		l.slots[host] = make(chan struct{}, cfg.WebhookHostLimit)
+	}
+
+	l.users[host]++
+
+	return l.slots[host]
+}
+
+// leave forgets the slots of a host once no webhook posts to it
+func (l *hostLimits) leave(host string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.users[host]--
+
+	if l.users[host] <= 0 {
+		delete(l.slots, host)
+		delete(l.users, host)
+	}
+}
+
+func (h *webhook) deliver(msg []byte, id string) error {
+	select {
+	case h.deliveries <- webhookDelivery{id: id, msg: msg}:
+		return nil
+	default:
+		return errors.New("webhook buffer is full")
+	}
+}
+
+// load is how many messages wait to be posted or are being posted
+func (h *webhook) load() int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return len(h.deliveries) + h.Status.InFlight
+}
+
+func (h *webhook) remoteAddr() string {
+	return h.URL
+}
+
+// signature is the X-Webhook-Signature of a request, an HMAC-SHA256 of the
+// timestamp and the body keyed with the secret of the webhook
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a message once, it returns the status of the response and whether
+// it's worth trying again after an error
+func (h *webhook) post(d webhookDelivery, attempt int) (int, bool, error) {
+	delivery := tracing.StartMessage("webhook delivery", tracing.Producer, d.msg)
+	delivery.Set("messaging.message.id", d.id, "http.url", h.URL, "http.resend_count", attempt-1)
+	defer delivery.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(d.msg))
+
+	if err != nil {
+		delivery.Fail(err)
+		return 0, false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ws-go-subscriber")
+	req.Header.Set("X-Webhook-ID", h.ID)
+	req.Header.Set("X-Webhook-Message-ID", d.id)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signature(h.secret, timestamp, d.msg))
+
+	if delivery != nil {
+		req.Header.Set("Traceparent", delivery.Context().TraceParent())
+	}
+
+	response, err := webhookClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		delivery.Fail(err)
+		return 0, true, err
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	delivery.Set("http.status_code", response.StatusCode)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response.StatusCode, false, nil
+	}
+
+	err = fmt.Errorf("webhook answered %s", response.Status)
+	delivery.Fail(err)
+
+	// Other client errors would fail again in the same way
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusRequestTimeout
+
+	return response.StatusCode, retry, err
+}
+
+// send posts a message until it's accepted, backing off exponentially between
+// attempts, and keeps it as a dead letter after webhook_attempts failures. Each
+// attempt waits for a slot of the host
+func (h *webhook) send(d webhookDelivery) {
+	log := logs.With("webhook", h.ID, "url", h.URL, "id", d.id)
+	backoff := cfg.WebhookBackoff
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case h.slots <- struct{}{}:
+		case <-h.done:
+			return
+		case <-stopping:
+			return
+		}
+
+		status, retry, err := h.post(d, attempt)
+		<-h.slots
+
+		h.mux.Lock()
+		h.Status.LastStatus = status
+
+		if err == nil {
+			now := time.Now()
+			h.Status.Delivered++
+			h.Status.LastError = ""
+			h.Status.LastSuccess = &now
+			h.mux.Unlock()
+			webhookRequests.Inc("success")
+			log.Sample().Debug("Message posted to webhook", "attempt", attempt)
+			return
+		}
+
+		h.Status.LastError = err.Error()
+		webhookRequests.Inc("failure")
+
+		if !retry || attempt >= cfg.WebhookAttempts {
+			h.deadLetters = append(h.deadLetters, deadLetter{ID: d.id, Message: d.msg, Attempts: attempt, Error: err.Error(), Time: time.Now()})
+
+			if len(h.deadLetters) > webhookDeadLetters {
+				h.deadLetters = h.deadLetters[len(h.deadLetters)-webhookDeadLetters:]
+			}
+
+			h.mux.Unlock()
+			dropped.Inc("dead_letter")
+			log.Warn("Giving up posting message to webhook", "attempts", attempt, "error", err)
+			return
+		}
+
+		h.Status.Retries++
+		h.mux.Unlock()
+		log.Info("Error posting message to webhook, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-h.done:
+			return
+		case <-stopping:
+			return
+		}
+
+		backoff *= 2
+
+		if backoff > cfg.WebhookMaxBackoff {
+			backoff = cfg.WebhookMaxBackoff
+		}
+	}
+}
+
+// work posts the messages of the webhook until it's removed, one of these runs
+// for each delivery allowed at once
+func (h *webhook) work() {
+	for {
+		select {
+		case d := <-h.deliveries:
+			h.mux.Lock()
+			h.Status.InFlight++
+			h.mux.Unlock()
+
+			h.send(d)
+
+			h.mux.Lock()
+			h.Status.InFlight--
+			h.mux.Unlock()
+		case <-h.done:
+			return
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// view copies the webhook with its current status, so it can be written out
+// without holding the lock
+func (h *webhook) view() *webhook {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	status := h.Status
+	status.Pending = len(h.deliveries)
+	status.DeadLetters = len(h.deadLetters)
+
+	return &webhook{ID: h.ID, URL: h.URL, Topics: h.Topics, Group: h.Group, Concurrency: h.Concurrency, Created: h.Created, Status: status}
+}
+
+// webhookStore holds the registered webhooks, and keeps them in a file when it
+// has one so they're registered again on the next start
+type webhookStore struct {
+	webhooks map[string]*webhook
+	file     string
+	mux      sync.Mutex
+}
+
+var webhooks = webhookStore{webhooks: make(map[string]*webhook)}
+
+// load registers the webhooks of the file, which is also where the changes are
+// saved. A missing file has none
+func (s *webhookStore) load(file string) error {
+	s.mux.Lock()
+	s.file = file
+	s.mux.Unlock()
+
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var saved []savedWebhook
+	err = json.Unmarshal(data, &saved)
+
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]*webhook, len(saved))
+	s.mux.Lock()
+
+	for i, w := range saved {
+		loaded[i] = newWebhook(w)
+		s.webhooks[w.ID] = loaded[i]
+	}
+
+	s.mux.Unlock()
+
+	for _, h := range loaded {
+		h.start()
+	}
+
+	return nil
+}
+
+// save writes the webhooks to a new file that then replaces the old one, the
+// caller holds the lock
+func (s *webhookStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	saved := make([]savedWebhook, 0, len(s.webhooks))
+
+	for _, h := range s.webhooks {
+		saved = append(saved, h.saved())
+	}
+
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Created.Before(saved[j].Created) })
+	data, err := json.MarshalIndent(saved, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(s.file+".tmp", data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(s.file+".tmp", s.file)
+}
+
+// add registers a webhook once it's saved
+func (s *webhookStore) add(h *webhook) error {
+	s.mux.Lock()
+	s.webhooks[h.ID] = h
+	err := s.save()
+
+	if err != nil {
+		delete(s.webhooks, h.ID)
+		s.mux.Unlock()
+		return err
+	}
+
+	s.mux.Unlock()
+	h.start()
+
+	return nil
+}
+
+// start runs the workers of a webhook and subscribes it to its topics
+func (h *webhook) start() {
+	h.slots = webhookHosts.join(h.host)
+
+	for i := 0; i < h.Concurrency; i++ {
+		go h.work()
+	}
+
+	for _, topic := range h.Topics {
+		if h.Group != "" {
+			subscribers.joinGroup(topic, h.Group, h, h)
+		} else {
+			subscribers.subscribe(topic, h, h)
+		}
+	}
+}
+
+// find returns a webhook only to the identity that registered it
+func (s *webhookStore) find(id string, identity string) (*webhook, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	h, ok := s.webhooks[id]
+
+	if !ok || h.identity != identity {
+		return nil, false
+	}
+
+	return h, true
+}
+
+// remove stops a webhook and tells whether it was still registered, only the
+// first of the requests removing it at once does. It's kept when the removal
+// can't be saved
+func (s *webhookStore) remove(h *webhook) (bool, error) {
+	s.mux.Lock()
+
+	if s.webhooks[h.ID] != h {
+		s.mux.Unlock()
+		return false, nil
+	}
+
+	delete(s.webhooks, h.ID)
+	err := s.save()
+
+	if err != nil {
+		s.webhooks[h.ID] = h
+		s.mux.Unlock()
+		return false, err
+	}
+
+	s.mux.Unlock()
+
+	unsubscribeAll(h)
+	close(h.done)
+	webhookHosts.leave(h.host)
+
+	return true, nil
+}
+
+// list returns the webhooks of an identity, oldest first
+func (s *webhookStore) list(identity string) []*webhook {
+	s.mux.Lock()
+	views := []*webhook{}
+
+	for _, h := range s.webhooks {
+		if h.identity == identity {
+			views = append(views, h)
+		}
+	}
+
+	s.mux.Unlock()
+
+	for i, h := range views {
+		views[i] = h.view()
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Created.Before(views[j].Created) })
+
+	return views
+}
+
+func (s *webhookStore) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.webhooks)
+}
+
+// registerWebhook serves GET /webhooks with the webhooks of the client, and
+// registers a new one on POST /webhooks with a body like
+// {"url":"https://...","topics":["news.*"],"secret":"...","concurrency":4}. The
+// secret is made up when it's not given, it's only answered here
+func registerWebhook(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/webhooks")
+	identity, ok := webhookAuth(w, r, log)
+
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		admin.ReplyJSON(w, http.StatusOK, webhooks.list(identity))
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		admin.ReplyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var body struct {
+		URL         string   `json:"url"`
+		Topics      []string `json:"topics"`
+		Group       string   `json:"group"`
+		Secret      string   `json:"secret"`
+		Concurrency int      `json:"concurrency"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, `the body must be like {"url":"https://example.com/hook","topics":["news"]}`)
+		return
+	}
+
+	target, err := url.Parse(body.URL)
+
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		admin.ReplyError(w, http.StatusBadRequest, "the url must be an absolute http or https URL")
+		return
+	}
+
+	if _, err := webhookAddresses(r.Context(), target.Hostname()); err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, "the url can't be posted to: "+err.Error())
+		return
+	}
+
+	if len(body.Topics) == 0 {
+		admin.ReplyError(w, http.StatusBadRequest, "at least one topic is needed")
+		return
+	}
+
+	for _, topic := range body.Topics {
+		if _, err := path.Match(topic, ""); topic == "" || err != nil {
+			admin.ReplyError(w, http.StatusBadRequest, "invalid topic "+topic)
+			return
+		}
+	}
+
+	if err := validGroup(body.Group); body.Group != "" && err != nil {
+		admin.ReplyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if body.Concurrency == 0 {
+		body.Concurrency = defaultWebhookConcurrency
+	}
+
+	if body.Concurrency < 0 || body.Concurrency > maxWebhookConcurrency {
+		admin.ReplyError(w, http.StatusBadRequest, "concurrency must be between 1 and "+strconv.Itoa(maxWebhookConcurrency))
+		return
+	}
+
+	if body.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		body.Secret = hex.EncodeToString(secret)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	h := newWebhook(savedWebhook{
+		ID:          hex.EncodeToString(id),
+		URL:         target.String(),
+		Topics:      body.Topics,
+		Group:       body.Group,
+		Concurrency: body.Concurrency,
+		Created:     time.Now(),
+		Identity:    identity,
+		Secret:      body.Secret,
+	})
+
+	err = webhooks.add(h)
+
+	if err != nil {
+		log.Error("Error saving the webhooks", "file", cfg.WebhookFile, "error", err)
+		admin.ReplyError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Info("Webhook registered", "webhook", h.ID, "url", h.URL, "identity", identity, "topics", strings.Join(h.Topics, ","))
+
+	admin.ReplyJSON(w, http.StatusCreated, struct {
+		*webhook
+		Secret string `json:"secret"`
+	}{h.view(), h.secret})
+}
+
+// manageWebhook serves the requests on one webhook:
+//
+//	GET or DELETE /webhooks/{id}
+//	GET or DELETE /webhooks/{id}/dead-letters
+func manageWebhook(w http.ResponseWriter, r *http.Request) {
+	log, _ := logs.Conn(r.RemoteAddr, "/webhooks")
+	identity, ok := webhookAuth(w, r, log)
+
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	h, ok := webhooks.find(parts[0], identity)
+
+	if !ok {
+		admin.ReplyError(w, http.StatusNotFound, "no webhook "+parts[0])
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		admin.ReplyJSON(w, http.StatusOK, h.view())
+	case len(parts) == 1 && r.Method == "DELETE":
+		removed, err := webhooks.remove(h)
+
+		if err != nil {
+			log.Error("Error saving the webhooks", "file", cfg.WebhookFile, "error", err)
+			admin.ReplyError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !removed {
+			admin.ReplyError(w, http.StatusNotFound, "no webhook "+parts[0])
+			return
+		}
+
+		log.Info("Webhook removed", "webhook", h.ID, "url", h.URL, "identity", identity)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "dead-letters" && r.Method == "GET":
+		h.mux.Lock()
+		letters := append([]deadLetter{}, h.deadLetters...)
+		h.mux.Unlock()
+		admin.ReplyJSON(w, http.StatusOK, letters)
+	case len(parts) == 2 && parts[1] == "dead-letters" && r.Method == "DELETE":
+		h.mux.Lock()
+		h.deadLetters = nil
+		h.mux.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.ReplyError(w, http.StatusNotFound, "unknown webhook request")
+	}
+}
+
+func webhookAuth(w http.ResponseWriter, r *http.Request, log logger) (string, bool) {
+	identity, ok := authenticate(r)
+
+	if !ok {
+		log.Warn("Error validating credentials", "identity", identity)
+		authFailures.Inc("/webhooks")
+		w.Header().Set("WWW-Authenticate", `Basic realm="subscriber"`)
+		admin.ReplyError(w, http.StatusUnauthorized, "invalid credentials")
+	}
+
+	return identity, ok
+}